@@ -0,0 +1,273 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A configuration file is a mapping of flag names to values written either as
+// TOML or as YAML. Tables (TOML) and nested maps (YAML) are joined to their keys
+// with a dash, so these are both the same as passing -output-dir /var/data/ps:
+//
+//	[output]
+//	dir = "/var/data/ps"
+//
+//	output:
+//	  dir: /var/data/ps
+//
+// Arrays set a flag once per element, which is how repeatable flags are filled.
+// Flags given on the command line always take precedence over the file.
+var configFile = flag.String("config", "", "Path to a TOML (.toml) or YAML (.yaml, .yml) crawl configuration file")
+
+// A single flag assignment read from a configuration file
+type configEntry struct {
+	line  int
+	key   string
+	value string
+}
+
+// Reads the configuration file and applies it to every flag not set on the command line
+func loadConfig(path string) error {
+	// Read the whole file, they are tiny
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// Parse it depending on the extension
+	var entries []configEntry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		entries, err = parseTOML(string(data))
+	case ".yaml", ".yml":
+		entries, err = parseYAML(string(data))
+	default:
+		return fmt.Errorf("%s: unknown configuration format, expected .toml, .yaml or .yml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s:%v", path, err)
+	}
+	// Collect the flags explicitly set on the command line
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	// Apply each entry in order
+	for _, entry := range entries {
+		// The crawls of a service share its file
+		if flag.Lookup(entry.key) == nil && serveFlags.Lookup(entry.key) != nil {
+			continue
+		}
+		if entry.key == "config" || flag.Lookup(entry.key) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, entry.line, entry.key)
+		}
+		if explicit[entry.key] {
+			continue
+		}
+		if err := flag.Set(entry.key, entry.value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", path, entry.line, entry.key, err)
+		}
+	}
+	return nil
+}
+
+// Parses the subset of TOML used by configuration files: tables, key/value
+// pairs, strings, numbers, booleans and single line arrays of those
+func parseTOML(data string) ([]configEntry, error) {
+	var entries []configEntry
+	prefix := ""
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		// A table header changes the prefix of every following key
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("%d: invalid table header %q", i+1, line)
+			}
+			prefix = configKey(line[1:len(line)-1]) + "-"
+			continue
+		}
+		// Otherwise it must be a key/value pair
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("%d: expected key = value", i+1)
+		}
+		key := prefix + configKey(line[:eq])
+		values, err := parseValues(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", i+1, err)
+		}
+		for _, value := range values {
+			entries = append(entries, configEntry{i + 1, key, value})
+		}
+	}
+	return entries, nil
+}
+
+// Parses the subset of YAML used by configuration files: nested block mappings,
+// block sequences of scalars, flow sequences and plain or quoted scalars
+func parseYAML(data string) ([]configEntry, error) {
+	var entries []configEntry
+	// Stack of the mapping keys enclosing the current line
+	var stack []yamlLevel
+	for i, raw := range strings.Split(data, "\n") {
+		line := strings.TrimRight(stripComment(raw), " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("%d: tabs are not allowed for indentation", i+1)
+		}
+		indent := len(line) - len(trimmed)
+		// Sequence items belong to the closest key with a smaller indent, or
+		// to a key without a value at the same indent
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			for len(stack) > 0 && (stack[len(stack)-1].indent > indent ||
+				stack[len(stack)-1].indent == indent && !stack[len(stack)-1].open) {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("%d: sequence item without a key", i+1)
+			}
+			value, err := parseScalar(strings.TrimSpace(trimmed[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("%d: %v", i+1, err)
+			}
+			entries = append(entries, configEntry{i + 1, yamlKey(stack), value})
+			continue
+		}
+		// Otherwise it must be a mapping entry
+		colon := strings.Index(trimmed, ":")
+		if colon < 0 || (colon+1 < len(trimmed) && trimmed[colon+1] != ' ') {
+			return nil, fmt.Errorf("%d: expected key: value", i+1)
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		rest := strings.TrimSpace(trimmed[colon+1:])
+		stack = append(stack, yamlLevel{indent, configKey(trimmed[:colon]), rest == ""})
+		// An empty value opens a nested mapping or sequence
+		if rest == "" {
+			continue
+		}
+		values, err := parseValues(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", i+1, err)
+		}
+		for _, value := range values {
+			entries = append(entries, configEntry{i + 1, yamlKey(stack), value})
+		}
+	}
+	return entries, nil
+}
+
+// A YAML mapping key, the indentation it was found at and whether it opens a
+// nested mapping or sequence
+type yamlLevel struct {
+	indent int
+	key    string
+	open   bool
+}
+
+// Joins the keys of the YAML mapping stack into a flag name
+func yamlKey(stack []yamlLevel) string {
+	keys := make([]string, len(stack))
+	for i, level := range stack {
+		keys[i] = level.key
+	}
+	return strings.Join(keys, "-")
+}
+
+// Normalizes a (possibly dotted or quoted) key into a flag name
+func configKey(key string) string {
+	key = strings.Trim(strings.TrimSpace(key), "\"'")
+	key = strings.Replace(key, ".", "-", -1)
+	return strings.Replace(key, "_", "-", -1)
+}
+
+// Parses either a single scalar or a flow/inline array of scalars
+func parseValues(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		scalar, err := parseScalar(value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{scalar}, nil
+	}
+	if !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("unterminated array %q", value)
+	}
+	var values []string
+	for _, item := range splitOutsideQuotes(value[1:len(value)-1], ',') {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		scalar, err := parseScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, scalar)
+	}
+	return values, nil
+}
+
+// Unquotes a scalar value, plain values are returned as is
+func parseScalar(value string) (string, error) {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return strconv.Unquote(value)
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+	}
+	if strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "'") {
+		return "", fmt.Errorf("unterminated string %s", value)
+	}
+	return value, nil
+}
+
+// Removes a trailing # comment that is not inside a quoted string, like YAML
+// the # must start the line or follow whitespace so URL fragments survive
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Splits s on sep ignoring separators inside quoted strings
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
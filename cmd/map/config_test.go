@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		data    string
+		entries []configEntry
+		err     string
+	}{
+		{
+			"tables",
+			"timeout = \"10s\"\n\n[output]\ndir = \"/var/data/ps\"\nmax_size = 3\n[sls]\npage-size = 100\n",
+			[]configEntry{{1, "timeout", "10s"}, {4, "output-dir", "/var/data/ps"}, {5, "output-max-size", "3"}, {7, "sls-page-size", "100"}},
+			"",
+		},
+		{
+			"dotted keys",
+			"output.dir = '/tmp'\n\"dead_after\" = 3\n",
+			[]configEntry{{1, "output-dir", "/tmp"}, {2, "dead-after", "3"}},
+			"",
+		},
+		{
+			"comments",
+			"# crawl\nretries = 2 # twice\nhints = \"http://a/hints#not-a-comment\"\nsls-url = http://b/records#fragment\n",
+			[]configEntry{{2, "retries", "2"}, {3, "hints", "http://a/hints#not-a-comment"}, {4, "sls-url", "http://b/records#fragment"}},
+			"",
+		},
+		{
+			"escapes",
+			"proxy-auth = \"user:p\\\"w # d\"\nsite = 'it''s'\n",
+			[]configEntry{{1, "proxy-auth", "user:p\"w # d"}, {2, "site", "it's"}},
+			"",
+		},
+		{
+			"arrays",
+			"hints = [\"http://a/hints\", 'http://b/x,y', http://c/hints,]\n",
+			[]configEntry{{1, "hints", "http://a/hints"}, {1, "hints", "http://b/x,y"}, {1, "hints", "http://c/hints"}},
+			"",
+		},
+		{"array of tables", "[[sinks]]\nname = \"file\"\n", nil, "1: invalid table header \"[[sinks]]\""},
+		{"unterminated table", "[output\n", nil, "1: invalid table header \"[output\""},
+		{"no value", "retries = 2\ndry-run\n", nil, "2: expected key = value"},
+		{"unterminated array", "hints = [\"a\", \"b\"\n", nil, "1: unterminated array"},
+		{"unterminated string", "site = \"lbl\n", nil, "1: unterminated string"},
+	} {
+		entries, err := parseTOML(test.data)
+		checkEntries(t, test.name, entries, err, test.entries, test.err)
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		data    string
+		entries []configEntry
+		err     string
+	}{
+		{
+			"nested maps",
+			"---\noutput:\n  dir: /var/data/ps\n  file:\n    max: 3\n  format: json\ntimeout: 10s\n",
+			[]configEntry{{3, "output-dir", "/var/data/ps"}, {5, "output-file-max", "3"}, {6, "output-format", "json"}, {7, "timeout", "10s"}},
+			"",
+		},
+		{
+			"sequences under nested keys",
+			"discovery:\n  hints:\n    - http://a/hints\n    - \"http://b/hints # quoted\"\n  sls_url:\n  - http://c/records\nretries: 1\n",
+			[]configEntry{{3, "discovery-hints", "http://a/hints"}, {4, "discovery-hints", "http://b/hints # quoted"}, {6, "discovery-sls-url", "http://c/records"}, {7, "retries", "1"}},
+			"",
+		},
+		{
+			"flow sequences",
+			"hints: [http://a/hints, \"http://b/x,y\", 'c']\n",
+			[]configEntry{{1, "hints", "http://a/hints"}, {1, "hints", "http://b/x,y"}, {1, "hints", "c"}},
+			"",
+		},
+		{
+			"comments",
+			"# crawl\ntimeout: 10s # ten\nhints: http://a/hints#fragment\nsite: 'lbl # ''b'''\n",
+			[]configEntry{{2, "timeout", "10s"}, {3, "hints", "http://a/hints#fragment"}, {4, "site", "lbl # 'b'"}},
+			"",
+		},
+		{"tab indentation", "output:\n\tdir: /tmp\n", nil, "2: tabs are not allowed for indentation"},
+		{"sequence without a key", "- http://a/hints\n", nil, "1: sequence item without a key"},
+		{"no space after the colon", "hints:http://a/hints\n", nil, "1: expected key: value"},
+		{"no colon", "output:\n  dir\n", nil, "2: expected key: value"},
+		{"unterminated string", "site: \"lbl\n", nil, "1: unterminated string"},
+	} {
+		entries, err := parseYAML(test.data)
+		checkEntries(t, test.name, entries, err, test.entries, test.err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// The command line wins over the file, the rest of the file applies and the
+	// settings of the service are left to it
+	if err := flag.CommandLine.Parse([]string{"-retries", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	path := write("crawl.yaml", "retries: 1\nmax-depth: 3\nevery: 1h\noutput:\n  dir: /var/data/ps\n")
+	if err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"retries": "5", "max-depth": "3", "output-dir": "/var/data/ps"} {
+		if got := flag.Lookup(name).Value.String(); got != want {
+			t.Errorf("-%s = %q, want %q", name, got, want)
+		}
+	}
+	for _, test := range []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"crawl.toml", "[crawl]\nspeed = 1\n", ":2: unknown setting \"crawl-speed\""},
+		{"nested.toml", "config = \"other.toml\"\n", ":1: unknown setting \"config\""},
+		{"invalid.toml", "sls-page-size = many\n", ":1: sls-page-size: "},
+		{"crawl.json", "{}", "unknown configuration format"},
+	} {
+		err := loadConfig(write(test.name, test.data))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+// Fails unless the entries and error are the expected ones, the error matching
+// when it starts with want
+func checkEntries(t *testing.T, name string, entries []configEntry, err error, want []configEntry, wantErr string) {
+	t.Helper()
+	if wantErr != "" {
+		if err == nil || !strings.HasPrefix(err.Error(), wantErr) {
+			t.Errorf("%s: error %v, want %q", name, err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("%s: got %v, want %v", name, entries, want)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+	"github.com/bored-engineer/ps-splunk/pkg/logging"
+	"github.com/bored-engineer/ps-splunk/pkg/sink"
+)
+
+// Flags of the discover subcommand, with those of the discovery and sinks
+var discoverFlags = flag.NewFlagSet("discover", flag.ExitOnError)
+
+// Returns the queue of the registrations stream, only written by discover
+func registrationsQueue() *sink.Queue {
+	if queue := sink.QueueNamed("registrations"); queue != nil {
+		return queue
+	}
+	return sink.NewQueue("registrations")
+}
+
+// Runs the discover subcommand: the caches and lookup services are read
+// without contacting any host, every record they hold being written to the
+// registrations stream of -output
+func discover(args []string) error {
+	registrations := registrationsQueue()
+	for _, fs := range []*flag.FlagSet{logging.Flags, httpx.Flags, discovery.Flags, sink.Flags} {
+		fs.VisitAll(func(f *flag.Flag) {
+			discoverFlags.Var(f.Value, f.Name, f.Usage)
+		})
+	}
+	discoverFlags.Usage = func() {
+		fmt.Fprintf(discoverFlags.Output(), "Usage: %s discover [flags]\n", os.Args[0])
+		discoverFlags.PrintDefaults()
+	}
+	discoverFlags.Parse(args)
+	sink.SetManifestFlags(discoverFlags)
+	for _, setup := range []func() error{logging.Setup, httpx.Setup, sink.Setup, discovery.Setup} {
+		if err := setup(); err != nil {
+			return err
+		}
+	}
+	if err := sink.Open(); err != nil {
+		return err
+	}
+	// Every record is emitted, the hosts are only counted
+	var records, hosts, expired atomic.Int64
+	var found sync.Map
+	discovery.Client = &http.Client{Transport: httpx.NewTransport(nil)}
+	discovery.Registered = func(registration event.Registration) {
+		records.Add(1)
+		if registration.Expired {
+			expired.Add(1)
+		}
+		registrations.Emit(registration)
+	}
+	discovery.Found = func(host string, origin string) {
+		if _, seen := found.LoadOrStore(host, true); !seen {
+			hosts.Add(1)
+		}
+	}
+	err := discovery.Run()
+	sink.Close()
+	if err != nil {
+		return fmt.Errorf("discovery: %v", err)
+	}
+	logger.Info("Discovery done", "records", records.Load(), "expired", expired.Load(), "hosts", hosts.Load())
+	return nil
+}
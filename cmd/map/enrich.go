@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/enrich"
+	"github.com/bored-engineer/ps-splunk/pkg/logging"
+)
+
+// Flags of the enrich subcommand, with those of the databases
+var enrichFlags = flag.NewFlagSet("enrich", flag.ExitOnError)
+var enrichOutput = enrichFlags.String("o", "", "File the enriched events are written to (default stdout)")
+
+// Runs the enrich subcommand: the events of newline delimited JSON files
+// written by a previous crawl get the location and AS of their address or
+// host, when they have none, so crawls run without the databases can be
+// enriched later
+func enrichFiles(args []string) error {
+	for _, fs := range []*flag.FlagSet{logging.Flags, enrich.Flags} {
+		fs.VisitAll(func(f *flag.Flag) {
+			enrichFlags.Var(f.Value, f.Name, f.Usage)
+		})
+	}
+	enrichFlags.Usage = func() {
+		fmt.Fprintf(enrichFlags.Output(), "Usage: %s enrich [flags] files... (- or none for stdin)\n", os.Args[0])
+		enrichFlags.PrintDefaults()
+	}
+	enrichFlags.Parse(args)
+	// Stdout is kept for the events
+	if *enrichOutput == "" {
+		logging.SetOutput(os.Stderr)
+	}
+	for _, setup := range []func() error{logging.Setup, enrich.Setup} {
+		if err := setup(); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if *enrichOutput != "" {
+		file, err := os.Create(*enrichOutput)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = bufio.NewWriter(file)
+	}
+	files := enrichFlags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, path := range files {
+		if err := enrichFile(w, path); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return w.Flush()
+}
+
+// Writes the events of a file, or stdin for -, enriched to w
+func enrichFile(w io.Writer, path string) error {
+	var reader io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+		if strings.HasSuffix(path, ".gz") {
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			reader = gz
+		}
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if _, err := w.Write(append(enrichEvent(line), '\n')); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Returns the event with the geo and asn fields of its address or host
+// appended, the event unchanged when it has them or neither
+func enrichEvent(line []byte) []byte {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(line, &fields) != nil || line[len(line)-1] != '}' {
+		return line
+	}
+	var host string
+	if json.Unmarshal(fields["address"], &host) != nil || host == "" {
+		if json.Unmarshal(fields["host"], &host) != nil {
+			return line
+		}
+	}
+	address, _ := discovery.SplitKey(host)
+	if address == "" {
+		return line
+	}
+	// Appended before the closing brace so the order of the fields is kept
+	enriched := append([]byte(nil), line[:len(line)-1]...)
+	for _, field := range []struct {
+		name  string
+		value interface{}
+	}{{"geo", enrich.LookupGeoIP(address)}, {"asn", enrich.LookupASN(address)}} {
+		if _, ok := fields[field.name]; ok {
+			continue
+		}
+		value, _ := json.Marshal(field.value)
+		if string(value) == "null" {
+			continue
+		}
+		enriched = append(append(append(enriched, `,"`...), field.name...), `":`...)
+		enriched = append(enriched, value...)
+	}
+	return append(enriched, '}')
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bored-engineer/ps-splunk/pkg/graph"
+)
+
+// Flags of the export subcommand
+var exportFlags = flag.NewFlagSet("export", flag.ExitOnError)
+var exportFormat = exportFlags.String("format", "", "Format written: graphml, dot or gexf (default from the -o extension, else graphml)")
+var exportOutput = exportFlags.String("o", "", "File the graph is written to (default stdout)")
+
+// Runs the export subcommand, building the host-to-host graph of a crawl from
+// its link stream files, for crawls run without -graph
+func export(args []string) error {
+	exportFlags.Usage = func() {
+		fmt.Fprintf(exportFlags.Output(), "Usage: %s export [flags] link-files... (- or none for stdin)\n", os.Args[0])
+		exportFlags.PrintDefaults()
+	}
+	exportFlags.Parse(args)
+	// Pick the format
+	if *exportFormat == "" {
+		*exportFormat = "graphml"
+		if *exportOutput != "" {
+			f, err := graph.FormatOf(*exportOutput)
+			if err != nil {
+				return err
+			}
+			*exportFormat = f
+		}
+	}
+	// Read every link file
+	g := graph.New()
+	files := exportFlags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, path := range files {
+		if err := readLinks(g, path); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	// Write the graph
+	w := os.Stdout
+	if *exportOutput != "" {
+		file, err := os.Create(*exportOutput)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return g.Write(w, strings.ToLower(*exportFormat))
+}
+
+// Adds the links of a file, or stdin for -, to the graph
+func readLinks(g *graph.Graph, path string) error {
+	if path == "-" {
+		return g.ReadLinks(os.Stdin)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return g.ReadLinks(file)
+}
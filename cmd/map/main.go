@@ -0,0 +1,173 @@
+// Command map crawls the perfSONAR hosts found through the lookup service and
+// writes what they measure to the configured sinks. Its subcommands also run
+// the crawls as a service, list the hosts discovery finds, enrich, replay and
+// export the files of past crawls.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/bored-engineer/ps-splunk/pkg/crawler"
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/enrich"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+	"github.com/bored-engineer/ps-splunk/pkg/logging"
+	"github.com/bored-engineer/ps-splunk/pkg/metrics"
+	"github.com/bored-engineer/ps-splunk/pkg/sink"
+)
+
+// Logger of the command
+var logger = logging.New("map")
+
+// Process flags of the crawl, the others belong to the packages
+var metricsAddr = flag.String("metrics-addr", "", "Address serving Prometheus metrics on /metrics and the status page of the crawl on /status/, e.g. :9100 (default disabled)")
+
+// A subcommand, run with the arguments after its name
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+// The subcommands, crawl being run when none is named
+var commands = []command{
+	{"crawl", "Discover and crawl the perfSONAR hosts into the sinks (the default)", crawl},
+	{"serve", "Run a crawl every -every as a service, with a control API", serve},
+	{"discover", "List the hosts discovery finds without contacting them", discover},
+	{"enrich", "Add the location and AS of the hosts to the events of past crawl files", enrichFiles},
+	{"export", "Build the host-to-host graph of past crawl link files", export},
+	{"replay", "Push the events of past crawl files through the sinks again", replay},
+}
+
+// Merge the flags of every package into the command line
+func init() {
+	for _, fs := range crawler.FlagSets() {
+		fs.VisitAll(func(f *flag.Flag) {
+			flag.Var(f.Value, f.Name, f.Usage)
+		})
+	}
+}
+
+// Entry point, running the subcommand named by the first argument. The
+// modular input and a command line starting with a flag crawl.
+func main() {
+	name, args := "crawl", os.Args[1:]
+	if !modinputMode() && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage(os.Stdout)
+		return
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(args); err != nil {
+				logger.Fatal("Command failed", "command", name, "err", err)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage(os.Stderr)
+	os.Exit(2)
+}
+
+// Lists the subcommands
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [command] [flags] [arguments]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-9s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun %s <command> -h for the flags of a command.\n", filepath.Base(os.Args[0]))
+}
+
+// Parses the crawl flags, or the stanza of the modular input, then the
+// configuration file, and checks them
+func parseCrawlFlags(args []string) error {
+	if modinputMode() {
+		if err := modinput(args); err != nil {
+			return fmt.Errorf("invalid modular input: %v", err)
+		}
+	} else {
+		flag.CommandLine.Parse(args)
+	}
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			return fmt.Errorf("reading %s: %v", *configFile, err)
+		}
+	}
+	sink.SetManifestFlags(flag.CommandLine)
+	return setup()
+}
+
+// Runs the crawl subcommand
+func crawl(args []string) error {
+	if err := parseCrawlFlags(args); err != nil {
+		return err
+	}
+	// Discovered hosts are queued for the crawl
+	discovery.Client = crawler.Client
+	discovery.Found = crawler.Dedup
+	discovery.Failed = crawler.DiscoveryFailed
+	discovery.Stopped = crawler.Stopped
+	if err := crawler.Start(); err != nil {
+		return fmt.Errorf("starting the crawl: %v", err)
+	}
+	// Expose the metrics
+	if *metricsAddr != "" {
+		go func() {
+			logger.Info("Serving metrics", "addr", *metricsAddr)
+			status := map[string]http.Handler{"/status/": http.StripPrefix("/status", crawler.StatusHandler())}
+			if err := metrics.Serve(*metricsAddr, status); err != nil {
+				logger.Fatal("Serving metrics failed", "err", err)
+			}
+		}()
+	}
+	// Stop cleanly when interrupted
+	handleSignals()
+	// Discover the first hosts to start the process, or lease them from the
+	// coordinator, then wait for every job
+	if crawler.IsWorker() {
+		if err := crawler.RunWorker(); err != nil {
+			return fmt.Errorf("crawling the shards: %v", err)
+		}
+	} else if err := discovery.Run(); err != nil {
+		return fmt.Errorf("discovery: %v", err)
+	}
+	if err := crawler.Finish(); err != nil {
+		return fmt.Errorf("finishing the crawl: %v", err)
+	}
+	return nil
+}
+
+// Checks the flags of every package and prepares them
+func setup() error {
+	for _, setup := range []func() error{logging.Setup, httpx.Setup, sink.Setup, discovery.Setup, crawler.Setup, enrich.Setup} {
+		if err := setup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stops the crawl on SIGINT or SIGTERM, the outputs are then drained and the
+// state written. A second signal exits immediately.
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Warn("Cancelling the running hosts, signal again to exit now", "signal", sig)
+		crawler.Stop()
+		sig = <-signals
+		logger.Fatal("Exiting without flushing", "signal", sig)
+	}()
+}
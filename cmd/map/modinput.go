@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bored-engineer/ps-splunk/pkg/crawler"
+	"github.com/bored-engineer/ps-splunk/pkg/logging"
+	"github.com/bored-engineer/ps-splunk/pkg/splunk"
+)
+
+// Installed as bin/ps_crawl in the Splunk app the command is a modular input:
+// splunkd runs it with --scheme for its arguments, with --validate-arguments
+// when an input is saved, and with no argument to run an input. The stanza of
+// the input is read from stdin, its parameters being the flags of the same
+// name, and the events are streamed back to splunkd on stdout unless output is
+// set. The crawl state is checkpointed in the checkpoint directory of splunkd
+// so an interrupted crawl resumes on the next run.
+func modinputMode() bool {
+	name := filepath.Base(os.Args[0])
+	return strings.TrimSuffix(name, filepath.Ext(name)) == splunk.ModinputScheme
+}
+
+// Characters not kept in the name of the checkpoint of a stanza
+var unsafeName = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// Runs the modular input command given by the arguments, exiting for --scheme
+// and --validate-arguments, or applies the stanza to run to the flags
+func modinput(args []string) error {
+	// Stdout belongs to splunkd
+	logging.SetOutput(os.Stderr)
+	mode := ""
+	if len(args) > 0 {
+		mode = args[0]
+	}
+	switch mode {
+	case "--scheme":
+		if err := splunk.Scheme(os.Stdout); err != nil {
+			return err
+		}
+		os.Exit(0)
+	case "--validate-arguments":
+		if err := validateStanza(); err != nil {
+			splunk.WriteValidationError(os.Stdout, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "":
+		return runStanza()
+	}
+	return fmt.Errorf("unknown modular input mode %q, expected --scheme or --validate-arguments", mode)
+}
+
+// Checks the stanza splunkd is about to save like a run would
+func validateStanza() error {
+	config, err := splunk.ReadInputConfig(os.Stdin)
+	if err != nil {
+		return err
+	}
+	stanza, err := config.Stanza()
+	if err != nil {
+		return err
+	}
+	if err := applyStanza(stanza); err != nil {
+		return err
+	}
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			return err
+		}
+	}
+	return setup()
+}
+
+// Applies the stanza to run, then defaults the output to splunkd and the
+// state file to the checkpoint directory, resuming the crawl it left pending
+func runStanza() error {
+	config, err := splunk.ReadInputConfig(os.Stdin)
+	if err != nil {
+		return err
+	}
+	stanza, err := config.Stanza()
+	if err != nil {
+		return err
+	}
+	if err := applyStanza(stanza); err != nil {
+		return err
+	}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	if !explicit["output"] {
+		flag.Set("output", "modinput")
+	}
+	if !explicit["state-file"] && config.CheckpointDir != "" {
+		name := unsafeName.ReplaceAllString(stanza.Name, "_")
+		flag.Set("state-file", filepath.Join(config.CheckpointDir, name+".json"))
+	}
+	if !explicit["resume"] {
+		path := flag.Lookup("state-file").Value.String()
+		if pending, err := pendingCheckpoint(path); err != nil {
+			return err
+		} else if pending > 0 {
+			logger.Info("Resuming the interrupted crawl of the input", "input", stanza.Name, "pending", pending)
+			flag.Set("resume", "true")
+		}
+	}
+	return nil
+}
+
+// Sets the flag of every parameter of the stanza, skipping the settings
+// splunkd adds to every input like interval and index
+func applyStanza(stanza *splunk.Stanza) error {
+	for _, param := range stanza.Values() {
+		if flag.Lookup(param[0]) == nil {
+			continue
+		}
+		if err := flag.Set(param[0], param[1]); err != nil {
+			return fmt.Errorf("%s: %v", param[0], err)
+		}
+	}
+	return nil
+}
+
+// Returns how many hosts the checkpoint at path left pending, none when the
+// input never ran
+func pendingCheckpoint(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var state crawler.CrawlState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+	return len(state.Pending), nil
+}
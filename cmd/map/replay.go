@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+	"github.com/bored-engineer/ps-splunk/pkg/logging"
+	"github.com/bored-engineer/ps-splunk/pkg/sink"
+)
+
+// Flags of the replay subcommand, with those of the sinks
+var replayFlags = flag.NewFlagSet("replay", flag.ExitOnError)
+var replayStream = replayFlags.String("stream", "", "Stream of every event replayed (default the stream in the name of each file)")
+var replayRewriteTime = replayFlags.Bool("rewrite-time", false, "Timestamp the events replayed now instead of keeping their collection time")
+
+// The time field of an event, the first of its header
+var eventTime = regexp.MustCompile(`"time":"[^"]*"`)
+
+// Runs the replay subcommand: the newline delimited JSON files written by a
+// previous crawl, or the dead-letter files of its sinks, are read again and
+// their events pushed through the sinks of -output
+func replay(args []string) error {
+	registrationsQueue()
+	for _, fs := range []*flag.FlagSet{logging.Flags, httpx.Flags, sink.Flags} {
+		fs.VisitAll(func(f *flag.Flag) {
+			replayFlags.Var(f.Value, f.Name, f.Usage)
+		})
+	}
+	replayFlags.Usage = func() {
+		fmt.Fprintf(replayFlags.Output(), "Usage: %s replay [flags] files or directories...\n", os.Args[0])
+		replayFlags.PrintDefaults()
+	}
+	replayFlags.Parse(args)
+	if replayFlags.NArg() == 0 {
+		replayFlags.Usage()
+		return fmt.Errorf("no file to replay")
+	}
+	if *replayStream != "" && sink.QueueNamed(*replayStream) == nil {
+		return fmt.Errorf("unknown stream %q", *replayStream)
+	}
+	// Expand the directories to the output files they hold
+	var files []string
+	for _, path := range replayFlags.Args() {
+		err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && (file == path || strings.HasSuffix(file, ".json") || strings.HasSuffix(file, ".json.gz")) {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sink.SetManifestFlags(replayFlags)
+	for _, setup := range []func() error{logging.Setup, httpx.Setup, sink.Setup} {
+		if err := setup(); err != nil {
+			return err
+		}
+	}
+	if err := sink.Open(); err != nil {
+		return err
+	}
+	total := 0
+	for _, file := range files {
+		count, err := replayFile(file)
+		total += count
+		if err != nil {
+			sink.Close()
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		logger.Info("File replayed", "file", file, "events", count)
+	}
+	sink.Close()
+	logger.Info("Replay done", "files", len(files), "events", total)
+	return nil
+}
+
+// Queues the events of a file, returning how many were
+func replayFile(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	stream := *replayStream
+	if stream == "" {
+		stream = fileStream(path)
+	}
+	count := 0
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		// Dead-letter records hold the event and its stream
+		var record struct {
+			Stream string          `json:"stream"`
+			Sink   string          `json:"sink"`
+			Event  json.RawMessage `json:"event"`
+		}
+		eventStream := stream
+		if json.Unmarshal(line, &record) == nil && record.Sink != "" && len(record.Event) > 0 {
+			line = record.Event
+			if *replayStream == "" {
+				eventStream = record.Stream
+			}
+		}
+		queue := sink.QueueNamed(eventStream)
+		if queue == nil {
+			return count, fmt.Errorf("unknown stream %q, use -stream", eventStream)
+		}
+		data := append([]byte(nil), line...)
+		if *replayRewriteTime {
+			if loc := eventTime.FindIndex(data); loc != nil {
+				now := fmt.Sprintf(`"time":%q`, time.Now().UTC().Format(event.TimeLayout))
+				data = append(append(append([]byte(nil), data[:loc[0]]...), now...), data[loc[1]:]...)
+			}
+		}
+		queue.Forward(append(data, '\n'))
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// Returns the stream an output file was written for, the leftmost stream name
+// in its name, or empty
+func fileStream(path string) string {
+	var names []string
+	for _, queue := range sink.Queues() {
+		names = append(names, regexp.QuoteMeta(queue.Name()))
+	}
+	// The leftmost match, so parse_errors isn't taken for errors
+	pattern := regexp.MustCompile(`(?:^|[^a-zA-Z])(` + strings.Join(names, "|") + `)(?:[^a-zA-Z]|$)`)
+	if match := pattern.FindStringSubmatch(filepath.Base(path)); match != nil {
+		return match[1]
+	}
+	return ""
+}
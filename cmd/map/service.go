@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/crawler"
+)
+
+// Flags of the serve subcommand, which takes those of the crawl as well. A
+// service runs each crawl as a child process of itself so every crawl starts
+// from a clean state.
+var serveFlags = flag.NewFlagSet("serve", flag.ExitOnError)
+var every = serveFlags.Duration("every", 24*time.Hour, "Time between the starts of the crawls")
+var controlAddr = serveFlags.String("control-addr", "", "Address the control API of the service listens on, e.g. 127.0.0.1:9300 (default disabled)")
+var controlToken = serveFlags.String("control-token", "", "Bearer token required by every request to the control API, PS_CONTROL_TOKEN when unset")
+
+// State of the service, shared with the control API
+var service = struct {
+	sync.Mutex
+	// The running crawl and its start, nil between crawls
+	crawl   *exec.Cmd
+	started time.Time
+	next    time.Time
+	runs    int
+	// Exit status and report of the last crawl
+	lastExit   string
+	lastReport json.RawMessage
+	// Rate limits adjusted through the API, passed to the next crawls
+	limits crawler.RateLimits
+	// Files of the running crawl
+	socket string
+	report string
+}{}
+
+// Asks the service for a crawl now, closed to stop it
+var crawlNow = make(chan struct{}, 1)
+var stopService = make(chan struct{})
+
+// The arguments of the crawls, those of the service without its own flags
+var crawlArgs []string
+
+// Runs the serve subcommand, checking the crawl flags before running the
+// service
+func serve(args []string) error {
+	serveFlags.VisitAll(func(f *flag.Flag) {
+		flag.Var(f.Value, f.Name, f.Usage)
+	})
+	if err := parseCrawlFlags(args); err != nil {
+		return err
+	}
+	if err := setupService(); err != nil {
+		return err
+	}
+	crawlArgs = withoutFlags(args, serveFlags)
+	return runService()
+}
+
+// Returns args without the flags of fs and their values
+func withoutFlags(args []string, fs *flag.FlagSet) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			return append(kept, args[i:]...)
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		own := fs.Lookup(name) != nil
+		f := flag.Lookup(name)
+		// The value is the next argument unless given with = or a boolean
+		end := i + 1
+		if !hasValue && f != nil && !isBoolFlag(f) && end < len(args) {
+			end++
+		}
+		if !own {
+			kept = append(kept, args[i:end]...)
+		}
+		i = end - 1
+	}
+	return kept
+}
+
+// Reports whether a flag takes no value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// Checks the service flags
+func setupService() error {
+	if *every <= 0 {
+		return fmt.Errorf("-every must be positive")
+	}
+	if *controlAddr == "" {
+		return nil
+	}
+	if *controlToken == "" {
+		*controlToken = os.Getenv("PS_CONTROL_TOKEN")
+	}
+	if *controlToken == "" {
+		return fmt.Errorf("-control-token is required with -control-addr")
+	}
+	return nil
+}
+
+// Runs a crawl every -every, or when asked to by the control API, until
+// interrupted
+func runService() error {
+	dir, err := ioutil.TempDir("", "ps-splunk-service")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	service.socket = filepath.Join(dir, "crawl.sock")
+	service.report = filepath.Join(dir, "report.json")
+	// A report file asked for is where the reports are read from
+	if f := flag.Lookup("report-file"); f.Value.String() != "" {
+		service.report = f.Value.String()
+	}
+	if *controlAddr != "" {
+		go func() {
+			logger.Info("Serving the control API", "addr", *controlAddr)
+			if err := http.ListenAndServe(*controlAddr, controlAPI()); err != nil {
+				logger.Fatal("Serving the control API failed", "err", err)
+			}
+		}()
+	}
+	handleServiceSignals()
+	for {
+		start := time.Now()
+		runCrawl()
+		next := start.Add(*every)
+		service.Lock()
+		service.next = next
+		service.Unlock()
+		select {
+		case <-stopService:
+			return nil
+		default:
+		}
+		logger.Info("Next crawl scheduled", "at", next.Format(time.RFC3339))
+		select {
+		case <-time.After(time.Until(next)):
+		case <-crawlNow:
+			logger.Info("Crawl requested through the control API")
+		case <-stopService:
+			return nil
+		}
+	}
+}
+
+// Runs a crawl as a child process with the arguments of the service, its own
+// control socket and report file, and the rate limits adjusted since
+func runCrawl() {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+	service.Lock()
+	// Later flags win over those of the service
+	args := append(append([]string{"crawl"}, crawlArgs...),
+		"-control-socket="+service.socket, "-report-file="+service.report)
+	if service.limits.Rate != nil {
+		args = append(args, "-rate="+strconv.FormatFloat(*service.limits.Rate, 'f', -1, 64))
+	}
+	if service.limits.RateBurst != nil {
+		args = append(args, "-rate-burst="+strconv.Itoa(*service.limits.RateBurst))
+	}
+	if service.limits.HostRate != nil {
+		args = append(args, "-host-rate="+strconv.FormatFloat(*service.limits.HostRate, 'f', -1, 64))
+	}
+	os.Remove(service.report)
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// Signals from the terminal are forwarded by the service, not delivered twice
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	logger.Info("Starting a crawl", "run", service.runs+1)
+	if err = cmd.Start(); err == nil {
+		service.crawl, service.started = cmd, time.Now()
+	}
+	service.Unlock()
+	if err == nil {
+		err = cmd.Wait()
+	}
+	service.Lock()
+	defer service.Unlock()
+	service.crawl = nil
+	service.runs++
+	service.lastExit = "ok"
+	if err != nil {
+		service.lastExit = err.Error()
+		logger.Error("Crawl failed", "err", err)
+	}
+	if report, err := ioutil.ReadFile(service.report); err == nil {
+		service.lastReport = report
+	}
+}
+
+// Stops the service on SIGINT or SIGTERM once the running crawl has stopped
+// cleanly. A second signal exits immediately.
+func handleServiceSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Warn("Stopping the service after the running crawl, signal again to exit now", "signal", sig)
+		close(stopService)
+		signalCrawl(sig)
+		sig = <-signals
+		signalCrawl(sig)
+		logger.Fatal("Exiting without flushing", "signal", sig)
+	}()
+}
+
+// Passes a signal on to the running crawl, if any
+func signalCrawl(sig os.Signal) {
+	service.Lock()
+	defer service.Unlock()
+	if service.crawl != nil {
+		service.crawl.Process.Signal(sig)
+	}
+}
+
+// Returns the handler of the control API
+func controlAPI() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/crawl", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "expected POST")
+			return
+		}
+		service.Lock()
+		running := service.crawl != nil
+		service.Unlock()
+		if running {
+			writeError(w, http.StatusConflict, "a crawl is already running")
+			return
+		}
+		select {
+		case crawlNow <- struct{}{}:
+		default:
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "crawl requested"})
+	})
+	mux.HandleFunc("/progress", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "expected GET")
+			return
+		}
+		status := struct {
+			Running   bool            `json:"running"`
+			Runs      int             `json:"runs"`
+			Started   string          `json:"started,omitempty"`
+			NextCrawl string          `json:"next_crawl,omitempty"`
+			LastExit  string          `json:"last_exit,omitempty"`
+			Progress  json.RawMessage `json:"progress,omitempty"`
+		}{}
+		service.Lock()
+		status.Running, status.Runs, status.LastExit = service.crawl != nil, service.runs, service.lastExit
+		if status.Running {
+			status.Started = service.started.UTC().Format(time.RFC3339)
+		} else if !service.next.IsZero() {
+			status.NextCrawl = service.next.UTC().Format(time.RFC3339)
+		}
+		service.Unlock()
+		if status.Running {
+			// The socket is missing until the crawl has started
+			if progress, err := callCrawl(http.MethodGet, "/progress", nil); err == nil {
+				status.Progress = progress
+			}
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("/rate-limits", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			service.Lock()
+			running, limits := service.crawl != nil, service.limits
+			service.Unlock()
+			if running {
+				if current, err := callCrawl(http.MethodGet, "/rate-limits", nil); err == nil {
+					writeJSON(w, http.StatusOK, current)
+					return
+				}
+			}
+			writeJSON(w, http.StatusOK, limits)
+		case http.MethodPost:
+			var limits crawler.RateLimits
+			if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid rate limits: "+err.Error())
+				return
+			}
+			if err := limits.Check(); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			// Remembered for the next crawls, and applied to the running one
+			service.Lock()
+			if limits.Rate != nil {
+				service.limits.Rate = limits.Rate
+			}
+			if limits.RateBurst != nil {
+				service.limits.RateBurst = limits.RateBurst
+			}
+			if limits.HostRate != nil {
+				service.limits.HostRate = limits.HostRate
+			}
+			running, merged := service.crawl != nil, service.limits
+			service.Unlock()
+			if running {
+				body, _ := json.Marshal(limits)
+				current, err := callCrawl(http.MethodPost, "/rate-limits", body)
+				if err != nil {
+					writeError(w, http.StatusBadGateway, "adjusting the running crawl failed: "+err.Error())
+					return
+				}
+				writeJSON(w, http.StatusOK, current)
+				return
+			}
+			writeJSON(w, http.StatusOK, merged)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "expected GET or POST")
+		}
+	})
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "expected GET")
+			return
+		}
+		service.Lock()
+		report := service.lastReport
+		service.Unlock()
+		if report == nil {
+			writeError(w, http.StatusNotFound, "no crawl has finished yet")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+	// The status page of the running crawl
+	mux.Handle("/status/", &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme, r.URL.Host = "http", "crawl"
+		},
+		Transport: crawlClient.Transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			service.Lock()
+			next := service.next
+			running := service.crawl != nil
+			service.Unlock()
+			if running {
+				http.Error(w, "The crawl isn't answering: "+err.Error(), http.StatusBadGateway)
+				return
+			}
+			http.Error(w, "No crawl is running, the next one starts at "+next.UTC().Format(time.RFC3339), http.StatusServiceUnavailable)
+		},
+	})
+	return requireToken(mux)
+}
+
+// Rejects the requests without the bearer token. Browsers give the token as
+// the password of basic authentication instead, with any user.
+func requireToken(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + *controlToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		if _, password, ok := r.BasicAuth(); ok {
+			given = []byte("Bearer " + password)
+		}
+		if subtle.ConstantTimeCompare(given, expected) != 1 {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+			w.Header().Add("WWW-Authenticate", `Basic realm="ps-splunk"`)
+			writeError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Client of the control socket of the running crawl
+var crawlClient = http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", service.socket)
+		},
+	},
+}
+
+// Calls the control socket of the running crawl, returning its JSON response
+func callCrawl(method, path string, body []byte) (json.RawMessage, error) {
+	req, err := http.NewRequest(method, "http://crawl"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := crawlClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// Writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
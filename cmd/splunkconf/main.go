@@ -0,0 +1,49 @@
+// Command splunkconf writes the props.conf and transforms.conf of the app from
+// the event structs, and the inputs.conf.spec of its modular input from the
+// crawler flags, run by go generate in pkg/event.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/bored-engineer/ps-splunk/pkg/splunk"
+)
+
+// Command line flags
+var dir = flag.String("dir", "default", "Directory of the app configuration the files are written to")
+var readme = flag.String("readme", "README", "Directory of the app the configuration specs are written to")
+
+func main() {
+	flag.Parse()
+	for name, write := range map[string]func(io.Writer) error{
+		"props.conf":      splunk.Props,
+		"transforms.conf": splunk.Transforms,
+	} {
+		if err := writeFile(filepath.Join(*dir, name), write); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := writeFile(filepath.Join(*readme, "inputs.conf.spec"), splunk.InputsSpec); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Writes a file through a temporary one so it is never half written
+func writeFile(path string, write func(io.Writer) error) error {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,3 @@
+module github.com/bored-engineer/ps-splunk
+
+go 1.21
@@ -0,0 +1,88 @@
+package crawler
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Aggregation flags
+var aggregateWindows = aggregateDurations{}
+
+func init() {
+	Flags.Var(aggregateWindows, "timeseries-aggregate", "Roll the time series up to windows of this duration, for every event type or per type as type=duration pairs (e.g. 5m or histogram-owdelay=5m,throughput=1h), emitting one event per window with the count, min, mean, max and p95 of its datapoints")
+}
+
+// Aggregation windows by event type, * being the catch-all
+type aggregateDurations map[string]time.Duration
+
+func (d aggregateDurations) String() string {
+	pairs := make([]string, 0, len(d))
+	for name, window := range d {
+		pairs = append(pairs, name+"="+window.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (d aggregateDurations) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		name := "*"
+		if len(kv) == 2 {
+			name = strings.TrimSpace(kv[0])
+		}
+		window, err := time.ParseDuration(strings.TrimSpace(kv[len(kv)-1]))
+		if err != nil || window < 0 || window%time.Second != 0 {
+			return fmt.Errorf("invalid aggregation window %q, expected a whole number of seconds such as 5m", pair)
+		}
+		d[name] = window
+	}
+	return nil
+}
+
+// Returns the aggregation window of eventType in seconds, 0 when its
+// datapoints are kept as they are
+func (d aggregateDurations) get(eventType string) int64 {
+	if window, ok := d[eventType]; ok {
+		return int64(window / time.Second)
+	}
+	return int64(d["*"] / time.Second)
+}
+
+// Queues an aggregate of point's series for each window of the rollup, the
+// values of its datapoints by window start
+func emitAggregates(point event.Datapoint, window int64, rollup map[int64][]float64) {
+	starts := make([]int64, 0, len(rollup))
+	for start := range rollup {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	for _, start := range starts {
+		values := rollup[start]
+		sort.Float64s(values)
+		var sum float64
+		for _, value := range values {
+			sum += value
+		}
+		mean := sum / float64(len(values))
+		// The nearest rank percentile
+		p95 := values[int(math.Ceil(0.95*float64(len(values))))-1]
+		aggregate := point
+		aggregate.Header = event.NewHeader()
+		aggregate.Timestamp = start
+		aggregate.AggregateWindow = int(window)
+		aggregate.Count = len(values)
+		aggregate.Min = &values[0]
+		aggregate.Mean = &mean
+		aggregate.Max = &values[len(values)-1]
+		aggregate.P95 = &p95
+		setSeriesValue(&aggregate, &mean)
+		datapointsAggregated.Add(float64(len(values)), point.EventType)
+		emitDatapoint(aggregate)
+	}
+}
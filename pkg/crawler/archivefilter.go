@@ -0,0 +1,60 @@
+package crawler
+
+import (
+	"path"
+	"strings"
+)
+
+// Archive filter flags
+var eventTypesFilter = Flags.String("event-types", "", "Comma separated esmond event types downloaded from the archives by any stream, e.g. throughput,histogram-owdelay (default all)")
+var toolsFilter = Flags.String("tools", "", "Comma separated tools whose measurements are downloaded from the archives, e.g. iperf3,owamp, matching pscheduler/iperf3 and bwctl/iperf3 alike (default all)")
+
+// Event types and tools allowed by the filters, nil allows them all
+var allowedEventTypes, allowedTools map[string]bool
+
+// Parses the archive filters
+func setupArchiveFilters() {
+	allowedEventTypes = filterSet(*eventTypesFilter)
+	allowedTools = filterSet(*toolsFilter)
+}
+
+// Returns the set of a comma separated list, nil when it is empty
+func filterSet(list string) map[string]bool {
+	var set map[string]bool
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item == "" {
+			continue
+		}
+		if set == nil {
+			set = make(map[string]bool)
+		}
+		set[item] = true
+	}
+	return set
+}
+
+// Whether the measurements of an event type are downloaded
+func eventTypeAllowed(eventType string) bool {
+	return allowedEventTypes == nil || allowedEventTypes[strings.ToLower(eventType)]
+}
+
+// Whether the measurements of a tool are downloaded, matched on its full
+// name or on its name without the scheduler it ran under
+func toolAllowed(tool string) bool {
+	tool = strings.ToLower(tool)
+	return allowedTools == nil || allowedTools[tool] || allowedTools[path.Base(tool)]
+}
+
+// Whether the data of a measurement's event type is downloaded, counting the
+// ones filtered out
+func archiveAllowed(measurement esmondMetadata, eventType string) bool {
+	switch {
+	case !eventTypeAllowed(eventType):
+		archiveFiltered.Inc("event_type")
+		return false
+	case !toolAllowed(measurement.ToolName):
+		archiveFiltered.Inc("tool")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package crawler
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Archive discovery flags
+var discoverArchives = Flags.Bool("discover-archives", true, "Read the graphs of the measurement archives each host names (toolkit esmond addresses, lookup service MA records, -mesh archives) instead of its localhost archive alone, an archive shared by several hosts being read once")
+
+// Archive graphData.cgi reads when the host names none of its own
+const localArchive = "http://localhost" + esmondArchive
+
+// The host each archive is read, or being read, through so the others naming
+// it skip it
+var archivesClaimed = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// Returns the measurement archives whose graphs are read through host: its
+// own archive, at the URL it gives or localhost, then the shared archives it
+// names
+func hostArchives(host string, toolkit *event.ToolkitSummary) []string {
+	if !*discoverArchives {
+		return []string{localArchive}
+	}
+	var named []string
+	if toolkit != nil {
+		for _, service := range toolkit.Services {
+			if service.Name == "esmond" {
+				named = append(named, service.Addresses...)
+			}
+		}
+	}
+	named = append(named, discovery.ArchivesOf(host)...)
+	var own, shared []string
+	seen := make(map[string]bool)
+	for _, archive := range named {
+		if archive = discovery.NormalizeArchive(archive); archive == "" || seen[archive] {
+			continue
+		}
+		seen[archive] = true
+		if ownArchive(host, archive) {
+			own = append(own, archive)
+		} else {
+			shared = append(shared, archive)
+		}
+	}
+	if len(own) == 0 {
+		own = []string{localArchive}
+	}
+	return append(own[:1], shared...)
+}
+
+// Reports whether an archive URL is on host itself
+func ownArchive(host string, archive string) bool {
+	u, err := url.Parse(archive)
+	if err != nil {
+		return false
+	}
+	name := discovery.CanonicalHost(u.Hostname())
+	return name == "localhost" || name == "127.0.0.1" || name == "::1" || sameHost(host, name)
+}
+
+// Reports whether a name or address given by an archive is host
+func sameHost(host string, name string) bool {
+	name = discovery.CanonicalHost(name)
+	address, _ := discovery.SplitKey(host)
+	if name == "" {
+		return false
+	}
+	if name == address {
+		return true
+	}
+	for _, addr := range discovery.AddressesOf(name) {
+		if addr == address {
+			return true
+		}
+	}
+	for _, alias := range discovery.NamesOf(address) {
+		if strings.EqualFold(name, alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the host a measurement read from an archive through host is
+// attributed to: host when it takes part in it, otherwise its measurement
+// agent or source, the archive being a central one other hosts write to
+func measurementHost(host string, agent string, source string, destination string) string {
+	if !*discoverArchives {
+		return host
+	}
+	for _, name := range []string{agent, source, destination} {
+		if sameHost(host, name) {
+			return host
+		}
+	}
+	for _, name := range []string{agent, source} {
+		if name = discovery.CanonicalHost(name); name == "" {
+			continue
+		}
+		if addrs := discovery.AddressesOf(name); len(addrs) > 0 {
+			return addrs[0]
+		}
+		return name
+	}
+	return host
+}
+
+// Returns the URL of the esmond archive of host at archive, its own being
+// read at the scheme it answered
+func esmondURL(host string, scheme string, archive string) string {
+	if ownArchive(host, archive) {
+		return discovery.HostURL(scheme, host, esmondArchive)
+	}
+	return archive
+}
+
+// Returns the URL of a path of the esmond API of archive, the URIs of its
+// metadata being absolute paths on the archive's host
+func archiveURL(archive string, uri string) string {
+	base, err := url.Parse(archive)
+	if err != nil {
+		return archive + uri
+	}
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return archive + uri
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// Returns the key an archive is claimed under: the address of its host, the
+// own archive of host being keyed by the address of host, and its path
+func archiveKey(host string, archive string) string {
+	u, err := url.Parse(archive)
+	if err != nil {
+		return archive
+	}
+	name := discovery.CanonicalHost(u.Hostname())
+	if ownArchive(host, archive) {
+		name, _ = discovery.SplitKey(host)
+	} else if addrs := discovery.AddressesOf(name); len(addrs) > 0 {
+		name = addrs[0]
+	}
+	return name + ":" + u.Port() + u.Path
+}
+
+// Claims an archive for host, false when another host read it
+func claimArchive(host string, archive string) bool {
+	key := archiveKey(host, archive)
+	archivesClaimed.Lock()
+	defer archivesClaimed.Unlock()
+	if owner, ok := archivesClaimed.m[key]; ok && owner != host {
+		return false
+	}
+	archivesClaimed.m[key] = host
+	return true
+}
+
+// Releases the claim of host on an archive it couldn't read, another host
+// naming it can then try
+func releaseArchive(host string, archive string) {
+	key := archiveKey(host, archive)
+	archivesClaimed.Lock()
+	defer archivesClaimed.Unlock()
+	if archivesClaimed.m[key] == host {
+		delete(archivesClaimed.m, key)
+	}
+}
@@ -0,0 +1,65 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Circuit breaker flags
+var breakerFailures = Flags.Int("breaker-failures", 3, "Consecutive failed requests to a host (transport errors, timeouts, 429 or 5xx) after which its remaining requests are skipped, 0 never skips")
+
+// Error of a request skipped as the circuit breaker of its host is open
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// Consecutive failed requests of the hosts being crawled
+var breakers = struct {
+	sync.Mutex
+	failures map[string]int
+}{failures: make(map[string]int)}
+
+// Checks the circuit breaker flags
+func setupBreaker() error {
+	if *breakerFailures < 0 {
+		return fmt.Errorf("-breaker-failures must be at least 0")
+	}
+	return nil
+}
+
+// Returns errBreakerOpen if the requests to host failed -breaker-failures
+// times in a row
+func checkBreaker(host string) error {
+	if *breakerFailures == 0 {
+		return nil
+	}
+	breakers.Lock()
+	defer breakers.Unlock()
+	if breakers.failures[host] >= *breakerFailures {
+		return errBreakerOpen
+	}
+	return nil
+}
+
+// Records whether a request to host failed, an answer closing its breaker
+func recordBreaker(host string, failed bool) {
+	if *breakerFailures == 0 {
+		return
+	}
+	breakers.Lock()
+	defer breakers.Unlock()
+	if !failed {
+		delete(breakers.failures, host)
+		return
+	}
+	breakers.failures[host]++
+	if breakers.failures[host] == *breakerFailures {
+		logger.Info("Circuit breaker opened, skipping the remaining requests", "host", host, "failures", *breakerFailures)
+	}
+}
+
+// Forgets the breaker of a host once its crawl is over
+func resetBreaker(host string) {
+	breakers.Lock()
+	defer breakers.Unlock()
+	delete(breakers.failures, host)
+}
@@ -0,0 +1,106 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Time budget flags
+var maxDuration = Flags.Duration("max-duration", 0, "Time budget of the whole crawl, once spent it stops like an interrupt and emits a truncated event, e.g. 2h (default unbounded)")
+var hostBudget = Flags.Duration("host-budget", 0, "Time budget of the crawl of each host, once spent its remaining requests are skipped and what was collected is kept, e.g. 10m (default unbounded)")
+
+// Error of a request skipped as the time budget of its host is spent
+var errHostBudget = errors.New("host time budget spent")
+
+// Set once -max-duration stopped the crawl
+var budgetSpent atomic.Bool
+
+// Contexts bounding the requests of the hosts being crawled to their budget
+var hostContexts = struct {
+	sync.Mutex
+	m map[string]context.Context
+}{m: make(map[string]context.Context)}
+
+// Checks the time budget flags
+func setupBudget() error {
+	if *maxDuration < 0 || *hostBudget < 0 {
+		return fmt.Errorf("-max-duration and -host-budget must be at least 0")
+	}
+	return nil
+}
+
+// Stops the crawl once -max-duration passed since it started
+func startBudget() {
+	if *maxDuration == 0 {
+		return
+	}
+	time.AfterFunc(*maxDuration-time.Since(crawlStart), func() {
+		if Stopped() {
+			return
+		}
+		logger.Warn("Crawl time budget spent, stopping", "max_duration", *maxDuration)
+		budgetSpent.Store(true)
+		Stop()
+	})
+}
+
+// Starts the budget of the crawl of host, the returned function ends it
+func beginHostBudget(host string) context.CancelFunc {
+	if *hostBudget == 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithTimeout(crawlCtx, *hostBudget)
+	hostContexts.Lock()
+	hostContexts.m[host] = ctx
+	hostContexts.Unlock()
+	return func() {
+		if ctx.Err() == context.DeadlineExceeded && !crawlCancelled() {
+			logger.Info("Host time budget spent, kept what was collected", "host", host, "host_budget", *hostBudget)
+			hostsOverBudget.Inc()
+		}
+		hostContexts.Lock()
+		delete(hostContexts.m, host)
+		hostContexts.Unlock()
+		cancel()
+	}
+}
+
+// Returns the context of the requests to host, bounded by its budget
+func hostContext(host string) context.Context {
+	hostContexts.Lock()
+	defer hostContexts.Unlock()
+	if ctx, ok := hostContexts.m[host]; ok {
+		return ctx
+	}
+	return crawlCtx
+}
+
+// Returns errHostBudget once the budget of host is spent
+func checkHostBudget(host string) error {
+	if ctx := hostContext(host); ctx.Err() == context.DeadlineExceeded && !crawlCancelled() {
+		return errHostBudget
+	}
+	return nil
+}
+
+// Queues the truncated event of a crawl stopped by -max-duration
+func emitTruncated() {
+	if !budgetSpent.Load() {
+		return
+	}
+	state := crawlState()
+	truncations.Emit(event.Truncation{
+		Header:         event.NewHeader(),
+		Reason:         "max_duration",
+		BudgetSeconds:  maxDuration.Seconds(),
+		ElapsedSeconds: time.Since(crawlStart).Seconds(),
+		Completed:      len(state.Completed),
+		Pending:        len(state.Pending),
+	})
+}
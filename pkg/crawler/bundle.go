@@ -0,0 +1,69 @@
+package crawler
+
+import (
+	"encoding/json"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Bundle flags
+var probeBundle = Flags.Bool("probe-bundle", true, "Probe the pScheduler and esmond archive of the hosts answering HTTP without a toolkit summary, so host_status tells testpoints and archives apart")
+
+// The perfSONAR install bundles told apart by classifyBundle
+const (
+	bundleToolkit   = "toolkit"
+	bundleCore      = "core"
+	bundleTestpoint = "testpoint"
+	bundleArchive   = "archive"
+)
+
+// Returns the install bundle of a host from the components that answered,
+// empty when none did. Only the full toolkit serves the toolkit summary, a
+// core install runs pScheduler and an esmond archive, a testpoint only
+// pScheduler and a central archive only esmond.
+func classifyBundle(status event.HostStatus) string {
+	switch {
+	case status.HasToolkit:
+		return bundleToolkit
+	case status.HasPScheduler && status.HasEsmond:
+		return bundleCore
+	case status.HasPScheduler:
+		return bundleTestpoint
+	case status.HasEsmond:
+		return bundleArchive
+	}
+	return ""
+}
+
+// Probes the pScheduler and esmond archive of a host that answered HTTP
+// without a toolkit summary, a JSON list from either meaning it runs it
+func probeBundleComponents(host string, scheme string) {
+	if !*probeBundle || !*collectHostStatus || scheme == "" {
+		return
+	}
+	answered := false
+	markHost(host, func(status *event.HostStatus) { answered = status.Reachable })
+	if !answered {
+		return
+	}
+	logger.Debug("Probing the bundle", "host", host)
+	if probeList(host, endpointPScheduler, discovery.HostURL(scheme, host, "/pscheduler/tests")) {
+		markHost(host, func(status *event.HostStatus) { status.HasPScheduler = true })
+	}
+	if probeList(host, endpointEsmond, discovery.HostURL(scheme, host, esmondArchive+"?limit=1")) {
+		markHost(host, func(status *event.HostStatus) { status.HasEsmond = true })
+	}
+}
+
+// Returns true if url answered a JSON list
+func probeList(host string, endpoint string, url string) bool {
+	resp, err := fetch(host, endpoint, url)
+	if err != nil {
+		return false
+	}
+	defer httpx.CloseBody(resp)
+	var list []json.RawMessage
+	return decodeResponse(endpoint, resp, httpx.JSONArray, &list) == nil
+}
@@ -0,0 +1,118 @@
+package crawler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Certificate flags
+var tlsExpiryWarning = Flags.Duration("tls-expiry-warning", 30*24*time.Hour, "Certificates of hosts expiring within this are an issue of their inventory")
+
+// The certificate each host presented over HTTPS, the first one seen
+var hostCertificates = struct {
+	sync.Mutex
+	m map[string]hostCertificate
+}{m: make(map[string]hostCertificate)}
+
+// A certificate presented by a host and when it expires
+type hostCertificate struct {
+	info     event.InventoryTLS
+	notAfter time.Time
+}
+
+// Records the certificate of host from an HTTPS answer, or from the error of a
+// handshake whose certificate wasn't trusted
+func observeTLS(host string, resp *http.Response, err error) {
+	var certs []*x509.Certificate
+	var verified *bool
+	verifyError := ""
+	var verifyErr *tls.CertificateVerificationError
+	switch {
+	case resp != nil && resp.TLS != nil:
+		certs = resp.TLS.PeerCertificates
+		// Certificates aren't checked at all with -insecure-skip-verify
+		if !*insecureSkipVerify {
+			trusted := len(resp.TLS.VerifiedChains) > 0
+			verified = &trusted
+		}
+	case err != nil && errors.As(err, &verifyErr):
+		certs = verifyErr.UnverifiedCertificates
+		trusted := false
+		verified, verifyError = &trusted, verifyErr.Err.Error()
+	}
+	if len(certs) == 0 {
+		return
+	}
+	hostCertificates.Lock()
+	defer hostCertificates.Unlock()
+	if _, seen := hostCertificates.m[host]; seen {
+		return
+	}
+	cert := certs[0]
+	hostCertificates.m[host] = hostCertificate{
+		info: event.InventoryTLS{
+			Subject:      cert.Subject.String(),
+			Issuer:       cert.Issuer.String(),
+			SerialNumber: serialNumber(cert.SerialNumber),
+			DNSNames:     cert.DNSNames,
+			NotBefore:    cert.NotBefore.UTC().Format(event.TimeLayout),
+			NotAfter:     cert.NotAfter.UTC().Format(event.TimeLayout),
+			SelfSigned:   bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil,
+			Verified:     verified,
+			VerifyError:  verifyError,
+		},
+		notAfter: cert.NotAfter,
+	}
+}
+
+// Returns a certificate serial number in hex
+func serialNumber(serial *big.Int) string {
+	if serial == nil {
+		return ""
+	}
+	return fmt.Sprintf("%X", serial)
+}
+
+// Returns the certificate host presented with the days it has left, nil when
+// it wasn't reached over HTTPS
+func certificateOf(host string) *event.InventoryTLS {
+	hostCertificates.Lock()
+	defer hostCertificates.Unlock()
+	cert, ok := hostCertificates.m[host]
+	if !ok {
+		return nil
+	}
+	found := cert.info
+	found.DaysLeft = time.Until(cert.notAfter).Hours() / 24
+	return &found
+}
+
+// Returns the issues of a certificate: expired, expiring within
+// -tls-expiry-warning, self-signed or not trusted
+func certificateIssues(cert *event.InventoryTLS) []string {
+	if cert == nil {
+		return nil
+	}
+	var issues []string
+	switch {
+	case cert.DaysLeft < 0:
+		issues = append(issues, "tls certificate expired")
+	case cert.DaysLeft*24 < tlsExpiryWarning.Hours():
+		issues = append(issues, fmt.Sprintf("tls certificate expires in %d days", int(cert.DaysLeft)))
+	}
+	if cert.SelfSigned {
+		issues = append(issues, "tls certificate self-signed")
+	} else if cert.Verified != nil && !*cert.Verified {
+		issues = append(issues, "tls certificate not trusted")
+	}
+	return issues
+}
@@ -0,0 +1,83 @@
+package crawler
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Clock skew flags
+var clockSkewThreshold = Flags.Duration("clock-skew-threshold", 5*time.Second, "Clock skew between a host and the collector, from the Date headers of its answers or the offset of its NTP, beyond which its host_status is clock_skewed, 0 never flags it")
+
+// Answers taking longer than this to arrive don't tell the clock skew, their
+// Date header could have been stamped anywhere in between
+const dateMaxRoundTrip = time.Second
+
+// Records the skew of the clock of host given by the Date header of an answer
+// to a request sent at sent and received at received, against the middle of
+// the round trip. The header has a resolution of a second so its middle is
+// compared.
+func observeDate(host string, header http.Header, sent time.Time, received time.Time) {
+	roundTrip := received.Sub(sent)
+	if roundTrip > dateMaxRoundTrip {
+		return
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return
+	}
+	skew := date.Add(500 * time.Millisecond).Sub(sent.Add(roundTrip / 2)).Seconds()
+	crawling.Lock()
+	defer crawling.Unlock()
+	if status, ok := crawling.m[host]; ok {
+		status.dateSkews = append(status.dateSkews, skew)
+	}
+}
+
+// Records the offset the NTP of host reports, in milliseconds
+func observeNTPOffset(host string, offset *float64) {
+	if offset == nil {
+		return
+	}
+	seconds := *offset / 1000
+	markHost(host, func(status *event.HostStatus) { status.NTPOffsetSeconds = &seconds })
+}
+
+// Sets the clock skew of a host status from the Date headers of its answers,
+// their median once those slower than dateMaxRoundTrip are left out, and flags
+// it when it or the NTP offset is beyond -clock-skew-threshold
+func setClockSkew(record *event.HostStatus, skews []float64) {
+	if len(skews) > 0 {
+		sorted := append([]float64(nil), skews...)
+		sort.Float64s(sorted)
+		median := sorted[len(sorted)/2]
+		if len(sorted)%2 == 0 {
+			median = (sorted[len(sorted)/2-1] + median) / 2
+		}
+		record.ClockSkewSeconds = &median
+	}
+	if *clockSkewThreshold <= 0 {
+		return
+	}
+	threshold := clockSkewThreshold.Seconds()
+	for _, skew := range []*float64{record.ClockSkewSeconds, record.NTPOffsetSeconds} {
+		if skew != nil && math.Abs(*skew) > threshold {
+			record.ClockSkewed = true
+		}
+	}
+	if !record.ClockSkewed {
+		return
+	}
+	hostsClockSkewed.Inc()
+	args := []interface{}{"host", record.Host}
+	if record.ClockSkewSeconds != nil {
+		args = append(args, "skew_seconds", *record.ClockSkewSeconds)
+	}
+	if record.NTPOffsetSeconds != nil {
+		args = append(args, "ntp_offset_seconds", *record.NTPOffsetSeconds)
+	}
+	logger.Warn("Clock skewed", args...)
+}
@@ -0,0 +1,55 @@
+package crawler
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Content-Type flags
+var strictContentType = Flags.Bool("strict-content-type", false, "Only parse the responses of hosts labelled with a JSON Content-Type (application/json, text/json or +json), instead of any response that parses as JSON")
+
+// Returned by decodeResponse for a response that isn't JSON, which is skipped
+// without a warning as the host doesn't have what was asked for
+var errNotJSON = errors.New("not a JSON response")
+
+// Decodes the JSON response of a host to a request for endpoint into v after
+// checking its top-level shape. Whatever its Content-Type, a response is
+// parsed unless -strict-content-type is given, and is only not JSON when it
+// doesn't parse and isn't labelled as JSON either. Every skip is counted by
+// reason: content_type, not_json or invalid_json.
+func decodeResponse(endpoint string, resp *http.Response, shape byte, v interface{}) error {
+	contentType := resp.Header.Get("Content-Type")
+	labelled := isJSONType(contentType)
+	if *strictContentType && !labelled {
+		contentSkipped.Inc(endpoint, "content_type")
+		logger.Debug("Skipping a response that isn't labelled JSON", "url", resp.Request.URL, "content_type", contentType)
+		return errNotJSON
+	}
+	err := httpx.DecodeShape(resp.Body, shape, v)
+	switch {
+	case err == nil:
+		if !labelled {
+			logger.Debug("Parsed a response not labelled JSON", "url", resp.Request.URL, "content_type", contentType)
+		}
+		return nil
+	case !labelled:
+		contentSkipped.Inc(endpoint, "not_json")
+		logger.Debug("Skipping a response that isn't JSON", "url", resp.Request.URL, "content_type", contentType)
+		return errNotJSON
+	}
+	contentSkipped.Inc(endpoint, "invalid_json")
+	return err
+}
+
+// Returns true if contentType is a JSON media type, whatever its parameters
+func isJSONType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
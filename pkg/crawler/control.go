@@ -0,0 +1,94 @@
+package crawler
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Control flags
+var controlSocket = Flags.String("control-socket", "", "Unix socket serving the progress of the crawl on GET /progress, adjusting its rate limits on GET and POST /rate-limits and serving its status page on /status/, used by the service mode of map")
+
+// Progress of the crawl as served on the control socket
+type controlProgress struct {
+	StartTime         string  `json:"start_time"`
+	Discovered        int64   `json:"discovered"`
+	Completed         int64   `json:"completed"`
+	Queued            int     `json:"queued"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	ETASeconds        float64 `json:"eta_seconds,omitempty"`
+	Stopping          bool    `json:"stopping"`
+}
+
+// Listens on -control-socket and serves it until the process exits
+func serveControl() error {
+	// A socket left by a previous crawl would fail the listen
+	os.Remove(*controlSocket)
+	listener, err := net.Listen("unix", *controlSocket)
+	if err != nil {
+		return err
+	}
+	// The request rate is averaged since the previous call
+	rate := requestRate{at: crawlStart}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/progress", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			controlError(w, http.StatusMethodNotAllowed, "expected GET")
+			return
+		}
+		now := time.Now()
+		p := currentProgress(now, rate.next(now))
+		controlJSON(w, http.StatusOK, controlProgress{
+			StartTime:         crawlStart.UTC().Format(event.TimeLayout),
+			Discovered:        p.discovered,
+			Completed:         p.completed,
+			Queued:            p.queued,
+			RequestsPerSecond: math.Round(p.rate*10) / 10,
+			ETASeconds:        p.eta.Seconds(),
+			Stopping:          Stopped(),
+		})
+	})
+	mux.HandleFunc("/rate-limits", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var limits RateLimits
+			if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+				controlError(w, http.StatusBadRequest, "invalid rate limits: "+err.Error())
+				return
+			}
+			if err := SetRateLimits(limits); err != nil {
+				controlError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		default:
+			controlError(w, http.StatusMethodNotAllowed, "expected GET or POST")
+			return
+		}
+		controlJSON(w, http.StatusOK, CurrentRateLimits())
+	})
+	mux.Handle("/status/", http.StripPrefix("/status", StatusHandler()))
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logger.Error("Serving the control socket failed", "socket", *controlSocket, "err", err)
+		}
+	}()
+	return nil
+}
+
+// Writes a JSON response
+func controlJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Writes a JSON error response
+func controlError(w http.ResponseWriter, status int, message string) {
+	controlJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,603 @@
+// Package crawler crawls the toolkit, graphs, esmond and pScheduler endpoints
+// of every host it is given, queueing the test partners it finds in turn, and
+// sends what it reads to the sink streams.
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/enrich"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+	"github.com/bored-engineer/ps-splunk/pkg/logging"
+	"github.com/bored-engineer/ps-splunk/pkg/sink"
+)
+
+// Flags of the crawl, merged into the command line by cmd/map
+var Flags = flag.NewFlagSet("crawler", flag.ContinueOnError)
+
+// Logger of the crawl
+var logger = logging.New("crawler")
+
+// FlagSets returns the flags of the crawl and of every package it uses, in the
+// order they are set up
+func FlagSets() []*flag.FlagSet {
+	return []*flag.FlagSet{logging.Flags, httpx.Flags, discovery.Flags, Flags, enrich.Flags, sink.Flags}
+}
+
+// Crawl flags
+var workers = Flags.Int("workers", 64, "Number of hosts crawled at the same time")
+var maxDepth = Flags.Int("max-depth", -1, "Maximum number of hops from the discovered seed hosts to crawl (-1 for no limit)")
+var maxHosts = Flags.Int("max-hosts", 0, "Maximum number of hosts to crawl (0 for no limit)")
+
+// -concurrency was renamed -workers, it is kept for the scripts still using it
+func init() {
+	Flags.IntVar(workers, "concurrency", *workers, "Deprecated alias of -workers")
+}
+
+// Holds the wait group before exiting, it tracks every queued host
+var wg sync.WaitGroup
+
+// Define a thread safe cache of hosts we've already looked up, the value
+// turns true once the host has been crawled. The depth of a host is the number
+// of hops from the seed hosts it was first found at.
+var cache = struct {
+	sync.RWMutex
+	m     map[string]bool
+	depth map[string]int
+}{m: make(map[string]bool), depth: make(map[string]int)}
+
+// The output queues, named by the suffix of their files
+var (
+	links        = sink.NewQueue("link")
+	summaries    = sink.NewQueue("summary")
+	results      = sink.NewQueue("results")
+	failed       = sink.NewQueue("failed")
+	tasks        = sink.NewQueue("tasks")
+	paths        = sink.NewQueue("paths")
+	timeSeries   = sink.NewQueue("timeseries")
+	inventory    = sink.NewQueue("inventory")
+	expected     = sink.NewQueue("expected")
+	components   = sink.NewQueue("components")
+	reports      = sink.NewQueue("report")
+	parseErrors  = sink.NewQueue("parse_errors")
+	hostStatuses = sink.NewQueue("host_status")
+	metricPoints = sink.NewQueue("metrics")
+	errorEvents  = sink.NewQueue("errors")
+	truncations  = sink.NewQueue("truncated")
+	pairs        = sink.NewQueue("pairs")
+)
+
+// Test defines structures for tests
+type Test struct {
+	LastUpdated   int    `json:"last_updated"`
+	DestinationIP string `json:"destination_ip"`
+	SourceIP      string `json:"source_ip"`
+}
+
+// Client is used for every request to the hosts, Setup installs its transport
+var Client = &http.Client{}
+
+// Queue of hosts waiting for a worker
+var jobs = newJobQueue()
+
+// Setup checks the crawl flags and prepares the client and rate limiters
+func Setup() error {
+	if *workers < 1 {
+		return fmt.Errorf("-workers must be at least 1")
+	}
+	if *maxDepth < -1 || *maxHosts < 0 {
+		return fmt.Errorf("-max-depth must be at least -1 and -max-hosts at least 0")
+	}
+	if *resultsSource != "graphs" && *resultsSource != "esmond" && *resultsSource != "auto" {
+		return fmt.Errorf("invalid -results-source %q, expected graphs, esmond or auto", *resultsSource)
+	}
+	if err := setupTimeWindow(); err != nil {
+		return err
+	}
+	if _, err := crawlSchemes(); err != nil {
+		return err
+	}
+	if err := setupTLS(); err != nil {
+		return err
+	}
+	if err := setupSample(); err != nil {
+		return err
+	}
+	if err := setupBudget(); err != nil {
+		return err
+	}
+	if err := setupBreaker(); err != nil {
+		return err
+	}
+	if err := setupDeadHosts(); err != nil {
+		return err
+	}
+	if err := setupGraph(); err != nil {
+		return err
+	}
+	if err := setupSummaryDedup(); err != nil {
+		return err
+	}
+	setupArchiveFilters()
+	setupVantage()
+	if err := setupDistributed(); err != nil {
+		return err
+	}
+	setupRateLimits()
+	return nil
+}
+
+// Closed once the crawl is finished to stop the checkpoints
+var checkpointDone = make(chan struct{})
+
+// Start resumes an interrupted crawl if asked to, opens the sinks and starts
+// the workers, hosts are then crawled as they are passed to Dedup
+func Start() error {
+	// Pick up where an interrupted crawl stopped, before the outputs are named
+	if *resume {
+		if err := resumeCrawl(*stateFile); err != nil {
+			return err
+		}
+	}
+	if *optOutFile != "" {
+		if err := loadOptOuts(*optOutFile); err != nil {
+			return err
+		}
+	}
+	if *deadHostsFile != "" {
+		if err := loadDeadHosts(*deadHostsFile); err != nil {
+			return err
+		}
+	}
+	if *summaryDedupFile != "" {
+		if err := loadSummaryRecords(*summaryDedupFile); err != nil {
+			return err
+		}
+	}
+	if *incrementalFile != "" {
+		if err := loadSeriesMarks(*incrementalFile); err != nil {
+			return err
+		}
+	}
+	if err := sink.Open(); err != nil {
+		return err
+	}
+	if *controlSocket != "" {
+		if err := serveControl(); err != nil {
+			return err
+		}
+	}
+	// Start the worker pool, the workers of a coordinator crawl its hosts
+	if isCoordinator() {
+		serveCoordinator()
+	} else {
+		for i := 0; i < *workers; i++ {
+			go workerLoop()
+		}
+	}
+	startBudget()
+	// Checkpoint and report the progress, a dry run has none
+	if *checkpointInterval > 0 && !*dryRun {
+		go checkpoint(*stateFile, *checkpointInterval, checkpointDone)
+	}
+	if !*dryRun {
+		progressStopped.Add(1)
+		go reportProgress(progressDone)
+	}
+	return nil
+}
+
+// Finish waits for every queued host to be crawled, checks the expected tests,
+// groups the hosts into components and reports, then drains the outputs and
+// writes the final crawl state
+func Finish() error {
+	wg.Wait()
+	if isCoordinator() {
+		waitForWorkers()
+	}
+	close(progressDone)
+	progressStopped.Wait()
+	// Stop the workers, check the expected tests, group the components and
+	// report, then let the writers drain the output queues
+	jobs.close()
+	flushAllLinks()
+	emitPairs()
+	writeExpectedTests()
+	writeComponents()
+	emitTombstones()
+	emitTruncated()
+	if *runReport || *reportFile != "" {
+		writeReport()
+	}
+	if !*dryRun {
+		sendHeadlines()
+	}
+	sink.Close()
+	if IsWorker() {
+		leaveCoordinator()
+	}
+	if *graphFile != "" {
+		if err := writeGraph(*graphFile); err != nil {
+			return err
+		}
+		logger.Info("Graph written", "file", *graphFile)
+	}
+	// Record the final state, listing what is left to do when interrupted
+	close(checkpointDone)
+	if *dryRun {
+		return nil
+	}
+	if err := writeCrawlState(*stateFile); err != nil {
+		return err
+	}
+	logger.Info("Crawl state written", "file", *stateFile)
+	if *deadHostsFile != "" {
+		if err := writeDeadHosts(*deadHostsFile); err != nil {
+			return err
+		}
+		logger.Info("Dead hosts written", "file", *deadHostsFile)
+	}
+	if *summaryDedupFile != "" {
+		if err := writeSummaryRecords(*summaryDedupFile); err != nil {
+			return err
+		}
+		logger.Info("Summary records written", "file", *summaryDedupFile)
+	}
+	if *incrementalFile != "" {
+		if err := writeSeriesMarks(*incrementalFile); err != nil {
+			return err
+		}
+		logger.Info("Series marks written", "file", *incrementalFile)
+	}
+	return nil
+}
+
+// Dedup adds an host to the queue and cache if not already in cache, origin
+// being the host it was found on or where discovery found it
+func Dedup(host string, origin string) {
+	host = discovery.CanonicalHost(host)
+	if host == "" {
+		return
+	}
+	// The coordinator of a distributed crawl queues the partners of workers
+	if IsWorker() {
+		addPartner(host, origin)
+		return
+	}
+	// Check and mark under the same lock so a host is never queued twice,
+	// hosts past the limits are linked but left out of the cache
+	cache.Lock()
+	depth := hostDepth(origin)
+	_, ok := cache.m[host]
+	add := !ok && (*maxDepth < 0 || depth <= *maxDepth) && (*maxHosts <= 0 || len(cache.m) < *maxHosts)
+	if add {
+		cache.m[host] = false
+		cache.depth[host] = depth
+	}
+	cache.Unlock()
+	// A link found again, by another test or direction or cache file, only
+	// counts towards the one emitted
+	link := event.Link{Address: host, Origin: origin, Discovery: discovery.SourceOf(origin), Depth: depth}
+	linkFrom(&link)
+	if !countLink(link.Origin, host) {
+		address, _ := discovery.SplitKey(host)
+		link.Header = event.NewHeader()
+		link.Meshes = discovery.MeshesOf(host)
+		link.Communities = discovery.CommunitiesOf(host)
+		link.Organization = discovery.OrganizationOf(host)
+		link.Geo = enrich.LookupGeoIP(address)
+		link.ASN = enrich.LookupASN(address)
+		keepLink(link)
+	}
+	if linkGraph != nil {
+		linkGraph.Add(link)
+	}
+	// Once stopping new hosts are only remembered as pending
+	if add && !stopping.Load() {
+		hostsDiscovered.Inc()
+		// Hosts whose admins opted out are completed without being crawled
+		if optedOut(host) {
+			logger.Debug("Skipping opted out host", "host", host)
+			hostsOptedOut.Inc()
+			cache.Lock()
+			cache.m[host] = true
+			cache.Unlock()
+			return
+		}
+		// Hosts left out of the sample are completed without being crawled
+		if !sampled(host) {
+			hostsUnsampled.Inc()
+			cache.Lock()
+			cache.m[host] = true
+			cache.Unlock()
+			return
+		}
+		// Dead hosts are completed without being crawled
+		if skipDead(host) {
+			hostsSkippedDead.Inc()
+			cache.Lock()
+			cache.m[host] = true
+			cache.Unlock()
+			return
+		}
+		// A dry run only lists the hosts it would crawl
+		if *dryRun {
+			return
+		}
+		// Queue it for the worker pool, the worker marks it done
+		wg.Add(1)
+		jobs.push(host)
+	}
+}
+
+// Returns the depth of a host found through origin, the cache lock must be held.
+// Hosts found while crawling another are one hop further from the seeds, while
+// seeds come from the lookup services and have no crawled origin.
+func hostDepth(origin string) int {
+	if parent, ok := cache.depth[origin]; ok {
+		return parent + 1
+	}
+	return 0
+}
+
+// Queues a host without recording a link, unless it was already crawled
+func requeue(host string) {
+	host = discovery.CanonicalHost(host)
+	cache.Lock()
+	completed, ok := cache.m[host]
+	cache.m[host] = completed
+	cache.Unlock()
+	if !ok && !*dryRun {
+		wg.Add(1)
+		jobs.push(host)
+	}
+}
+
+// Takes hosts from the job queue until it is closed
+func workerLoop() {
+	for {
+		host, ok := jobs.pop()
+		if !ok {
+			return
+		}
+		start := time.Now()
+		beginHostStatus(host)
+		beginHostActivity(host)
+		endBudget := beginHostBudget(host)
+		alive := worker(host)
+		endBudget()
+		resetBreaker(host)
+		endHostActivity(host, !crawlCancelled(), alive, time.Since(start))
+		flushLinks(host)
+		// Hosts interrupted by a shutdown stay pending
+		if !crawlCancelled() {
+			recordHost(host, alive)
+			if alive {
+				markReachable(host)
+			}
+			emitHostStatus(host, time.Since(start))
+			hostDuration.Observe(time.Since(start).Seconds())
+			hostsCrawled.Inc()
+			cache.Lock()
+			cache.m[host] = true
+			cache.Unlock()
+		}
+		wg.Done()
+	}
+}
+
+// Handles a job, returns false if nothing was collected from the host
+func worker(host string) bool {
+	scheme, summary, toolkit, ok := getSummary(host)
+	if !ok {
+		// Endpoints on a non-standard port may only serve a measurement archive
+		if _, pinned := discovery.SplitKey(host); pinned != "" && *resultsSource != "graphs" && crawlEsmond(host, pinned, hostArchives(host, nil)) {
+			hostsWithArchive.Inc()
+			markHost(host, func(status *event.HostStatus) { status.HasEsmond = true })
+			return true
+		}
+		// Testpoints and archives answer without a toolkit
+		probeBundleComponents(host, scheme)
+		return false
+	}
+	hostsResponsive.Inc()
+	countHostUp(host)
+	markHost(host, func(status *event.HostStatus) { status.HasToolkit = true })
+	// Add to summaries output queue, unless it went to the parse errors
+	if toolkit != nil {
+		setToolkitVersion(host, toolkit.ToolkitVersion)
+		address, _ := discovery.SplitKey(host)
+		emitSummary(event.Summary{
+			Header:       event.NewHeader(),
+			Host:         host,
+			Discovery:    discovery.SourcesOf(host),
+			DualStack:    probeDualStack(host, scheme),
+			Meshes:       discovery.MeshesOf(host),
+			Communities:  discovery.CommunitiesOf(host),
+			Organization: discovery.OrganizationOf(host),
+			Geo:          enrich.LookupGeoIP(address),
+			ASN:          enrich.LookupASN(address),
+			Toolkit:      toolkit,
+			Summary:      summary,
+		})
+		// What the toolkit runs and how it is set up
+		if *collectInventory {
+			crawlInventory(host, scheme, *toolkit)
+		}
+	}
+	// Get the tests and their results from wherever the host has them
+	esmond, archive := false, false
+	archives := hostArchives(host, toolkit)
+	switch *resultsSource {
+	case "graphs":
+		archive = crawlGraphs(host, scheme, archives)
+	case "esmond":
+		archive = crawlEsmond(host, scheme, archives)
+		esmond = true
+	case "auto":
+		if archive = crawlGraphs(host, scheme, archives); !archive {
+			archive = crawlEsmond(host, scheme, archives)
+			esmond = true
+		}
+	}
+	if archive {
+		hostsWithArchive.Inc()
+		markHost(host, func(status *event.HostStatus) {
+			status.HasGraphs = !esmond
+			status.HasEsmond = esmond
+		})
+	}
+	// Paths are only in esmond, read them unless the results already did
+	if *collectPaths && !(esmond && esmondReadsPaths()) {
+		crawlPaths(host, scheme)
+	}
+	// Per test time series, one event per datapoint
+	if *collectTimeSeries || *metricsFormat {
+		crawlTimeSeries(host, scheme)
+	}
+	// Get what pScheduler has scheduled
+	if *pscheduler && crawlPScheduler(host, scheme) {
+		markHost(host, func(status *event.HostStatus) { status.HasPScheduler = true })
+	}
+	return true
+}
+
+// Requests the toolkit summary of host with its keys normalized, returns false
+// if the host has no toolkit, with the scheme it answered over if any. A summary that doesn't conform goes to the parse
+// errors, its toolkit is then nil but the host is still crawled.
+func getSummary(host string) (string, []byte, *event.ToolkitSummary, bool) {
+	logger.Debug("Getting summary", "host", host)
+	scheme, resp, err := fetchScheme(host, endpointSummary, "/toolkit/services/host.cgi?method=get_summary")
+	if err != nil {
+		logger.Warn("Getting summary failed", "host", host, "err", err)
+		return "", nil, nil, false
+	}
+	defer httpx.CloseBody(resp)
+	// Read the response, which must be an object, skipping the host if it
+	// isn't JSON
+	var summary json.RawMessage
+	if err := decodeResponse(endpointSummary, resp, httpx.JSONObject, &summary); err != nil {
+		if !errors.Is(err, errNotJSON) {
+			logger.Warn("Invalid summary", "host", host, "err", err)
+			emitParseError(host, endpointSummary, resp.Request.URL.String(), nil, err)
+		}
+		return scheme, nil, nil, false
+	}
+	summary = normalizeKeys(host, endpointSummary, resp.Request.URL.String(), summary)
+	toolkit, err := event.ParseToolkitSummary(summary)
+	if err != nil {
+		logger.Warn("Invalid summary", "host", host, "err", err)
+		emitParseError(host, endpointSummary, resp.Request.URL.String(), summary, err)
+	}
+	return scheme, summary, toolkit, true
+}
+
+// Gets the test list and results of the archives of host from its graphs
+// package, returns false if the host doesn't have it
+func crawlGraphs(host string, scheme string, archives []string) bool {
+	found := false
+	for _, archive := range archives {
+		if *discoverArchives && !claimArchive(host, archive) {
+			logger.Debug("Skipping an archive read through another host", "host", host, "archive", archive)
+			continue
+		}
+		if crawlGraphsArchive(host, scheme, archive) {
+			found = true
+		} else if *discoverArchives {
+			releaseArchive(host, archive)
+		}
+	}
+	return found
+}
+
+// Gets the test list and results of one archive from the graphs package of
+// host, returns false if it couldn't
+func crawlGraphsArchive(host string, scheme string, archive string) bool {
+	// Get the test list
+	logger.Debug("Getting test list", "host", host, "archive", archive)
+	query := "&url=" + url.QueryEscape(archive)
+	resp, err := fetch(host, endpointTestList, discovery.HostURL(scheme, host, "/perfsonar-graphs/graphData.cgi?action=test_list"+query))
+	if err != nil {
+		logger.Warn("Getting test list failed", "host", host, "err", err)
+		return false
+	}
+	// Make a object for the tests to be stored in
+	tests := []Test{}
+	// Parse the body, if it wasn't a json response the graphs aren't installed
+	err = decodeResponse(endpointTestList, resp, httpx.JSONArray, &tests)
+	httpx.CloseBody(resp)
+	if err != nil {
+		if !errors.Is(err, errNotJSON) {
+			logger.Warn("Invalid test list", "host", host, "err", err)
+		}
+		return false
+	}
+	// For each test
+	for _, test := range tests {
+		// Partners of tests without recent data are likely gone
+		if stale(test) {
+			logger.Debug("Skipping a stale test", "host", host, "source", test.SourceIP, "destination", test.DestinationIP, "last_updated", test.LastUpdated)
+			testsStale.Inc()
+			continue
+		}
+		// Queue both the src and dst
+		Dedup(test.DestinationIP, host)
+		Dedup(test.SourceIP, host)
+		notePair(test.SourceIP, test.DestinationIP, host)
+	}
+	// Get the test results
+	logger.Debug("Getting test results", "host", host, "archive", archive)
+	resp, err = fetch(host, endpointResults, discovery.HostURL(scheme, host, "/perfsonar-graphs/graphData.cgi?action=tests"+query))
+	if err != nil {
+		logger.Warn("Getting test results failed", "host", host, "err", err)
+		return true
+	}
+	defer httpx.CloseBody(resp)
+	// Read the testResults
+	var testResults []json.RawMessage
+	// Parse the body, skipping the results if it wasn't a json response
+	err = decodeResponse(endpointResults, resp, httpx.JSONArray, &testResults)
+	if err != nil {
+		if !errors.Is(err, errNotJSON) {
+			logger.Warn("Invalid test results", "host", host, "err", err)
+			emitParseError(host, endpointResults, resp.Request.URL.String(), nil, err)
+		}
+		return true
+	}
+	// Loop each result, those that don't conform go to the parse errors
+	for _, raw := range testResults {
+		testResult, adapter := event.AdaptGraphsResult(toolkitVersion(host), normalizeKeys(host, endpointResults, resp.Request.URL.String(), raw))
+		graphs, err := event.ParseGraphsResult(testResult)
+		if err != nil {
+			logger.Warn("Skipping an invalid test result", "host", host, "err", err)
+			emitParseError(host, endpointResults, resp.Request.URL.String(), testResult, err)
+			continue
+		}
+		// Add to testResults output queue
+		result := event.Result{Header: event.NewHeader(), Host: host, Source: "graphs", Graphs: graphs, Adapter: adapter, Result: testResult, Raw: rawPayload(raw)}
+		if !ownArchive(host, archive) {
+			result.Archive = archive
+		}
+		if owner := measurementHost(host, "", graphs.SourceIP, graphs.DestinationIP); owner != host {
+			result.Host, result.ReadVia = owner, host
+		}
+		results.Emit(result)
+		var throughputs []float64
+		for _, name := range []string{"throughput_src_val", "throughput_dst_val"} {
+			if throughput, ok := graphs.Values[name]; ok {
+				throughputs = append(throughputs, throughput)
+			}
+		}
+		countTest(host, throughputs...)
+	}
+	return true
+}
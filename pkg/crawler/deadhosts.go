@@ -0,0 +1,123 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Dead host flags
+var deadHostsFile = Flags.String("dead-hosts", "", "File tracking the hosts nothing was collected from across runs, those failing -dead-after runs in a row are skipped (default disabled)")
+var deadAfter = Flags.Int("dead-after", 3, "Runs in a row nothing must be collected from a host in before it is skipped as dead")
+var deadRetry = Flags.Int("dead-retry", 10, "Runs a dead host is skipped for before it is tried again, it is forgotten once it answers")
+
+// DeadHost is the record of a host nothing was collected from in its last
+// runs, Skipped counting the runs it was skipped in since it was last tried
+type DeadHost struct {
+	Failures    int    `json:"failures"`
+	Skipped     int    `json:"skipped"`
+	LastFailure string `json:"last_failure"`
+}
+
+// The dead hosts read from -dead-hosts, updated as hosts are crawled
+var deadHosts = struct {
+	sync.Mutex
+	m map[string]*DeadHost
+}{m: make(map[string]*DeadHost)}
+
+// Checks the dead host flags
+func setupDeadHosts() error {
+	if *deadAfter < 1 || *deadRetry < 0 {
+		return fmt.Errorf("-dead-after must be at least 1 and -dead-retry at least 0")
+	}
+	return nil
+}
+
+// Reads the dead hosts of the previous runs, there are none on the first run
+func loadDeadHosts(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	deadHosts.Lock()
+	defer deadHosts.Unlock()
+	if err := json.Unmarshal(data, &deadHosts.m); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	dead := 0
+	for _, host := range deadHosts.m {
+		if host.Failures >= *deadAfter {
+			dead++
+		}
+	}
+	logger.Info("Dead hosts loaded", "file", path, "tracked", len(deadHosts.m), "dead", dead)
+	return nil
+}
+
+// Returns true if host is dead and skipped this run. Every -dead-retry runs it
+// is tried again instead, a dry run leaving the records untouched.
+func skipDead(host string) bool {
+	if *deadHostsFile == "" {
+		return false
+	}
+	deadHosts.Lock()
+	defer deadHosts.Unlock()
+	record, ok := deadHosts.m[host]
+	if !ok || record.Failures < *deadAfter {
+		return false
+	}
+	if record.Skipped >= *deadRetry {
+		if !*dryRun {
+			record.Skipped = 0
+		}
+		logger.Debug("Retrying dead host", "host", host, "failures", record.Failures)
+		return false
+	}
+	if !*dryRun {
+		record.Skipped++
+	}
+	logger.Debug("Skipping dead host", "host", host, "failures", record.Failures)
+	return true
+}
+
+// Records whether anything was collected from host, forgetting it if so
+func recordHost(host string, alive bool) {
+	if *deadHostsFile == "" {
+		return
+	}
+	deadHosts.Lock()
+	defer deadHosts.Unlock()
+	if alive {
+		delete(deadHosts.m, host)
+		return
+	}
+	record, ok := deadHosts.m[host]
+	if !ok {
+		record = &DeadHost{}
+		deadHosts.m[host] = record
+	}
+	record.Failures++
+	record.LastFailure = time.Now().UTC().Format(event.TimeLayout)
+}
+
+// Writes the dead hosts to path, through a temporary file so it is never half
+// written
+func writeDeadHosts(path string) error {
+	deadHosts.Lock()
+	data, err := json.MarshalIndent(deadHosts.m, "", "  ")
+	deadHosts.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,437 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+	"github.com/bored-engineer/ps-splunk/pkg/sink"
+)
+
+// Distributed crawl flags
+var coordinatorAddr = Flags.String("coordinator-addr", "", "Run as the coordinator of a distributed crawl listening on this address: the discovered hosts are handed out in shards to the workers and the events they forward are written to the sinks")
+var coordinatorURL = Flags.String("coordinator", "", "Run as a worker of a distributed crawl: crawl the shards leased from the coordinator at this URL, e.g. http://coordinator:9400, and forward the events to it instead of discovering hosts")
+var coordinatorToken = Flags.String("coordinator-token", "", "Bearer token shared by the coordinator and the workers of a distributed crawl, PS_COORDINATOR_TOKEN when unset")
+var shardSize = Flags.Int("shard-size", 25, "Number of hosts in each shard handed to a worker of a distributed crawl")
+var shardLease = Flags.Duration("shard-lease", 30*time.Minute, "How long a worker has to crawl a shard before it is handed to another, and how long the coordinator waits for silent workers at the end")
+
+// How long a worker waits before asking again when every host is leased
+const leaseRetryDelay = 5 * time.Second
+
+// Number of times a failing call to the coordinator is retried
+const coordinatorRetries = 10
+
+// Name of the worker, unique even with several on a collector, set by
+// setupDistributed
+var workerName string
+
+// Checks the distributed crawl flags, a worker forwards its events to the
+// coordinator
+func setupDistributed() error {
+	if *coordinatorAddr == "" && *coordinatorURL == "" {
+		return nil
+	}
+	if *coordinatorAddr != "" && *coordinatorURL != "" {
+		return fmt.Errorf("-coordinator-addr and -coordinator are exclusive")
+	}
+	if *coordinatorToken == "" {
+		*coordinatorToken = os.Getenv("PS_COORDINATOR_TOKEN")
+	}
+	if *coordinatorToken == "" {
+		return fmt.Errorf("-coordinator-token is required for a distributed crawl")
+	}
+	if *shardSize < 1 || *shardLease <= 0 {
+		return fmt.Errorf("-shard-size must be at least 1 and -shard-lease positive")
+	}
+	if *coordinatorURL != "" {
+		if *resume {
+			return fmt.Errorf("-resume isn't supported by the workers of a distributed crawl")
+		}
+		workerName = fmt.Sprintf("%s-%d", event.Vantage(), os.Getpid())
+		sink.ForwardTo(*coordinatorURL, *coordinatorToken)
+	}
+	return nil
+}
+
+// IsWorker returns true when the crawl is a worker of a distributed crawl,
+// its hosts are leased from the coordinator instead of discovered
+func IsWorker() bool {
+	return *coordinatorURL != ""
+}
+
+// Returns true when the crawl is the coordinator of a distributed crawl, its
+// hosts are crawled by the workers
+func isCoordinator() bool {
+	return *coordinatorAddr != ""
+}
+
+// A shard of hosts leased to a worker, with the run the worker's events
+// belong to
+type shard struct {
+	ID    string      `json:"id"`
+	RunID string      `json:"run_id"`
+	Hosts []shardHost `json:"hosts"`
+	// Who leased it and until when
+	worker  string
+	expires time.Time
+}
+
+// A host of a shard and its depth
+type shardHost struct {
+	Host  string `json:"host"`
+	Depth int    `json:"depth"`
+}
+
+// What a worker found crawling a shard: the hosts crawled by whether they were
+// up, those left out being handed out again, and the test partners found
+type shardResult struct {
+	Up       map[string]bool `json:"up"`
+	Partners []shardPartner  `json:"partners,omitempty"`
+}
+
+// A test partner found through a crawled host
+type shardPartner struct {
+	Host   string `json:"host"`
+	Origin string `json:"origin"`
+}
+
+// State of the coordinator: the leased shards by id, the workers by when they
+// were last seen, until they leave, and whether the hosts are all crawled.
+// Events are forwarded under the read lock so the sinks aren't closed under
+// them.
+var coordinator = struct {
+	sync.RWMutex
+	shards  map[string]*shard
+	next    int
+	workers map[string]time.Time
+	done    bool
+	closed  bool
+}{shards: make(map[string]*shard), workers: make(map[string]time.Time)}
+
+// Serves the coordinator API until the process exits
+func serveCoordinator() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lease", leaseHandler)
+	mux.HandleFunc("/shards/", completeHandler)
+	mux.HandleFunc("/events", eventsHandler)
+	mux.HandleFunc("/leave", func(w http.ResponseWriter, r *http.Request) {
+		coordinator.Lock()
+		delete(coordinator.workers, r.URL.Query().Get("worker"))
+		coordinator.Unlock()
+		logger.Info("Worker left", "worker", r.URL.Query().Get("worker"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	expected := []byte("Bearer " + *coordinatorToken)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			controlError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		if r.Method != http.MethodPost {
+			controlError(w, http.StatusMethodNotAllowed, "expected POST")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+	go func() {
+		for range time.Tick(time.Minute) {
+			reclaimShards(time.Now())
+		}
+	}()
+	go func() {
+		logger.Info("Coordinating the crawl", "addr", *coordinatorAddr)
+		if err := http.ListenAndServe(*coordinatorAddr, handler); err != nil {
+			logger.Fatal("Serving the coordinator failed", "err", err)
+		}
+	}()
+}
+
+// Hands out the next shard to a worker: 204 while every host is leased, 410
+// once the crawl is done
+func leaseHandler(w http.ResponseWriter, r *http.Request) {
+	worker := r.URL.Query().Get("worker")
+	now := time.Now()
+	reclaimShards(now)
+	coordinator.Lock()
+	defer coordinator.Unlock()
+	coordinator.workers[worker] = now
+	if coordinator.done || Stopped() {
+		controlError(w, http.StatusGone, "the crawl is done")
+		return
+	}
+	hosts := jobs.take(*shardSize)
+	if len(hosts) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	coordinator.next++
+	s := &shard{ID: strconv.Itoa(coordinator.next), RunID: event.RunID, worker: worker, expires: now.Add(*shardLease)}
+	cache.RLock()
+	for _, host := range hosts {
+		s.Hosts = append(s.Hosts, shardHost{Host: host, Depth: cache.depth[host]})
+	}
+	cache.RUnlock()
+	coordinator.shards[s.ID] = s
+	logger.Debug("Shard leased", "shard", s.ID, "worker", worker, "hosts", len(hosts))
+	controlJSON(w, http.StatusOK, s)
+}
+
+// Hands out again the shards whose lease expired
+func reclaimShards(now time.Time) {
+	coordinator.Lock()
+	defer coordinator.Unlock()
+	for id, s := range coordinator.shards {
+		if now.Before(s.expires) {
+			continue
+		}
+		logger.Warn("Shard lease expired, handing it out again", "shard", id, "worker", s.worker)
+		delete(coordinator.shards, id)
+		for _, host := range s.Hosts {
+			handOutAgain(host.Host)
+		}
+	}
+}
+
+// Records a crawled shard on POST /shards/<id>: its partners are queued first
+// so the crawl can't look finished, then its hosts are completed or handed out
+// again
+func completeHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/shards/")
+	var result shardResult
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		controlError(w, http.StatusBadRequest, "invalid shard result: "+err.Error())
+		return
+	}
+	coordinator.Lock()
+	s, ok := coordinator.shards[id]
+	delete(coordinator.shards, id)
+	coordinator.workers[r.URL.Query().Get("worker")] = time.Now()
+	coordinator.Unlock()
+	for _, partner := range result.Partners {
+		Dedup(partner.Host, partner.Origin)
+	}
+	if !ok {
+		// Its lease expired and the hosts were handed out again
+		controlError(w, http.StatusConflict, "unknown or expired shard "+id)
+		return
+	}
+	for _, host := range s.Hosts {
+		up, crawled := result.Up[host.Host]
+		if !crawled {
+			handOutAgain(host.Host)
+			continue
+		}
+		hostsCrawled.Inc()
+		if up {
+			hostsResponsive.Inc()
+			markReachable(host.Host)
+		}
+		cache.Lock()
+		cache.m[host.Host] = true
+		cache.Unlock()
+		wg.Done()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Queues a leased host for another shard, once stopping it is left pending
+func handOutAgain(host string) {
+	if stopping.Load() {
+		wg.Done()
+		return
+	}
+	jobs.push(host)
+}
+
+// Queues the events a worker forwards on POST /events?stream=<name>, one per line
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	queue := sink.QueueNamed(r.URL.Query().Get("stream"))
+	if queue == nil {
+		controlError(w, http.StatusBadRequest, "unknown stream")
+		return
+	}
+	coordinator.RLock()
+	defer coordinator.RUnlock()
+	if coordinator.closed {
+		controlError(w, http.StatusGone, "the crawl is finished")
+		return
+	}
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			queue.Forward(line)
+		}
+		if err != nil {
+			break
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Once every host is crawled, tells the workers the crawl is done and waits
+// for them to forward their last events and leave, or to be silent for
+// -shard-lease. No event is accepted afterwards.
+func waitForWorkers() {
+	coordinator.Lock()
+	coordinator.done = true
+	coordinator.Unlock()
+	for {
+		coordinator.RLock()
+		active := 0
+		for _, seen := range coordinator.workers {
+			if time.Since(seen) < *shardLease {
+				active++
+			}
+		}
+		coordinator.RUnlock()
+		if active == 0 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	coordinator.Lock()
+	coordinator.closed = true
+	coordinator.Unlock()
+}
+
+// Partners found crawling the current shard of a worker
+var workerPartners = struct {
+	sync.Mutex
+	list []shardPartner
+}{}
+
+// Records a test partner for the coordinator instead of queueing it
+func addPartner(host string, origin string) {
+	workerPartners.Lock()
+	defer workerPartners.Unlock()
+	workerPartners.list = append(workerPartners.list, shardPartner{Host: host, Origin: origin})
+}
+
+// RunWorker crawls the shards leased from the coordinator until it has none
+// left or the crawl is stopped, then Finish forwards the last events
+func RunWorker() error {
+	failures := 0
+	for !Stopped() {
+		s, status, err := callCoordinator("/lease", nil)
+		if err != nil {
+			failures++
+			if failures > coordinatorRetries {
+				return err
+			}
+			delay := httpx.Backoff(failures)
+			logger.Warn("Leasing a shard failed, retrying", "delay", delay, "err", err)
+			time.Sleep(delay)
+			continue
+		}
+		failures = 0
+		switch status {
+		case http.StatusGone:
+			logger.Info("The coordinator has no hosts left")
+			return nil
+		case http.StatusNoContent:
+			time.Sleep(leaseRetryDelay)
+			continue
+		}
+		var leased shard
+		if err := json.Unmarshal(s, &leased); err != nil {
+			return fmt.Errorf("invalid shard: %v", err)
+		}
+		// Nothing is being crawled between shards
+		event.RunID = leased.RunID
+		crawlShard(leased)
+	}
+	return nil
+}
+
+// Crawls the hosts of a shard and reports them to the coordinator
+func crawlShard(s shard) {
+	logger.Info("Crawling shard", "shard", s.ID, "hosts", len(s.Hosts))
+	for _, host := range s.Hosts {
+		cache.Lock()
+		cache.m[host.Host] = false
+		cache.depth[host.Host] = host.Depth
+		cache.Unlock()
+		hostsDiscovered.Inc()
+		wg.Add(1)
+		jobs.push(host.Host)
+	}
+	wg.Wait()
+	result := shardResult{Up: make(map[string]bool)}
+	cache.RLock()
+	hostActivity.Lock()
+	for _, host := range s.Hosts {
+		if cache.m[host.Host] {
+			result.Up[host.Host] = hostActivity.up[host.Host]
+		}
+	}
+	hostActivity.Unlock()
+	cache.RUnlock()
+	workerPartners.Lock()
+	result.Partners, workerPartners.list = workerPartners.list, nil
+	workerPartners.Unlock()
+	body, _ := json.Marshal(result)
+	for attempt := 1; ; attempt++ {
+		_, status, err := callCoordinator("/shards/"+url.PathEscape(s.ID), body)
+		if err == nil && status == http.StatusConflict {
+			logger.Warn("The lease of the shard expired before it was crawled", "shard", s.ID)
+		}
+		if err == nil || attempt > coordinatorRetries {
+			if err != nil {
+				logger.Error("Reporting the shard failed", "shard", s.ID, "err", err)
+			}
+			return
+		}
+		time.Sleep(httpx.Backoff(attempt))
+	}
+}
+
+// Tells the coordinator the worker is leaving, once its events are forwarded
+func leaveCoordinator() {
+	if _, _, err := callCoordinator("/leave", nil); err != nil {
+		logger.Warn("Leaving the coordinator failed", "err", err)
+	}
+}
+
+// HTTP client used for the calls to the coordinator
+var coordinatorClient = http.Client{Timeout: time.Minute}
+
+// Posts to path of the coordinator as this worker, returning the response
+// body and status. Error statuses other than 409 and 410 are errors.
+func callCoordinator(path string, body []byte) ([]byte, int, error) {
+	u := strings.TrimSuffix(*coordinatorURL, "/") + path + "?worker=" + url.QueryEscape(workerName)
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+*coordinatorToken)
+	resp, err := coordinatorClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer httpx.CloseBody(resp)
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusConflict && resp.StatusCode != http.StatusGone {
+		return nil, 0, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return data, resp.StatusCode, nil
+}
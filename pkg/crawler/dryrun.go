@@ -0,0 +1,20 @@
+package crawler
+
+import "sort"
+
+// Dry run flags
+var dryRun = Flags.Bool("dry-run", false, "Only discover and dedup the hosts without requesting anything from them, writing the link stream and listing the hosts that would be crawled in the report")
+
+// Returns the sorted hosts found but not crawled, all of them in a dry run
+func pendingHosts() []string {
+	cache.RLock()
+	defer cache.RUnlock()
+	hosts := []string{}
+	for host, completed := range cache.m {
+		if !completed {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
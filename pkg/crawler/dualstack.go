@@ -0,0 +1,114 @@
+package crawler
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Dual-stack flags
+var dualStack = Flags.Bool("dual-stack", false, "Probe the IPv4 and IPv6 addresses of every host name with both concurrently, recording which families accept connections in the dual_stack field of its summaries")
+
+// Probes of the host names, each name is probed once for all its addresses
+var dualStackProbes = struct {
+	sync.Mutex
+	m map[string]*dualStackProbe
+}{m: make(map[string]*dualStackProbe)}
+
+// Probe of a host name, done by the first summary of one of its addresses
+type dualStackProbe struct {
+	once   sync.Once
+	result *event.DualStack
+}
+
+// Returns the reachability per address family of every name host was
+// resolved from that has both IPv4 and IPv6 addresses
+func probeDualStack(host string, scheme string) []event.DualStack {
+	if !*dualStack {
+		return nil
+	}
+	var probes []event.DualStack
+	for _, name := range discovery.NamesOf(host) {
+		if result := probeName(name, host, scheme); result != nil {
+			probes = append(probes, *result)
+		}
+	}
+	return probes
+}
+
+// Probes the first IPv4 and IPv6 addresses of name concurrently on the port
+// host answered on, nil unless it has both
+func probeName(name string, host string, scheme string) *event.DualStack {
+	var v4, v6 string
+	for _, addr := range discovery.AddressesOf(name) {
+		if ip, err := netip.ParseAddr(addr); err != nil {
+			continue
+		} else if ip.Is4() && v4 == "" {
+			v4 = addr
+		} else if ip.Is6() && v6 == "" {
+			v6 = addr
+		}
+	}
+	if v4 == "" || v6 == "" {
+		return nil
+	}
+	dualStackProbes.Lock()
+	probe, ok := dualStackProbes.m[name]
+	if !ok {
+		probe = &dualStackProbe{}
+		dualStackProbes.m[name] = probe
+	}
+	dualStackProbes.Unlock()
+	probe.once.Do(func() {
+		port := probePort(host, scheme)
+		result := &event.DualStack{Name: name}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			result.IPv4 = probeFamily("tcp4", v4, port)
+		}()
+		go func() {
+			defer wg.Done()
+			result.IPv6 = probeFamily("tcp6", v6, port)
+		}()
+		wg.Wait()
+		logger.Debug("Probed dual-stack host", "name", name, "ipv4", result.IPv4.Reachable, "ipv6", result.IPv6.Reachable)
+		probe.result = result
+	})
+	return probe.result
+}
+
+// Returns the port the toolkit of host answered on with scheme
+func probePort(host string, scheme string) string {
+	u, err := url.Parse(discovery.HostURL(scheme, host, "/"))
+	if err == nil && u.Port() != "" {
+		return u.Port()
+	}
+	if scheme == "http" {
+		return "80"
+	}
+	return "443"
+}
+
+// Connects to address on port over network, directly rather than through a
+// proxy, and reports whether it was accepted
+func probeFamily(network string, address string, port string) *event.FamilyReachability {
+	ctx, cancel := context.WithTimeout(crawlCtx, *httpx.Timeout)
+	defer cancel()
+	var dialer net.Dialer
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(address, port))
+	if err != nil {
+		return &event.FamilyReachability{Address: address, Error: errorType(err)}
+	}
+	conn.Close()
+	return &event.FamilyReachability{Address: address, Reachable: true, ConnectSeconds: time.Since(start).Seconds()}
+}
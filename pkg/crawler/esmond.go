@@ -0,0 +1,221 @@
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Measurement archive flags
+var resultsSource = Flags.String("results-source", "auto", "Where test results are read: graphs (graphData.cgi), esmond (the measurement archive) or auto (esmond when the graphs are missing)")
+var esmondTimeRange = Flags.Duration("esmond-time-range", 24*time.Hour, "How far back measurements are read from esmond when -since isn't set")
+var esmondEventTypes = Flags.String("esmond-event-types", "", "Comma separated esmond event types read, e.g. throughput,packet-loss-rate (default all)")
+var esmondSummaryWindow = Flags.Int("esmond-summary-window", 86400, "Summary window in seconds read from esmond, 0 reads the base data")
+
+// Path of the archive on each host
+const esmondArchive = "/esmond/perfsonar/archive/"
+
+// Metadata of a measurement stored in esmond
+type esmondMetadata struct {
+	MetadataKey      string            `json:"metadata-key"`
+	Source           string            `json:"source"`
+	Destination      string            `json:"destination"`
+	InputSource      string            `json:"input-source"`
+	InputDestination string            `json:"input-destination"`
+	MeasurementAgent string            `json:"measurement-agent"`
+	ToolName         string            `json:"tool-name"`
+	SubjectType      string            `json:"subject-type"`
+	EventTypes       []esmondEventType `json:"event-types"`
+}
+
+// Event type stored for a measurement, with its base data and summaries
+type esmondEventType struct {
+	EventType   string `json:"event-type"`
+	BaseURI     string `json:"base-uri"`
+	TimeUpdated *int64 `json:"time-updated"`
+	Summaries   []struct {
+		SummaryType   string `json:"summary-type"`
+		SummaryWindow string `json:"summary-window"`
+		URI           string `json:"uri"`
+	} `json:"summaries"`
+}
+
+// Reads the measurements of the esmond archives of host into the results
+// queue, returns false if it has none
+func crawlEsmond(host string, scheme string, archives []string) bool {
+	// Only the event types downloaded at all need their metadata
+	eventTypes := *esmondEventTypes
+	if strings.TrimSpace(eventTypes) == "" {
+		eventTypes = *eventTypesFilter
+	}
+	found := false
+	for _, archive := range archives {
+		if *discoverArchives && !claimArchive(host, archive) {
+			logger.Debug("Skipping an archive read through another host", "host", host, "archive", archive)
+			continue
+		}
+		if crawlEsmondTypes(host, esmondURL(host, scheme, archive), strings.Split(eventTypes, ",")) {
+			found = true
+		} else if *discoverArchives {
+			releaseArchive(host, archive)
+		}
+	}
+	return found
+}
+
+// Reads the measurements of the given event types from the esmond archive at
+// the archive URL, an empty type reads them all
+func crawlEsmondTypes(host string, archive string, eventTypes []string) bool {
+	for _, eventType := range eventTypes {
+		eventType = strings.TrimSpace(eventType)
+		if eventType != "" && !eventTypeAllowed(eventType) {
+			continue
+		}
+		// Get the metadata of every measurement updated within the time window
+		query := windowQuery()
+		if eventType != "" {
+			query.Set("event-type", eventType)
+		}
+		logger.Debug("Getting esmond metadata", "host", host, "archive", archive)
+		metadata, ok := getEsmondMetadata(host, archive+"?"+query.Encode())
+		if !ok {
+			return false
+		}
+		for _, measurement := range metadata {
+			// Queue both the src and dst
+			if measurement.Source != "" {
+				Dedup(measurement.Source, host)
+			}
+			if measurement.Destination != "" {
+				Dedup(measurement.Destination, host)
+			}
+			notePair(measurement.Source, measurement.Destination, host)
+			for _, stored := range measurement.EventTypes {
+				if eventType != "" && stored.EventType != eventType || !archiveAllowed(measurement, stored.EventType) {
+					continue
+				}
+				getEsmondSeries(host, archive, measurement, stored)
+			}
+		}
+	}
+	return true
+}
+
+// Fetches the measurement metadata at uri, returns false if the host has no archive
+func getEsmondMetadata(host string, uri string) ([]esmondMetadata, bool) {
+	resp, err := fetch(host, endpointEsmond, uri)
+	if err != nil {
+		logger.Warn("Getting esmond metadata failed", "host", host, "err", err)
+		return nil, false
+	}
+	defer httpx.CloseBody(resp)
+	// If it wasn't a json response the host has no archive
+	var metadata []esmondMetadata
+	if err := decodeResponse(endpointEsmond, resp, httpx.JSONArray, &metadata); err != nil {
+		if !errors.Is(err, errNotJSON) {
+			logger.Warn("Invalid esmond metadata", "host", host, "uri", uri, "err", err)
+		}
+		return nil, false
+	}
+	observeMeasurements(host, metadata)
+	return metadata, true
+}
+
+// Reads the base data or the chosen summaries of one event type, packet
+// traces have no summaries and go to the paths queue instead
+func getEsmondSeries(host string, archive string, measurement esmondMetadata, stored esmondEventType) {
+	if stored.EventType == "packet-trace" {
+		if *collectPaths {
+			emitPaths(host, archive, measurement, stored.BaseURI)
+		}
+		return
+	}
+	result := event.EsmondResult{
+		Archive:          archive,
+		MetadataKey:      measurement.MetadataKey,
+		Source:           measurement.Source,
+		Destination:      measurement.Destination,
+		InputSource:      measurement.InputSource,
+		InputDestination: measurement.InputDestination,
+		MeasurementAgent: measurement.MeasurementAgent,
+		ToolName:         measurement.ToolName,
+		SubjectType:      measurement.SubjectType,
+		EventType:        stored.EventType,
+	}
+	if *esmondSummaryWindow == 0 {
+		emitEsmondSeries(host, stored.BaseURI, result)
+		return
+	}
+	window := strconv.Itoa(*esmondSummaryWindow)
+	for _, summary := range stored.Summaries {
+		if summary.SummaryWindow != window {
+			continue
+		}
+		result.SummaryType = summary.SummaryType
+		result.SummaryWindow = *esmondSummaryWindow
+		emitEsmondSeries(host, summary.URI, result)
+	}
+}
+
+// Fetches the datapoints at uri of the archive of result within the time
+// window and queues them as a result
+func emitEsmondSeries(host string, uri string, result event.EsmondResult) {
+	start, ok := seriesStart("results", host, uri, result.SummaryWindow > 0)
+	if !ok {
+		return
+	}
+	result.TimeStart = start.Unix()
+	result.TimeEnd = windowEnd.Unix()
+	resp, err := fetch(host, endpointEsmond, archiveURL(result.Archive, uri+"?"+windowQueryFrom(start).Encode()))
+	if err != nil {
+		logger.Warn("Getting esmond data failed", "host", host, "err", err)
+		return
+	}
+	defer httpx.CloseBody(resp)
+	var raw json.RawMessage
+	if err := httpx.DecodeShape(resp.Body, httpx.JSONArray, &raw); err != nil {
+		logger.Warn("Invalid esmond data", "host", host, "uri", uri, "err", err)
+		emitParseError(host, endpointEsmond, resp.Request.URL.String(), nil, err)
+		return
+	}
+	var adapter string
+	result.Data, adapter = event.AdaptEsmondData(archiveVersion(host, result.Archive), raw)
+	// Add to results output queue
+	series, err := json.Marshal(result)
+	if err != nil {
+		logger.Error("Serializing esmond data failed", "host", host, "err", err)
+		return
+	}
+	emitted := event.Result{Header: event.NewHeader(), Host: host, Source: "esmond", Adapter: adapter, Result: series, Raw: rawPayload(raw)}
+	if !ownArchive(host, result.Archive) {
+		emitted.Archive = result.Archive
+	}
+	if owner := measurementHost(host, result.MeasurementAgent, result.Source, result.Destination); owner != host {
+		emitted.Host, emitted.ReadVia = owner, host
+	}
+	results.Emit(emitted)
+	var points []struct {
+		TS  int64       `json:"ts"`
+		Val interface{} `json:"val"`
+	}
+	json.Unmarshal(result.Data, &points)
+	var newest int64
+	var throughputs []float64
+	for _, point := range points {
+		if point.TS > newest {
+			newest = point.TS
+		}
+		if result.EventType == "throughput" {
+			if value := event.SeriesValue(point.Val); value != nil {
+				throughputs = append(throughputs, *value)
+			}
+		}
+	}
+	countTest(host, throughputs...)
+	markSeries("results", host, uri, newest)
+}
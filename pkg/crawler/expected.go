@@ -0,0 +1,128 @@
+package crawler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Expected test flags
+var checkExpectedTests = Flags.Bool("expected-tests", true, "Compare the tests of the -mesh configs with the esmond archives crawled and send each to the expected stream, flagging those without recent data as gaps")
+
+// Measurements seen in the esmond archives crawled, by source, destination and
+// event type, with when they were last updated and the hosts storing them
+var measured = struct {
+	sync.Mutex
+	m map[measuredKey]*measurement
+}{m: make(map[measuredKey]*measurement)}
+
+type measuredKey struct {
+	source      string
+	destination string
+	eventType   string
+}
+
+type measurement struct {
+	updated  int64
+	archives map[string]bool
+}
+
+// Records the measurements listed by the esmond archive of host, under both
+// the addresses and the names they were tested with
+func observeMeasurements(host string, metadata []esmondMetadata) {
+	if !*checkExpectedTests || len(discovery.Meshes()) == 0 {
+		return
+	}
+	measured.Lock()
+	defer measured.Unlock()
+	for _, item := range metadata {
+		for _, stored := range item.EventTypes {
+			var updated int64
+			if stored.TimeUpdated != nil {
+				updated = *stored.TimeUpdated
+			}
+			for _, source := range []string{item.Source, item.InputSource} {
+				for _, destination := range []string{item.Destination, item.InputDestination} {
+					key := measuredKey{discovery.CanonicalHost(source), discovery.CanonicalHost(destination), stored.EventType}
+					if key.source == "" || key.destination == "" {
+						continue
+					}
+					m := measured.m[key]
+					if m == nil {
+						m = &measurement{archives: make(map[string]bool)}
+						measured.m[key] = m
+					}
+					if updated > m.updated {
+						m.updated = updated
+					}
+					m.archives[host] = true
+				}
+			}
+		}
+	}
+}
+
+// Queues every test expected by the meshes to the expected stream, flagging
+// those the crawled archives have no data of within the time window
+func writeExpectedTests() {
+	meshes := discovery.Meshes()
+	if !*checkExpectedTests || len(meshes) == 0 {
+		return
+	}
+	if stopping.Load() {
+		logger.Info("Crawl interrupted, not checking the expected tests")
+		return
+	}
+	if *dryRun {
+		logger.Info("Dry run, not checking the expected tests")
+		return
+	}
+	names := make(map[string][]string)
+	keysOf := func(address string) []string {
+		if keys, ok := names[address]; ok {
+			return keys
+		}
+		keys := discovery.AddressKeys(address)
+		names[address] = keys
+		return keys
+	}
+	gaps := 0
+	for _, mesh := range meshes {
+		for _, test := range mesh.Config.ExpectedTests() {
+			test.Header = event.NewHeader()
+			test.Mesh = mesh.Name
+			var updated int64
+			archives := make(map[string]bool)
+			measured.Lock()
+			for _, source := range keysOf(test.Source) {
+				for _, destination := range keysOf(test.Destination) {
+					if m := measured.m[measuredKey{source, destination, test.EventType}]; m != nil {
+						if m.updated > updated {
+							updated = m.updated
+						}
+						for archive := range m.archives {
+							archives[archive] = true
+						}
+					}
+				}
+			}
+			measured.Unlock()
+			for archive := range archives {
+				test.Archives = append(test.Archives, archive)
+			}
+			sort.Strings(test.Archives)
+			if updated > 0 {
+				test.LastUpdated = time.Unix(updated, 0).UTC().Format(event.TimeLayout)
+			}
+			test.Gap = len(archives) == 0 || updated > 0 && updated < windowStart.Unix()
+			if test.Gap {
+				gaps++
+			}
+			expected.Emit(test)
+		}
+	}
+	logger.Info("Checked the expected tests", "gaps", gaps)
+}
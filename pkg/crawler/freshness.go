@@ -0,0 +1,23 @@
+package crawler
+
+import (
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/flagvar"
+)
+
+// Freshness flags
+var minFreshness = flagvar.Duration(0)
+
+func init() {
+	Flags.Var(&minFreshness, "min-freshness", "Age of the last data of a graphs test past which its partners aren't crawled, pruning dead edges, e.g. 7d (0 crawls them all)")
+}
+
+// Returns true if the test produced no data within -min-freshness, tests
+// without a last update time being kept
+func stale(test Test) bool {
+	if minFreshness == 0 || test.LastUpdated == 0 {
+		return false
+	}
+	return crawlStart.Sub(time.Unix(int64(test.LastUpdated), 0)) > time.Duration(minFreshness)
+}
@@ -0,0 +1,93 @@
+package crawler
+
+import (
+	"os"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/graph"
+)
+
+// Graph flags
+var (
+	graphFile      = Flags.String("graph", "", "File the host-to-host graph of the crawl is written to when it ends, as GraphML (.graphml), DOT (.dot, .gv) or GEXF (.gexf)")
+	findComponents = Flags.Bool("components", true, "Group the hosts into connected components of the test graph when the crawl ends, emitting their membership to the components stream")
+)
+
+// Graph of the links emitted, nil without -graph or -components
+var linkGraph *graph.Graph
+
+// Checks the graph flags
+func setupGraph() error {
+	if *graphFile != "" {
+		if _, err := graph.FormatOf(*graphFile); err != nil {
+			return err
+		}
+	}
+	if *graphFile != "" || *findComponents {
+		linkGraph = graph.New()
+	}
+	return nil
+}
+
+// Records that a crawled host answered
+func markReachable(host string) {
+	if linkGraph != nil {
+		linkGraph.MarkReachable(host)
+	}
+}
+
+// Queues the component of every host of the graph to the components stream,
+// labeled with the mesh it likely is. The coordinator of a distributed crawl
+// groups them, its workers only seeing their shards.
+func writeComponents() {
+	if linkGraph == nil || !*findComponents || IsWorker() {
+		return
+	}
+	if stopping.Load() {
+		logger.Info("Crawl interrupted, not grouping the hosts into components")
+		return
+	}
+	if *dryRun {
+		logger.Info("Dry run, not grouping the hosts into components")
+		return
+	}
+	found := linkGraph.Components()
+	for _, component := range found {
+		for _, host := range component.Hosts {
+			member := event.Component{
+				Header:         event.NewHeader(),
+				Component:      component.ID,
+				Label:          component.Label,
+				Host:           host.ID,
+				Reachable:      host.Reachable,
+				Meshes:         host.Meshes,
+				Hosts:          len(component.Hosts),
+				ReachableHosts: component.Reachable,
+			}
+			components.Emit(member)
+		}
+		logger.Debug("Component found", "component", component.ID, "label", component.Label,
+			"hosts", len(component.Hosts), "reachable", component.Reachable)
+	}
+	logger.Info("Grouped the hosts into components", "components", len(found))
+}
+
+// Writes the graph to path, through a temporary file so it is never half written
+func writeGraph(path string) error {
+	format, err := graph.FormatOf(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := linkGraph.Write(file, format); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,91 @@
+package crawler
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/sink"
+)
+
+// Headline numbers of the run, under the empty name, and of each mesh
+var headlines = struct {
+	sync.Mutex
+	m map[string]*headline
+}{m: make(map[string]*headline)}
+
+// Hosts up, test results seen and throughput values measured by them
+type headline struct {
+	hostsUp        int
+	tests          int
+	throughputSum  float64
+	throughputSeen int
+}
+
+// Calls count with the headlines host counts in, the run's and its meshes'
+func countHeadlines(host string, count func(*headline)) {
+	if !sink.SendsStats() {
+		return
+	}
+	headlines.Lock()
+	defer headlines.Unlock()
+	for _, name := range append([]string{""}, discovery.MeshesOf(host)...) {
+		h, ok := headlines.m[name]
+		if !ok {
+			h = &headline{}
+			headlines.m[name] = h
+		}
+		count(h)
+	}
+}
+
+// Counts a host that returned its summary
+func countHostUp(host string) {
+	countHeadlines(host, func(h *headline) { h.hostsUp++ })
+}
+
+// Counts a test result read from host with its throughput values in bits per
+// second, if any
+func countTest(host string, throughputs ...float64) {
+	countHeadlines(host, func(h *headline) {
+		h.tests++
+		for _, throughput := range throughputs {
+			h.throughputSum += throughput
+			h.throughputSeen++
+		}
+	})
+}
+
+// Characters not kept in the names of the numbers
+var statNameReplaced = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Sends the headline numbers of the run and of each mesh to StatsD and Graphite
+func sendHeadlines() {
+	if !sink.SendsStats() {
+		return
+	}
+	stats := map[string]float64{
+		"run.hosts_discovered": hostsDiscovered.Total(),
+		"run.hosts_crawled":    hostsCrawled.Total(),
+		"run.hosts_up":         0,
+		"run.tests":            0,
+	}
+	headlines.Lock()
+	for name, h := range headlines.m {
+		prefix := "run."
+		if name != "" {
+			prefix = "mesh." + statNameReplaced.ReplaceAllString(name, "_") + "."
+		}
+		stats[prefix+"hosts_up"] = float64(h.hostsUp)
+		stats[prefix+"tests"] = float64(h.tests)
+		if h.throughputSeen > 0 {
+			stats[prefix+"throughput_mean"] = h.throughputSum / float64(h.throughputSeen)
+		}
+	}
+	headlines.Unlock()
+	if err := sink.SendStats(stats); err != nil {
+		logger.Error("Sending the headline numbers failed", "err", err)
+		return
+	}
+	logger.Info("Headline numbers sent", "count", len(stats))
+}
@@ -0,0 +1,154 @@
+package crawler
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Host status flags
+var collectHostStatus = Flags.Bool("host-status", true, "Emit a host_status event per crawled host with what it runs and the status codes and connect, TLS handshake, first byte and total times of every endpoint called")
+
+// Status of the hosts being crawled, from when a worker takes them until
+// their crawl ends
+var crawling = struct {
+	sync.Mutex
+	m map[string]*hostStatus
+}{m: make(map[string]*hostStatus)}
+
+// Status of a host being crawled and the timings of each endpoint
+type hostStatus struct {
+	status    event.HostStatus
+	endpoints map[string]*event.EndpointStatus
+	timings   map[string]*endpointTimings
+	dateSkews []float64
+}
+
+// Sums of the timings of the calls to an endpoint, the phases only over the
+// calls that went through them
+type endpointTimings struct {
+	total, dns, connect, tls, firstByte     float64
+	dnsCalls, connectCalls, tlsCalls, bytes int
+}
+
+// Adds a phase of a call to a sum, returning the new mean
+func addPhase(sum *float64, calls *int, phase time.Duration) float64 {
+	if phase > 0 {
+		*sum += phase.Seconds()
+		*calls++
+	}
+	if *calls == 0 {
+		return 0
+	}
+	return *sum / float64(*calls)
+}
+
+// Starts tracking the status of host
+func beginHostStatus(host string) {
+	if !*collectHostStatus {
+		return
+	}
+	crawling.Lock()
+	defer crawling.Unlock()
+	crawling.m[host] = &hostStatus{
+		status:    event.HostStatus{Host: host},
+		endpoints: make(map[string]*event.EndpointStatus),
+		timings:   make(map[string]*endpointTimings),
+	}
+}
+
+// Records a call to an endpoint of host, with its status code or the type of
+// its error and its timing
+func observeCall(host string, endpoint string, code int, errType string, timing httpx.Timing) {
+	crawling.Lock()
+	defer crawling.Unlock()
+	status, ok := crawling.m[host]
+	if !ok {
+		return
+	}
+	calls, ok := status.endpoints[endpoint]
+	if !ok {
+		calls = &event.EndpointStatus{Endpoint: endpoint}
+		status.endpoints[endpoint] = calls
+		status.timings[endpoint] = &endpointTimings{}
+	}
+	calls.Calls++
+	if errType != "" {
+		if calls.Errors == nil {
+			calls.Errors = make(map[string]int)
+		}
+		calls.Errors[errType]++
+	} else {
+		if calls.StatusCodes == nil {
+			calls.StatusCodes = make(map[string]int)
+		}
+		calls.StatusCodes[strconv.Itoa(code)]++
+		calls.LastStatus = code
+		status.status.Reachable = true
+	}
+	if timing.Connect > 0 {
+		calls.NewConnections++
+	}
+	sums := status.timings[endpoint]
+	sums.total += timing.Total.Seconds()
+	calls.LatencySeconds = sums.total / float64(calls.Calls)
+	if seconds := timing.Total.Seconds(); seconds > calls.MaxLatencySeconds {
+		calls.MaxLatencySeconds = seconds
+	}
+	calls.DNSSeconds = addPhase(&sums.dns, &sums.dnsCalls, timing.DNS)
+	calls.ConnectSeconds = addPhase(&sums.connect, &sums.connectCalls, timing.Connect)
+	calls.TLSHandshakeSeconds = addPhase(&sums.tls, &sums.tlsCalls, timing.TLSHandshake)
+	calls.FirstByteSeconds = addPhase(&sums.firstByte, &sums.bytes, timing.FirstByte)
+}
+
+// Response body recording its call once closed
+type timedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *timedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// Records what was found on host
+func markHost(host string, mark func(status *event.HostStatus)) {
+	crawling.Lock()
+	defer crawling.Unlock()
+	if status, ok := crawling.m[host]; ok {
+		mark(&status.status)
+	}
+}
+
+// Queues the status of host once its crawl ended and stops tracking it
+func emitHostStatus(host string, duration time.Duration) {
+	crawling.Lock()
+	status, ok := crawling.m[host]
+	delete(crawling.m, host)
+	crawling.Unlock()
+	if !ok {
+		return
+	}
+	record := status.status
+	record.Header = event.NewHeader()
+	record.DurationSeconds = duration.Seconds()
+	record.Bundle = classifyBundle(record)
+	setClockSkew(&record, status.dateSkews)
+	if record.Bundle != "" {
+		hostsByBundle.Inc(record.Bundle)
+	}
+	record.Endpoints = make([]event.EndpointStatus, 0, len(status.endpoints))
+	for _, calls := range status.endpoints {
+		record.Endpoints = append(record.Endpoints, *calls)
+	}
+	sort.Slice(record.Endpoints, func(i, j int) bool { return record.Endpoints[i].Endpoint < record.Endpoints[j].Endpoint })
+	hostStatuses.Emit(record)
+}
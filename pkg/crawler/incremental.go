@@ -0,0 +1,108 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Incremental fetch flags
+var incrementalFile = Flags.String("incremental", "", "File keeping the newest datapoint read from every esmond series across runs, later runs only requesting the newer ones (default disabled)")
+
+// Newest datapoint timestamp of every series: those read by the previous
+// runs, which set where this run starts, and those read by this run
+var seriesMarks = struct {
+	sync.Mutex
+	previous map[string]int64
+	current  map[string]int64
+}{previous: make(map[string]int64), current: make(map[string]int64)}
+
+// Reads the newest datapoints of the previous runs, there are none on the
+// first run
+func loadSeriesMarks(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	seriesMarks.Lock()
+	defer seriesMarks.Unlock()
+	if err := json.Unmarshal(data, &seriesMarks.previous); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	logger.Info("Series marks loaded", "file", path, "series", len(seriesMarks.previous))
+	return nil
+}
+
+// Returns the key of the series at uri on host read into stream, kept apart
+// per vantage point like the summary records
+func seriesKey(stream string, host string, uri string) string {
+	return event.Vantage() + " " + stream + " " + host + " " + uri
+}
+
+// Returns where the time window of the series at uri starts, after the newest
+// datapoint read by a previous run, or false when it can't have newer ones.
+// The newest datapoint of a summary is read again as its window may have
+// been filling up since.
+func seriesStart(stream string, host string, uri string, summarized bool) (time.Time, bool) {
+	if *incrementalFile == "" {
+		return windowStart, true
+	}
+	seriesMarks.Lock()
+	newest, ok := seriesMarks.previous[seriesKey(stream, host, uri)]
+	seriesMarks.Unlock()
+	if !ok {
+		return windowStart, true
+	}
+	if !summarized {
+		newest++
+	}
+	start := time.Unix(newest, 0)
+	if !start.After(windowStart) {
+		return windowStart, true
+	}
+	return start, start.Before(windowEnd)
+}
+
+// Records the newest datapoint read from the series at uri
+func markSeries(stream string, host string, uri string, newest int64) {
+	if *incrementalFile == "" || newest == 0 {
+		return
+	}
+	key := seriesKey(stream, host, uri)
+	seriesMarks.Lock()
+	defer seriesMarks.Unlock()
+	if newest > seriesMarks.current[key] {
+		seriesMarks.current[key] = newest
+	}
+}
+
+// Writes the newest datapoints to path, through a temporary file so it is
+// never half written. Series with nothing newer than the start of the time
+// window are forgotten, the window starting after them anyway.
+func writeSeriesMarks(path string) error {
+	seriesMarks.Lock()
+	marks := make(map[string]int64, len(seriesMarks.previous))
+	for _, m := range []map[string]int64{seriesMarks.previous, seriesMarks.current} {
+		for key, newest := range m {
+			if newest >= windowStart.Unix() && newest > marks[key] {
+				marks[key] = newest
+			}
+		}
+	}
+	seriesMarks.Unlock()
+	data, err := json.MarshalIndent(marks, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,108 @@
+package crawler
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Inventory flags
+var collectInventory = Flags.Bool("inventory", true, "Build a host inventory event per toolkit from its summary and details")
+
+// Calls a host.cgi method of the toolkit for an endpoint, returning its answer
+// with the keys normalized or nil if there was none
+func callHostMethod(host string, scheme string, endpoint string, method string) json.RawMessage {
+	logger.Debug("Calling host.cgi", "host", host, "method", method)
+	resp, err := fetch(host, endpoint, discovery.HostURL(scheme, host, "/toolkit/services/host.cgi?method="+method))
+	if err != nil {
+		return nil
+	}
+	defer httpx.CloseBody(resp)
+	var raw json.RawMessage
+	if err := decodeResponse(endpoint, resp, httpx.JSONObject, &raw); err != nil {
+		logger.Debug("Invalid host.cgi answer", "host", host, "method", method, "err", err)
+		return nil
+	}
+	return normalizeKeys(host, endpoint, resp.Request.URL.String(), raw)
+}
+
+// Reads the host details, services, clock and calendar and queues the
+// inventory of the host built with its summary
+func crawlInventory(host string, scheme string, info event.ToolkitSummary) {
+	// The details fill in what the summary leaves out
+	if raw := callHostMethod(host, scheme, endpointDetails, "get_details"); raw != nil {
+		if details, err := event.ParseToolkitSummary(raw); err != nil {
+			logger.Debug("Invalid details", "host", host, "err", err)
+		} else {
+			if info.Distribution == "" {
+				info.Distribution = details.Distribution
+			}
+			if info.KernelVersion == "" {
+				info.KernelVersion = details.KernelVersion
+			}
+			if info.ToolkitRPMVersion == "" {
+				info.ToolkitRPMVersion = details.ToolkitRPMVersion
+			}
+		}
+	}
+	// The services method lists every service with its current state
+	if raw := callHostMethod(host, scheme, endpointServices, "get_services"); raw != nil {
+		if services, err := event.ParseToolkitSummary(raw); err != nil {
+			logger.Debug("Invalid services", "host", host, "err", err)
+		} else if len(services.Services) > 0 {
+			info.Services = services.Services
+		}
+	}
+	var ntp *event.InventoryNTP
+	if raw := callHostMethod(host, scheme, endpointNTP, "get_ntp_info"); raw != nil {
+		var err error
+		if ntp, err = event.ParseNTPInfo(raw); err != nil {
+			logger.Debug("Invalid NTP info", "host", host, "err", err)
+		} else {
+			observeNTPOffset(host, ntp.Offset)
+			if ntp.Synchronized != nil {
+				info.NTPSynchronized = ntp.Synchronized
+			}
+		}
+	}
+	calendar := callHostMethod(host, scheme, endpointCalendar, "get_calendar")
+	record := event.Inventory{
+		Header:             event.NewHeader(),
+		Host:               host,
+		ToolkitVersion:     info.ToolkitVersion,
+		ToolkitRPMVersion:  info.ToolkitRPMVersion,
+		OS:                 info.Distribution,
+		KernelVersion:      info.KernelVersion,
+		NTPSynchronized:    info.NTPSynchronized,
+		AutoUpdates:        info.AutoUpdates,
+		GloballyRegistered: info.GloballyRegistered,
+		Communities:        append([]string{}, info.Communities...),
+		Services:           []event.InventoryService{},
+		NTP:                ntp,
+		Calendar:           calendar,
+		TLS:                certificateOf(host),
+		Issues:             []string{},
+	}
+	sort.Strings(record.Communities)
+	if record.NTPSynchronized != nil && !*record.NTPSynchronized {
+		record.Issues = append(record.Issues, "ntp not synchronized")
+	}
+	record.Issues = append(record.Issues, certificateIssues(record.TLS)...)
+	for _, service := range info.Services {
+		entry := event.InventoryService{
+			Name:      service.Name,
+			Version:   service.Version,
+			Enabled:   service.Enabled,
+			Running:   service.Running,
+			Addresses: service.Addresses,
+		}
+		if entry.Enabled != nil && *entry.Enabled && entry.Running != nil && !*entry.Running {
+			record.Issues = append(record.Issues, service.Name+" enabled but not running")
+		}
+		record.Services = append(record.Services, entry)
+	}
+	inventory.Emit(record)
+}
@@ -0,0 +1,92 @@
+package crawler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/bored-engineer/ps-splunk/pkg/flagvar"
+)
+
+// Response size flags
+var maxResponseSize = flagvar.ByteSize(50 << 20)
+var endpointMaxResponseSizes = endpointSizes{}
+
+func init() {
+	Flags.Var(&maxResponseSize, "max-response-size", "Largest response body read from a host, e.g. 50M (0 for no limit)")
+	Flags.Var(endpointMaxResponseSizes, "endpoint-max-response-size", "Per endpoint response size limits overriding -max-response-size, e.g. results=200M,summary=1M")
+}
+
+// Flag holding sizes keyed by endpoint name, given as name=size pairs
+type endpointSizes map[string]flagvar.ByteSize
+
+func (e endpointSizes) String() string {
+	pairs := make([]string, 0, len(e))
+	for name, size := range e {
+		pairs = append(pairs, name+"="+size.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (e endpointSizes) Set(value string) error {
+	return parseEndpointPairs(value, func(name string, value string) error {
+		var size flagvar.ByteSize
+		if err := size.Set(value); err != nil {
+			return fmt.Errorf("invalid size %q for %s", value, name)
+		}
+		e[name] = size
+		return nil
+	})
+}
+
+// Returns the response size limit of endpoint, 0 for none
+func responseLimit(endpoint string) int64 {
+	if size, ok := endpointMaxResponseSizes[endpoint]; ok {
+		return int64(size)
+	}
+	return int64(maxResponseSize)
+}
+
+// Caps the body of a response from endpoint, reading past the limit fails
+// instead of growing without bounds. Bodies announced as too large fail on the
+// first read without being downloaded.
+func limitBody(endpoint string, resp *http.Response) {
+	limit := responseLimit(endpoint)
+	if limit <= 0 {
+		return
+	}
+	body := &limitedBody{body: resp.Body, limit: limit}
+	body.reader = io.LimitReader(resp.Body, limit+1)
+	if resp.ContentLength > limit {
+		body.reader = io.LimitReader(resp.Body, 0)
+		body.read = resp.ContentLength
+	}
+	resp.Body = body
+}
+
+// Response body failing once more than limit bytes were read
+type limitedBody struct {
+	reader io.Reader
+	body   io.ReadCloser
+	limit  int64
+	read   int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.read > b.limit {
+		return 0, fmt.Errorf("response larger than %d bytes", b.limit)
+	}
+	n, err := b.reader.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		return n - int(b.read-b.limit), fmt.Errorf("response larger than %d bytes", b.limit)
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,81 @@
+package crawler
+
+import (
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Links found but not emitted yet by origin and address, each counting the
+// times it was found. The links found on a host are emitted once its crawl
+// ended, those of the discovery sources when the crawl ends.
+var pendingLinks = struct {
+	sync.Mutex
+	m map[[2]string]*event.Link
+}{m: make(map[[2]string]*event.Link)}
+
+// Links a host found in a cache file from the cache itself rather than the
+// file, the files of a cache listing the same hosts over and over
+func linkFrom(link *event.Link) {
+	if link.Discovery == nil || link.Discovery.Source != "cache" {
+		return
+	}
+	source := *link.Discovery
+	source.File = ""
+	link.Origin = "cache," + source.Cache
+	link.Discovery = &source
+}
+
+// Counts another find of the link from origin to address, returns false if
+// it wasn't found before
+func countLink(origin string, address string) bool {
+	pendingLinks.Lock()
+	defer pendingLinks.Unlock()
+	if link, ok := pendingLinks.m[[2]string{origin, address}]; ok {
+		link.Count++
+		return true
+	}
+	return false
+}
+
+// Keeps a link found for the first time until its origin is crawled, counting
+// it if another worker kept it meanwhile
+func keepLink(link event.Link) {
+	pendingLinks.Lock()
+	defer pendingLinks.Unlock()
+	key := [2]string{link.Origin, link.Address}
+	if kept, ok := pendingLinks.m[key]; ok {
+		kept.Count++
+		return
+	}
+	link.Count = 1
+	pendingLinks.m[key] = &link
+}
+
+// Queues the links found on origin with their counts
+func flushLinks(origin string) {
+	pendingLinks.Lock()
+	var found []*event.Link
+	for key, link := range pendingLinks.m {
+		if key[0] == origin {
+			found = append(found, link)
+			delete(pendingLinks.m, key)
+		}
+	}
+	pendingLinks.Unlock()
+	for _, link := range found {
+		links.Emit(*link)
+	}
+}
+
+// Queues every link left, those of the discovery sources and of the hosts
+// crawled elsewhere
+func flushAllLinks() {
+	pendingLinks.Lock()
+	found := pendingLinks.m
+	pendingLinks.m = make(map[[2]string]*event.Link)
+	pendingLinks.Unlock()
+	for _, link := range found {
+		links.Emit(*link)
+	}
+}
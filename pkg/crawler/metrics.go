@@ -0,0 +1,138 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+	"github.com/bored-engineer/ps-splunk/pkg/metrics"
+	"github.com/bored-engineer/ps-splunk/pkg/sink"
+)
+
+// The crawl metrics
+var (
+	hostsDiscovered       = metrics.NewCounterVec("ps_hosts_discovered_total", "Hosts discovered and queued for crawling.")
+	hostsCrawled          = metrics.NewCounterVec("ps_hosts_crawled_total", "Hosts whose crawl finished.")
+	hostsResponsive       = metrics.NewCounterVec("ps_hosts_responsive_total", "Hosts that returned a toolkit summary.")
+	hostsWithArchive      = metrics.NewCounterVec("ps_hosts_with_archive_total", "Hosts whose graphs or esmond archive answered.")
+	hostsSkippedDead      = metrics.NewCounterVec("ps_hosts_skipped_dead_total", "Hosts skipped as dead by -dead-hosts.")
+	hostsOptedOut         = metrics.NewCounterVec("ps_hosts_opted_out_total", "Hosts skipped as listed by -opt-out-file.")
+	hostsOverBudget       = metrics.NewCounterVec("ps_hosts_over_budget_total", "Hosts whose crawl was cut short by -host-budget.")
+	hostsByBundle         = metrics.NewCounterVec("ps_hosts_by_bundle_total", "Crawled hosts by the perfSONAR bundle they run (toolkit, core, testpoint, archive).", "bundle")
+	hostsUnsampled        = metrics.NewCounterVec("ps_hosts_unsampled_total", "Hosts left out of the -sample.")
+	hostsGone             = metrics.NewCounterVec("ps_hosts_gone_total", "Hosts tracked by -summary-dedup given a tombstone.")
+	hostsClockSkewed      = metrics.NewCounterVec("ps_hosts_clock_skewed_total", "Hosts whose clock is skewed beyond -clock-skew-threshold.")
+	summariesUnchanged    = metrics.NewCounterVec("ps_summaries_unchanged_total", "Summaries suppressed by -summary-dedup as unchanged.")
+	testsStale            = metrics.NewCounterVec("ps_tests_stale_total", "Graphs tests whose partners weren't crawled as older than -min-freshness.")
+	requestsIssued        = metrics.NewCounterVec("ps_requests_total", "HTTP requests issued to hosts by endpoint and status code.", "endpoint", "code")
+	breakerSkipped        = metrics.NewCounterVec("ps_requests_short_circuited_total", "Requests to hosts skipped by their open circuit breaker by endpoint.", "endpoint")
+	requestsDisallowed    = metrics.NewCounterVec("ps_requests_disallowed_total", "Requests to hosts not made as disallowed by their robots.txt.")
+	contentSkipped        = metrics.NewCounterVec("ps_content_skipped_total", "Responses of hosts skipped as not JSON by endpoint and reason.", "endpoint", "reason")
+	archiveFiltered       = metrics.NewCounterVec("ps_archive_filtered_total", "Esmond measurement series listed by an archive but not downloaded, by the -event-types or -tools filter.", "filter")
+	datapointsAggregated  = metrics.NewCounterVec("ps_datapoints_aggregated_total", "Time series datapoints rolled up by -timeseries-aggregate by event type.", "event_type")
+	parseErrorsByEndpoint = metrics.NewCounterVec("ps_parse_errors_total", "Payloads of hosts that didn't conform by endpoint.", "endpoint")
+	errorsByType          = metrics.NewCounterVec("ps_errors_total", "Failed requests to hosts by endpoint and error type.", "endpoint", "type")
+	requestDuration       = metrics.NewHistogramVec("ps_request_duration_seconds", "Duration of HTTP requests to hosts by endpoint.", metrics.DurationBuckets, "endpoint")
+	hostDuration          = metrics.NewHistogramVec("ps_host_crawl_duration_seconds", "Time spent crawling each host.", metrics.DurationBuckets)
+	_                     = metrics.NewGaugeFunc("ps_queue_depth", "Items waiting in the job and output queues.", "queue", func() map[string]float64 {
+		depths := map[string]float64{"jobs": float64(jobs.len())}
+		for _, queue := range sink.Queues() {
+			depths[queue.Name()] = float64(queue.Len())
+		}
+		return depths
+	})
+	_ = metrics.NewGaugeFunc("ps_crawl_duration_seconds", "Time since the crawl started.", "", func() map[string]float64 {
+		return map[string]float64{"": time.Since(crawlStart).Seconds()}
+	})
+)
+
+// When the crawl started
+var crawlStart = time.Now()
+
+// Issues a GET to a host for an endpoint, waiting for the rate limiters and
+// recording the request metrics
+func get(host string, endpoint string, url string) (*http.Response, error) {
+	// Hosts that keep failing aren't requested anymore
+	if err := checkBreaker(host); err != nil {
+		breakerSkipped.Inc(endpoint)
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	if err := checkHostBudget(host); err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	// A stopped crawl doesn't wait for the rate limiters of its last requests
+	if crawlCancelled() {
+		return nil, fmt.Errorf("%s: %w", url, crawlCtx.Err())
+	}
+	// Paths disallowed by the robots.txt of the host aren't requested
+	if endpoint != endpointRobots {
+		if err := checkRobots(host, url); err != nil {
+			return nil, err
+		}
+	}
+	// Every endpoint of a host shares its rate limit
+	address, _ := discovery.SplitKey(host)
+	throttle(address)
+	start := time.Now()
+	ctx, trace := httpx.WithTrace(hostContext(host))
+	resp, err := httpx.Request(ctx, Client, url, endpointTimeout(endpoint))
+	observeTLS(host, resp, err)
+	requestDuration.Observe(time.Since(start).Seconds(), endpoint)
+	// The robots.txt probe stays out of the circuit breaker, it must not
+	// change how a host is retried
+	probe := endpoint == endpointRobots
+	if err != nil {
+		requestsIssued.Inc(endpoint, "error")
+		errorsByType.Inc(endpoint, errorType(err))
+		// Requests cancelled by a shutdown didn't fail
+		if !crawlCancelled() && !probe {
+			recordBreaker(host, true)
+		}
+		observeCall(host, endpoint, 0, errorType(err), trace.Finish())
+		return nil, err
+	}
+	requestsIssued.Inc(endpoint, strconv.Itoa(resp.StatusCode))
+	observeDate(host, resp.Header, start, time.Now())
+	if !probe {
+		recordBreaker(host, httpx.RetryableStatus(resp.StatusCode))
+	}
+	limitBody(endpoint, resp)
+	// The call is only over once its body was read and closed
+	resp.Body = &timedBody{ReadCloser: resp.Body, done: func() {
+		observeCall(host, endpoint, resp.StatusCode, "", trace.Finish())
+	}}
+	// A host without a robots.txt has nothing to opt out of
+	if resp.StatusCode >= 400 && !(probe && resp.StatusCode == http.StatusNotFound) {
+		errorsByType.Inc(endpoint, statusCategory(resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// Classifies a transport error
+func errorType(err error) string {
+	var dnsErr *net.DNSError
+	var timeout interface{ Timeout() bool }
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &timeout) && timeout.Timeout():
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "conn_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "conn_reset"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case strings.Contains(err.Error(), "tls:"), strings.Contains(err.Error(), "x509:"):
+		return "tls"
+	}
+	return "other"
+}
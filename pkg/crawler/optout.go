@@ -0,0 +1,263 @@
+package crawler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Opt-out flags
+var optOutFile = Flags.String("opt-out-file", "", "File listing the hosts whose admins asked not to be crawled, one host name, address, CIDR or *.domain per line, read at the start of every run")
+var honorRobots = Flags.Bool("robots", false, "Read the robots.txt of every host first and skip the endpoints it disallows to ps-splunk, or to every crawler when it doesn't name ps-splunk")
+
+// Product token matched against the User-agent lines of robots.txt
+const robotsAgent = "ps-splunk"
+
+// Most of a robots.txt read, as required of crawlers by RFC 9309
+const robotsMaxSize = 500 << 10
+
+// Error of a request to a path the robots.txt of its host disallows
+var errRobotsDisallowed = errors.New("disallowed by robots.txt")
+
+// Hosts opted out by -opt-out-file: names and addresses, domains whose every
+// host opted out and address ranges
+var optOuts = struct {
+	hosts    map[string]bool
+	domains  []string
+	prefixes []netip.Prefix
+}{hosts: make(map[string]bool)}
+
+// Reads -opt-out-file, blank lines and those starting with # are skipped
+func loadOptOuts(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(entry, "*."):
+			optOuts.domains = append(optOuts.domains, discovery.CanonicalHost(entry[1:]))
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid range %q: %v", path, line, entry, err)
+			}
+			optOuts.prefixes = append(optOuts.prefixes, prefix.Masked())
+		default:
+			optOuts.hosts[discovery.CanonicalHost(entry)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	logger.Info("Opt-outs loaded", "file", path, "hosts", len(optOuts.hosts), "domains", len(optOuts.domains), "ranges", len(optOuts.prefixes))
+	return nil
+}
+
+// Returns true if host, by its address or one of the names it was resolved
+// from, opted out of the crawl
+func optedOut(host string) bool {
+	if *optOutFile == "" {
+		return false
+	}
+	address, _ := discovery.SplitKey(host)
+	if addr, err := netip.ParseAddr(address); err == nil {
+		for _, prefix := range optOuts.prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	for _, name := range append([]string{address}, discovery.NamesOf(address)...) {
+		if optOuts.hosts[name] {
+			return true
+		}
+		for _, domain := range optOuts.domains {
+			if strings.HasSuffix(name, domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The rules of a robots.txt that apply to ps-splunk, nil allowing everything
+type robotsRules []robotsRule
+
+// An Allow or Disallow line
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// The robots.txt of every origin crawled, read once each
+var robots = struct {
+	sync.Mutex
+	m map[string]*robotsEntry
+}{m: make(map[string]*robotsEntry)}
+
+// The robots.txt of an origin, read by the first request to it
+type robotsEntry struct {
+	once  sync.Once
+	rules robotsRules
+}
+
+// Returns errRobotsDisallowed if -robots is set and the robots.txt of the
+// origin of rawURL disallows its path
+func checkRobots(host string, rawURL string) error {
+	if !*honorRobots {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	origin := u.Scheme + "://" + u.Host
+	robots.Lock()
+	entry, ok := robots.m[origin]
+	if !ok {
+		entry = &robotsEntry{}
+		robots.m[origin] = entry
+	}
+	robots.Unlock()
+	entry.once.Do(func() { entry.rules = readRobots(host, origin) })
+	if !entry.rules.allowed(u.RequestURI()) {
+		requestsDisallowed.Inc()
+		return fmt.Errorf("%s: %w", rawURL, errRobotsDisallowed)
+	}
+	return nil
+}
+
+// Reads the robots.txt of origin. Like a missing one, one that can't be read
+// allows everything: the requests to an unreachable host fail on their own.
+func readRobots(host string, origin string) robotsRules {
+	resp, err := get(host, endpointRobots, origin+"/robots.txt")
+	if err != nil {
+		logger.Debug("Getting robots.txt failed", "host", host, "origin", origin, "err", err)
+		return nil
+	}
+	defer httpx.CloseBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	rules, err := parseRobots(io.LimitReader(resp.Body, robotsMaxSize))
+	if err != nil {
+		logger.Debug("Reading robots.txt failed", "host", host, "origin", origin, "err", err)
+		return nil
+	}
+	if len(rules) > 0 {
+		logger.Debug("Robots.txt rules apply", "host", host, "origin", origin, "rules", len(rules))
+	}
+	return rules
+}
+
+// Parses a robots.txt, returning the rules of the groups naming ps-splunk or,
+// when none does, those of the groups for every crawler
+func parseRobots(r io.Reader) (robotsRules, error) {
+	var ownRules, allRules robotsRules
+	named, wildcard := false, false
+	// Whether the group being read applies, and whether its User-agent lines
+	// are over
+	ownGroup, allGroup, inRules := false, false, true
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "user-agent":
+			// User-agent lines following rules start a new group
+			if inRules {
+				ownGroup, allGroup, inRules = false, false, false
+			}
+			switch agent := strings.ToLower(value); {
+			case agent == "*":
+				allGroup, wildcard = true, true
+			case agent == robotsAgent:
+				ownGroup, named = true, true
+			}
+		case "allow", "disallow":
+			inRules = true
+			// An empty Disallow allows everything
+			if value == "" {
+				continue
+			}
+			rule := robotsRule{allow: strings.EqualFold(strings.TrimSpace(key), "allow"), pattern: value}
+			if ownGroup {
+				ownRules = append(ownRules, rule)
+			}
+			if allGroup {
+				allRules = append(allRules, rule)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, bufio.ErrTooLong) {
+		return nil, err
+	}
+	if named {
+		return ownRules, nil
+	}
+	if wildcard {
+		return allRules, nil
+	}
+	return nil, nil
+}
+
+// Returns true unless the longest rule matching path disallows it, Allow
+// winning a tie
+func (rules robotsRules) allowed(path string) bool {
+	allow, longest := true, -1
+	for _, rule := range rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if n := len(rule.pattern); n > longest || n == longest && rule.allow {
+			allow, longest = rule.allow, n
+		}
+	}
+	return allow
+}
+
+// Matches path against a robots.txt pattern, a prefix in which * matches any
+// characters and a trailing $ anchors the end
+func robotsMatch(pattern string, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for _, part := range parts[1:] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	if !anchored {
+		return true
+	}
+	// The last part must end the path, which the first match may not have
+	last := parts[len(parts)-1]
+	return rest == "" || len(parts) > 1 && strings.HasSuffix(path, last)
+}
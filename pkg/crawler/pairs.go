@@ -0,0 +1,89 @@
+package crawler
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Test pair flags
+var collectPairs = Flags.Bool("pairs", true, "Emit a pairs event per pair of hosts tested together once the crawl ends, with whether they test in one or both directions")
+
+// Tests seen between every pair of hosts, keyed by the pair in order
+var testPairs = struct {
+	sync.Mutex
+	m map[[2]string]*testPair
+}{m: make(map[[2]string]*testPair)}
+
+// Directions tested between a pair of hosts and the hosts listing the tests
+type testPair struct {
+	aToB, bToA bool
+	tests      int
+	reporters  map[string]bool
+}
+
+// Records a test from source to destination listed by host
+func notePair(source string, destination string, host string) {
+	if !*collectPairs {
+		return
+	}
+	source, destination = discovery.CanonicalHost(source), discovery.CanonicalHost(destination)
+	if source == "" || destination == "" || source == destination {
+		return
+	}
+	key, forward := [2]string{source, destination}, true
+	if destination < source {
+		key, forward = [2]string{destination, source}, false
+	}
+	testPairs.Lock()
+	defer testPairs.Unlock()
+	pair, ok := testPairs.m[key]
+	if !ok {
+		pair = &testPair{reporters: make(map[string]bool)}
+		testPairs.m[key] = pair
+	}
+	if forward {
+		pair.aToB = true
+	} else {
+		pair.bToA = true
+	}
+	pair.tests++
+	pair.reporters[host] = true
+}
+
+// Queues a pairs event per pair of hosts tested together
+func emitPairs() {
+	testPairs.Lock()
+	defer testPairs.Unlock()
+	keys := make([][2]string, 0, len(testPairs.m))
+	for key := range testPairs.m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		pair := testPairs.m[key]
+		reporters := make([]string, 0, len(pair.reporters))
+		for host := range pair.reporters {
+			reporters = append(reporters, host)
+		}
+		sort.Strings(reporters)
+		record := event.LinkPair{
+			Header:    event.NewHeader(),
+			HostA:     key[0],
+			HostB:     key[1],
+			AToB:      pair.aToB,
+			BToA:      pair.bToA,
+			Direction: "one_way",
+			Tests:     pair.tests,
+			Reporters: reporters,
+		}
+		if pair.aToB && pair.bToA {
+			record.Direction = "both"
+		}
+		pairs.Emit(record)
+	}
+}
@@ -0,0 +1,84 @@
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Queues a payload read from url on host that doesn't conform to what endpoint
+// returns to the parse errors, the payload being nil when it isn't JSON
+func emitParseError(host string, endpoint string, url string, payload json.RawMessage, err error) {
+	parseErrorsByEndpoint.Inc(endpoint)
+	emitError(host, endpoint, url, "parse", 0, err)
+	parseErrors.Emit(event.ParseError{
+		Header:   event.NewHeader(),
+		Host:     host,
+		Endpoint: endpoint,
+		URL:      url,
+		Error:    err.Error(),
+		Payload:  payload,
+	})
+}
+
+// Returns a payload read from url on host for endpoint with its keys
+// normalized, queueing it as read to the parse errors when keys collided
+func normalizeKeys(host string, endpoint string, url string, payload json.RawMessage) json.RawMessage {
+	normalized, err := event.NormalizeKeys(payload)
+	if err != nil {
+		logger.Warn("Colliding payload keys", "host", host, "endpoint", endpoint, "err", err)
+		emitParseError(host, endpoint, url, payload, err)
+	}
+	return normalized
+}
+
+// Queues an error of the request of url from host for endpoint to the errors
+// stream under category, with the HTTP status when the host answered
+func emitError(host string, endpoint string, url string, category string, status int, err error) {
+	errorEvents.Emit(event.RequestError{
+		Header:   event.NewHeader(),
+		Host:     host,
+		Endpoint: endpoint,
+		URL:      url,
+		Category: category,
+		Status:   status,
+		Error:    err.Error(),
+	})
+}
+
+// Queues the last attempt of a request that failed for good to the errors
+// stream, status being that of the answer or 0 when none came. The attempts
+// retried or falling back to another scheme aren't errors of the crawl.
+func emitRequestError(host string, endpoint string, url string, status int, err error) {
+	category := errorType(err)
+	if status != 0 {
+		category = statusCategory(status)
+	}
+	emitError(host, endpoint, url, category, status, err)
+}
+
+// DiscoveryFailed queues a hints file, cache or lookup service at rawURL that
+// couldn't be read to the errors stream, under its source as the endpoint
+func DiscoveryFailed(source string, rawURL string, err error) {
+	host := rawURL
+	if u, parseErr := url.Parse(rawURL); parseErr == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	emitRequestError(host, source, rawURL, 0, err)
+}
+
+// Queues an answer with an error status that isn't retried to the errors stream
+func emitStatusError(host string, endpoint string, url string, resp *http.Response) {
+	if resp.StatusCode >= 400 {
+		emitError(host, endpoint, url, statusCategory(resp.StatusCode), resp.StatusCode, errors.New(resp.Status))
+	}
+}
+
+// Returns the error category of an HTTP status, http_4xx or http_5xx
+func statusCategory(status int) string {
+	return "http_" + strconv.Itoa(status/100) + "xx"
+}
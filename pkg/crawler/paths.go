@@ -0,0 +1,147 @@
+package crawler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Path flags
+var collectPaths = Flags.Bool("paths", true, "Read the traceroute/tracepath measurements (packet-trace) of each host's esmond archive into the paths stream")
+
+// Whether crawling esmond for results also reads the packet traces
+func esmondReadsPaths() bool {
+	if strings.TrimSpace(*esmondEventTypes) == "" {
+		return true
+	}
+	for _, eventType := range strings.Split(*esmondEventTypes, ",") {
+		if strings.TrimSpace(eventType) == "packet-trace" {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads only the packet traces of the host's esmond archive
+func crawlPaths(host string, scheme string) {
+	if !eventTypeAllowed("packet-trace") {
+		return
+	}
+	crawlEsmondTypes(host, discovery.HostURL(scheme, host, esmondArchive), []string{"packet-trace"})
+}
+
+// Fetches the packet traces at uri within the time window and queues a path per run
+func emitPaths(host string, archive string, measurement esmondMetadata, uri string) {
+	start, ok := seriesStart("paths", host, uri, false)
+	if !ok {
+		return
+	}
+	resp, err := fetch(host, endpointEsmond, archiveURL(archive, uri+"?"+windowQueryFrom(start).Encode()))
+	if err != nil {
+		logger.Warn("Getting paths failed", "host", host, "err", err)
+		return
+	}
+	defer httpx.CloseBody(resp)
+	// Every datapoint is a run with a list of probes
+	var runs []struct {
+		TS  int64 `json:"ts"`
+		Val []struct {
+			TTL          int      `json:"ttl"`
+			Query        int      `json:"query"`
+			IP           string   `json:"ip"`
+			Hostname     string   `json:"hostname"`
+			RTT          *float64 `json:"rtt"`
+			MTU          *int     `json:"mtu"`
+			Success      int      `json:"success"`
+			ErrorMessage string   `json:"error_message"`
+		} `json:"val"`
+	}
+	var raw json.RawMessage
+	if err := httpx.DecodeShape(resp.Body, httpx.JSONArray, &raw); err != nil {
+		logger.Warn("Invalid paths", "host", host, "uri", uri, "err", err)
+		return
+	}
+	adapted, _ := event.AdaptEsmondData(archiveVersion(host, archive), raw)
+	if err := json.Unmarshal(adapted, &runs); err != nil {
+		logger.Warn("Invalid paths", "host", host, "uri", uri, "err", err)
+		return
+	}
+	owner := measurementHost(host, measurement.MeasurementAgent, measurement.Source, measurement.Destination)
+	var newest int64
+	for _, run := range runs {
+		if run.TS > newest {
+			newest = run.TS
+		}
+		path := event.Path{
+			Header:      event.NewHeader(),
+			Host:        owner,
+			Archive:     archive,
+			MetadataKey: measurement.MetadataKey,
+			Source:      measurement.Source,
+			Destination: measurement.Destination,
+			ToolName:    measurement.ToolName,
+			Timestamp:   run.TS,
+		}
+		for _, probe := range run.Val {
+			path.Hops = append(path.Hops, event.PathHop{
+				TTL:      probe.TTL,
+				Query:    probe.Query,
+				IP:       discovery.CanonicalHost(probe.IP),
+				Hostname: probe.Hostname,
+				RTT:      probe.RTT,
+				MTU:      probe.MTU,
+				Success:  probe.Success != 0,
+				Error:    probe.ErrorMessage,
+			})
+			if probe.TTL > path.HopCount {
+				path.HopCount = probe.TTL
+			}
+		}
+		if owner != host {
+			path.ReadVia = host
+		}
+		path.PathID = pathID(path.Hops)
+		paths.Emit(path)
+	}
+	markSeries("paths", host, uri, newest)
+}
+
+// Hashes the route of a path: the addresses answering at each hop in order,
+// with * for hops that never answered
+func pathID(hops []event.PathHop) string {
+	answers := make(map[int][]string)
+	maxTTL := 0
+	for _, hop := range hops {
+		if hop.TTL > maxTTL {
+			maxTTL = hop.TTL
+		}
+		if hop.IP != "" {
+			answers[hop.TTL] = append(answers[hop.TTL], hop.IP)
+		}
+	}
+	route := make([]string, 0, maxTTL)
+	for ttl := 1; ttl <= maxTTL; ttl++ {
+		addresses := answers[ttl]
+		if len(addresses) == 0 {
+			route = append(route, "*")
+			continue
+		}
+		// Load balanced hops answer from several addresses
+		sort.Strings(addresses)
+		unique := addresses[:1]
+		for _, address := range addresses[1:] {
+			if address != unique[len(unique)-1] {
+				unique = append(unique, address)
+			}
+		}
+		route = append(route, strings.Join(unique, "|"))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(route, ",")))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,121 @@
+package crawler
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress flags
+var progressInterval = Flags.Duration("progress", 30*time.Second, "How often a progress line with the hosts completed, queue depth, request rate and ETA is logged, 0 disables it")
+var progressBar = Flags.Bool("progress-bar", false, "Redraw a progress bar on stderr every second when it is a terminal")
+
+// Closed by Finish to stop reporting the progress, which then waits for the
+// last bar to be ended
+var progressDone = make(chan struct{})
+var progressStopped sync.WaitGroup
+
+// Snapshot of the crawl progress
+type progress struct {
+	discovered int64
+	completed  int64
+	queued     int
+	rate       float64
+	eta        time.Duration
+}
+
+// Requests per second since the previous call
+type requestRate struct {
+	requests float64
+	at       time.Time
+}
+
+func (r *requestRate) next(now time.Time) float64 {
+	requests := requestsIssued.Total()
+	rate := 0.0
+	if elapsed := now.Sub(r.at).Seconds(); elapsed > 0 {
+		rate = (requests - r.requests) / elapsed
+	}
+	r.requests, r.at = requests, now
+	return rate
+}
+
+// Returns the progress of the crawl, dead, opted out and unsampled hosts being
+// completed as they are skipped. The ETA is how long the hosts discovered so far take at the pace
+// hosts were completed since the start.
+func currentProgress(now time.Time, rate float64) progress {
+	p := progress{
+		discovered: int64(hostsDiscovered.Total()),
+		completed:  int64(hostsCrawled.Total() + hostsSkippedDead.Total() + hostsOptedOut.Total() + hostsUnsampled.Total()),
+		queued:     jobs.len(),
+		rate:       rate,
+	}
+	if remaining := p.discovered - p.completed; p.completed > 0 && remaining > 0 {
+		perHost := now.Sub(crawlStart) / time.Duration(p.completed)
+		p.eta = (perHost * time.Duration(remaining)).Round(time.Second)
+	}
+	return p
+}
+
+// Returns the ETA, unknown until a host was completed
+func (p progress) etaString() string {
+	if p.eta <= 0 {
+		return "unknown"
+	}
+	return p.eta.String()
+}
+
+// Logs a progress line every -progress and redraws the bar every second until
+// done is closed
+func reportProgress(done <-chan struct{}) {
+	defer progressStopped.Done()
+	var lines, bars <-chan time.Time
+	if *progressInterval > 0 {
+		ticker := time.NewTicker(*progressInterval)
+		defer ticker.Stop()
+		lines = ticker.C
+	}
+	bar := *progressBar && isTerminal(os.Stderr)
+	if bar {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		bars = ticker.C
+	}
+	lineRate := requestRate{at: time.Now()}
+	barRate := lineRate
+	for {
+		select {
+		case now := <-lines:
+			p := currentProgress(now, lineRate.next(now))
+			logger.Info("Progress", "completed", p.completed, "discovered", p.discovered, "queued", p.queued,
+				"requests_per_second", math.Round(p.rate*10)/10, "eta", p.etaString())
+		case now := <-bars:
+			fmt.Fprint(os.Stderr, "\r\033[K"+drawBar(currentProgress(now, barRate.next(now))))
+		case <-done:
+			if bar {
+				fmt.Fprintln(os.Stderr)
+			}
+			return
+		}
+	}
+}
+
+// Renders the progress as a bar of the hosts completed followed by the counts
+func drawBar(p progress) string {
+	const width = 30
+	filled := 0
+	if p.discovered > 0 {
+		filled = int(min(p.completed*width/p.discovered, width))
+	}
+	return fmt.Sprintf("[%s%s] %d/%d hosts  %d queued  %.1f req/s  ETA %s",
+		strings.Repeat("=", filled), strings.Repeat(" ", width-filled), p.completed, p.discovered, p.queued, p.rate, p.etaString())
+}
+
+// Returns true if file is a terminal rather than a pipe or a file
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,110 @@
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// pScheduler flags
+var pscheduler = Flags.Bool("pscheduler", true, "Read the scheduled tasks and their recent runs from each host's pScheduler")
+var pschedulerRuns = Flags.Int("pscheduler-runs", 5, "Maximum number of recent runs read per task, 0 skips the runs")
+var pschedulerRunsSince = Flags.Duration("pscheduler-runs-since", 24*time.Hour, "How far back task runs are read")
+
+// Participants named in a task's test spec
+type taskSpec struct {
+	Test struct {
+		Spec struct {
+			Source string `json:"source"`
+			Dest   string `json:"dest"`
+		} `json:"spec"`
+	} `json:"test"`
+	Href string `json:"href"`
+}
+
+// Reads every task scheduled on the host into the tasks queue, returns false
+// if the host has no pScheduler
+func crawlPScheduler(host string, scheme string) bool {
+	base := discovery.HostURL(scheme, host, "/pscheduler/tasks")
+	logger.Debug("Getting pScheduler tasks", "host", host)
+	resp, err := fetch(host, endpointPScheduler, base+"?expanded=true&detail=true")
+	if err != nil {
+		logger.Warn("Getting pScheduler tasks failed", "host", host, "err", err)
+		return false
+	}
+	// If it wasn't a json response the host has no pScheduler
+	var list []json.RawMessage
+	err = decodeResponse(endpointPScheduler, resp, httpx.JSONArray, &list)
+	httpx.CloseBody(resp)
+	if err != nil {
+		if !errors.Is(err, errNotJSON) {
+			logger.Warn("Invalid pScheduler tasks", "host", host, "url", base, "err", err)
+		}
+		return false
+	}
+	for _, raw := range list {
+		if len(raw) == 0 || raw[0] != httpx.JSONObject {
+			logger.Warn("Skipping a task that isn't an object", "host", host, "url", base)
+			continue
+		}
+		var spec taskSpec
+		json.Unmarshal(raw, &spec)
+		// Queue both the src and dst
+		if spec.Test.Spec.Source != "" {
+			Dedup(spec.Test.Spec.Source, host)
+		}
+		if spec.Test.Spec.Dest != "" {
+			Dedup(spec.Test.Spec.Dest, host)
+		}
+		// Tasks without a source run from the host itself
+		source := spec.Test.Spec.Source
+		if source == "" {
+			source, _ = discovery.SplitKey(host)
+		}
+		notePair(source, spec.Test.Spec.Dest, host)
+		task := event.Task{Header: event.NewHeader(), Host: host, Task: raw, Runs: []json.RawMessage{}}
+		// Tasks whose test doesn't decode are still kept as they were sent
+		if task.Spec, err = event.ParseTaskSpec(raw); err != nil {
+			logger.Warn("Invalid pScheduler task spec", "host", host, "url", base, "err", err)
+			emitParseError(host, endpointPScheduler, base, raw, err)
+		}
+		if *pschedulerRuns > 0 && spec.Href != "" {
+			task.Runs = getTaskRuns(host, base+"/"+path.Base(spec.Href)+"/runs")
+		}
+		tasks.Emit(task)
+	}
+	return true
+}
+
+// Returns the most recent finished runs of a task
+func getTaskRuns(host string, runs string) []json.RawMessage {
+	query := url.Values{
+		"expanded": {"true"},
+		"upcoming": {"false"},
+		"start":    {time.Now().Add(-*pschedulerRunsSince).UTC().Format(time.RFC3339)},
+		"limit":    {strconv.Itoa(*pschedulerRuns)},
+	}
+	resp, err := fetch(host, endpointPScheduler, runs+"?"+query.Encode())
+	if err != nil {
+		logger.Warn("Getting pScheduler runs failed", "host", host, "err", err)
+		return []json.RawMessage{}
+	}
+	defer httpx.CloseBody(resp)
+	var list []json.RawMessage
+	if err := httpx.DecodeShape(resp.Body, httpx.JSONArray, &list); err != nil {
+		logger.Warn("Invalid pScheduler runs", "host", host, "url", runs, "err", err)
+		return []json.RawMessage{}
+	}
+	// Keep the newest runs if the server ignored the limit
+	if len(list) > *pschedulerRuns {
+		list = list[len(list)-*pschedulerRuns:]
+	}
+	return list
+}
@@ -0,0 +1,80 @@
+package crawler
+
+import "sync"
+
+// Unbounded FIFO of hosts waiting to be crawled, pushing never blocks so the
+// workers can queue the test partners they discover without deadlocking
+type jobQueue struct {
+	sync.Mutex
+	ready  *sync.Cond
+	hosts  []string
+	closed bool
+}
+
+// Creates an empty job queue
+func newJobQueue() *jobQueue {
+	q := &jobQueue{}
+	q.ready = sync.NewCond(q)
+	return q
+}
+
+// Adds a host to the back of the queue
+func (q *jobQueue) push(host string) {
+	q.Lock()
+	q.hosts = append(q.hosts, host)
+	q.Unlock()
+	q.ready.Signal()
+}
+
+// Removes the host at the front of the queue, waiting for one if it is empty.
+// Returns false once the queue is closed and empty.
+func (q *jobQueue) pop() (string, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.hosts) == 0 && !q.closed {
+		q.ready.Wait()
+	}
+	if len(q.hosts) == 0 {
+		return "", false
+	}
+	host := q.hosts[0]
+	q.hosts[0] = ""
+	q.hosts = q.hosts[1:]
+	return host, true
+}
+
+// Removes up to n hosts from the front of the queue without waiting
+func (q *jobQueue) take(n int) []string {
+	q.Lock()
+	defer q.Unlock()
+	if n > len(q.hosts) {
+		n = len(q.hosts)
+	}
+	hosts := append([]string(nil), q.hosts[:n]...)
+	q.hosts = q.hosts[n:]
+	return hosts
+}
+
+// Returns the number of hosts waiting in the queue
+func (q *jobQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.hosts)
+}
+
+// Empties the queue, returning the hosts that were waiting
+func (q *jobQueue) drain() []string {
+	q.Lock()
+	defer q.Unlock()
+	hosts := q.hosts
+	q.hosts = nil
+	return hosts
+}
+
+// Wakes up all the waiting workers so they can exit once the queue is drained
+func (q *jobQueue) close() {
+	q.Lock()
+	q.closed = true
+	q.Unlock()
+	q.ready.Broadcast()
+}
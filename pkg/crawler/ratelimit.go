@@ -0,0 +1,161 @@
+package crawler
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rate limiting flags, a rate of 0 disables that limiter
+var globalRate = Flags.Float64("rate", 0, "Maximum requests per second across all hosts, 0 for unlimited")
+var globalBurst = Flags.Int("rate-burst", 10, "Number of requests allowed to exceed -rate in a burst")
+var hostRate = Flags.Float64("host-rate", 1, "Maximum requests per second to a single host, 0 for unlimited")
+
+// Token bucket refilled at rate tokens per second up to burst tokens
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Creates a full token bucket, or nil if the rate is unlimited
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Takes a token, sleeping until it has been refilled if the bucket is empty.
+// Tokens go negative while callers wait so each one gets its own slot.
+func (b *tokenBucket) wait() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	deficit, rate := -b.tokens, b.rate
+	b.Unlock()
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / rate * float64(time.Second)))
+	}
+}
+
+// The global limiter, created from the flags in Setup and replaced when the
+// rate limits are adjusted
+var globalLimiter atomic.Pointer[tokenBucket]
+
+// Define a thread safe set of per host limiters, rate being the current -host-rate
+var hostLimiters = struct {
+	sync.Mutex
+	rate float64
+	m    map[string]*tokenBucket
+}{m: make(map[string]*tokenBucket)}
+
+// Creates the limiters from the flags
+func setupRateLimits() {
+	globalLimiter.Store(newTokenBucket(*globalRate, *globalBurst))
+	hostLimiters.Lock()
+	hostLimiters.rate = *hostRate
+	hostLimiters.Unlock()
+}
+
+// Waits until a request to host is allowed by both the global and the host limiter
+func throttle(host string) {
+	globalLimiter.Load().wait()
+	hostLimiters.Lock()
+	if hostLimiters.rate <= 0 {
+		hostLimiters.Unlock()
+		return
+	}
+	limiter, ok := hostLimiters.m[host]
+	if !ok {
+		limiter = newTokenBucket(hostLimiters.rate, 1)
+		hostLimiters.m[host] = limiter
+	}
+	hostLimiters.Unlock()
+	limiter.wait()
+}
+
+// RateLimits are the rate limits of the crawl, as their flags. Those left nil
+// are unchanged by SetRateLimits.
+type RateLimits struct {
+	Rate      *float64 `json:"rate,omitempty"`
+	RateBurst *int     `json:"rate_burst,omitempty"`
+	HostRate  *float64 `json:"host_rate,omitempty"`
+}
+
+// Check returns an error if a rate limit is out of range
+func (l RateLimits) Check() error {
+	if l.Rate != nil && *l.Rate < 0 {
+		return fmt.Errorf("rate must not be negative")
+	}
+	if l.RateBurst != nil && *l.RateBurst < 1 {
+		return fmt.Errorf("rate_burst must be at least 1")
+	}
+	if l.HostRate != nil && *l.HostRate < 0 {
+		return fmt.Errorf("host_rate must not be negative")
+	}
+	return nil
+}
+
+// Serializes the changes to the rate limits
+var rateLimitsMu sync.Mutex
+
+// CurrentRateLimits returns the rate limits in effect
+func CurrentRateLimits() RateLimits {
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+	rate, burst := *globalRate, *globalBurst
+	hostLimiters.Lock()
+	host := hostLimiters.rate
+	hostLimiters.Unlock()
+	return RateLimits{Rate: &rate, RateBurst: &burst, HostRate: &host}
+}
+
+// SetRateLimits adjusts the rate limits of the running crawl. The global
+// limiter starts over with a full burst, the hosts keep their limiters at the
+// new rate.
+func SetRateLimits(l RateLimits) error {
+	if err := l.Check(); err != nil {
+		return err
+	}
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+	if l.Rate != nil || l.RateBurst != nil {
+		if l.Rate != nil {
+			*globalRate = *l.Rate
+		}
+		if l.RateBurst != nil {
+			*globalBurst = *l.RateBurst
+		}
+		globalLimiter.Store(newTokenBucket(*globalRate, *globalBurst))
+	}
+	if l.HostRate != nil {
+		hostLimiters.Lock()
+		hostLimiters.rate = *l.HostRate
+		if *l.HostRate <= 0 {
+			hostLimiters.m = make(map[string]*tokenBucket)
+		}
+		for _, limiter := range hostLimiters.m {
+			limiter.Lock()
+			limiter.rate = *l.HostRate
+			limiter.Unlock()
+		}
+		hostLimiters.Unlock()
+	}
+	logger.Info("Rate limits adjusted", "rate", *globalRate, "rate_burst", *globalBurst, "host_rate", hostLimiters.rate)
+	return nil
+}
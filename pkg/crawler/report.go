@@ -0,0 +1,116 @@
+package crawler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/sink"
+)
+
+// Report flags
+var runReport = Flags.Bool("report", true, "Print a JSON report of the crawl when it ends and send it to the report stream")
+var reportFile = Flags.String("report-file", "", "Also write the JSON report of the crawl to this file when it ends, even with -report=false")
+
+// Builds the report of the crawl from the metrics
+func buildReport() event.Report {
+	end := time.Now()
+	report := event.Report{
+		Header:                   event.NewHeader(),
+		StartTime:                crawlStart.UTC().Format(event.TimeLayout),
+		EndTime:                  end.UTC().Format(event.TimeLayout),
+		DurationSeconds:          end.Sub(crawlStart).Seconds(),
+		Interrupted:              stopping.Load(),
+		Truncated:                budgetSpent.Load(),
+		HostsDiscovered:          int64(hostsDiscovered.Total()),
+		HostsCrawled:             int64(hostsCrawled.Total()),
+		HostsResponsive:          int64(hostsResponsive.Total()),
+		HostsWithArchive:         int64(hostsWithArchive.Total()),
+		HostsSkippedDead:         int64(hostsSkippedDead.Total()),
+		HostsOptedOut:            int64(hostsOptedOut.Total()),
+		HostsOverBudget:          int64(hostsOverBudget.Total()),
+		HostsUnsampled:           int64(hostsUnsampled.Total()),
+		HostsGone:                int64(hostsGone.Total()),
+		HostsClockSkewed:         int64(hostsClockSkewed.Total()),
+		SummariesUnchanged:       int64(summariesUnchanged.Total()),
+		TestsStale:               int64(testsStale.Total()),
+		Requests:                 int64(requestsIssued.Total()),
+		RequestsShortCircuited:   int64(breakerSkipped.Total()),
+		RequestsDisallowed:       int64(requestsDisallowed.Total()),
+		Errors:                   counts(errorsByType.SumBy("type")),
+		ErrorsByEndpoint:         counts(errorsByType.SumBy("endpoint")),
+		ContentSkipped:           counts(contentSkipped.SumBy("reason")),
+		ContentSkippedByEndpoint: counts(contentSkipped.SumBy("endpoint")),
+		ArchiveFiltered:          counts(archiveFiltered.SumBy("filter")),
+		Bundles:                  counts(hostsByBundle.SumBy("bundle")),
+		DatapointsAggregated:     counts(datapointsAggregated.SumBy("event_type")),
+		ParseErrors:              counts(parseErrorsByEndpoint.SumBy("endpoint")),
+		Events:                   make(map[string]int64),
+		Bytes:                    make(map[string]int64),
+	}
+	events, bytes := sink.EmittedBy()
+	for _, queue := range sink.Queues() {
+		if queue == reports {
+			continue
+		}
+		report.Events[queue.Name()] = int64(events[queue.Name()])
+		report.Bytes[queue.Name()] = int64(bytes[queue.Name()])
+	}
+	if *sampleRate < 1 {
+		report.Sample, report.SampleSeed = *sampleRate, *sampleSeed
+	}
+	if *dryRun {
+		report.DryRun = true
+		report.Hosts = pendingHosts()
+	}
+	return report
+}
+
+// Converts summed counters to counts
+func counts(values map[string]float64) map[string]int64 {
+	converted := make(map[string]int64, len(values))
+	for key, value := range values {
+		converted[key] = int64(value)
+	}
+	return converted
+}
+
+// Prints the report of the crawl and queues it to the report stream, and
+// writes it to -report-file. It isn't printed when stdout carries the events,
+// the report event is already there.
+func writeReport() {
+	report := buildReport()
+	if *reportFile != "" {
+		if err := writeReportFile(*reportFile, report); err != nil {
+			logger.Error("Writing the report failed", "file", *reportFile, "err", err)
+		}
+	}
+	if !*runReport {
+		return
+	}
+	reports.Emit(report)
+	if sink.WritesStdout() {
+		return
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		logger.Error("Serializing the report failed", "err", err)
+		return
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
+
+// Writes the report to path through a temporary file so readers never see a
+// partial report
+func writeReportFile(path string, report event.Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
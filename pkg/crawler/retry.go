@@ -0,0 +1,163 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Names of the endpoints requested from each host
+const (
+	endpointSummary    = "summary"
+	endpointDetails    = "details"
+	endpointServices   = "services"
+	endpointNTP        = "ntp"
+	endpointCalendar   = "calendar"
+	endpointTestList   = "test_list"
+	endpointResults    = "results"
+	endpointEsmond     = "esmond"
+	endpointPScheduler = "pscheduler"
+	// The robots.txt read by -robots before any other endpoint of an origin
+	endpointRobots = "robots"
+)
+
+// Every endpoint name accepted by the per endpoint flags
+var endpoints = []string{endpointSummary, endpointDetails, endpointServices, endpointNTP, endpointCalendar, endpointTestList, endpointResults, endpointEsmond, endpointPScheduler}
+
+// Retry flags
+var retries = Flags.Int("retries", 2, "Number of times a failed request to a host is retried")
+var endpointRetries = endpointInts{}
+
+func init() {
+	Flags.Var(endpointRetries, "endpoint-retries", "Per endpoint retry counts overriding -retries, e.g. summary=1,results=4")
+}
+
+// Requests url from host for the named endpoint, retrying transient failures
+// (transport errors, 429 and 5xx) with exponential backoff and jitter. When all
+// the attempts failed the host is queued to the failed output.
+func fetch(host string, endpoint string, url string) (*http.Response, error) {
+	// Work out how many attempts this endpoint gets
+	attempts := *retries
+	if n, ok := endpointRetries[endpoint]; ok {
+		attempts = n
+	}
+	attempts++
+	var err error
+	// Status of the last attempt, 0 when it got no answer
+	var status int
+	for attempt := 1; ; attempt++ {
+		resp, getErr := get(host, endpoint, url)
+		// What robots.txt disallows is neither retried nor recorded as failed
+		if errors.Is(getErr, errRobotsDisallowed) {
+			return nil, getErr
+		}
+		// Once the breaker of the host is open or its budget spent an endpoint
+		// not requested yet is skipped, and one being retried fails with its
+		// last error
+		if errors.Is(getErr, errBreakerOpen) || errors.Is(getErr, errHostBudget) {
+			if attempt == 1 {
+				return nil, getErr
+			}
+			attempts = attempt - 1
+			break
+		}
+		err, status = getErr, 0
+		if err == nil && !httpx.RetryableStatus(resp.StatusCode) {
+			emitStatusError(host, endpoint, url, resp)
+			return resp, nil
+		}
+		// A stopped crawl is neither retried nor recorded as failed
+		if crawlCancelled() {
+			if err == nil {
+				httpx.CloseBody(resp)
+				err = fmt.Errorf("%s: %v", url, crawlCtx.Err())
+			}
+			return nil, err
+		}
+		// Turn a bad status into an error and release the connection
+		if err == nil {
+			httpx.CloseBody(resp)
+			status = resp.StatusCode
+			err = fmt.Errorf("%s: %s", url, resp.Status)
+		}
+		if attempt >= attempts {
+			break
+		}
+		delay := httpx.Backoff(attempt)
+		logger.Info("Retrying request", "endpoint", endpoint, "host", host, "delay", delay, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-crawlCtx.Done():
+			return nil, err
+		}
+	}
+	// Record the host so it can be reprocessed later
+	emitRequestError(host, endpoint, url, status, err)
+	failed.Emit(event.Failure{
+		Header:   event.NewHeader(),
+		Address:  host,
+		Endpoint: endpoint,
+		URL:      url,
+		Attempts: attempts,
+		Error:    err.Error(),
+	})
+	return nil, err
+}
+
+// Returns true for the errors of requests that were skipped rather than made
+func skippedRequest(err error) bool {
+	return errors.Is(err, errRobotsDisallowed) || errors.Is(err, errBreakerOpen) || errors.Is(err, errHostBudget)
+}
+
+// Flag holding integers keyed by endpoint name, given as name=value pairs
+// separated by commas or by repeating the flag
+type endpointInts map[string]int
+
+func (e endpointInts) String() string {
+	pairs := make([]string, 0, len(e))
+	for name, value := range e {
+		pairs = append(pairs, name+"="+strconv.Itoa(value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (e endpointInts) Set(value string) error {
+	return parseEndpointPairs(value, func(name string, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid count %q for %s", value, name)
+		}
+		e[name] = n
+		return nil
+	})
+}
+
+// Splits name=value pairs, checking every name is a known endpoint
+func parseEndpointPairs(value string, set func(name string, value string) error) error {
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected endpoint=value, got %q", pair)
+		}
+		name := strings.TrimSpace(kv[0])
+		known := false
+		for _, endpoint := range endpoints {
+			known = known || endpoint == name
+		}
+		if !known {
+			return fmt.Errorf("unknown endpoint %q, expected one of %s", name, strings.Join(endpoints, ", "))
+		}
+		if err := set(name, strings.TrimSpace(kv[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package crawler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+)
+
+// Sampling flags
+var sampleRate = Flags.Float64("sample", 1, "Fraction of the discovered hosts crawled for a quick estimate, e.g. 0.05, the others are only linked")
+var sampleSeed = Flags.Int64("sample-seed", 0, "Seed picking the hosts of -sample, the same seed always picking the same hosts (default a random seed, logged)")
+
+// Checks the sampling flags, picking a seed when none was given
+func setupSample() error {
+	if *sampleRate <= 0 || *sampleRate > 1 {
+		return fmt.Errorf("-sample must be above 0 and at most 1")
+	}
+	if *sampleRate == 1 {
+		return nil
+	}
+	if *sampleSeed == 0 {
+		*sampleSeed = rand.Int63()
+	}
+	logger.Info("Sampling the discovered hosts", "sample", *sampleRate, "sample_seed", *sampleSeed)
+	return nil
+}
+
+// Returns true if host is in the sample. A host is picked by the hash of the
+// seed and its name rather than by the order it was found in, so a seed
+// always samples the same hosts.
+func sampled(host string) bool {
+	if *sampleRate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	var seed [8]byte
+	binary.BigEndian.PutUint64(seed[:], uint64(*sampleSeed))
+	h.Write(seed[:])
+	h.Write([]byte(host))
+	// The top 53 bits of the hash as a float in [0, 1)
+	return float64(h.Sum64()>>11)/(1<<53) < *sampleRate
+}
@@ -0,0 +1,133 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Shutdown and resume flags
+var stateFile = Flags.String("state-file", "crawl-state.json", "File the completed and pending hosts are checkpointed to, and resumed from with -resume")
+var checkpointInterval = Flags.Duration("checkpoint-interval", time.Minute, "How often the crawl state is checkpointed, 0 only writes it at the end")
+var resume = Flags.Bool("resume", false, "Resume the crawl recorded in -state-file: completed hosts are skipped and pending ones queued first")
+
+// Set once a shutdown was requested, no new hosts are crawled after that
+var stopping atomic.Bool
+
+// CrawlState lists which hosts of a crawl were completed and which are pending
+type CrawlState struct {
+	RunID     string   `json:"run_id"`
+	StartTime string   `json:"start_time"`
+	Time      string   `json:"time"`
+	Completed []string `json:"completed"`
+	Pending   []string `json:"pending"`
+}
+
+// Stop stops the crawl: the queued hosts are dropped and the in-flight
+// requests of the running ones are cancelled, leaving them pending, Finish
+// then drains the outputs
+func Stop() {
+	if stopping.Swap(true) {
+		return
+	}
+	cancelCrawl()
+	// The dropped hosts stay pending in the cache
+	for range jobs.drain() {
+		wg.Done()
+	}
+}
+
+// Stopped reports whether Stop was called
+func Stopped() bool {
+	return stopping.Load()
+}
+
+// Returns the current state of every host found so far
+func crawlState() CrawlState {
+	state := CrawlState{
+		RunID:     event.RunID,
+		StartTime: event.StartTime,
+		Time:      time.Now().UTC().Format(event.TimeLayout),
+		Completed: []string{},
+		Pending:   []string{},
+	}
+	cache.RLock()
+	for host, completed := range cache.m {
+		if completed {
+			state.Completed = append(state.Completed, host)
+		} else {
+			state.Pending = append(state.Pending, host)
+		}
+	}
+	cache.RUnlock()
+	sort.Strings(state.Completed)
+	sort.Strings(state.Pending)
+	return state
+}
+
+// Checkpoints the crawl state every interval until done is closed
+func checkpoint(path string, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := writeCrawlState(path); err != nil {
+				logger.Error("Checkpointing the crawl state failed", "file", path, "err", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Restores the state of an earlier crawl: it keeps its run id and output files,
+// completed hosts are marked as crawled and pending ones are queued
+func resumeCrawl(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		logger.Info("No crawl state, starting a new crawl", "file", path)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state CrawlState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if state.RunID != "" {
+		event.RunID = state.RunID
+	}
+	if state.StartTime != "" {
+		event.StartTime = state.StartTime
+	}
+	cache.Lock()
+	for _, host := range state.Completed {
+		cache.m[discovery.CanonicalHost(host)] = true
+	}
+	cache.Unlock()
+	for _, host := range state.Pending {
+		requeue(host)
+	}
+	logger.Info("Resuming crawl", "run_id", event.RunID, "completed", len(state.Completed), "pending", len(state.Pending))
+	return nil
+}
+
+// Writes the crawl state to path, through a temporary file so it is never half written
+func writeCrawlState(path string) error {
+	data, err := json.MarshalIndent(crawlState(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
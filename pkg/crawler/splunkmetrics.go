@@ -0,0 +1,68 @@
+package crawler
+
+import (
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Splunk metrics flags
+var metricsFormat = Flags.Bool("metrics-format", false, "Send the numeric datapoints of the time series to the metrics stream in the Splunk metrics format (metric_name, _value and the test as dimensions) instead of the timeseries stream, implies -timeseries")
+
+// Queues a datapoint of a time series, as metrics with -metrics-format when
+// it has a numeric value
+func emitDatapoint(point event.Datapoint) {
+	name, value := metricOf(point)
+	if !*metricsFormat || value == nil {
+		timeSeries.Emit(point)
+		return
+	}
+	metric := event.Metric{
+		Header:          point.Header,
+		MetricName:      name,
+		Value:           *value,
+		ArchiveHost:     point.Host,
+		MetadataKey:     point.MetadataKey,
+		Source:          point.Source,
+		Destination:     point.Destination,
+		ToolName:        point.ToolName,
+		EventType:       point.EventType,
+		SummaryType:     point.SummaryType,
+		SummaryWindow:   point.SummaryWindow,
+		AggregateWindow: point.AggregateWindow,
+	}
+	metric.Time = time.Unix(point.Timestamp, 0).UTC().Format(event.TimeLayout)
+	if point.AggregateWindow == 0 {
+		metricPoints.Emit(metric)
+		return
+	}
+	// An aggregate is a metric per statistic
+	for _, stat := range []struct {
+		name  string
+		value float64
+	}{
+		{"count", float64(point.Count)},
+		{"min", *point.Min},
+		{"mean", *point.Mean},
+		{"max", *point.Max},
+		{"p95", *point.P95},
+	} {
+		metric.MetricName = name + "." + stat.name
+		metric.Value = stat.value
+		metricPoints.Emit(metric)
+	}
+}
+
+// Returns the metric name and value of a datapoint, a nil value when it
+// isn't numeric
+func metricOf(point event.Datapoint) (string, *float64) {
+	switch {
+	case point.Throughput != nil:
+		return "perfsonar.throughput", point.Throughput
+	case point.Latency != nil:
+		return "perfsonar.latency", point.Latency
+	case point.Loss != nil:
+		return "perfsonar.loss", point.Loss
+	}
+	return "", nil
+}
@@ -0,0 +1,303 @@
+package crawler
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/sink"
+)
+
+// Number of recently crawled hosts listed by the status page
+const recentHostsKept = 50
+
+// Hosts being crawled by when their crawl started, the hosts crawled last
+// and whether each crawled host was up, for the status page
+var hostActivity = struct {
+	sync.Mutex
+	active map[string]time.Time
+	recent []recentHost
+	up     map[string]bool
+}{active: make(map[string]time.Time), up: make(map[string]bool)}
+
+// A host whose crawl finished
+type recentHost struct {
+	Host     string  `json:"host"`
+	Finished string  `json:"finished"`
+	Seconds  float64 `json:"seconds"`
+	Up       bool    `json:"up"`
+}
+
+// Records that a worker started crawling host
+func beginHostActivity(host string) {
+	hostActivity.Lock()
+	defer hostActivity.Unlock()
+	hostActivity.active[host] = time.Now()
+}
+
+// Records the end of the crawl of host, finished unless it was interrupted
+func endHostActivity(host string, finished bool, up bool, took time.Duration) {
+	hostActivity.Lock()
+	defer hostActivity.Unlock()
+	delete(hostActivity.active, host)
+	if !finished {
+		return
+	}
+	hostActivity.up[host] = up
+	if len(hostActivity.recent) == recentHostsKept {
+		hostActivity.recent = hostActivity.recent[1:]
+	}
+	hostActivity.recent = append(hostActivity.recent, recentHost{
+		Host:     host,
+		Finished: time.Now().UTC().Format(event.TimeLayout),
+		Seconds:  math.Round(took.Seconds()*1000) / 1000,
+		Up:       up,
+	})
+}
+
+// Status of the crawl served to the status page
+type crawlStatus struct {
+	Progress         controlProgress  `json:"progress"`
+	ElapsedSeconds   float64          `json:"elapsed_seconds"`
+	Queues           map[string]int   `json:"queues"`
+	Requests         int64            `json:"requests"`
+	StatusCodes      map[string]int64 `json:"status_codes"`
+	Errors           int64            `json:"errors"`
+	ErrorRatio       float64          `json:"error_ratio"`
+	ErrorsPerMinute  float64          `json:"errors_per_minute"`
+	ErrorsByType     map[string]int64 `json:"errors_by_type"`
+	ErrorsByEndpoint map[string]int64 `json:"errors_by_endpoint"`
+	Crawling         []crawlingHost   `json:"crawling"`
+	Recent           []recentHost     `json:"recent"`
+	Hosts            []discoveredHost `json:"hosts"`
+}
+
+// A host being crawled and for how long
+type crawlingHost struct {
+	Host    string  `json:"host"`
+	Since   string  `json:"since"`
+	Seconds float64 `json:"seconds"`
+}
+
+// A discovered host, its state being queued, crawling or crawled
+type discoveredHost struct {
+	Host    string   `json:"host"`
+	State   string   `json:"state"`
+	Up      *bool    `json:"up,omitempty"`
+	Depth   int      `json:"depth"`
+	Sources []string `json:"sources,omitempty"`
+	Meshes  []string `json:"meshes,omitempty"`
+}
+
+// Builds the status of the crawl, the request rate averaged since the
+// previous call
+func buildStatus(rate *requestRate) crawlStatus {
+	now := time.Now()
+	p := currentProgress(now, rate.next(now))
+	elapsed := now.Sub(crawlStart)
+	status := crawlStatus{
+		Progress: controlProgress{
+			StartTime:         crawlStart.UTC().Format(event.TimeLayout),
+			Discovered:        p.discovered,
+			Completed:         p.completed,
+			Queued:            p.queued,
+			RequestsPerSecond: math.Round(p.rate*10) / 10,
+			ETASeconds:        p.eta.Seconds(),
+			Stopping:          Stopped(),
+		},
+		ElapsedSeconds:   math.Round(elapsed.Seconds()),
+		Queues:           map[string]int{"jobs": jobs.len()},
+		Requests:         int64(requestsIssued.Total()),
+		StatusCodes:      counts(requestsIssued.SumBy("code")),
+		Errors:           int64(errorsByType.Total()),
+		ErrorsByType:     counts(errorsByType.SumBy("type")),
+		ErrorsByEndpoint: counts(errorsByType.SumBy("endpoint")),
+	}
+	for _, queue := range sink.Queues() {
+		status.Queues[queue.Name()] = queue.Len()
+	}
+	if status.Requests > 0 {
+		status.ErrorRatio = math.Round(float64(status.Errors)/float64(status.Requests)*1000) / 1000
+	}
+	if minutes := elapsed.Minutes(); minutes > 0 {
+		status.ErrorsPerMinute = math.Round(float64(status.Errors)/minutes*10) / 10
+	}
+	hostActivity.Lock()
+	for host, since := range hostActivity.active {
+		status.Crawling = append(status.Crawling, crawlingHost{
+			Host:    host,
+			Since:   since.UTC().Format(event.TimeLayout),
+			Seconds: math.Round(now.Sub(since).Seconds()),
+		})
+	}
+	// Newest first
+	for i := len(hostActivity.recent) - 1; i >= 0; i-- {
+		status.Recent = append(status.Recent, hostActivity.recent[i])
+	}
+	up := make(map[string]bool, len(hostActivity.up))
+	for host, alive := range hostActivity.up {
+		up[host] = alive
+	}
+	active := make(map[string]bool, len(hostActivity.active))
+	for host := range hostActivity.active {
+		active[host] = true
+	}
+	hostActivity.Unlock()
+	sort.Slice(status.Crawling, func(i, j int) bool { return status.Crawling[i].Seconds > status.Crawling[j].Seconds })
+	cache.RLock()
+	for host, crawled := range cache.m {
+		h := discoveredHost{Host: host, State: "queued", Depth: cache.depth[host]}
+		switch {
+		case crawled:
+			h.State = "crawled"
+		case active[host]:
+			h.State = "crawling"
+		}
+		if alive, ok := up[host]; ok {
+			h.Up = &alive
+		}
+		status.Hosts = append(status.Hosts, h)
+	}
+	cache.RUnlock()
+	sort.Slice(status.Hosts, func(i, j int) bool { return status.Hosts[i].Host < status.Hosts[j].Host })
+	for i := range status.Hosts {
+		for _, source := range discovery.SourcesOf(status.Hosts[i].Host) {
+			status.Hosts[i].Sources = append(status.Hosts[i].Sources, source.Source)
+		}
+		status.Hosts[i].Meshes = discovery.MeshesOf(status.Hosts[i].Host)
+	}
+	return status
+}
+
+// StatusHandler serves a status page of the running crawl on / refreshing
+// itself from /status.json: the queue depths, the hosts being and recently
+// crawled, the error rates and a searchable table of the discovered hosts
+func StatusHandler() http.Handler {
+	rate := requestRate{at: crawlStart}
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		status := buildStatus(&rate)
+		mu.Unlock()
+		controlJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(statusPage))
+	})
+	return mux
+}
+
+// The status page, rendered in the browser from /status.json every 5 seconds
+const statusPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ps-splunk crawl status</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; font-size: 90%; }
+th { background: #eee; }
+.down { color: #b00; }
+.cols { display: flex; gap: 2em; flex-wrap: wrap; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Crawl status</h1>
+<p id="summary">Loading&hellip;</p>
+<p id="error"></p>
+<div class="cols">
+<div><h2>Queues</h2><table id="queues"></table></div>
+<div><h2>Errors by type</h2><table id="errors-type"></table></div>
+<div><h2>Errors by endpoint</h2><table id="errors-endpoint"></table></div>
+<div><h2>Status codes</h2><table id="codes"></table></div>
+</div>
+<div class="cols">
+<div><h2>Crawling</h2><table id="crawling"></table></div>
+<div><h2>Recently crawled</h2><table id="recent"></table></div>
+</div>
+<h2>Discovered hosts</h2>
+<p><input id="search" type="search" placeholder="Search hosts, states, sources and meshes" size="50"> <span id="count"></span></p>
+<table id="hosts"></table>
+<script>
+var last = null;
+function cell(tag, text, cls) {
+  var c = document.createElement(tag);
+  c.textContent = text;
+  if (cls) c.className = cls;
+  return c;
+}
+function fill(id, head, rows) {
+  var table = document.getElementById(id);
+  table.textContent = "";
+  var tr = document.createElement("tr");
+  head.forEach(function (h) { tr.appendChild(cell("th", h)); });
+  table.appendChild(tr);
+  rows.forEach(function (row) {
+    var tr = document.createElement("tr");
+    row.cells.forEach(function (v) { tr.appendChild(cell("td", v == null ? "" : v, row.cls)); });
+    table.appendChild(tr);
+  });
+}
+function pairs(m) {
+  return Object.keys(m || {}).sort().map(function (k) { return {cells: [k, m[k]]}; });
+}
+function renderHosts() {
+  if (!last) return;
+  var terms = document.getElementById("search").value.toLowerCase().split(/\s+/).filter(Boolean);
+  var hosts = (last.hosts || []).filter(function (h) {
+    var text = [h.host, h.state, h.up === false ? "down" : h.up ? "up" : ""].concat(h.sources || [], h.meshes || []).join(" ").toLowerCase();
+    return terms.every(function (t) { return text.indexOf(t) >= 0; });
+  });
+  document.getElementById("count").textContent = hosts.length + " of " + (last.hosts || []).length;
+  fill("hosts", ["Host", "State", "Up", "Depth", "Sources", "Meshes"], hosts.map(function (h) {
+    return {cells: [h.host, h.state, h.up == null ? "" : h.up ? "yes" : "no", h.depth, (h.sources || []).join(", "), (h.meshes || []).join(", ")], cls: h.up === false ? "down" : ""};
+  }));
+}
+function render(s) {
+  last = s;
+  var p = s.progress;
+  document.getElementById("summary").textContent =
+    (p.stopping ? "Stopping. " : "") + "Started " + p.start_time + ", " + s.elapsed_seconds + "s ago. " +
+    p.completed + "/" + p.discovered + " hosts completed, " + p.queued + " queued, " +
+    p.requests_per_second + " req/s, ETA " + (p.eta_seconds ? Math.round(p.eta_seconds) + "s" : "unknown") + ". " +
+    s.errors + " errors in " + s.requests + " requests (" + (s.error_ratio * 100).toFixed(1) + "%, " + s.errors_per_minute + "/min).";
+  fill("queues", ["Queue", "Depth"], pairs(s.queues));
+  fill("errors-type", ["Type", "Errors"], pairs(s.errors_by_type));
+  fill("errors-endpoint", ["Endpoint", "Errors"], pairs(s.errors_by_endpoint));
+  fill("codes", ["Code", "Requests"], pairs(s.status_codes));
+  fill("crawling", ["Host", "Since", "Seconds"], (s.crawling || []).map(function (h) { return {cells: [h.host, h.since, h.seconds]}; }));
+  fill("recent", ["Host", "Finished", "Seconds", "Up"], (s.recent || []).map(function (h) {
+    return {cells: [h.host, h.finished, h.seconds, h.up ? "yes" : "no"], cls: h.up ? "" : "down"};
+  }));
+  renderHosts();
+}
+function refresh() {
+  fetch("status.json").then(function (r) {
+    if (!r.ok) throw new Error(r.status + " " + r.statusText);
+    return r.json();
+  }).then(function (s) {
+    document.getElementById("error").textContent = "";
+    render(s);
+  }).catch(function (e) {
+    document.getElementById("error").textContent = "Refreshing failed: " + e.message;
+  });
+}
+document.getElementById("search").addEventListener("input", renderHosts);
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
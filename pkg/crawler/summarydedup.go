@@ -0,0 +1,193 @@
+package crawler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Summary dedup flags
+var summaryDedupFile = Flags.String("summary-dedup", "", "File tracking the summary of every host across runs, a summary is only emitted when it changed or -summary-refresh passed and hosts gone get a tombstone summary (default disabled)")
+var summaryRefresh = Flags.Duration("summary-refresh", 24*time.Hour, "How long an unchanged summary is suppressed for by -summary-dedup before it is emitted again, 0 never emits it again")
+var tombstoneAfter = Flags.Int("tombstone-after", 1, "Complete runs in a row a host tracked by -summary-dedup must be missing from before its tombstone is emitted")
+
+// SummaryRecord is the last summary emitted for a host: the hash of its
+// content, when it was emitted and the run that last saw it, Missed counting
+// the complete runs in a row it was missing from
+type SummaryRecord struct {
+	Hash     string `json:"hash"`
+	Emitted  string `json:"emitted"`
+	LastSeen string `json:"last_seen"`
+	RunID    string `json:"run_id"`
+	Missed   int    `json:"missed,omitempty"`
+}
+
+// The summary records read from -summary-dedup, updated as summaries are
+// emitted, by summaryKey
+var summaryRecords = struct {
+	sync.Mutex
+	m map[string]*SummaryRecord
+}{m: make(map[string]*SummaryRecord)}
+
+// Checks the summary dedup flags
+func setupSummaryDedup() error {
+	if *summaryRefresh < 0 || *tombstoneAfter < 1 {
+		return fmt.Errorf("-summary-refresh must be at least 0 and -tombstone-after at least 1")
+	}
+	return nil
+}
+
+// Reads the summary records of the previous runs, there are none on the first run
+func loadSummaryRecords(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	summaryRecords.Lock()
+	defer summaryRecords.Unlock()
+	if err := json.Unmarshal(data, &summaryRecords.m); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	// Records written before the vantage point was part of the key are this
+	// collector's
+	for key, record := range summaryRecords.m {
+		if !strings.Contains(key, " ") {
+			delete(summaryRecords.m, key)
+			summaryRecords.m[summaryKey(key)] = record
+		}
+	}
+	logger.Info("Summary records loaded", "file", path, "tracked", len(summaryRecords.m))
+	return nil
+}
+
+// Returns the key of the summary record of host, the records of each vantage
+// point kept apart so the summaries seen from one don't suppress another's
+func summaryKey(host string) string {
+	return event.Vantage() + " " + host
+}
+
+// Emits the summary of a host unless -summary-dedup has the same one emitted
+// less than -summary-refresh ago
+func emitSummary(summary event.Summary) {
+	if *summaryDedupFile == "" {
+		summaries.Emit(summary)
+		return
+	}
+	hash := hashSummary(summary)
+	now := time.Now()
+	summaryRecords.Lock()
+	key := summaryKey(summary.Host)
+	record, ok := summaryRecords.m[key]
+	if !ok {
+		record = &SummaryRecord{}
+		summaryRecords.m[key] = record
+	}
+	record.LastSeen = summary.Time
+	record.RunID = event.RunID
+	record.Missed = 0
+	emit := record.Hash != hash || *summaryRefresh > 0 && refreshDue(record.Emitted, now)
+	if emit {
+		record.Hash = hash
+		record.Emitted = summary.Time
+	}
+	summaryRecords.Unlock()
+	if !emit {
+		summariesUnchanged.Inc()
+		logger.Debug("Summary unchanged", "host", summary.Host)
+		return
+	}
+	summaries.Emit(summary)
+}
+
+// Returns true if a summary emitted at emitted is due to be emitted again
+func refreshDue(emitted string, now time.Time) bool {
+	at, err := time.Parse(event.TimeLayout, emitted)
+	return err != nil || now.Sub(at) >= *summaryRefresh
+}
+
+// Returns the hash of the content of a summary, leaving out the header, the
+// discovery sources found so far and the connect times, which vary between runs
+func hashSummary(summary event.Summary) string {
+	summary.Header = event.Header{}
+	summary.Discovery = nil
+	dualStack := make([]event.DualStack, len(summary.DualStack))
+	for i, probe := range summary.DualStack {
+		dualStack[i] = event.DualStack{Name: probe.Name, IPv4: withoutTime(probe.IPv4), IPv6: withoutTime(probe.IPv6)}
+	}
+	summary.DualStack = dualStack
+	data, _ := json.Marshal(summary)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns a copy of a reachability without its connect time
+func withoutTime(reachability *event.FamilyReachability) *event.FamilyReachability {
+	if reachability == nil {
+		return nil
+	}
+	copied := *reachability
+	copied.ConnectSeconds = 0
+	return &copied
+}
+
+// Counts a miss for every tracked host this run had no summary of, emitting
+// the tombstone of those missing -tombstone-after runs in a row and forgetting
+// them. Hosts only count as missing if they were crawled, or weren't found by
+// a crawl without limits, so interrupted and dry runs are left out.
+func emitTombstones() {
+	if *summaryDedupFile == "" || *dryRun || Stopped() {
+		return
+	}
+	limited := *maxDepth >= 0 || *maxHosts > 0 || *sampleRate < 1
+	summaryRecords.Lock()
+	defer summaryRecords.Unlock()
+	cache.RLock()
+	defer cache.RUnlock()
+	prefix := summaryKey("")
+	for key, record := range summaryRecords.m {
+		if record.RunID == event.RunID || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		host := strings.TrimPrefix(key, prefix)
+		if completed, found := cache.m[host]; found && !completed || !found && limited || !sampled(host) {
+			continue
+		}
+		if record.Missed++; record.Missed < *tombstoneAfter {
+			continue
+		}
+		summaries.Emit(event.Summary{
+			Header:    event.NewHeader(),
+			Host:      host,
+			Tombstone: true,
+			LastSeen:  record.LastSeen,
+		})
+		hostsGone.Inc()
+		logger.Debug("Host gone", "host", host, "last_seen", record.LastSeen)
+		delete(summaryRecords.m, key)
+	}
+}
+
+// Writes the summary records to path, through a temporary file so it is
+// never half written
+func writeSummaryRecords(path string) error {
+	summaryRecords.Lock()
+	data, err := json.MarshalIndent(summaryRecords.m, "", "  ")
+	summaryRecords.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
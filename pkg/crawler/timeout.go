@@ -0,0 +1,59 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Timeout flags
+var endpointTimeouts = endpointDurations{}
+
+func init() {
+	Flags.Var(endpointTimeouts, "endpoint-timeouts", "Per endpoint request timeouts overriding -timeout, e.g. summary=5s,results=2m")
+}
+
+// Context of every request to a host, cancelled when the crawl is stopped so
+// in-flight requests don't hold up the shutdown
+var crawlCtx, cancelCrawl = context.WithCancel(context.Background())
+
+// Flag holding durations keyed by endpoint name, given as name=value pairs
+type endpointDurations map[string]time.Duration
+
+func (e endpointDurations) String() string {
+	pairs := make([]string, 0, len(e))
+	for name, value := range e {
+		pairs = append(pairs, name+"="+value.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (e endpointDurations) Set(value string) error {
+	return parseEndpointPairs(value, func(name string, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid timeout %q for %s", value, name)
+		}
+		e[name] = d
+		return nil
+	})
+}
+
+// Returns the timeout of requests to endpoint
+func endpointTimeout(endpoint string) time.Duration {
+	if d, ok := endpointTimeouts[endpoint]; ok {
+		return d
+	}
+	return *httpx.Timeout
+}
+
+// Returns true once the crawl was stopped, the errors of its requests are
+// then cancellations rather than failures of the host
+func crawlCancelled() bool {
+	return crawlCtx.Err() != nil
+}
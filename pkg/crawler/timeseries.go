@@ -0,0 +1,226 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Time window and time series flags
+var since = Flags.String("since", "", "Start of the measurements read from esmond, an RFC 3339 time or a duration before now (default -esmond-time-range before -until)")
+var until = Flags.String("until", "", "End of the measurements read from esmond, an RFC 3339 time or a duration before now (default now)")
+var collectTimeSeries = Flags.Bool("timeseries", false, "Read the time series of every test of a host's esmond archive into the timeseries stream, one event per datapoint")
+var timeSeriesEventTypes = Flags.String("timeseries-event-types", "throughput,histogram-owdelay,packet-loss-rate", "Comma separated esmond event types read as time series")
+var timeSeriesWindows = summaryWindows{"throughput": 0, "histogram-owdelay": 300, "packet-loss-rate": 300}
+
+func init() {
+	Flags.Var(timeSeriesWindows, "timeseries-window", "Summary window in seconds of the time series, for every event type or per type as type=seconds pairs, 0 reads the base data")
+}
+
+// The time window measurements are read in, set from the flags in main
+var windowStart, windowEnd time.Time
+
+// Summary windows in seconds by event type, * being the catch-all
+type summaryWindows map[string]int
+
+func (w summaryWindows) String() string {
+	pairs := make([]string, 0, len(w))
+	for name, window := range w {
+		pairs = append(pairs, name+"="+strconv.Itoa(window))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (w summaryWindows) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		name := "*"
+		if len(kv) == 2 {
+			name = strings.TrimSpace(kv[0])
+		}
+		window, err := strconv.Atoi(strings.TrimSpace(kv[len(kv)-1]))
+		if err != nil || window < 0 {
+			return fmt.Errorf("invalid summary window %q", pair)
+		}
+		// A catch-all replaces the defaults
+		if name == "*" {
+			for eventType := range w {
+				delete(w, eventType)
+			}
+		}
+		w[name] = window
+	}
+	return nil
+}
+
+// Returns the summary window of eventType
+func (w summaryWindows) get(eventType string) int {
+	if window, ok := w[eventType]; ok {
+		return window
+	}
+	return w["*"]
+}
+
+// Parses -since and -until into the time window
+func setupTimeWindow() error {
+	now := time.Now()
+	var err error
+	windowEnd = now
+	if *until != "" {
+		if windowEnd, err = parseWindowTime(*until, now); err != nil {
+			return fmt.Errorf("invalid -until: %v", err)
+		}
+	}
+	windowStart = windowEnd.Add(-*esmondTimeRange)
+	if *since != "" {
+		if windowStart, err = parseWindowTime(*since, now); err != nil {
+			return fmt.Errorf("invalid -since: %v", err)
+		}
+	}
+	if !windowStart.Before(windowEnd) {
+		return fmt.Errorf("-since must be before -until")
+	}
+	return nil
+}
+
+// Parses an RFC 3339 time, or a duration before now
+func parseWindowTime(value string, now time.Time) (time.Time, error) {
+	if ago, err := time.ParseDuration(value); err == nil {
+		return now.Add(-ago), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Returns the esmond query parameters selecting the time window
+func windowQuery() url.Values {
+	return windowQueryFrom(windowStart)
+}
+
+// Returns the esmond query parameters selecting the time window from start
+func windowQueryFrom(start time.Time) url.Values {
+	return url.Values{
+		"format":     {"json"},
+		"time-start": {strconv.FormatInt(start.Unix(), 10)},
+		"time-end":   {strconv.FormatInt(windowEnd.Unix(), 10)},
+	}
+}
+
+// Reads the time series of every test in the host's esmond archive into the timeseries queue
+func crawlTimeSeries(host string, scheme string) {
+	archive := discovery.HostURL(scheme, host, esmondArchive)
+	for _, eventType := range strings.Split(*timeSeriesEventTypes, ",") {
+		eventType = strings.TrimSpace(eventType)
+		if eventType == "" || !eventTypeAllowed(eventType) {
+			continue
+		}
+		query := windowQuery()
+		query.Set("event-type", eventType)
+		logger.Debug("Getting time series", "host", host, "event_type", eventType)
+		metadata, ok := getEsmondMetadata(host, archive+"?"+query.Encode())
+		if !ok {
+			return
+		}
+		window := timeSeriesWindows.get(eventType)
+		for _, measurement := range metadata {
+			for _, stored := range measurement.EventTypes {
+				if stored.EventType != eventType || !archiveAllowed(measurement, eventType) {
+					continue
+				}
+				point := event.Datapoint{
+					Host:          host,
+					Archive:       archive,
+					MetadataKey:   measurement.MetadataKey,
+					Source:        measurement.Source,
+					Destination:   measurement.Destination,
+					ToolName:      measurement.ToolName,
+					EventType:     eventType,
+					SummaryWindow: window,
+				}
+				if window == 0 {
+					emitDatapoints(host, scheme, stored.BaseURI, point)
+					continue
+				}
+				for _, summary := range stored.Summaries {
+					if summary.SummaryWindow == strconv.Itoa(window) {
+						point.SummaryType = summary.SummaryType
+						emitDatapoints(host, scheme, summary.URI, point)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Fetches the datapoints at uri within the time window and queues an event for each
+func emitDatapoints(host string, scheme string, uri string, point event.Datapoint) {
+	start, ok := seriesStart("timeseries", host, uri, point.SummaryWindow > 0)
+	if !ok {
+		return
+	}
+	resp, err := fetch(host, endpointEsmond, discovery.HostURL(scheme, host, uri+"?"+windowQueryFrom(start).Encode()))
+	if err != nil {
+		logger.Warn("Getting time series failed", "host", host, "err", err)
+		return
+	}
+	defer httpx.CloseBody(resp)
+	var raw json.RawMessage
+	if err := httpx.DecodeShape(resp.Body, httpx.JSONArray, &raw); err != nil {
+		logger.Warn("Invalid time series", "host", host, "uri", uri, "err", err)
+		return
+	}
+	var data []struct {
+		TS  int64           `json:"ts"`
+		Val json.RawMessage `json:"val"`
+	}
+	adapted, _ := event.AdaptEsmondData(toolkitVersion(host), raw)
+	if err := json.Unmarshal(adapted, &data); err != nil {
+		logger.Warn("Invalid time series", "host", host, "uri", uri, "err", err)
+		return
+	}
+	// Numeric datapoints are rolled up when aggregating, the others kept
+	window := aggregateWindows.get(point.EventType)
+	rollup := make(map[int64][]float64)
+	var newest int64
+	for _, datapoint := range data {
+		if datapoint.TS > newest {
+			newest = datapoint.TS
+		}
+		var val interface{}
+		json.Unmarshal(datapoint.Val, &val)
+		value := event.SeriesValue(val)
+		if window > 0 && value != nil {
+			start := datapoint.TS - datapoint.TS%window
+			rollup[start] = append(rollup[start], *value)
+			continue
+		}
+		sample := point
+		sample.Header = event.NewHeader()
+		sample.Timestamp = datapoint.TS
+		sample.Value = datapoint.Val
+		setSeriesValue(&sample, value)
+		emitDatapoint(sample)
+	}
+	emitAggregates(point, window, rollup)
+	markSeries("timeseries", host, uri, newest)
+}
+
+// Sets the throughput, latency or loss of a datapoint by its event type
+func setSeriesValue(point *event.Datapoint, value *float64) {
+	switch point.EventType {
+	case "throughput":
+		point.Throughput = value
+	case "histogram-owdelay", "histogram-rtt":
+		point.Latency = value
+	case "packet-loss-rate":
+		point.Loss = value
+	}
+}
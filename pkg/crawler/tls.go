@@ -0,0 +1,99 @@
+package crawler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/bored-engineer/ps-splunk/pkg/discovery"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Protocol and TLS flags
+var scheme = Flags.String("scheme", "https-first", "Protocol used to reach hosts: https-first (falling back to http), https or http")
+var insecureSkipVerify = Flags.Bool("insecure-skip-verify", false, "Don't verify host certificates, needed for toolkits with self-signed certificates")
+var caBundle = Flags.String("ca-bundle", "", "PEM file of CA certificates trusted in addition to the system roots")
+var clientCert = Flags.String("client-cert", "", "PEM certificate presented to hosts asking for a client certificate")
+var clientKey = Flags.String("client-key", "", "PEM private key of -client-cert")
+
+// Returns the schemes tried for each host, in order
+func crawlSchemes() ([]string, error) {
+	switch *scheme {
+	case "https-first":
+		return []string{"https", "http"}, nil
+	case "https", "http":
+		return []string{*scheme}, nil
+	}
+	return nil, fmt.Errorf("invalid -scheme %q, expected https-first, https or http", *scheme)
+}
+
+// Builds the TLS configuration from the flags and installs it on the client
+func setupTLS() error {
+	config := &tls.Config{InsecureSkipVerify: *insecureSkipVerify}
+	// Trust the extra CAs on top of the system ones
+	if *caBundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(*caBundle)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", *caBundle)
+		}
+		config.RootCAs = pool
+	}
+	// Load the client certificate
+	if *clientCert != "" || *clientKey != "" {
+		if *clientCert == "" || *clientKey == "" {
+			return fmt.Errorf("-client-cert and -client-key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	Client.Transport = httpx.NewTransport(config)
+	return nil
+}
+
+// Requests path from host with each scheme in turn until one answers, falling
+// back immediately when a connection can't be made. Only the last scheme is
+// retried and recorded as failed. Returns the scheme the host answered on.
+func fetchScheme(host string, endpoint string, path string) (string, *http.Response, error) {
+	schemes, err := crawlSchemes()
+	if err != nil {
+		return "", nil, err
+	}
+	// Endpoints found on their own port are only tried with their scheme
+	if _, pinned := discovery.SplitKey(host); pinned != "" {
+		schemes = []string{pinned}
+	}
+	for _, scheme := range schemes[:len(schemes)-1] {
+		url := discovery.HostURL(scheme, host, path)
+		resp, err := get(host, endpoint, url)
+		if err != nil && (crawlCancelled() || skippedRequest(err)) {
+			return "", nil, err
+		}
+		if err != nil {
+			logger.Info("Falling back to the next scheme", "scheme", scheme, "host", host, "err", err)
+			continue
+		}
+		// The host speaks this scheme, so retry the status errors on it
+		if httpx.RetryableStatus(resp.StatusCode) {
+			httpx.CloseBody(resp)
+			resp, err = fetch(host, endpoint, url)
+		} else {
+			emitStatusError(host, endpoint, url, resp)
+		}
+		return scheme, resp, err
+	}
+	scheme := schemes[len(schemes)-1]
+	resp, err := fetch(host, endpoint, discovery.HostURL(scheme, host, path))
+	return scheme, resp, err
+}
@@ -0,0 +1,15 @@
+package crawler
+
+import "github.com/bored-engineer/ps-splunk/pkg/event"
+
+// Vantage point flags
+var collectorID = Flags.String("collector", "", "ID of this collector, in the collector field of every event (default the hostname)")
+var collectorSite = Flags.String("site", "", "Site of this collector, in the site field of every event, telling apart the vantage points of a multi-collector deployment")
+
+// Tags the events with the vantage point given by the flags
+func setupVantage() {
+	if *collectorID != "" {
+		event.Collector = *collectorID
+	}
+	event.Site = *collectorSite
+}
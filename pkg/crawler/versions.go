@@ -0,0 +1,50 @@
+package crawler
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Result normalization flags
+var rawResults = Flags.Bool("raw-results", false, "Keep the graphs tests and esmond datapoints as the host sent them under the raw field of the results, before the adapter of its toolkit version normalized them")
+
+// The toolkit version of each host crawled, picking the adapters of its results
+var toolkitVersions = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// Records the toolkit version host reported
+func setToolkitVersion(host string, version string) {
+	if version == "" {
+		return
+	}
+	toolkitVersions.Lock()
+	defer toolkitVersions.Unlock()
+	toolkitVersions.m[host] = version
+}
+
+// Returns the toolkit version of host, empty when it reported none and its
+// results are told apart by their shape
+func toolkitVersion(host string) string {
+	toolkitVersions.Lock()
+	defer toolkitVersions.Unlock()
+	return toolkitVersions.m[host]
+}
+
+// Returns the toolkit version of the archive read through host, central
+// archives reporting none
+func archiveVersion(host string, archive string) string {
+	if !ownArchive(host, archive) {
+		return ""
+	}
+	return toolkitVersion(host)
+}
+
+// Returns the payload kept under raw with -raw-results
+func rawPayload(raw json.RawMessage) json.RawMessage {
+	if !*rawResults {
+		return nil
+	}
+	return raw
+}
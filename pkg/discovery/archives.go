@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The measurement archive URLs named for each host by the lookup service MA
+// records and the mesh tests, keyed by the canonical name or address given
+var archiveMembers = struct {
+	sync.Mutex
+	m map[string]map[string]bool
+}{m: make(map[string]map[string]bool)}
+
+// Records that the archive at uri holds the measurements of host, unless uri
+// isn't an http or https URL
+func tagArchive(host string, uri string) {
+	uri = NormalizeArchive(uri)
+	if host = CanonicalHost(host); host == "" || uri == "" {
+		return
+	}
+	archiveMembers.Lock()
+	defer archiveMembers.Unlock()
+	if archiveMembers.m[host] == nil {
+		archiveMembers.m[host] = make(map[string]bool)
+	}
+	archiveMembers.m[host][uri] = true
+}
+
+// NormalizeArchive returns the URL of a measurement archive with a trailing
+// slash, or empty unless it is an http or https URL
+func NormalizeArchive(uri string) string {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+// Reports whether a lookup service record is a measurement archive
+func (r Record) isArchive() bool {
+	for _, serviceType := range r.ServiceType {
+		if serviceType == "ma" || serviceType == "esmond" {
+			return true
+		}
+	}
+	return false
+}
+
+// ArchivesOf returns the sorted measurement archive URLs the lookup services
+// and meshes name for the address of a host key or a name it was resolved
+// from
+func ArchivesOf(host string) []string {
+	address, _ := SplitKey(host)
+	address = CanonicalHost(address)
+	keys := append([]string{address}, NamesOf(address)...)
+	archiveMembers.Lock()
+	defer archiveMembers.Unlock()
+	seen := make(map[string]bool)
+	var archives []string
+	for _, key := range keys {
+		for uri := range archiveMembers.m[key] {
+			if !seen[uri] {
+				seen[uri] = true
+				archives = append(archives, uri)
+			}
+		}
+	}
+	sort.Strings(archives)
+	return archives
+}
@@ -0,0 +1,241 @@
+package discovery
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Unbounded FIFO of the URLs of a cache file waiting to be resolved, pushing
+// never blocks so the tarball is read at the pace of the network while its
+// hosts are resolved
+type cacheRows struct {
+	sync.Mutex
+	ready  *sync.Cond
+	urls   []string
+	closed bool
+}
+
+// Creates an empty row queue
+func newCacheRows() *cacheRows {
+	q := &cacheRows{}
+	q.ready = sync.NewCond(q)
+	return q
+}
+
+// Adds the URL of a row to the back of the queue
+func (q *cacheRows) push(url string) {
+	q.Lock()
+	q.urls = append(q.urls, url)
+	q.Unlock()
+	q.ready.Signal()
+}
+
+// Removes the URL at the front of the queue, waiting for one if it is empty.
+// Returns false once the queue is closed and empty.
+func (q *cacheRows) pop() (string, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.urls) == 0 && !q.closed {
+		q.ready.Wait()
+	}
+	if len(q.urls) == 0 {
+		return "", false
+	}
+	url := q.urls[0]
+	q.urls[0] = ""
+	q.urls = q.urls[1:]
+	return url, true
+}
+
+// Marks the end of the file, pop returns false once the queue is empty
+func (q *cacheRows) close() {
+	q.Lock()
+	q.closed = true
+	q.Unlock()
+	q.ready.Broadcast()
+}
+
+// Process the rows of a cache file as they are read
+func processCache(rows *cacheRows, origin string) {
+	defer wg.Done()
+	// Loop each record
+	for {
+		row, ok := rows.pop()
+		if !ok || Stopped() {
+			return
+		}
+		// Parse the url
+		url, err := url.Parse(row)
+		if err != nil {
+			logger.Debug("Invalid cache record", "origin", origin, "err", err)
+			continue
+		}
+		// If there was a host/port resolve it to an IP and queue
+		if url.Host != "" {
+			getIP(url.Scheme, url.Hostname(), url.Port(), origin)
+		}
+	}
+}
+
+// Cache tarballs already read, several hints files may list the same ones
+var cachesRead = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// Reads a given cache file listed by hints, unless another hints file listed
+// it first
+func getCache(hints string, cache string) error {
+	cachesRead.Lock()
+	read := cachesRead.m[cache]
+	cachesRead.m[cache] = true
+	cachesRead.Unlock()
+	if read {
+		logger.Debug("Skipping cache listed by several hints", "cache", cache, "hints", hints)
+		return nil
+	}
+	// Get the main lookup file
+	resp, err := httpx.Request(context.Background(), Client, cache, *httpx.Timeout)
+	if err != nil {
+		return sourceFailed("cache", cache, err)
+	}
+	defer httpx.CloseBody(resp)
+	// Un g-zip the tarball as it is received
+	gzf, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return sourceFailed("cache", cache, err)
+	}
+	// Create a tar reader
+	tarReader := tar.NewReader(gzf)
+	// Loop forever
+	for {
+		// Read the next file
+		header, err := tarReader.Next()
+		// If at end of tar, bail else bail with the error
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return sourceFailed("cache", cache, err)
+		}
+		// Depending on the type of entry
+		switch header.Typeflag {
+		case tar.TypeReg:
+			logger.Info("Processing cache file", "cache", cache, "file", header.Name)
+			origin := "cache," + header.Name + "," + cache
+			addSource(origin, event.DiscoverySource{Source: "cache", URL: hints, Cache: cache, File: header.Name})
+			rows := newCacheRows()
+			wg.Add(1)
+			go processCache(rows, origin)
+			skipped, err := readPSV(tarReader, func(record []string) {
+				if Registered != nil {
+					Registered(cacheRegistration(origin, header.Name, record))
+				}
+				rows.push(record[0])
+			})
+			rows.close()
+			if skipped > 0 {
+				logger.Warn("Skipped invalid cache rows", "cache", cache, "file", header.Name, "rows", skipped)
+			}
+			if err != nil {
+				return sourceFailed("cache", cache, err)
+			}
+		case tar.TypeDir:
+			continue
+		default:
+			break
+		}
+	}
+}
+
+// Returns the registration event of a cache row of file read from origin. The
+// files of the cache are named list.<service type>.
+func cacheRegistration(origin string, file string, record []string) event.Registration {
+	registration := event.Registration{
+		Header:       event.NewHeader(),
+		Discovery:    *SourceOf(origin),
+		Type:         "service",
+		Hosts:        []string{},
+		Locators:     []string{record[0]},
+		ServiceTypes: []string{strings.TrimPrefix(path.Base(file), "list.")},
+		Fields:       append([]string(nil), record[1:]...),
+	}
+	if u, err := url.Parse(record[0]); err == nil && u.Host != "" {
+		registration.Hosts = appendHost(registration.Hosts, EndpointKey(u.Scheme, u.Hostname(), u.Port()))
+	}
+	return registration
+}
+
+// Reads a cache file as PSV, calling row with every record as it arrives. The
+// record is reused by the next row. Only the URL of a row is used, so rows
+// are not checked to have the same number of fields and invalid ones are
+// skipped, an error reading the file ends it.
+func readPSV(file io.Reader, row func(record []string)) (skipped int, err error) {
+	r := csv.NewReader(file)
+	r.Comma = '|'
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return skipped, nil
+		} else if _, invalid := err.(*csv.ParseError); invalid {
+			skipped++
+			continue
+		} else if err != nil {
+			return skipped, err
+		}
+		row(record)
+	}
+}
+
+// Reads every cache listed by a hints file, failing when the hints file or
+// every cache it lists couldn't be read
+func getCaches(hints string) error {
+	// Get the hints file
+	resp, err := httpx.Request(context.Background(), Client, hints, *httpx.Timeout)
+	if err != nil {
+		return sourceFailed("hints", hints, err)
+	}
+	// Create a scanner for the body
+	scanner := bufio.NewScanner(resp.Body)
+	var caches sync.WaitGroup
+	var failures atomic.Int32
+	listed := 0
+	// For each newline
+	for scanner.Scan() {
+		// Get the information on that cache
+		cache := scanner.Text()
+		listed++
+		caches.Add(1)
+		go func() {
+			defer caches.Done()
+			if getCache(hints, cache) != nil {
+				failures.Add(1)
+			}
+		}()
+	}
+	httpx.CloseBody(resp)
+	err = scanner.Err()
+	caches.Wait()
+	if err != nil {
+		return sourceFailed("hints", hints, err)
+	}
+	if listed > 0 && int(failures.Load()) == listed {
+		return fmt.Errorf("%s: every cache failed", hints)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/flagvar"
+)
+
+// Community flags
+var communityFilter = flagvar.StringList{}
+
+func init() {
+	Flags.Var(&communityFilter, "community", "Only crawl the hosts of the lookup service records tagged with this community (group-communities, e.g. WLCG, case insensitive), repeat for several")
+}
+
+// The communities of the lookup service records naming each host, keyed by
+// the canonical name or address the records give
+var communityMembers = struct {
+	sync.Mutex
+	m map[string]map[string]bool
+}{m: make(map[string]map[string]bool)}
+
+// Checks that -community can be applied, only lookup service records carry
+// communities
+func setupCommunities() error {
+	if len(communityFilter) == 0 {
+		return nil
+	}
+	if *seedsFile != "" || len(meshURLs) > 0 || !strings.Contains(*source, "sls") {
+		return fmt.Errorf("-community needs the hosts discovered from the lookup services with -discovery sls or cache,sls")
+	}
+	return nil
+}
+
+// Records the communities of a record naming host
+func tagCommunities(host string, communities []string) {
+	if len(communities) == 0 {
+		return
+	}
+	host = CanonicalHost(host)
+	communityMembers.Lock()
+	defer communityMembers.Unlock()
+	if communityMembers.m[host] == nil {
+		communityMembers.m[host] = make(map[string]bool)
+	}
+	for _, community := range communities {
+		if community = strings.TrimSpace(community); community != "" {
+			communityMembers.m[host][community] = true
+		}
+	}
+}
+
+// Reports whether a record tagged with communities is crawled under
+// -community
+func inCommunities(communities []string) bool {
+	if len(communityFilter) == 0 {
+		return true
+	}
+	for _, community := range communities {
+		for _, wanted := range communityFilter {
+			if strings.EqualFold(strings.TrimSpace(community), strings.TrimSpace(wanted)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CommunitiesOf returns the sorted communities of the lookup service records
+// naming the address of a host key or a name it was resolved from
+func CommunitiesOf(host string) []string {
+	address, _ := SplitKey(host)
+	address = CanonicalHost(address)
+	keys := append([]string{address}, NamesOf(address)...)
+	communityMembers.Lock()
+	defer communityMembers.Unlock()
+	var communities []string
+	for _, key := range keys {
+		for community := range communityMembers.m[key] {
+			communities = append(communities, community)
+		}
+	}
+	sort.Strings(communities)
+	unique := communities[:0]
+	for i, community := range communities {
+		if i == 0 || community != communities[i-1] {
+			unique = append(unique, community)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,131 @@
+// Package discovery finds the perfSONAR hosts to crawl, from the lookup
+// service cache, the lookup service REST API, a seed list or mesh configs.
+package discovery
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/flagvar"
+	"github.com/bored-engineer/ps-splunk/pkg/logging"
+)
+
+// Flags of the discovery, merged into the command line by cmd/map
+var Flags = flag.NewFlagSet("discovery", flag.ContinueOnError)
+
+// Logger of the discovery
+var logger = logging.New("discovery")
+
+// Discovery flags
+var hintsURLs = flagvar.StringList{}
+var source = Flags.String("discovery", "cache", "Where hosts are discovered: cache (the -hints cache tarballs), sls (the lookup service REST API) or both as cache,sls, read concurrently")
+
+// Hints file read when no -hints is given
+const defaultHints = "http://www.perfsonar.net/ls.cache.hints"
+
+func init() {
+	Flags.Var(&hintsURLs, "hints", "URL of a lookup service cache hints file, repeat to read several concurrently (default "+defaultHints+")")
+}
+
+// Found is called with the key of every host discovered and where it was
+// found, the crawler sets it to queue the host
+var Found = func(host string, origin string) {}
+
+// Registered is called, when set, with every record of the caches and lookup
+// services read, expired ones included, before their hosts are resolved
+var Registered func(registration event.Registration)
+
+// Failed is called with every hints file, cache or lookup service that
+// couldn't be read and why, the crawler sets it to queue the error. The other
+// sources are still read.
+var Failed = func(source string, url string, err error) {}
+
+// Stopped reports whether the crawl is shutting down, discovery stops early
+// once it returns true
+var Stopped = func() bool { return false }
+
+// Client is used for every discovery request
+var Client = http.DefaultClient
+
+// Wait for the caches and lookup services being read
+var wg sync.WaitGroup
+
+// Setup checks the discovery flags and sets up the resolver
+func Setup() error {
+	for _, name := range strings.Split(*source, ",") {
+		if name = strings.TrimSpace(name); name != "cache" && name != "sls" {
+			return fmt.Errorf("invalid -discovery %q, expected cache, sls or cache,sls", *source)
+		}
+	}
+	if err := setupCommunities(); err != nil {
+		return err
+	}
+	return setupResolver()
+}
+
+// Run discovers the hosts to start the crawl from, unless they were listed,
+// and returns once every source has been read. The hints files and lookup
+// services are all read concurrently, failing only when every one does.
+func Run() error {
+	switch {
+	case *seedsFile != "" || len(meshURLs) > 0:
+		if *seedsFile != "" {
+			if err := getSeeds(*seedsFile); err != nil {
+				return err
+			}
+		}
+		if err := getMeshes(); err != nil {
+			return err
+		}
+	default:
+		// Each source counts as failed when it couldn't be read at all
+		var read sync.WaitGroup
+		var sources, failures atomic.Int32
+		readSource := func(get func() error) {
+			sources.Add(1)
+			read.Add(1)
+			go func() {
+				defer read.Done()
+				if get() != nil {
+					failures.Add(1)
+				}
+			}()
+		}
+		for _, name := range strings.Split(*source, ",") {
+			switch strings.TrimSpace(name) {
+			case "cache":
+				hints := hintsURLs
+				if len(hints) == 0 {
+					hints = []string{defaultHints}
+				}
+				for _, url := range hints {
+					url := url
+					readSource(func() error { return getCaches(url) })
+				}
+			case "sls":
+				readSource(getLookupServices)
+			}
+		}
+		read.Wait()
+		wg.Wait()
+		if failures.Load() == sources.Load() {
+			return errors.New("every source failed")
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+// Logs a hints file, cache or lookup service at url that couldn't be read and
+// passes it to Failed, returning err
+func sourceFailed(source string, url string, err error) error {
+	logger.Error("Reading discovery source failed", "source", source, "url", url, "err", err)
+	Failed(source, url, err)
+	return err
+}
@@ -0,0 +1,163 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CanonicalHost returns the form of a host used in events and as the cache key: addresses in
+// their canonical net/netip form without brackets (IPv4-mapped IPv6 addresses
+// become IPv4), names lower cased without the trailing dot
+func CanonicalHost(host string) string {
+	host = strings.TrimSpace(host)
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return addr.Unmap().String()
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// EndpointKey returns the cache key of the toolkit at host and port reached with scheme.
+// Hosts on the default port of http or https, or found through other
+// protocols, are keyed by their canonical form and crawled with -scheme. Others
+// are keyed by their scheme://host:port origin so every endpoint on a
+// non-standard port is crawled on its own.
+func EndpointKey(scheme string, host string, port string) string {
+	host = CanonicalHost(host)
+	switch scheme = strings.ToLower(scheme); {
+	case host == "" || port == "":
+		return host
+	case scheme == "http" && port != "80", scheme == "https" && port != "443":
+		return HostURL(scheme, host, ":"+port)
+	}
+	return host
+}
+
+// SplitKey splits a cache key into its host and the scheme it is pinned to, empty
+// unless the key is an origin made by EndpointKey
+func SplitKey(key string) (string, string) {
+	if !strings.Contains(key, "://") {
+		return key, ""
+	}
+	u, err := url.Parse(key)
+	if err != nil || u.Host == "" {
+		return key, ""
+	}
+	return CanonicalHost(u.Hostname()), u.Scheme
+}
+
+// HostURL builds the URL of path on host, IPv6 addresses are only bracketed here.
+// Endpoint keys pinned to an origin are used as they are.
+func HostURL(scheme string, host string, path string) string {
+	if strings.Contains(host, "://") {
+		return host + path
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && addr.Is6() {
+		host = "[" + strings.Replace(host, "%", "%25", 1) + "]"
+	}
+	return scheme + "://" + host + path
+}
+
+// Host names resolved by discovery and the addresses of each, and the names
+// every address was resolved from
+var resolvedNames = struct {
+	sync.Mutex
+	addrs map[string][]string
+	names map[string][]string
+}{addrs: make(map[string][]string), names: make(map[string][]string)}
+
+// Records the addresses a host name resolved to
+func addResolvedName(host string, addrs []string) {
+	if net.ParseIP(host) != nil || len(addrs) == 0 {
+		return
+	}
+	name := CanonicalHost(host)
+	resolvedNames.Lock()
+	defer resolvedNames.Unlock()
+	if _, ok := resolvedNames.addrs[name]; ok {
+		return
+	}
+	for _, addr := range addrs {
+		addr = CanonicalHost(addr)
+		resolvedNames.addrs[name] = append(resolvedNames.addrs[name], addr)
+		resolvedNames.names[addr] = append(resolvedNames.names[addr], name)
+	}
+}
+
+// NamesOf returns the sorted host names the address of a host key was
+// resolved from, none for hosts only listed by address
+func NamesOf(host string) []string {
+	address, _ := SplitKey(host)
+	resolvedNames.Lock()
+	defer resolvedNames.Unlock()
+	names := append([]string(nil), resolvedNames.names[CanonicalHost(address)]...)
+	sort.Strings(names)
+	return names
+}
+
+// AddressesOf returns the addresses a host name resolved to
+func AddressesOf(name string) []string {
+	resolvedNames.Lock()
+	defer resolvedNames.Unlock()
+	return resolvedNames.addrs[CanonicalHost(name)]
+}
+
+// Looks up a given string until it is resolved to an IP then queues it, along
+// with the endpoint of the scheme and port it was listed with
+func getIP(scheme string, host string, port string, origin string) {
+	addrs := ResolveHost(host)
+	addResolvedName(host, addrs)
+	for _, addr := range addrs {
+		// Add to results, with the endpoint on its own port if it has one
+		addSourceMember(addr, origin)
+		Found(addr, origin)
+		if key := EndpointKey(scheme, addr, port); key != CanonicalHost(addr) {
+			Found(key, origin)
+		}
+	}
+}
+
+// Appends a host key to hosts unless empty or listed
+func appendHost(hosts []string, key string) []string {
+	if key == "" {
+		return hosts
+	}
+	for _, host := range hosts {
+		if host == key {
+			return hosts
+		}
+	}
+	return append(hosts, key)
+}
+
+// ResolveHost returns the IPs of a host, an IP being its own. Timeouts and
+// server failures are retried, a host that doesn't exist isn't.
+func ResolveHost(host string) []string {
+	// Bail if none provided
+	if host == "" {
+		return nil
+	}
+	// Try to parse it as an IP, if fails look it up
+	if addr := net.ParseIP(host); addr != nil {
+		return []string{addr.String()}
+	}
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), *dnsTimeout)
+		addrs, err := resolver.LookupHost(ctx, host)
+		cancel()
+		if err == nil {
+			return addrs
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound || attempt >= *dnsRetries || Stopped() {
+			logger.Debug("Resolving host failed", "host", host, "attempts", attempt+1, "err", err)
+			return nil
+		}
+		logger.Debug("Retrying host resolution", "host", host, "err", err)
+	}
+}
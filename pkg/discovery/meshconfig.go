@@ -0,0 +1,467 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/flagvar"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Mesh discovery flags
+var meshURLs = flagvar.StringList{}
+
+func init() {
+	Flags.Var(&meshURLs, "mesh", "URL or file of a MaDDash MeshConfig or pSConfig JSON whose hosts are crawled instead of discovering them, repeat for several")
+}
+
+// Meshes read by getMeshes, kept for their expected tests
+var meshes struct {
+	sync.Mutex
+	list []*Mesh
+}
+
+// Mesh is a mesh config with its name and where it was read from
+type Mesh struct {
+	Name     string
+	Location string
+	Config   *MeshConfig
+}
+
+// Names of the meshes listing each address
+var meshMembers = struct {
+	sync.Mutex
+	m map[string]map[string]bool
+}{m: make(map[string]map[string]bool)}
+
+// MeshConfig is the subset of a legacy MeshConfig or a pSConfig listing hosts
+// and the tests run between them
+type MeshConfig struct {
+	Description string `json:"description"`
+	Meta        struct {
+		DisplayName string `json:"display-name"`
+	} `json:"_meta"`
+	// MeshConfig hosts, listed by organization and site
+	Organizations []struct {
+		Hosts    []meshHost    `json:"hosts"`
+		Archives []meshArchive `json:"measurement_archives"`
+		Sites    []struct {
+			Hosts    []meshHost    `json:"hosts"`
+			Archives []meshArchive `json:"measurement_archives"`
+		} `json:"sites"`
+	} `json:"organizations"`
+	Tests meshTests `json:"tests"`
+	// pSConfig hosts keyed by their name, and the tasks testing groups of them
+	Addresses map[string]meshAddress `json:"addresses"`
+	Groups    map[string]psGroup     `json:"groups"`
+	Tasks     map[string]psTask      `json:"tasks"`
+	Archives  map[string]psArchive   `json:"archives"`
+}
+
+// Tests of a mesh, a list in a MeshConfig and keyed by name in a pSConfig
+type meshTests struct {
+	legacy []meshTest
+	named  map[string]psTest
+}
+
+func (t *meshTests) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == httpx.JSONArray {
+		return json.Unmarshal(data, &t.legacy)
+	}
+	return json.Unmarshal(data, &t.named)
+}
+
+// MeshConfig test, its members paired as the type says
+type meshTest struct {
+	Description string `json:"description"`
+	Disabled    bool   `json:"disabled"`
+	Members     struct {
+		Type          string        `json:"type"`
+		Members       []meshAddress `json:"members"`
+		AMembers      []meshAddress `json:"a_members"`
+		BMembers      []meshAddress `json:"b_members"`
+		CenterAddress meshAddress   `json:"center_address"`
+	} `json:"members"`
+	Parameters struct {
+		Type string `json:"type"`
+	} `json:"parameters"`
+}
+
+// pSConfig group of addresses, referenced by name
+type psGroup struct {
+	Type           string         `json:"type"`
+	Unidirectional bool           `json:"unidirectional"`
+	Addresses      []psAddressRef `json:"addresses"`
+	AAddresses     []psAddressRef `json:"a-addresses"`
+	BAddresses     []psAddressRef `json:"b-addresses"`
+}
+
+type psAddressRef struct {
+	Name string `json:"name"`
+}
+
+// pSConfig task running a test between the addresses of a group, archived
+// to the archives it names
+type psTask struct {
+	Group    string   `json:"group"`
+	Test     string   `json:"test"`
+	Disabled bool     `json:"disabled"`
+	Archives []string `json:"archives"`
+}
+
+// pSConfig archive, esmond ones holding the URL of the archive
+type psArchive struct {
+	Archiver string `json:"archiver"`
+	Data     struct {
+		URL string `json:"url"`
+	} `json:"data"`
+}
+
+// MeshConfig measurement archive of the tests of a host, site or organization
+type meshArchive struct {
+	Type    string `json:"type"`
+	ReadURL string `json:"read_url"`
+}
+
+type psTest struct {
+	Type string `json:"type"`
+}
+
+type meshHost struct {
+	Addresses []meshAddress `json:"addresses"`
+	Archives  []meshArchive `json:"measurement_archives"`
+}
+
+// Address listed in a mesh, either a plain string or an object holding it
+type meshAddress string
+
+func (a *meshAddress) UnmarshalJSON(data []byte) error {
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		*a = meshAddress(address)
+		return nil
+	}
+	var object struct {
+		Address string `json:"address"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	*a = meshAddress(object.Address)
+	return nil
+}
+
+// Returns the name of the mesh, the location it was read from if it has none
+func (c *MeshConfig) name(location string) string {
+	if c.Meta.DisplayName != "" {
+		return c.Meta.DisplayName
+	}
+	if c.Description != "" {
+		return c.Description
+	}
+	return location
+}
+
+// Returns every address listed in the mesh, without duplicates
+func (c *MeshConfig) addresses() []string {
+	seen := make(map[string]bool)
+	var addresses []string
+	add := func(list ...meshAddress) {
+		for _, address := range list {
+			if a := strings.TrimSpace(string(address)); a != "" && !seen[a] {
+				seen[a] = true
+				addresses = append(addresses, a)
+			}
+		}
+	}
+	for _, organization := range c.Organizations {
+		for _, host := range organization.Hosts {
+			add(host.Addresses...)
+		}
+		for _, site := range organization.Sites {
+			for _, host := range site.Hosts {
+				add(host.Addresses...)
+			}
+		}
+	}
+	for _, test := range c.Tests.legacy {
+		add(test.Members.Members...)
+		add(test.Members.AMembers...)
+		add(test.Members.BMembers...)
+		add(test.Members.CenterAddress)
+	}
+	names := make([]string, 0, len(c.Addresses))
+	for name := range c.Addresses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(c.Addresses[name])
+	}
+	return addresses
+}
+
+// Returns the measurement archive URLs of the tests of every address of the
+// mesh: those of its MeshConfig host, site and organization, or the esmond
+// archives of its pSConfig tasks
+func (c *MeshConfig) archives() map[string][]string {
+	archives := make(map[string][]string)
+	add := func(hosts []meshHost, inherited ...[]meshArchive) {
+		for _, host := range hosts {
+			for _, list := range append(inherited, host.Archives) {
+				for _, archive := range list {
+					for _, address := range addressList(host.Addresses) {
+						archives[address] = append(archives[address], archive.ReadURL)
+					}
+				}
+			}
+		}
+	}
+	for _, organization := range c.Organizations {
+		add(organization.Hosts, organization.Archives)
+		for _, site := range organization.Sites {
+			add(site.Hosts, organization.Archives, site.Archives)
+		}
+	}
+	for _, task := range c.Tasks {
+		group, ok := c.Groups[task.Group]
+		if task.Disabled || !ok {
+			continue
+		}
+		for _, name := range task.Archives {
+			archive, ok := c.Archives[name]
+			if !ok || archive.Archiver != "esmond" {
+				continue
+			}
+			for _, refs := range [][]psAddressRef{group.Addresses, group.AAddresses, group.BAddresses} {
+				for _, ref := range refs {
+					if address := string(c.Addresses[ref.Name]); address != "" {
+						archives[address] = append(archives[address], archive.Data.URL)
+					}
+				}
+			}
+		}
+	}
+	return archives
+}
+
+// Queues the hosts of every -mesh, tagging them with the name of their mesh
+func getMeshes() error {
+	for _, location := range meshURLs {
+		config, err := readMeshConfig(location)
+		if err != nil {
+			return err
+		}
+		name := config.name(location)
+		meshes.Lock()
+		meshes.list = append(meshes.list, &Mesh{name, location, config})
+		meshes.Unlock()
+		addresses := config.addresses()
+		logger.Info("Read mesh", "mesh", name, "hosts", len(addresses))
+		for address, archives := range config.archives() {
+			for _, archive := range archives {
+				tagArchive(parseLocator(address).host, archive)
+			}
+		}
+		origin := "mesh," + name + "," + location
+		addSource(origin, event.DiscoverySource{Source: "mesh", URL: location})
+		for _, address := range addresses {
+			seed := parseLocator(address)
+			for _, addr := range ResolveHost(seed.host) {
+				tagMesh(addr, name)
+			}
+			getIP(seed.scheme, seed.host, seed.port, origin)
+		}
+	}
+	return nil
+}
+
+// Reads a mesh config from a URL or a file
+func readMeshConfig(location string) (*MeshConfig, error) {
+	var r io.Reader
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		resp, err := httpx.Request(context.Background(), Client, location, *httpx.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		defer httpx.CloseBody(resp)
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("%s: %s", location, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		file, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+	var config MeshConfig
+	if err := httpx.DecodeShape(r, httpx.JSONObject, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", location, err)
+	}
+	return &config, nil
+}
+
+// Records that address is listed in the mesh name
+func tagMesh(address string, name string) {
+	address = CanonicalHost(address)
+	meshMembers.Lock()
+	defer meshMembers.Unlock()
+	if meshMembers.m[address] == nil {
+		meshMembers.m[address] = make(map[string]bool)
+	}
+	meshMembers.m[address][name] = true
+}
+
+// MeshesOf returns the sorted names of the meshes listing the address of a
+// host key
+func MeshesOf(host string) []string {
+	address, _ := SplitKey(host)
+	meshMembers.Lock()
+	defer meshMembers.Unlock()
+	var names []string
+	for name := range meshMembers.m[CanonicalHost(address)] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Meshes returns the meshes read so far, in the order of -mesh
+func Meshes() []*Mesh {
+	meshes.Lock()
+	defer meshes.Unlock()
+	return append([]*Mesh(nil), meshes.list...)
+}
+
+// AddressKeys returns the forms an address of a mesh can be found under in
+// the archives: its canonical name and the addresses it resolves to
+func AddressKeys(address string) []string {
+	host := parseLocator(address).host
+	keys := append([]string{CanonicalHost(host)}, ResolveHost(host)...)
+	for i := range keys {
+		keys[i] = CanonicalHost(keys[i])
+	}
+	return keys
+}
+
+// Esmond event type holding the data of each test type, MeshConfig types being
+// mapped to their pSConfig names first
+var testEventTypes = map[string]string{
+	"throughput": "throughput",
+	"latencybg":  "histogram-owdelay",
+	"latency":    "histogram-owdelay",
+	"trace":      "packet-trace",
+	"rtt":        "histogram-rtt",
+}
+
+var legacyTestTypes = map[string]string{
+	"perfsonarbuoy/bwctl": "throughput",
+	"perfsonarbuoy/owamp": "latencybg",
+	"traceroute":          "trace",
+	"pinger":              "rtt",
+}
+
+// ExpectedTests returns the tests of the mesh between each pair of its hosts,
+// for the test types that store their data in esmond
+func (c *MeshConfig) ExpectedTests() []event.ExpectedTest {
+	var tests []event.ExpectedTest
+	add := func(task string, testType string, pairs [][2]string) {
+		eventType, ok := testEventTypes[testType]
+		if !ok {
+			return
+		}
+		for _, pair := range pairs {
+			tests = append(tests, event.ExpectedTest{
+				Task:        task,
+				TestType:    testType,
+				EventType:   eventType,
+				Source:      pair[0],
+				Destination: pair[1],
+			})
+		}
+	}
+	for _, test := range c.Tests.legacy {
+		if test.Disabled {
+			continue
+		}
+		members := test.Members
+		add(test.Description, legacyTestTypes[test.Parameters.Type], meshPairs(members.Type, addressList(members.Members),
+			addressList(members.AMembers), addressList(members.BMembers), string(members.CenterAddress), false))
+	}
+	tasks := make([]string, 0, len(c.Tasks))
+	for name := range c.Tasks {
+		tasks = append(tasks, name)
+	}
+	sort.Strings(tasks)
+	for _, name := range tasks {
+		task := c.Tasks[name]
+		group, ok := c.Groups[task.Group]
+		if task.Disabled || !ok {
+			continue
+		}
+		resolve := func(refs []psAddressRef) []string {
+			var addresses []string
+			for _, ref := range refs {
+				if address := string(c.Addresses[ref.Name]); address != "" {
+					addresses = append(addresses, address)
+				}
+			}
+			return addresses
+		}
+		add(name, c.Tests.named[task.Test].Type, meshPairs(group.Type, resolve(group.Addresses),
+			resolve(group.AAddresses), resolve(group.BAddresses), "", group.Unidirectional))
+	}
+	return tests
+}
+
+// Returns the source and destination of every test of a group: all ordered
+// pairs of a mesh, a to b (and back unless unidirectional) when disjoint, and
+// to and from the center of a star
+func meshPairs(kind string, members []string, a []string, b []string, center string, unidirectional bool) [][2]string {
+	var pairs [][2]string
+	add := func(sources []string, destinations []string) {
+		for _, source := range sources {
+			for _, destination := range destinations {
+				if source != destination {
+					pairs = append(pairs, [2]string{source, destination})
+				}
+			}
+		}
+	}
+	switch kind {
+	case "mesh", "ordered_mesh":
+		add(members, members)
+	case "disjoint":
+		add(a, b)
+		if !unidirectional {
+			add(b, a)
+		}
+	case "star":
+		if center != "" {
+			add([]string{center}, members)
+			add(members, []string{center})
+		}
+	}
+	return pairs
+}
+
+// Returns the trimmed mesh addresses that aren't empty
+func addressList(list []meshAddress) []string {
+	var addresses []string
+	for _, address := range list {
+		if a := strings.TrimSpace(string(address)); a != "" {
+			addresses = append(addresses, a)
+		}
+	}
+	return addresses
+}
@@ -0,0 +1,154 @@
+package discovery
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// The person records of the lookup services keyed by their URI
+var persons = struct {
+	sync.Mutex
+	m map[string]event.Admin
+}{m: make(map[string]event.Admin)}
+
+// The organization of the lookup service records naming each host, keyed by
+// the canonical name or address the records give
+var organizationMembers = struct {
+	sync.Mutex
+	m map[string]*event.Organization
+}{m: make(map[string]*event.Organization)}
+
+// Reads the person records of a lookup service, the administrators the host
+// and service records point to. When they can't be read the hosts are still
+// read, without their administrators.
+func getPersons(service string) {
+	logger.Info("Querying lookup service records", "type", "person", "service", service)
+	_ = readRecords(service, "person", func(record Record) {
+		if record.URI == "" {
+			return
+		}
+		persons.Lock()
+		persons.m[personKey(record.URI)] = event.Admin{
+			Name:         first(record.PersonName),
+			Emails:       record.PersonEmails,
+			Organization: first(record.Organization),
+		}
+		persons.Unlock()
+	})
+}
+
+// Returns the key of a person URI, the administrators of a record being given
+// relative to the lookup service or as URLs
+func personKey(uri string) string {
+	if i := strings.Index(uri, "lookup/"); i >= 0 {
+		return uri[i:]
+	}
+	return uri
+}
+
+// Records the site and administrators of a record naming host
+func tagOrganization(host string, record Record) {
+	org := event.Organization{
+		SiteName: first(record.SiteName),
+		City:     first(record.City),
+		State:    first(record.LocationState),
+		Country:  first(record.Country),
+		Domains:  append([]string(nil), record.Domains...),
+	}
+	persons.Lock()
+	for _, uri := range append(append([]string(nil), record.HostAdmins...), record.ServiceAdmins...) {
+		if admin, ok := persons.m[personKey(uri)]; ok {
+			org.Admins = append(org.Admins, admin)
+		}
+	}
+	persons.Unlock()
+	for _, admin := range org.Admins {
+		if admin.Organization != "" {
+			org.Organization = admin.Organization
+			break
+		}
+	}
+	if org.SiteName == "" && org.Organization == "" && org.City == "" && org.State == "" && org.Country == "" && len(org.Domains) == 0 && len(org.Admins) == 0 {
+		return
+	}
+	host = CanonicalHost(host)
+	organizationMembers.Lock()
+	defer organizationMembers.Unlock()
+	existing := organizationMembers.m[host]
+	switch {
+	case existing == nil:
+		organizationMembers.m[host] = &org
+	case first(record.Type) == "host":
+		// The host record is the authority on its site, services only fill in
+		mergeOrganization(&org, *existing)
+		*existing = org
+	default:
+		mergeOrganization(existing, org)
+	}
+}
+
+// Fills the fields of dst that are empty from src and adds the domains and
+// administrators it lacks
+func mergeOrganization(dst *event.Organization, src event.Organization) {
+	for _, field := range []struct{ dst, src *string }{
+		{&dst.SiteName, &src.SiteName},
+		{&dst.Organization, &src.Organization},
+		{&dst.City, &src.City},
+		{&dst.State, &src.State},
+		{&dst.Country, &src.Country},
+	} {
+		if *field.dst == "" {
+			*field.dst = *field.src
+		}
+	}
+	for _, domain := range src.Domains {
+		if !containsString(dst.Domains, domain) {
+			dst.Domains = append(dst.Domains, domain)
+		}
+	}
+	for _, admin := range src.Admins {
+		known := false
+		for _, other := range dst.Admins {
+			if other.Name == admin.Name && strings.Join(other.Emails, ",") == strings.Join(admin.Emails, ",") {
+				known = true
+				break
+			}
+		}
+		if !known {
+			dst.Admins = append(dst.Admins, admin)
+		}
+	}
+}
+
+// Reports whether values holds value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// OrganizationOf returns the site and administrators the lookup service
+// records naming the address of a host key, or a name it was resolved from,
+// register it with, nil when none does
+func OrganizationOf(host string) *event.Organization {
+	address, _ := SplitKey(host)
+	address = CanonicalHost(address)
+	keys := append([]string{address}, NamesOf(address)...)
+	organizationMembers.Lock()
+	defer organizationMembers.Unlock()
+	var org *event.Organization
+	for _, key := range keys {
+		if found := organizationMembers.m[key]; found != nil {
+			if org == nil {
+				org = &event.Organization{}
+			}
+			mergeOrganization(org, *found)
+		}
+	}
+	return org
+}
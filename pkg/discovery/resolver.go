@@ -0,0 +1,151 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Resolver flags
+var dnsServer = Flags.String("dns-server", "", "DNS server host names are resolved with instead of the system resolver: host:port (UDP then TCP), tls://host:853 (DNS over TLS) or an https:// DNS over HTTPS URL")
+var dnsTimeout = Flags.Duration("dns-timeout", 5*time.Second, "Timeout of each attempt to resolve a host name")
+var dnsRetries = Flags.Int("dns-retries", 2, "Number of times resolving a host name is retried after a timeout or server failure")
+
+// Resolver of the host names, Setup replaces it when -dns-server is given
+var resolver = net.DefaultResolver
+
+// Checks the resolver flags and sets up the resolver of -dns-server
+func setupResolver() error {
+	if *dnsTimeout <= 0 || *dnsRetries < 0 {
+		return fmt.Errorf("-dns-timeout must be positive and -dns-retries at least 0")
+	}
+	if *dnsServer == "" {
+		return nil
+	}
+	dial, err := dnsDialer(*dnsServer)
+	if err != nil {
+		return fmt.Errorf("invalid -dns-server %q: %v", *dnsServer, err)
+	}
+	resolver = &net.Resolver{PreferGo: true, Dial: dial}
+	return nil
+}
+
+// Returns how the resolver reaches server. Connections that aren't packet
+// connections get DNS messages framed by their length, as over TCP, which is
+// what DNS over TLS uses and what the DNS over HTTPS connections unwrap.
+func dnsDialer(server string) (func(ctx context.Context, network string, address string) (net.Conn, error), error) {
+	var dialer net.Dialer
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		// A plain host:port, over the network the resolver asks for
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, server)
+		}, nil
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		return func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, u.Scheme, u.Host)
+		}, nil
+	case "tls":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "853")
+		}
+		tlsDialer := &tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+		return func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return tlsDialer.DialContext(ctx, "tcp", host)
+		}, nil
+	case "https":
+		return func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return &dohConn{url: u.String()}, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("expected host:port, udp://, tcp://, tls:// or https://")
+}
+
+// Connection of the resolver to a DNS over HTTPS server: every length framed
+// message written is POSTed to the server and its answer read back framed
+type dohConn struct {
+	url      string
+	deadline time.Time
+	query    bytes.Buffer
+	answer   bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.query.Write(b)
+	for c.query.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.query.Bytes()))
+		if c.query.Len() < 2+size {
+			break
+		}
+		c.query.Next(2)
+		answer, err := c.exchange(c.query.Next(size))
+		if err != nil {
+			return 0, err
+		}
+		binary.Write(&c.answer, binary.BigEndian, uint16(len(answer)))
+		c.answer.Write(answer)
+	}
+	return len(b), nil
+}
+
+// Sends a DNS message to the server, returning its answer
+func (c *dohConn) exchange(query []byte) ([]byte, error) {
+	ctx := context.Background()
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	httpx.Identify(req)
+	resp, err := Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", c.url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.answer.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.answer.Read(b)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
+
+// Address of a DNS over HTTPS connection
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "https" }
+func (dohAddr) String() string  { return "doh" }
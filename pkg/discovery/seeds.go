@@ -0,0 +1,43 @@
+package discovery
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Seed flags
+var seedsFile = Flags.String("seeds", "", "File listing the hosts to start from instead of discovering them, one host, address or URL per line, - for stdin")
+
+// Queues the hosts listed in path, or stdin for -. Blank lines and # comments
+// are skipped, URLs keep their scheme and port like lookup service records.
+func getSeeds(path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	origin := "seeds," + path
+	addSource(origin, event.DiscoverySource{Source: "seeds", URL: path})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		seed := parseLocator(line)
+		getIP(seed.scheme, seed.host, seed.port, origin)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,309 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/flagvar"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Lookup service discovery flags
+var slsBootstrap = Flags.String("sls-bootstrap", "http://ps1.es.net:8096/lookup/activehosts.json", "URL of the list of active lookup services, used when no -sls-url is given")
+var slsURLs = flagvar.StringList{}
+var slsTypes = Flags.String("sls-types", "host,service", "Comma separated lookup service record types queried for hosts")
+var slsAdmins = Flags.Bool("sls-admins", true, "Read the person records of the lookup services first to add the organization and administrators of the hosts to their events")
+var slsPageSize = Flags.Int("sls-page-size", 0, "Records requested per page using skip/limit, 0 fetches each record type in a single request")
+
+func init() {
+	Flags.Var(&slsURLs, "sls-url", "Records URL of a lookup service to query, e.g. http://ps-west.es.net:8090/lookup/records, repeat for several")
+}
+
+// Record is the subset of a lookup service record used for discovery and
+// its registration events
+type Record struct {
+	Type           []string `json:"type"`
+	URI            string   `json:"uri"`
+	Expires        string   `json:"expires"`
+	State          []string `json:"state"`
+	ClientUUID     []string `json:"client-uuid"`
+	HostName       []string `json:"host-name"`
+	ServiceLocator []string `json:"service-locator"`
+	ServiceType    []string `json:"service-type"`
+	ServiceName    []string `json:"service-name"`
+	Communities    []string `json:"group-communities"`
+	Domains        []string `json:"group-domains"`
+	SiteName       []string `json:"location-sitename"`
+	City           []string `json:"location-city"`
+	LocationState  []string `json:"location-state"`
+	Country        []string `json:"location-country"`
+	ToolkitVersion []string `json:"pshost-toolkitversion"`
+	HostAdmins     []string `json:"host-administrators"`
+	ServiceAdmins  []string `json:"service-administrators"`
+	PersonName     []string `json:"person-name"`
+	PersonEmails   []string `json:"person-emails"`
+	Organization   []string `json:"person-organization"`
+}
+
+// Bootstrap list of the lookup services
+type activeHosts struct {
+	Hosts []struct {
+		Locator string `json:"locator"`
+		Status  string `json:"status"`
+	} `json:"hosts"`
+}
+
+// Queries every lookup service for each record type, failing when the lookup
+// services couldn't be listed or none of them could be read
+func getLookupServices() error {
+	services := slsURLs
+	if len(services) == 0 {
+		var err error
+		if services, err = getActiveLookupServices(*slsBootstrap); err != nil {
+			return sourceFailed("sls", *slsBootstrap, err)
+		}
+	}
+	var read sync.WaitGroup
+	var failures atomic.Int32
+	for _, service := range services {
+		service := service
+		read.Add(1)
+		go func() {
+			defer read.Done()
+			if getServiceRecords(service) != nil {
+				failures.Add(1)
+			}
+		}()
+	}
+	read.Wait()
+	if len(services) > 0 && int(failures.Load()) == len(services) {
+		return errors.New("every lookup service failed")
+	}
+	return nil
+}
+
+// Queries a lookup service for each record type, once its person records are
+// read so the hosts are joined with their administrators. Fails when no record
+// type could be read.
+func getServiceRecords(service string) error {
+	if *slsAdmins {
+		getPersons(service)
+	}
+	var read sync.WaitGroup
+	var failures atomic.Int32
+	queried := 0
+	for _, recordType := range strings.Split(*slsTypes, ",") {
+		if recordType = strings.TrimSpace(recordType); recordType == "" {
+			continue
+		}
+		logger.Info("Querying lookup service records", "type", recordType, "service", service)
+		queried++
+		read.Add(1)
+		go func(recordType string) {
+			defer read.Done()
+			if getRecords(service, recordType) != nil {
+				failures.Add(1)
+			}
+		}(recordType)
+	}
+	read.Wait()
+	if queried > 0 && int(failures.Load()) == queried {
+		return fmt.Errorf("%s: every record type failed", service)
+	}
+	return nil
+}
+
+// Returns the records URLs of the alive lookup services in the bootstrap list
+func getActiveLookupServices(bootstrap string) ([]string, error) {
+	resp, err := httpx.Request(context.Background(), Client, bootstrap, *httpx.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer httpx.CloseBody(resp)
+	var active activeHosts
+	if err := json.NewDecoder(resp.Body).Decode(&active); err != nil {
+		return nil, fmt.Errorf("%s: %v", bootstrap, err)
+	}
+	var services []string
+	for _, host := range active.Hosts {
+		if host.Status == "alive" && host.Locator != "" {
+			services = append(services, host.Locator)
+		}
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("%s: no alive lookup services", bootstrap)
+	}
+	return services, nil
+}
+
+// Fetches all the records of a type from a lookup service and queues their
+// hosts
+func getRecords(service string, recordType string) error {
+	origin := "sls," + recordType + "," + service
+	addSource(origin, event.DiscoverySource{Source: "sls", URL: service, RecordType: recordType})
+	now := time.Now()
+	return readRecords(service, recordType, func(record Record) {
+		expired := record.expired(now)
+		if Registered != nil {
+			Registered(record.registration(origin, recordType, expired))
+		}
+		if expired {
+			return
+		}
+		// The communities, organization and archives are kept for every
+		// host, only those of -community being crawled
+		locators := record.locators()
+		for _, locator := range locators {
+			tagCommunities(locator.host, record.Communities)
+			tagOrganization(locator.host, record)
+		}
+		if record.isArchive() {
+			for _, service := range record.ServiceLocator {
+				tagArchive(parseLocator(service).host, service)
+			}
+		}
+		if !inCommunities(record.Communities) {
+			return
+		}
+		for _, locator := range locators {
+			getIP(locator.scheme, locator.host, locator.port, origin)
+		}
+	})
+}
+
+// Calls each with every record of a type from a lookup service, page by page,
+// until discovery stops. Fails when a page couldn't be read.
+func readRecords(service string, recordType string, each func(record Record)) error {
+	for skip := 0; ; skip += *slsPageSize {
+		// Build the query
+		query, err := url.Parse(service)
+		if err != nil {
+			return sourceFailed("sls", service, err)
+		}
+		params := query.Query()
+		params.Set("type", recordType)
+		if *slsPageSize > 0 {
+			params.Set("skip", strconv.Itoa(skip))
+			params.Set("limit", strconv.Itoa(*slsPageSize))
+		}
+		query.RawQuery = params.Encode()
+		// Fetch the page
+		resp, err := httpx.Request(context.Background(), Client, query.String(), *httpx.Timeout)
+		if err != nil {
+			return sourceFailed("sls", query.String(), err)
+		}
+		var records []Record
+		err = json.NewDecoder(resp.Body).Decode(&records)
+		httpx.CloseBody(resp)
+		if err != nil {
+			return sourceFailed("sls", query.String(), err)
+		}
+		for _, record := range records {
+			if Stopped() {
+				return nil
+			}
+			each(record)
+		}
+		// A short page is the last one
+		if *slsPageSize <= 0 || len(records) < *slsPageSize {
+			return nil
+		}
+	}
+}
+
+// Returns true if the lease of the record ran out before now
+func (r Record) expired(now time.Time) bool {
+	for _, state := range r.State {
+		if state == "expired" || state == "deleted" {
+			return true
+		}
+	}
+	if r.Expires == "" {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339Nano, r.Expires)
+	return err == nil && expires.Before(now)
+}
+
+// Returns the registration event of the record read from origin
+func (r Record) registration(origin string, recordType string, expired bool) event.Registration {
+	registration := event.Registration{
+		Header:         event.NewHeader(),
+		Discovery:      *SourceOf(origin),
+		Type:           first(r.Type),
+		Hosts:          []string{},
+		Locators:       append(append([]string(nil), r.HostName...), r.ServiceLocator...),
+		ServiceTypes:   r.ServiceType,
+		Names:          r.ServiceName,
+		Communities:    r.Communities,
+		Domains:        r.Domains,
+		SiteName:       first(r.SiteName),
+		City:           first(r.City),
+		Country:        first(r.Country),
+		ToolkitVersion: first(r.ToolkitVersion),
+		Administrators: append(append([]string(nil), r.HostAdmins...), r.ServiceAdmins...),
+		URI:            r.URI,
+		ClientUUID:     first(r.ClientUUID),
+		Expires:        r.Expires,
+		State:          first(r.State),
+		Expired:        expired,
+	}
+	if registration.Type == "" {
+		registration.Type = recordType
+	}
+	for _, l := range r.locators() {
+		registration.Hosts = appendHost(registration.Hosts, EndpointKey(l.scheme, l.host, l.port))
+	}
+	return registration
+}
+
+// Returns the first value of a record field, or empty
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Where a record says a host can be reached, the scheme and port are only
+// known for service locators
+type locator struct {
+	scheme string
+	host   string
+	port   string
+}
+
+// Returns the host names and addresses mentioned by the record
+func (r Record) locators() []locator {
+	var locators []locator
+	for _, host := range r.HostName {
+		locators = append(locators, locator{host: host})
+	}
+	for _, service := range r.ServiceLocator {
+		if l := parseLocator(service); l.host != "" {
+			locators = append(locators, l)
+		}
+	}
+	return locators
+}
+
+// Parses a service locator, either a URL or a host:port pair
+func parseLocator(service string) locator {
+	if u, err := url.Parse(service); err == nil && u.Host != "" {
+		return locator{scheme: u.Scheme, host: u.Hostname(), port: u.Port()}
+	}
+	if host, port, err := net.SplitHostPort(service); err == nil {
+		return locator{host: host, port: port}
+	}
+	return locator{host: strings.Trim(service, "[]")}
+}
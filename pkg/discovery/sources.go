@@ -0,0 +1,67 @@
+package discovery
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// The discovery sources keyed by the origin of the hosts they found, and the
+// origins that found each address
+var sources = struct {
+	sync.Mutex
+	m       map[string]event.DiscoverySource
+	members map[string]map[string]bool
+}{m: make(map[string]event.DiscoverySource), members: make(map[string]map[string]bool)}
+
+// Registers the discovery source of origin, the first one registered is kept
+func addSource(origin string, source event.DiscoverySource) {
+	sources.Lock()
+	defer sources.Unlock()
+	if _, ok := sources.m[origin]; !ok {
+		sources.m[origin] = source
+	}
+}
+
+// Records that origin found the address of a host key
+func addSourceMember(host string, origin string) {
+	address, _ := SplitKey(host)
+	address = CanonicalHost(address)
+	sources.Lock()
+	defer sources.Unlock()
+	if sources.members[address] == nil {
+		sources.members[address] = make(map[string]bool)
+	}
+	sources.members[address][origin] = true
+}
+
+// SourceOf returns the discovery source of origin, nil when origin is a
+// crawled host
+func SourceOf(origin string) *event.DiscoverySource {
+	sources.Lock()
+	defer sources.Unlock()
+	source, ok := sources.m[origin]
+	if !ok {
+		return nil
+	}
+	return &source
+}
+
+// SourcesOf returns the discovery sources that found the address of a host
+// key, sorted by their origin
+func SourcesOf(host string) []event.DiscoverySource {
+	address, _ := SplitKey(host)
+	sources.Lock()
+	defer sources.Unlock()
+	var origins []string
+	for origin := range sources.members[CanonicalHost(address)] {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	var found []event.DiscoverySource
+	for _, origin := range origins {
+		found = append(found, sources.m[origin])
+	}
+	return found
+}
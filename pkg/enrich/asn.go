@@ -0,0 +1,425 @@
+package enrich
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// ASN enrichment flags
+var asnDB = Flags.String("asn-db", "", "Database mapping addresses to their origin AS: a MaxMind GeoLite2-ASN .mmdb, a pyasn dump or an MRT TABLE_DUMP_V2 RIB (optionally .gz or .bz2)")
+var asnDBFormat = Flags.String("asn-db-format", "auto", "Format of -asn-db: auto (from the file name), mmdb, pyasn or mrt")
+var asnNames = Flags.String("asn-names", "", "pyasn style JSON file of AS names keyed by AS number, used with pyasn and MRT databases")
+var asnWhois = Flags.String("asn-whois", "", "Team Cymru whois server (e.g. whois.cymru.com:43) queried for addresses the database does not cover")
+
+// ASN is the network originating an address
+type ASN struct {
+	Number uint32 `json:"number"`
+	Name   string `json:"name,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// The opened ASN sources, all nil or empty when disabled
+var asnMMDB *mmdbReader
+var asnTable *prefixTable
+var asnNameMap map[uint32]string
+
+// Whois answers by address, including misses, so each address is asked once
+var asnWhoisCache = struct {
+	sync.Mutex
+	m map[netip.Addr]*ASN
+}{m: make(map[netip.Addr]*ASN)}
+
+// Longest prefix match table of announced prefixes to origin AS numbers,
+// kept as one map per prefix length
+type prefixTable struct {
+	v4 [33]map[netip.Prefix]uint32
+	v6 [129]map[netip.Prefix]uint32
+}
+
+// Adds an announced prefix, the first origin seen for a prefix is kept
+func (t *prefixTable) insert(prefix netip.Prefix, asn uint32) {
+	prefix = prefix.Masked()
+	maps := t.v6[:]
+	if prefix.Addr().Is4() {
+		maps = t.v4[:]
+	}
+	bits := prefix.Bits()
+	if maps[bits] == nil {
+		maps[bits] = make(map[netip.Prefix]uint32)
+	}
+	if _, ok := maps[bits][prefix]; !ok {
+		maps[bits][prefix] = asn
+	}
+}
+
+// Returns the most specific prefix containing an address and its origin
+func (t *prefixTable) lookup(addr netip.Addr) (netip.Prefix, uint32, bool) {
+	maps := t.v6[:]
+	if addr.Is4() {
+		maps = t.v4[:]
+	}
+	for bits := len(maps) - 1; bits >= 0; bits-- {
+		if maps[bits] == nil {
+			continue
+		}
+		prefix := netip.PrefixFrom(addr, bits).Masked()
+		if asn, ok := maps[bits][prefix]; ok {
+			return prefix, asn, true
+		}
+	}
+	return netip.Prefix{}, 0, false
+}
+
+// Opens the ASN database and names if given
+func setupASN() error {
+	if *asnNames != "" {
+		if err := loadASNames(*asnNames); err != nil {
+			return err
+		}
+	}
+	if *asnDB == "" {
+		return nil
+	}
+	// Guess the format from the file name
+	format := *asnDBFormat
+	if format == "auto" {
+		name := strings.ToLower(*asnDB)
+		name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".bz2")
+		switch {
+		case strings.HasSuffix(name, ".mmdb"):
+			format = "mmdb"
+		case strings.HasSuffix(name, ".mrt") || strings.Contains(name, "rib."):
+			format = "mrt"
+		default:
+			format = "pyasn"
+		}
+	}
+	switch format {
+	case "mmdb":
+		reader, err := openMMDB(*asnDB)
+		if err != nil {
+			return err
+		}
+		logger.Info("Loaded ASN database", "database", reader.description)
+		asnMMDB = reader
+		return nil
+	case "pyasn", "mrt":
+		table := &prefixTable{}
+		var count int
+		var err error
+		if format == "pyasn" {
+			count, err = loadPyASN(*asnDB, table)
+		} else {
+			count, err = loadMRT(*asnDB, table)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", *asnDB, err)
+		}
+		logger.Info("Loaded ASN database", "database", *asnDB, "prefixes", count)
+		asnTable = table
+		return nil
+	}
+	return fmt.Errorf("invalid -asn-db-format %q, expected auto, mmdb, pyasn or mrt", *asnDBFormat)
+}
+
+// Opens a file, decompressing it according to its extension
+func openCompressed(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = bufio.NewReader(f)
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		r = gz
+	case strings.HasSuffix(path, ".bz2"):
+		r = bzip2.NewReader(r)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// Reads a pyasn AS names file, a JSON object of names keyed by AS number
+func loadASNames(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var names map[string]string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	asnNameMap = make(map[uint32]string, len(names))
+	for number, name := range names {
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(number), "AS"), 10, 32)
+		if err != nil {
+			continue
+		}
+		asnNameMap[uint32(asn)] = name
+	}
+	return nil
+}
+
+// Reads a pyasn IPASN dump: one "prefix<TAB>asn" per line, ; starts a comment
+func loadPyASN(path string, table *prefixTable) (int, error) {
+	f, err := openCompressed(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, ";") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return count, fmt.Errorf("%d: expected prefix and AS number", line)
+		}
+		prefix, err := netip.ParsePrefix(fields[0])
+		if err != nil {
+			return count, fmt.Errorf("%d: %v", line, err)
+		}
+		// Multi origin prefixes are written as sets, keep the first
+		number := strings.Trim(fields[1], "{}")
+		if i := strings.Index(number, ","); i >= 0 {
+			number = number[:i]
+		}
+		asn, err := strconv.ParseUint(number, 10, 32)
+		if err != nil {
+			return count, fmt.Errorf("%d: invalid AS number %q", line, fields[1])
+		}
+		table.insert(prefix, uint32(asn))
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// Reads the unicast RIB entries of an MRT TABLE_DUMP_V2 file (RFC 6396), the
+// origin of a prefix being the last AS in the path of its first entry
+func loadMRT(path string, table *prefixTable) (int, error) {
+	f, err := openCompressed(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	count := 0
+	header := make([]byte, 12)
+	for {
+		// Common header: timestamp, type, subtype and length
+		if _, err := io.ReadFull(f, header); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+		kind := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+		if _, err := io.ReadFull(f, body); err != nil {
+			return count, err
+		}
+		// Only RIB_IPV4_UNICAST and RIB_IPV6_UNICAST matter
+		if kind != 13 || (subtype != 2 && subtype != 4) {
+			continue
+		}
+		prefix, asn, ok := parseMRTRIB(body, subtype == 4)
+		if !ok {
+			continue
+		}
+		table.insert(prefix, asn)
+		count++
+	}
+}
+
+// Decodes the prefix and origin AS of a RIB record
+func parseMRTRIB(body []byte, ipv6 bool) (netip.Prefix, uint32, bool) {
+	// Sequence number then the prefix length and its significant bytes
+	if len(body) < 5 {
+		return netip.Prefix{}, 0, false
+	}
+	bits := int(body[4])
+	size := (bits + 7) / 8
+	if len(body) < 5+size+2 {
+		return netip.Prefix{}, 0, false
+	}
+	var addr netip.Addr
+	if ipv6 {
+		var b [16]byte
+		if size > 16 {
+			return netip.Prefix{}, 0, false
+		}
+		copy(b[:], body[5:5+size])
+		addr = netip.AddrFrom16(b)
+	} else {
+		var b [4]byte
+		if size > 4 {
+			return netip.Prefix{}, 0, false
+		}
+		copy(b[:], body[5:5+size])
+		addr = netip.AddrFrom4(b)
+	}
+	prefix := netip.PrefixFrom(addr, bits)
+	// Then one entry per peer: peer index, originated time and attributes
+	entries := int(binary.BigEndian.Uint16(body[5+size:]))
+	rest := body[5+size+2:]
+	for i := 0; i < entries && len(rest) >= 8; i++ {
+		length := int(binary.BigEndian.Uint16(rest[6:8]))
+		if len(rest) < 8+length {
+			break
+		}
+		if asn := bgpOriginAS(rest[8 : 8+length]); asn != 0 {
+			return prefix, asn, true
+		}
+		rest = rest[8+length:]
+	}
+	return netip.Prefix{}, 0, false
+}
+
+// Returns the origin AS from the AS_PATH of BGP path attributes, MRT always
+// encodes AS numbers with four bytes
+func bgpOriginAS(attributes []byte) uint32 {
+	for len(attributes) >= 3 {
+		flags, kind := attributes[0], attributes[1]
+		// The extended length flag makes the length two bytes
+		offset, length := 3, int(attributes[2])
+		if flags&0x10 != 0 {
+			if len(attributes) < 4 {
+				return 0
+			}
+			offset, length = 4, int(binary.BigEndian.Uint16(attributes[2:4]))
+		}
+		if len(attributes) < offset+length {
+			return 0
+		}
+		value := attributes[offset : offset+length]
+		attributes = attributes[offset+length:]
+		if kind != 2 {
+			continue
+		}
+		// The origin ends the last AS_SEQUENCE, or is any member of a final AS_SET
+		origin := uint32(0)
+		for len(value) >= 2 {
+			segment, n := value[0], int(value[1])
+			if len(value) < 2+n*4 {
+				break
+			}
+			if n > 0 {
+				switch segment {
+				case 1:
+					origin = binary.BigEndian.Uint32(value[2:])
+				case 2:
+					origin = binary.BigEndian.Uint32(value[2+(n-1)*4:])
+				}
+			}
+			value = value[2+n*4:]
+		}
+		return origin
+	}
+	return 0
+}
+
+// LookupASN returns the origin network of an address, or nil if it is unknown
+func LookupASN(address string) *ASN {
+	if asnMMDB == nil && asnTable == nil && *asnWhois == "" {
+		return nil
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	if asnMMDB != nil {
+		record, bits, err := asnMMDB.lookup(net.IP(addr.AsSlice()))
+		if err != nil {
+			logger.Warn("ASN lookup failed", "address", address, "err", err)
+		} else if number := mmdbUint(mmdbPath(record, "autonomous_system_number")); number != 0 {
+			asn := &ASN{Number: uint32(number), Prefix: netip.PrefixFrom(addr, bits).Masked().String()}
+			asn.Name, _ = mmdbPath(record, "autonomous_system_organization").(string)
+			return asn
+		}
+	}
+	if asnTable != nil {
+		if prefix, number, ok := asnTable.lookup(addr); ok {
+			return &ASN{Number: number, Name: asnNameMap[number], Prefix: prefix.String()}
+		}
+	}
+	if *asnWhois != "" {
+		return whoisASN(addr)
+	}
+	return nil
+}
+
+// Asks the Team Cymru whois service for the origin of an address
+func whoisASN(addr netip.Addr) *ASN {
+	asnWhoisCache.Lock()
+	asn, ok := asnWhoisCache.m[addr]
+	asnWhoisCache.Unlock()
+	if ok {
+		return asn
+	}
+	asn, err := queryCymru(*asnWhois, addr)
+	if err != nil {
+		logger.Warn("ASN whois failed", "address", addr, "err", err)
+		return nil
+	}
+	asnWhoisCache.Lock()
+	asnWhoisCache.m[addr] = asn
+	asnWhoisCache.Unlock()
+	return asn
+}
+
+// Sends a verbose bulk query, answered with a header and one line like
+// "AS | IP | BGP Prefix | CC | Registry | Allocated | AS Name"
+func queryCymru(server string, addr netip.Addr) (*ASN, error) {
+	conn, err := net.DialTimeout("tcp", server, *httpx.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(*httpx.Timeout))
+	if _, err := fmt.Fprintf(conn, "begin\nverbose\n%s\nend\n", addr); err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) < 7 {
+			continue
+		}
+		number, err := strconv.ParseUint(strings.TrimSpace(fields[0]), 10, 32)
+		if err != nil {
+			// Either the header or NA for unannounced addresses
+			continue
+		}
+		return &ASN{
+			Number: uint32(number),
+			Name:   strings.TrimSpace(fields[6]),
+			Prefix: strings.TrimSpace(fields[2]),
+		}, nil
+	}
+	return nil, scanner.Err()
+}
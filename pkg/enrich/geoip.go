@@ -0,0 +1,83 @@
+// Package enrich locates hosts and finds the network originating them, from
+// MaxMind databases, pyasn and MRT dumps or Team Cymru's whois.
+package enrich
+
+import (
+	"flag"
+	"net"
+
+	"github.com/bored-engineer/ps-splunk/pkg/logging"
+)
+
+// Flags of the enrichments
+var Flags = flag.NewFlagSet("enrich", flag.ContinueOnError)
+
+// Logger of the enrichment
+var logger = logging.New("enrich")
+
+// Enrichment flags
+var geoipDB = Flags.String("geoip-db", "", "MaxMind GeoIP2/GeoLite2 City or Country database (.mmdb) used to locate every host")
+
+// The opened GeoIP database, nil when disabled
+var geoip *mmdbReader
+
+// GeoIP is the location of an address according to the GeoIP database
+type GeoIP struct {
+	CountryCode string   `json:"country_code,omitempty"`
+	Country     string   `json:"country,omitempty"`
+	City        string   `json:"city,omitempty"`
+	Latitude    *float64 `json:"latitude,omitempty"`
+	Longitude   *float64 `json:"longitude,omitempty"`
+}
+
+// Setup opens the GeoIP and ASN databases that were given
+func Setup() error {
+	if err := setupGeoIP(); err != nil {
+		return err
+	}
+	return setupASN()
+}
+
+// Opens the GeoIP database if one was given
+func setupGeoIP() error {
+	if *geoipDB == "" {
+		return nil
+	}
+	reader, err := openMMDB(*geoipDB)
+	if err != nil {
+		return err
+	}
+	logger.Info("Loaded GeoIP database", "database", reader.description)
+	geoip = reader
+	return nil
+}
+
+// LookupGeoIP returns the location of an address, or nil if it is unknown
+func LookupGeoIP(address string) *GeoIP {
+	if geoip == nil {
+		return nil
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+	record, _, err := geoip.lookup(ip)
+	if err != nil {
+		logger.Warn("GeoIP lookup failed", "address", address, "err", err)
+		return nil
+	}
+	if record == nil {
+		return nil
+	}
+	geo := &GeoIP{}
+	geo.CountryCode, _ = mmdbPath(record, "country", "iso_code").(string)
+	geo.Country, _ = mmdbPath(record, "country", "names", "en").(string)
+	geo.City, _ = mmdbPath(record, "city", "names", "en").(string)
+	if latitude, ok := mmdbPath(record, "location", "latitude").(float64); ok {
+		geo.Latitude = &latitude
+	}
+	if longitude, ok := mmdbPath(record, "location", "longitude").(float64); ok {
+		geo.Longitude = &longitude
+	}
+	return geo
+}
@@ -0,0 +1,284 @@
+package enrich
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// Reader for MaxMind DB files (GeoIP2/GeoLite2 and compatible databases),
+// following https://maxmind.github.io/MaxMind-DB/. The whole file is kept in
+// memory and looked up without locking, so a reader is safe for concurrent use.
+type mmdbReader struct {
+	buffer      []byte
+	data        []byte
+	nodeCount   uint
+	recordSize  uint
+	ipVersion   uint
+	ipv4Start   uint
+	description string
+}
+
+// Marks the start of the metadata section at the end of the file
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// Opens a MaxMind DB file
+func openMMDB(path string) (*mmdbReader, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// The metadata is a map after the last marker
+	start := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	metadataSection := buffer[start+len(mmdbMetadataMarker):]
+	value, _, err := mmdbDecode(metadataSection, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid metadata: %v", path, err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid metadata", path)
+	}
+	r := &mmdbReader{
+		buffer:     buffer,
+		nodeCount:  uint(mmdbUint(metadata["node_count"])),
+		recordSize: uint(mmdbUint(metadata["record_size"])),
+		ipVersion:  uint(mmdbUint(metadata["ip_version"])),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, r.recordSize)
+	}
+	if descriptions, ok := metadata["description"].(map[string]interface{}); ok {
+		r.description, _ = descriptions["en"].(string)
+	}
+	// The data section follows the search tree and 16 bytes of zeros
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(start) {
+		return nil, fmt.Errorf("%s: search tree larger than the file", path)
+	}
+	r.data = buffer[treeSize+16 : start]
+	// IPv4 addresses live under ::/96 in IPv6 trees
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// Returns the left (bit 0) or right (bit 1) record of a search tree node
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.buffer[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buffer[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.buffer[node*8+bit*4:]))
+	}
+}
+
+// Looks up an address, returning nil if the database has no data for it, and
+// the length of the network prefix the data was found for
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, int, error) {
+	// Walk the tree bit by bit from the right starting node
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, 0, nil
+	}
+	depth := 0
+	for ; depth < len(ip)*8 && node < r.nodeCount; depth++ {
+		bit := uint(ip[depth/8]>>(7-uint(depth%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node == r.nodeCount {
+		return nil, 0, nil
+	}
+	if node < r.nodeCount {
+		return nil, 0, fmt.Errorf("search tree too deep for %s", ip)
+	}
+	offset := node - r.nodeCount - 16
+	if offset >= uint(len(r.data)) {
+		return nil, 0, fmt.Errorf("invalid data pointer for %s", ip)
+	}
+	value, _, err := mmdbDecode(r.data, offset)
+	return value, depth, err
+}
+
+// Decodes the value at offset of a data section, returning the offset after it
+func mmdbDecode(data []byte, offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(data)) {
+		return nil, 0, fmt.Errorf("offset %d out of range", offset)
+	}
+	control := data[offset]
+	offset++
+	kind := uint(control >> 5)
+	// Pointers encode their size differently and are followed right away
+	if kind == 1 {
+		size := uint(control>>3) & 3
+		if offset+size+1 > uint(len(data)) {
+			return nil, 0, fmt.Errorf("truncated pointer")
+		}
+		b := data[offset : offset+size+1]
+		var pointer uint
+		switch size {
+		case 0:
+			pointer = uint(control&7)<<8 | uint(b[0])
+		case 1:
+			pointer = (uint(control&7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			pointer = (uint(control&7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			pointer = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := mmdbDecode(data, pointer)
+		return value, offset + size + 1, err
+	}
+	// Extended types store the type in the next byte
+	if kind == 0 {
+		if offset >= uint(len(data)) {
+			return nil, 0, fmt.Errorf("truncated extended type")
+		}
+		kind = 7 + uint(data[offset])
+		offset++
+	}
+	// Sizes above 28 continue in the next bytes
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(data)) {
+			return nil, 0, fmt.Errorf("truncated size")
+		}
+		n := uint(0)
+		for _, b := range data[offset : offset+extra] {
+			n = n<<8 | uint(b)
+		}
+		offset += extra
+		switch size {
+		case 29:
+			size = 29 + n
+		case 30:
+			size = 285 + n
+		default:
+			size = 65821 + n
+		}
+	}
+	switch kind {
+	case 7:
+		// Map of size key/value pairs
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := mmdbDecode(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := mmdbDecode(data, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, _ := key.(string)
+			m[name] = value
+			offset = next
+		}
+		return m, offset, nil
+	case 11:
+		// Array of size values
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := mmdbDecode(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case 14:
+		// Booleans keep their value in the size
+		return size != 0, offset, nil
+	case 12, 13:
+		// Data cache containers and end markers carry no value
+		return nil, offset, nil
+	}
+	if offset+size > uint(len(data)) {
+		return nil, 0, fmt.Errorf("truncated value of type %d", kind)
+	}
+	b := data[offset : offset+size]
+	offset += size
+	switch kind {
+	case 2:
+		return string(b), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4:
+		return append([]byte{}, b...), offset, nil
+	case 5, 6, 9:
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8:
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		// Shorter int32 values are not sign extended
+		return int64(int32(n)), offset, nil
+	case 10:
+		// uint128 values are kept as their big endian bytes
+		return append([]byte{}, b...), offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", kind)
+}
+
+// Converts a decoded unsigned integer, returning 0 for anything else
+func mmdbUint(value interface{}) uint64 {
+	switch n := value.(type) {
+	case uint64:
+		return n
+	case int64:
+		if n >= 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
+
+// Follows a path of map keys through a decoded value
+func mmdbPath(value interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
@@ -0,0 +1,210 @@
+package event
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Adapters of the results of each toolkit major version, read into the 4.x
+// shape ParseGraphsResult and the esmond readers expect
+var graphsAdapters = map[int]func(map[string]interface{}) map[string]interface{}{
+	3: adaptGraphs3,
+	4: func(fields map[string]interface{}) map[string]interface{} { return fields },
+	5: adaptGraphs5,
+}
+
+// Timestamps larger than this are in milliseconds
+const millisecondTimestamps = 1e12
+
+// Measurements of the graphs package, 5.x nesting the statistics of each
+// direction of them (throughput_src, loss_dst, ...) in an object
+var graphsMeasurements = map[string]bool{"throughput": true, "owdelay": true, "loss": true, "rtt": true}
+
+// Reports whether 5.x nests key in an object: the ends of a test and the
+// directions of its measurements
+func nestedIn5(key string) bool {
+	if key == "source" || key == "destination" {
+		return true
+	}
+	measurement := strings.TrimSuffix(strings.TrimSuffix(key, "_src"), "_dst")
+	return measurement != key && graphsMeasurements[measurement]
+}
+
+// ToolkitMajor returns the major version of a toolkit version such as 4.4.2,
+// v5.0.1 or 3.5.1-1.el7, 0 when it has none
+func ToolkitMajor(version string) int {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	end := strings.IndexFunc(version, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(version)
+	}
+	major, err := strconv.Atoi(version[:end])
+	if err != nil {
+		return 0
+	}
+	return major
+}
+
+// Returns the adapter of a major version, the closest known one for versions
+// past it and 0 when there is none
+func adapterMajor(major int) int {
+	switch {
+	case major <= 0:
+		return 0
+	case major < 3:
+		return 3
+	case major > 5:
+		return 5
+	}
+	return major
+}
+
+// Guesses the major version whose graphs package listed a test from its shape:
+// 5.x nests its ends and measurements in objects, 3.x names the ends source
+// and destination. Other objects don't tell versions apart.
+func detectGraphsMajor(fields map[string]interface{}) int {
+	for key, value := range fields {
+		if _, nested := value.(map[string]interface{}); nested && nestedIn5(key) {
+			return 5
+		}
+	}
+	if _, ok := fields["source_ip"]; !ok {
+		if _, ok := fields["source"]; ok {
+			return 3
+		}
+	}
+	return 4
+}
+
+// AdaptGraphsResult returns a test listed by the graphs package of a toolkit
+// of the given version, with its keys normalized by NormalizeKeys, in the 4.x
+// shape ParseGraphsResult reads, and the adapter that read it (3.x, 4.x or
+// 5.x). Unknown versions are told apart by their shape.
+func AdaptGraphsResult(version string, raw json.RawMessage) (json.RawMessage, string) {
+	fields, ok := decodeValue(raw).(map[string]interface{})
+	if !ok {
+		return raw, ""
+	}
+	major := adapterMajor(ToolkitMajor(version))
+	if major == 0 {
+		major = detectGraphsMajor(fields)
+	}
+	adapted, err := json.Marshal(graphsAdapters[major](fields))
+	if err != nil {
+		return raw, ""
+	}
+	return adapted, strconv.Itoa(major) + ".x"
+}
+
+// Reads a 3.x test: its ends are source and destination and the values of a
+// direction have no statistic (throughput_src for throughput_src_val)
+func adaptGraphs3(fields map[string]interface{}) map[string]interface{} {
+	adapted := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		switch {
+		case key == "source" || key == "destination":
+			key += "_ip"
+		case key == "source_name" || key == "destination_name":
+			key = strings.TrimSuffix(key, "_name") + "_host"
+		case key == "last_update":
+			key = "last_updated"
+		case strings.HasSuffix(key, "_src") || strings.HasSuffix(key, "_dst"):
+			key += "_val"
+		}
+		if _, taken := adapted[key]; !taken {
+			adapted[key] = value
+		}
+	}
+	return adapted
+}
+
+// Reads a 5.x test: its ends are objects with an ip and a host, every
+// measurement an object of statistics and the timestamps in milliseconds.
+// Other objects are kept as they are.
+func adaptGraphs5(fields map[string]interface{}) map[string]interface{} {
+	adapted := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		nested, ok := value.(map[string]interface{})
+		if !ok || !nestedIn5(key) {
+			adapted[key] = value
+			continue
+		}
+		for name, item := range nested {
+			switch {
+			case (key == "source" || key == "destination") && (name == "ip" || name == "address"):
+				name = "ip"
+			case (key == "source" || key == "destination") && name == "hostname":
+				name = "host"
+			case name == "value":
+				name = "val"
+			}
+			adapted[key+"_"+name] = item
+		}
+	}
+	if updated, ok := adapted["last_updated"].(json.Number); ok {
+		if ms, err := updated.Float64(); err == nil && ms > millisecondTimestamps {
+			adapted["last_updated"] = json.Number(strconv.FormatFloat(ms/1000, 'f', -1, 64))
+		}
+	}
+	return adapted
+}
+
+// AdaptEsmondData returns the datapoints of an esmond series read from a
+// toolkit of the given version in the 4.x shape, a list of ts and val in
+// seconds, and the adapter that read it. 5.x archives name them timestamp and
+// value in milliseconds, unknown versions are told apart by their shape.
+func AdaptEsmondData(version string, raw json.RawMessage) (json.RawMessage, string) {
+	points, ok := decodeValue(raw).([]interface{})
+	if !ok {
+		return raw, ""
+	}
+	major := adapterMajor(ToolkitMajor(version))
+	if major == 0 {
+		major = 4
+		for _, point := range points {
+			fields, _ := point.(map[string]interface{})
+			if _, ok := fields["ts"]; fields != nil && !ok {
+				major = 5
+				break
+			}
+			if ts, ok := fields["ts"].(json.Number); ok {
+				if n, err := ts.Float64(); err == nil && n > millisecondTimestamps {
+					major = 5
+					break
+				}
+			}
+		}
+	}
+	label := strconv.Itoa(major) + ".x"
+	if major != 5 {
+		return raw, label
+	}
+	for i, point := range points {
+		fields, ok := point.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		adapted := make(map[string]interface{}, len(fields))
+		for key, value := range fields {
+			switch key {
+			case "timestamp", "time":
+				key = "ts"
+			case "value":
+				key = "val"
+			}
+			adapted[key] = value
+		}
+		if ts, ok := adapted["ts"].(json.Number); ok {
+			if ms, err := ts.Int64(); err == nil && ms > millisecondTimestamps {
+				adapted["ts"] = json.Number(strconv.FormatInt(ms/1000, 10))
+			}
+		}
+		points[i] = adapted
+	}
+	adapted, err := json.Marshal(points)
+	if err != nil {
+		return raw, ""
+	}
+	return adapted, label
+}
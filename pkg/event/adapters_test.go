@@ -0,0 +1,158 @@
+package event
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// A test listed by the graphs package of a 4.x toolkit, the shape every
+// adapter reads into
+const graphs4 = `{
+	"source_ip": "198.129.254.30",
+	"destination_ip": "192.188.18.50",
+	"source_host": "sacr-pt1.es.net",
+	"destination_host": "ps.example.edu",
+	"protocol": "tcp",
+	"last_updated": 1697040000,
+	"throughput_src_val": 9412345678,
+	"throughput_dst_val": 8123456789,
+	"throughput_src_average": 9100000000,
+	"owdelay_src_val": 0.0123,
+	"loss_src_val": 0
+}`
+
+func TestToolkitMajor(t *testing.T) {
+	for _, test := range []struct {
+		version string
+		major   int
+	}{
+		{"4.4.2", 4},
+		{"v5.0.1", 5},
+		{"3.5.1-1.el7", 3},
+		{" 5 ", 5},
+		{"", 0},
+		{"unknown", 0},
+	} {
+		if major := ToolkitMajor(test.version); major != test.major {
+			t.Errorf("ToolkitMajor(%q) = %d, want %d", test.version, major, test.major)
+		}
+	}
+}
+
+func TestAdaptGraphsResult(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		version string
+		raw     string
+		want    string
+		adapter string
+	}{
+		{"4.x", "4.4.2", graphs4, graphs4, "4.x"},
+		{"4.x detected", "", graphs4, graphs4, "4.x"},
+		{
+			"4.x with an object",
+			"",
+			`{"source_ip": "198.129.254.30", "destination_ip": "192.188.18.50", "metadata": {"value": 1}}`,
+			`{"source_ip": "198.129.254.30", "destination_ip": "192.188.18.50", "metadata": {"value": 1}}`,
+			"4.x",
+		},
+		{
+			"3.x",
+			"3.5.1-1.el7",
+			`{"source": "198.129.254.30", "destination": "192.188.18.50", "source_name": "sacr-pt1.es.net",
+				"last_update": 1697040000, "throughput_src": 9412345678, "owdelay_dst": 0.0123}`,
+			`{"source_ip": "198.129.254.30", "destination_ip": "192.188.18.50", "source_host": "sacr-pt1.es.net",
+				"last_updated": 1697040000, "throughput_src_val": 9412345678, "owdelay_dst_val": 0.0123}`,
+			"3.x",
+		},
+		{
+			"3.x detected",
+			"",
+			`{"source": "198.129.254.30", "destination": "192.188.18.50", "loss_src": 0}`,
+			`{"source_ip": "198.129.254.30", "destination_ip": "192.188.18.50", "loss_src_val": 0}`,
+			"3.x",
+		},
+		{
+			"5.x",
+			"5.0.1",
+			`{"source": {"ip": "198.129.254.30", "hostname": "sacr-pt1.es.net"}, "destination": {"address": "192.188.18.50"},
+				"protocol": "tcp", "last_updated": 1697040000000,
+				"throughput_src": {"value": 9412345678, "average": 9100000000}, "metadata": {"value": 1}}`,
+			`{"source_ip": "198.129.254.30", "source_host": "sacr-pt1.es.net", "destination_ip": "192.188.18.50",
+				"protocol": "tcp", "last_updated": 1697040000,
+				"throughput_src_val": 9412345678, "throughput_src_average": 9100000000, "metadata": {"value": 1}}`,
+			"5.x",
+		},
+		{
+			"5.x detected",
+			"",
+			`{"source": {"ip": "198.129.254.30"}, "destination": {"ip": "192.188.18.50"}, "loss_dst": {"value": 0}}`,
+			`{"source_ip": "198.129.254.30", "destination_ip": "192.188.18.50", "loss_dst_val": 0}`,
+			"5.x",
+		},
+		{"not an object", "4.4.2", `[1, 2]`, `[1, 2]`, ""},
+	} {
+		adapted, adapter := AdaptGraphsResult(test.version, json.RawMessage(test.raw))
+		if adapter != test.adapter {
+			t.Errorf("%s: adapter %q, want %q", test.name, adapter, test.adapter)
+		}
+		assertJSON(t, test.name, adapted, test.want)
+	}
+}
+
+func TestAdaptEsmondData(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		version string
+		raw     string
+		want    string
+		adapter string
+	}{
+		{"4.x", "4.4.2", `[{"ts": 1697040000, "val": 9412345678}]`, `[{"ts": 1697040000, "val": 9412345678}]`, "4.x"},
+		{"4.x detected", "", `[{"ts": 1697040000, "val": 0.0123}]`, `[{"ts": 1697040000, "val": 0.0123}]`, "4.x"},
+		{
+			"5.x",
+			"5.0.1",
+			`[{"timestamp": 1697040000000, "value": 9412345678}, {"time": 1697040060, "value": 1}]`,
+			`[{"ts": 1697040000, "val": 9412345678}, {"ts": 1697040060, "val": 1}]`,
+			"5.x",
+		},
+		{
+			"5.x detected by its names",
+			"",
+			`[{"timestamp": 1697040000, "value": {"min": 1}}]`,
+			`[{"ts": 1697040000, "val": {"min": 1}}]`,
+			"5.x",
+		},
+		{
+			"5.x detected by its milliseconds",
+			"",
+			`[{"ts": 1697040000000, "val": 1}]`,
+			`[{"ts": 1697040000, "val": 1}]`,
+			"5.x",
+		},
+		{"not a list", "", `{"ts": 1697040000}`, `{"ts": 1697040000}`, ""},
+	} {
+		adapted, adapter := AdaptEsmondData(test.version, json.RawMessage(test.raw))
+		if adapter != test.adapter {
+			t.Errorf("%s: adapter %q, want %q", test.name, adapter, test.adapter)
+		}
+		assertJSON(t, test.name, adapted, test.want)
+	}
+}
+
+// Fails unless got and want hold the same JSON value
+func assertJSON(t *testing.T, name string, got json.RawMessage, want string) {
+	t.Helper()
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("%s: invalid JSON %s: %v", name, got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatalf("%s: invalid expected JSON: %v", name, err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("%s: got %s, want %s", name, got, want)
+	}
+}
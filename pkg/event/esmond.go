@@ -0,0 +1,151 @@
+package event
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// EsmondResult is one measurement series read from an esmond archive
+type EsmondResult struct {
+	Archive          string          `json:"archive"`
+	MetadataKey      string          `json:"metadata_key"`
+	Source           string          `json:"source"`
+	Destination      string          `json:"destination"`
+	InputSource      string          `json:"input_source"`
+	InputDestination string          `json:"input_destination"`
+	MeasurementAgent string          `json:"measurement_agent"`
+	ToolName         string          `json:"tool_name"`
+	SubjectType      string          `json:"subject_type"`
+	EventType        string          `json:"event_type"`
+	SummaryType      string          `json:"summary_type,omitempty"`
+	SummaryWindow    int             `json:"summary_window"`
+	TimeStart        int64           `json:"time_start"`
+	TimeEnd          int64           `json:"time_end"`
+	Data             json.RawMessage `json:"data"`
+}
+
+// Path is one traceroute or tracepath run read from an esmond archive. The
+// path id identifies the route taken so changes show up as a new id.
+type Path struct {
+	Header
+	Host        string    `json:"host"`
+	Archive     string    `json:"archive"`
+	MetadataKey string    `json:"metadata_key"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	ToolName    string    `json:"tool_name"`
+	Timestamp   int64     `json:"ts"`
+	PathID      string    `json:"path_id"`
+	HopCount    int       `json:"hop_count"`
+	Hops        []PathHop `json:"hops"`
+	// The host a central archive was read through, when the path is
+	// attributed to the host measuring it
+	ReadVia string `json:"read_via,omitempty"`
+}
+
+// PathHop is the answer to one probe of a path
+type PathHop struct {
+	TTL      int      `json:"ttl"`
+	Query    int      `json:"query"`
+	IP       string   `json:"ip,omitempty"`
+	Hostname string   `json:"hostname,omitempty"`
+	RTT      *float64 `json:"rtt,omitempty"`
+	MTU      *int     `json:"mtu,omitempty"`
+	Success  bool     `json:"success"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Datapoint is one value of a time series read from an esmond archive. The
+// value is kept as stored and the throughput (bits per second), latency
+// (milliseconds, the mean for histograms) or loss (rate) is added when known.
+// An aggregate rolls the datapoints of a window starting at its timestamp up
+// instead, its throughput, latency or loss being their mean.
+type Datapoint struct {
+	Header
+	Host          string          `json:"host"`
+	Archive       string          `json:"archive"`
+	MetadataKey   string          `json:"metadata_key"`
+	Source        string          `json:"source"`
+	Destination   string          `json:"destination"`
+	ToolName      string          `json:"tool_name"`
+	EventType     string          `json:"event_type"`
+	SummaryType   string          `json:"summary_type,omitempty"`
+	SummaryWindow int             `json:"summary_window"`
+	Timestamp     int64           `json:"ts"`
+	Value         json.RawMessage `json:"value,omitempty"`
+	Throughput    *float64        `json:"throughput,omitempty"`
+	Latency       *float64        `json:"latency,omitempty"`
+	Loss          *float64        `json:"loss,omitempty"`
+	// Set on aggregates only
+	AggregateWindow int      `json:"aggregate_window,omitempty"`
+	Count           int      `json:"count,omitempty"`
+	Min             *float64 `json:"min,omitempty"`
+	Mean            *float64 `json:"mean,omitempty"`
+	Max             *float64 `json:"max,omitempty"`
+	P95             *float64 `json:"p95,omitempty"`
+}
+
+// Metric is a numeric datapoint of a time series in the Splunk metrics format:
+// the measurement named by metric_name and its _value, with the test as
+// dimensions, named apart from the source and host fields of Splunk. The time
+// of its header is the time of the datapoint.
+type Metric struct {
+	Header
+	MetricName      string  `json:"metric_name"`
+	Value           float64 `json:"_value"`
+	ArchiveHost     string  `json:"archive_host"`
+	MetadataKey     string  `json:"metadata_key"`
+	Source          string  `json:"source_address"`
+	Destination     string  `json:"destination_address"`
+	ToolName        string  `json:"tool_name"`
+	EventType       string  `json:"event_type"`
+	SummaryType     string  `json:"summary_type,omitempty"`
+	SummaryWindow   int     `json:"summary_window"`
+	AggregateWindow int     `json:"aggregate_window,omitempty"`
+}
+
+// SeriesValue returns a datapoint value as a number: numbers as they are, the
+// mean of the statistics summaries and of histograms, nil for anything else
+func SeriesValue(val interface{}) *float64 {
+	object, ok := val.(map[string]interface{})
+	if !ok {
+		return JSONFloat(val)
+	}
+	if mean, ok := object["mean"]; ok {
+		return JSONFloat(mean)
+	}
+	return HistogramMean(object)
+}
+
+// JSONFloat returns a JSON number as a float, nil for anything else
+func JSONFloat(value interface{}) *float64 {
+	switch v := value.(type) {
+	case float64:
+		return &v
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return &f
+		}
+	}
+	return nil
+}
+
+// HistogramMean returns the mean of an esmond histogram of bucket values to
+// counts
+func HistogramMean(histogram map[string]interface{}) *float64 {
+	var sum, count float64
+	for bucket, n := range histogram {
+		value, err := strconv.ParseFloat(bucket, 64)
+		weight := JSONFloat(n)
+		if err != nil || weight == nil {
+			return nil
+		}
+		sum += value * *weight
+		count += *weight
+	}
+	if count == 0 {
+		return nil
+	}
+	mean := sum / count
+	return &mean
+}
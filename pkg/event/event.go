@@ -0,0 +1,290 @@
+// Package event defines the events of every output stream and the header
+// they share.
+package event
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/enrich"
+)
+
+// SchemaVersion is the version of the event schema, bumped whenever a field
+// changes meaning
+const SchemaVersion = 3
+
+// TimeLayout is the layout of event timestamps, matching TIME_FORMAT in props.conf
+const TimeLayout = "2006-01-02T15:04:05.000000-07:00"
+
+// RunID identifies the crawl, it is shared by every event of it
+var RunID = NewUUID()
+
+// StartTime is when the crawl started, it names the output files so it has no
+// spaces or colons
+var StartTime = time.Now().UTC().Format("20060102T150405Z")
+
+// Collector identifies the collector running the crawl, the name of the
+// machine unless set with -collector, and Site where it runs. Together they
+// are the vantage point of the crawl.
+var Collector, _ = os.Hostname()
+var Site string
+
+// Vantage returns the vantage point of the crawl, the collector at its site
+func Vantage() string {
+	if Site == "" {
+		return Collector
+	}
+	return Collector + "@" + Site
+}
+
+// Header holds the fields common to every event, the time is when the event
+// was collected and is what Splunk uses as _time
+type Header struct {
+	SchemaVersion int    `json:"schema_version"`
+	RunID         string `json:"run_id"`
+	Time          string `json:"time"`
+	Collector     string `json:"collector"`
+	Site          string `json:"site,omitempty"`
+}
+
+// NewHeader returns the header of an event collected now
+func NewHeader() Header {
+	return Header{
+		SchemaVersion: SchemaVersion,
+		RunID:         RunID,
+		Time:          time.Now().UTC().Format(TimeLayout),
+		Collector:     Collector,
+		Site:          Site,
+	}
+}
+
+// DiscoverySource is the discovery source a host was found by: the hints file,
+// cache tarball and file of the cache, the lookup service and record type of
+// sls, the seed list or the mesh
+type DiscoverySource struct {
+	Source     string `json:"source"`
+	URL        string `json:"url"`
+	Cache      string `json:"cache,omitempty"`
+	File       string `json:"file,omitempty"`
+	RecordType string `json:"record_type,omitempty"`
+}
+
+// Organization is where the lookup service records of a host register it,
+// joined with the person records of their administrators
+type Organization struct {
+	SiteName     string   `json:"site_name,omitempty"`
+	Organization string   `json:"organization,omitempty"`
+	City         string   `json:"city,omitempty"`
+	State        string   `json:"state,omitempty"`
+	Country      string   `json:"country,omitempty"`
+	Domains      []string `json:"domains,omitempty"`
+	Admins       []Admin  `json:"admins,omitempty"`
+}
+
+// Admin is an administrator of a host, from its lookup service person record
+type Admin struct {
+	Name         string   `json:"name,omitempty"`
+	Emails       []string `json:"emails,omitempty"`
+	Organization string   `json:"organization,omitempty"`
+}
+
+// Registration is a record of a discovery source as it was registered, a
+// lookup service record or a row of a cache file, with the hosts it names.
+// Expired records are kept, flagged, for registry hygiene reports.
+type Registration struct {
+	Header
+	Discovery      DiscoverySource `json:"discovery"`
+	Type           string          `json:"type"`
+	Hosts          []string        `json:"hosts"`
+	Locators       []string        `json:"locators,omitempty"`
+	ServiceTypes   []string        `json:"service_types,omitempty"`
+	Names          []string        `json:"names,omitempty"`
+	Communities    []string        `json:"communities,omitempty"`
+	Domains        []string        `json:"domains,omitempty"`
+	SiteName       string          `json:"site_name,omitempty"`
+	City           string          `json:"city,omitempty"`
+	Country        string          `json:"country,omitempty"`
+	ToolkitVersion string          `json:"toolkit_version,omitempty"`
+	Administrators []string        `json:"administrators,omitempty"`
+	URI            string          `json:"uri,omitempty"`
+	ClientUUID     string          `json:"client_uuid,omitempty"`
+	Expires        string          `json:"expires,omitempty"`
+	State          string          `json:"state,omitempty"`
+	Expired        bool            `json:"expired"`
+	// The columns of a cache row after its URL
+	Fields []string `json:"fields,omitempty"`
+}
+
+// Link records that a host was found through origin, with the discovery
+// source of the origin unless it is a crawled host
+type Link struct {
+	Header
+	Address      string           `json:"address"`
+	Origin       string           `json:"origin"`
+	Discovery    *DiscoverySource `json:"discovery,omitempty"`
+	Depth        int              `json:"depth"`
+	Meshes       []string         `json:"meshes,omitempty"`
+	Communities  []string         `json:"communities,omitempty"`
+	Organization *Organization    `json:"organization,omitempty"`
+	Geo          *enrich.GeoIP    `json:"geo,omitempty"`
+	ASN          *enrich.ASN      `json:"asn,omitempty"`
+	// Times the link was found, by every test and direction listing it
+	Count int `json:"count"`
+}
+
+// LinkPair consolidates the tests between two hosts, HostA sorting before
+// HostB, into whether they test in one or both directions, with the hosts
+// whose test lists named them
+type LinkPair struct {
+	Header
+	HostA     string   `json:"host_a"`
+	HostB     string   `json:"host_b"`
+	AToB      bool     `json:"a_to_b"`
+	BToA      bool     `json:"b_to_a"`
+	Direction string   `json:"direction"`
+	Tests     int      `json:"tests"`
+	Reporters []string `json:"reporters"`
+}
+
+// Summary is the toolkit summary of a host, with every discovery source that
+// found it so far
+type Summary struct {
+	Header
+	Host         string            `json:"host"`
+	Discovery    []DiscoverySource `json:"discovery,omitempty"`
+	DualStack    []DualStack       `json:"dual_stack,omitempty"`
+	Meshes       []string          `json:"meshes,omitempty"`
+	Communities  []string          `json:"communities,omitempty"`
+	Organization *Organization     `json:"organization,omitempty"`
+	Geo          *enrich.GeoIP     `json:"geo,omitempty"`
+	ASN          *enrich.ASN       `json:"asn,omitempty"`
+	Toolkit      *ToolkitSummary   `json:"toolkit,omitempty"`
+	Summary      json.RawMessage   `json:"summary"`
+	// Set by -summary-dedup on the summary of a host gone, with when it was
+	// last seen
+	Tombstone bool   `json:"tombstone,omitempty"`
+	LastSeen  string `json:"last_seen,omitempty"`
+}
+
+// DualStack is whether each address family of a host name with both IPv4 and
+// IPv6 addresses accepts connections, probed concurrently. Summaries list one
+// per name their address was resolved from.
+type DualStack struct {
+	Name string              `json:"name"`
+	IPv4 *FamilyReachability `json:"ipv4"`
+	IPv6 *FamilyReachability `json:"ipv6"`
+}
+
+// FamilyReachability is the outcome of connecting to an address of a family,
+// with the connect time or the error category
+type FamilyReachability struct {
+	Address        string  `json:"address"`
+	Reachable      bool    `json:"reachable"`
+	ConnectSeconds float64 `json:"connect_seconds,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// Result is a test result read from a host, either a graphs test or an esmond series
+type Result struct {
+	Header
+	Host   string `json:"host"`
+	Source string `json:"source"`
+	// The archive read, unless the own one of the host
+	Archive string `json:"archive,omitempty"`
+	// The host a central archive was read through, when the result is
+	// attributed to the host measuring it
+	ReadVia string        `json:"read_via,omitempty"`
+	Graphs  *GraphsResult `json:"graphs,omitempty"`
+	// The toolkit version whose adapter read the result (3.x, 4.x or 5.x)
+	Adapter string          `json:"adapter,omitempty"`
+	Result  json.RawMessage `json:"result"`
+	// The payload as the host sent it, with -raw-results
+	Raw json.RawMessage `json:"raw,omitempty"`
+}
+
+// Failure records a host endpoint that could not be fetched after all retries
+type Failure struct {
+	Header
+	Address  string `json:"address"`
+	Endpoint string `json:"endpoint"`
+	URL      string `json:"url"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// Component is a host's membership of a connected component of the test
+// graph, labeled with the mesh its hosts likely form
+type Component struct {
+	Header
+	Component      int      `json:"component"`
+	Label          string   `json:"label"`
+	Host           string   `json:"host"`
+	Reachable      bool     `json:"reachable"`
+	Meshes         []string `json:"meshes,omitempty"`
+	Hosts          int      `json:"hosts"`
+	ReachableHosts int      `json:"reachable_hosts"`
+}
+
+// Report totals a crawl once it ended
+type Report struct {
+	Header
+	StartTime                string           `json:"start_time"`
+	EndTime                  string           `json:"end_time"`
+	DurationSeconds          float64          `json:"duration_seconds"`
+	Interrupted              bool             `json:"interrupted"`
+	Truncated                bool             `json:"truncated"`
+	HostsDiscovered          int64            `json:"hosts_discovered"`
+	HostsCrawled             int64            `json:"hosts_crawled"`
+	HostsResponsive          int64            `json:"hosts_responsive"`
+	HostsWithArchive         int64            `json:"hosts_with_archive"`
+	HostsSkippedDead         int64            `json:"hosts_skipped_dead"`
+	HostsOptedOut            int64            `json:"hosts_opted_out"`
+	HostsOverBudget          int64            `json:"hosts_over_budget"`
+	HostsUnsampled           int64            `json:"hosts_unsampled"`
+	HostsGone                int64            `json:"hosts_gone"`
+	HostsClockSkewed         int64            `json:"hosts_clock_skewed"`
+	SummariesUnchanged       int64            `json:"summaries_unchanged"`
+	TestsStale               int64            `json:"tests_stale"`
+	Requests                 int64            `json:"requests"`
+	RequestsShortCircuited   int64            `json:"requests_short_circuited"`
+	RequestsDisallowed       int64            `json:"requests_disallowed"`
+	Errors                   map[string]int64 `json:"errors"`
+	ErrorsByEndpoint         map[string]int64 `json:"errors_by_endpoint"`
+	ContentSkipped           map[string]int64 `json:"content_skipped"`
+	ContentSkippedByEndpoint map[string]int64 `json:"content_skipped_by_endpoint"`
+	ArchiveFiltered          map[string]int64 `json:"archive_filtered"`
+	Bundles                  map[string]int64 `json:"bundles"`
+	DatapointsAggregated     map[string]int64 `json:"datapoints_aggregated"`
+	ParseErrors              map[string]int64 `json:"parse_errors"`
+	Events                   map[string]int64 `json:"events"`
+	Bytes                    map[string]int64 `json:"bytes"`
+	// Set by -sample, the counts being those of the sample
+	Sample     float64 `json:"sample,omitempty"`
+	SampleSeed int64   `json:"sample_seed,omitempty"`
+	// Set by -dry-run, with the hosts that would have been crawled
+	DryRun bool     `json:"dry_run,omitempty"`
+	Hosts  []string `json:"hosts,omitempty"`
+}
+
+// Truncation marks a crawl stopped by its time budget, the hosts it left
+// pending being resumed by -resume
+type Truncation struct {
+	Header
+	Reason         string  `json:"reason"`
+	BudgetSeconds  float64 `json:"budget_seconds"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Completed      int     `json:"completed"`
+	Pending        int     `json:"pending"`
+}
+
+// NewUUID returns a random version 4 UUID
+func NewUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,497 @@
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ToolkitSummary is the toolkit summary of a host validated and normalized:
+// flags given as 0/1 or yes/no are booleans and coordinates given as strings
+// are numbers
+type ToolkitSummary struct {
+	ToolkitVersion     string                `json:"toolkit_version,omitempty"`
+	ToolkitRPMVersion  string                `json:"toolkit_rpm_version,omitempty"`
+	Distribution       string                `json:"distribution,omitempty"`
+	KernelVersion      string                `json:"kernel_version,omitempty"`
+	ExternalAddress    *ToolkitAddress       `json:"external_address,omitempty"`
+	Location           *ToolkitLocation      `json:"location,omitempty"`
+	Administrator      *ToolkitAdministrator `json:"administrator,omitempty"`
+	Communities        []string              `json:"communities,omitempty"`
+	NTPSynchronized    *bool                 `json:"ntp_synchronized,omitempty"`
+	AutoUpdates        *bool                 `json:"auto_updates,omitempty"`
+	GloballyRegistered *bool                 `json:"globally_registered,omitempty"`
+	Services           []ToolkitService      `json:"services,omitempty"`
+}
+
+// ToolkitAddress is the external address a toolkit reports
+type ToolkitAddress struct {
+	Address     string   `json:"address,omitempty"`
+	IPv4Address string   `json:"ipv4_address,omitempty"`
+	IPv6Address string   `json:"ipv6_address,omitempty"`
+	DNSName     string   `json:"dns_name,omitempty"`
+	Interface   string   `json:"iface,omitempty"`
+	MTU         *float64 `json:"mtu,omitempty"`
+	Speed       *float64 `json:"speed,omitempty"`
+}
+
+// ToolkitLocation is where a toolkit says it is
+type ToolkitLocation struct {
+	City      string   `json:"city,omitempty"`
+	State     string   `json:"state,omitempty"`
+	Country   string   `json:"country,omitempty"`
+	ZipCode   string   `json:"zipcode,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+// ToolkitAdministrator is who runs a toolkit
+type ToolkitAdministrator struct {
+	Name         string `json:"name,omitempty"`
+	Email        string `json:"email,omitempty"`
+	Organization string `json:"organization,omitempty"`
+}
+
+// ToolkitService is a service listed in a toolkit summary
+type ToolkitService struct {
+	Name      string   `json:"name"`
+	Version   string   `json:"version,omitempty"`
+	Enabled   *bool    `json:"enabled,omitempty"`
+	Running   *bool    `json:"running,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// GraphsResult is a test listed by the graphs package validated and
+// normalized, every measurement of it (throughput_src_val, owdelay_dst_average,
+// ...) being a number in Values
+type GraphsResult struct {
+	SourceIP        string             `json:"source_ip"`
+	DestinationIP   string             `json:"destination_ip"`
+	SourceHost      string             `json:"source_host,omitempty"`
+	DestinationHost string             `json:"destination_host,omitempty"`
+	Protocol        string             `json:"protocol,omitempty"`
+	LastUpdated     *float64           `json:"last_updated,omitempty"`
+	Values          map[string]float64 `json:"values,omitempty"`
+}
+
+// RequestError is a failed request to a host, or a payload it sent that didn't
+// parse, classified by its category: dns, conn_refused, conn_reset,
+// unreachable, timeout, tls, other, http_4xx, http_5xx or parse
+type RequestError struct {
+	Header
+	Host     string `json:"host"`
+	Endpoint string `json:"endpoint"`
+	URL      string `json:"url,omitempty"`
+	Category string `json:"category"`
+	Status   int    `json:"status,omitempty"`
+	Error    string `json:"error"`
+}
+
+// ParseError is a payload read from a host that doesn't conform to what its
+// endpoint returns, kept instead of the event it would have been
+type ParseError struct {
+	Header
+	Host     string          `json:"host"`
+	Endpoint string          `json:"endpoint"`
+	URL      string          `json:"url,omitempty"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+// ParseToolkitSummary validates a toolkit summary, with its keys normalized
+// by NormalizeKeys, listing every field that doesn't conform in the error
+func ParseToolkitSummary(raw json.RawMessage) (*ToolkitSummary, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		return nil, fmt.Errorf("expected an object")
+	}
+	var v validator
+	summary := &ToolkitSummary{
+		ToolkitVersion:     v.str(fields, "", "toolkit_version"),
+		ToolkitRPMVersion:  v.str(fields, "", "toolkit_rpm_version"),
+		Distribution:       v.str(fields, "", "distribution"),
+		KernelVersion:      v.str(fields, "", "kernel_version"),
+		Communities:        v.strs(fields, "", "communities"),
+		AutoUpdates:        v.boolean(fields, "", "auto_updates"),
+		GloballyRegistered: v.boolean(fields, "", "globally_registered"),
+	}
+	if address := v.object(fields["external_address"], "external_address"); address != nil {
+		summary.ExternalAddress = &ToolkitAddress{
+			Address:     v.str(address, "external_address.", "address"),
+			IPv4Address: v.str(address, "external_address.", "ipv4_address"),
+			IPv6Address: v.str(address, "external_address.", "ipv6_address"),
+			DNSName:     v.str(address, "external_address.", "dns_name"),
+			Interface:   v.str(address, "external_address.", "iface"),
+			MTU:         v.number(address, "external_address.", "mtu"),
+			Speed:       v.number(address, "external_address.", "speed"),
+		}
+	}
+	if location := v.object(fields["location"], "location"); location != nil {
+		summary.Location = &ToolkitLocation{
+			City:      v.str(location, "location.", "city"),
+			State:     v.str(location, "location.", "state"),
+			Country:   v.str(location, "location.", "country"),
+			ZipCode:   v.str(location, "location.", "zipcode"),
+			Latitude:  v.number(location, "location.", "latitude"),
+			Longitude: v.number(location, "location.", "longitude"),
+		}
+	}
+	if admin := v.object(fields["administrator"], "administrator"); admin != nil {
+		summary.Administrator = &ToolkitAdministrator{
+			Name:         v.str(admin, "administrator.", "name"),
+			Email:        v.str(admin, "administrator.", "email"),
+			Organization: v.str(admin, "administrator.", "organization"),
+		}
+	}
+	if ntp := v.object(fields["ntp"], "ntp"); ntp != nil {
+		summary.NTPSynchronized = v.boolean(ntp, "ntp.", "synchronized")
+	}
+	for i, raw := range v.list(fields, "", "services") {
+		path := fmt.Sprintf("services[%d]", i)
+		service := v.object(raw, path)
+		if service == nil {
+			continue
+		}
+		path += "."
+		entry := ToolkitService{
+			Name:      v.str(service, path, "name"),
+			Version:   v.str(service, path, "version"),
+			Enabled:   v.boolean(service, path, "enabled"),
+			Running:   v.boolean(service, path, "is_running"),
+			Addresses: v.strs(service, path, "addresses"),
+		}
+		if entry.Name == "" {
+			v.fail(path+"name", "a service name")
+		}
+		summary.Services = append(summary.Services, entry)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// ParseNTPInfo validates the get_ntp_info answer of a toolkit, with its keys
+// normalized by NormalizeKeys, listing every field that doesn't conform in the
+// error
+func ParseNTPInfo(raw json.RawMessage) (*InventoryNTP, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		return nil, fmt.Errorf("expected an object")
+	}
+	var v validator
+	ntp := &InventoryNTP{
+		Synchronized:    v.boolean(fields, "", "synchronized"),
+		Source:          v.str(fields, "", "host"),
+		Stratum:         v.number(fields, "", "stratum"),
+		Offset:          v.number(fields, "", "offset"),
+		Delay:           v.number(fields, "", "delay"),
+		PollingInterval: v.number(fields, "", "polling_interval"),
+	}
+	if ntp.Source == "" {
+		ntp.Source = v.str(fields, "", "address")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return ntp, nil
+}
+
+// ParseGraphsResult validates a test listed by the graphs package, with its
+// keys normalized by NormalizeKeys, listing every field that doesn't conform
+// in the error. The test must name both its ends.
+func ParseGraphsResult(raw json.RawMessage) (*GraphsResult, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		return nil, fmt.Errorf("expected an object")
+	}
+	var v validator
+	result := &GraphsResult{
+		SourceIP:        v.str(fields, "", "source_ip"),
+		DestinationIP:   v.str(fields, "", "destination_ip"),
+		SourceHost:      v.str(fields, "", "source_host"),
+		DestinationHost: v.str(fields, "", "destination_host"),
+		Protocol:        v.str(fields, "", "protocol"),
+		LastUpdated:     v.number(fields, "", "last_updated"),
+	}
+	if result.SourceIP == "" {
+		v.fail("source_ip", "the source address")
+	}
+	if result.DestinationIP == "" {
+		v.fail("destination_ip", "the destination address")
+	}
+	for name := range fields {
+		switch name {
+		case "source_ip", "destination_ip", "source_host", "destination_host", "protocol", "last_updated":
+			continue
+		}
+		// Anything else that isn't a measurement is only kept in the payload
+		var value float64
+		switch field := decodeValue(fields[name]).(type) {
+		case json.Number:
+			value, _ = field.Float64()
+		case string:
+			n, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				continue
+			}
+			value = n
+		default:
+			continue
+		}
+		if result.Values == nil {
+			result.Values = make(map[string]float64)
+		}
+		result.Values[name] = value
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// NormalizeKeys returns a JSON payload with the keys of every object in it
+// in snake_case, toolkits of different versions naming the same fields
+// toolkitVersion, Toolkit-Version or toolkit_version. Keys of an object
+// normalized to the same name, such as maxRTT and max_rtt, keep the value of
+// the one already in snake_case, else of the first in order, the others being
+// listed in the error.
+func NormalizeKeys(raw json.RawMessage) (json.RawMessage, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return raw, nil
+	}
+	var collisions []string
+	normalized, err := json.Marshal(normalizeKeys(value, "", &collisions))
+	if err != nil {
+		return raw, nil
+	}
+	if len(collisions) > 0 {
+		return normalized, fmt.Errorf("colliding keys: %s", strings.Join(collisions, ", "))
+	}
+	return normalized, nil
+}
+
+// Normalizes the keys of the objects in a decoded value found at path,
+// appending the keys dropped for colliding with another to collisions
+func normalizeKeys(value interface{}, path string, collisions *[]string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		normalized := make(map[string]interface{}, len(v))
+		kept := make(map[string]string, len(v))
+		for _, key := range keys {
+			name := SnakeCase(key)
+			item := normalizeKeys(v[key], path+name+".", collisions)
+			if other, ok := kept[name]; ok {
+				if key != name {
+					*collisions = append(*collisions, fmt.Sprintf("%s%s dropped for %s", path, key, other))
+					continue
+				}
+				*collisions = append(*collisions, fmt.Sprintf("%s%s dropped for %s", path, other, key))
+			}
+			normalized[name] = item
+			kept[name] = key
+		}
+		return normalized
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeKeys(item, path+strconv.Itoa(i)+".", collisions)
+		}
+	}
+	return value
+}
+
+// SnakeCase returns a key in snake_case: lower cased, words split on case
+// changes, dashes, dots and spaces joined by underscores
+func SnakeCase(key string) string {
+	runes := []rune(strings.TrimSpace(key))
+	var snake strings.Builder
+	for i, r := range runes {
+		switch {
+		case r == '-' || r == ' ' || r == '.':
+			snake.WriteByte('_')
+		case unicode.IsUpper(r):
+			// A new word starts after a lower case letter or digit, or at the
+			// last capital of an acronym followed by a lower case letter
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				snake.WriteByte('_')
+			}
+			snake.WriteRune(unicode.ToLower(r))
+		default:
+			snake.WriteRune(r)
+		}
+	}
+	return snake.String()
+}
+
+// ToolkitBool reads a flag of a toolkit, given as a boolean, 0/1 or a yes/no
+// string, nil if it is none of them
+func ToolkitBool(value interface{}) *bool {
+	var b bool
+	switch v := value.(type) {
+	case bool:
+		b = v
+	case float64:
+		b = v != 0
+	case json.Number:
+		n, err := v.Float64()
+		if err != nil {
+			return nil
+		}
+		b = n != 0
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "yes", "true", "on", "running":
+			b = true
+		case "no", "false", "off", "disabled", "stopped":
+			b = false
+		default:
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil
+			}
+			b = n != 0
+		}
+	default:
+		return nil
+	}
+	return &b
+}
+
+// Reads the fields of a payload, collecting those that don't conform. Missing
+// and null fields are left empty, they are not errors.
+type validator struct {
+	problems []string
+}
+
+// Records that field isn't what was expected
+func (v *validator) fail(field string, expected string) {
+	v.problems = append(v.problems, field+": expected "+expected)
+}
+
+// Returns the problems found as one error, nil if there are none
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	sort.Strings(v.problems)
+	return fmt.Errorf("%s", strings.Join(v.problems, "; "))
+}
+
+// Decodes a value, nil when it is missing or null
+func decodeValue(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if decoder.Decode(&value) != nil {
+		return nil
+	}
+	return value
+}
+
+// Returns the fields of an object, nil if it is missing or not an object
+func (v *validator) object(raw json.RawMessage, path string) map[string]json.RawMessage {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(raw, &fields) != nil {
+		v.fail(path, "an object")
+		return nil
+	}
+	return fields
+}
+
+// Returns a string field, numbers such as versions are read as their text
+func (v *validator) str(fields map[string]json.RawMessage, path string, name string) string {
+	switch value := decodeValue(fields[name]).(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(value)
+	case json.Number:
+		return value.String()
+	}
+	v.fail(path+name, "a string")
+	return ""
+}
+
+// Returns a number field, numbers given as strings are read as numbers
+func (v *validator) number(fields map[string]json.RawMessage, path string, name string) *float64 {
+	var n float64
+	var err error
+	switch value := decodeValue(fields[name]).(type) {
+	case nil:
+		return nil
+	case json.Number:
+		n, err = value.Float64()
+	case string:
+		if strings.TrimSpace(value) == "" {
+			return nil
+		}
+		n, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+	default:
+		err = fmt.Errorf("not a number")
+	}
+	if err != nil {
+		v.fail(path+name, "a number")
+		return nil
+	}
+	return &n
+}
+
+// Returns a flag field, see ToolkitBool
+func (v *validator) boolean(fields map[string]json.RawMessage, path string, name string) *bool {
+	value := decodeValue(fields[name])
+	if value == nil {
+		return nil
+	}
+	b := ToolkitBool(value)
+	if b == nil {
+		v.fail(path+name, "a boolean")
+	}
+	return b
+}
+
+// Returns a list field
+func (v *validator) list(fields map[string]json.RawMessage, path string, name string) []json.RawMessage {
+	raw := fields[name]
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	var items []json.RawMessage
+	if json.Unmarshal(raw, &items) != nil {
+		v.fail(path+name, "a list")
+		return nil
+	}
+	return items
+}
+
+// Returns a list of strings field
+func (v *validator) strs(fields map[string]json.RawMessage, path string, name string) []string {
+	var values []string
+	for i, raw := range v.list(fields, path, name) {
+		value, ok := decodeValue(raw).(string)
+		if !ok {
+			v.fail(fmt.Sprintf("%s%s[%d]", path, name, i), "a string")
+			continue
+		}
+		values = append(values, value)
+	}
+	return values
+}
@@ -0,0 +1,56 @@
+package event
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNormalizeKeys(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		raw  string
+		want string
+		err  string
+	}{
+		{
+			"renamed",
+			`{"toolkitVersion": "4.4.2", "Toolkit-Version": "4.4.2", "external.address": {"dnsName": "ps.example.edu"}}`,
+			`{"toolkit_version": "4.4.2", "external_address": {"dns_name": "ps.example.edu"}}`,
+			"colliding keys: toolkitVersion dropped for Toolkit-Version",
+		},
+		{
+			"snake_case kept",
+			`{"maxRTT": 1, "max_rtt": 2, "MaxRtt": 3}`,
+			`{"max_rtt": 2}`,
+			"colliding keys: maxRTT dropped for MaxRtt, MaxRtt dropped for max_rtt",
+		},
+		{
+			"nested",
+			`{"services": [{"name": "owamp", "IsRunning": true, "is_running": false}]}`,
+			`{"services": [{"name": "owamp", "is_running": false}]}`,
+			"colliding keys: services.0.IsRunning dropped for is_running",
+		},
+		{"no collision", `{"ntpSynchronized": 1}`, `{"ntp_synchronized": 1}`, ""},
+		{"not JSON", `{`, `{`, ""},
+	} {
+		normalized, err := NormalizeKeys(json.RawMessage(test.raw))
+		if got := errString(err); got != test.err {
+			t.Errorf("%s: error %q, want %q", test.name, got, test.err)
+		}
+		if test.raw == test.want {
+			if string(normalized) != test.want {
+				t.Errorf("%s: got %s, want %s", test.name, normalized, test.want)
+			}
+			continue
+		}
+		assertJSON(t, test.name, normalized, test.want)
+	}
+}
+
+// Returns the message of err, empty when nil
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,33 @@
+package event
+
+//go:generate go run ../../cmd/splunkconf -dir ../../default -readme ../../README
+
+// Stream is an output stream and the event written to it, the Splunk
+// sourcetype of the stream being ps-<name>
+type Stream struct {
+	Name  string
+	Event interface{}
+}
+
+// Streams lists every output stream, the Splunk configuration is generated
+// from their events
+var Streams = []Stream{
+	{"link", Link{}},
+	{"summary", Summary{}},
+	{"results", Result{}},
+	{"failed", Failure{}},
+	{"tasks", Task{}},
+	{"paths", Path{}},
+	{"timeseries", Datapoint{}},
+	{"inventory", Inventory{}},
+	{"expected", ExpectedTest{}},
+	{"components", Component{}},
+	{"report", Report{}},
+	{"parse_errors", ParseError{}},
+	{"host_status", HostStatus{}},
+	{"metrics", Metric{}},
+	{"errors", RequestError{}},
+	{"truncated", Truncation{}},
+	{"pairs", LinkPair{}},
+	{"registrations", Registration{}},
+}
@@ -0,0 +1,165 @@
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TaskSpec is the test of a pScheduler task decoded into typed fields, the
+// durations in seconds whether the spec gives them in ISO 8601 or as numbers
+type TaskSpec struct {
+	Type                  string   `json:"type"`
+	Tool                  string   `json:"tool,omitempty"`
+	Tools                 []string `json:"tools,omitempty"`
+	Source                string   `json:"source,omitempty"`
+	Dest                  string   `json:"dest,omitempty"`
+	Protocol              string   `json:"protocol,omitempty"`
+	IPVersion             *float64 `json:"ip_version,omitempty"`
+	DurationSeconds       *float64 `json:"duration_seconds,omitempty"`
+	IntervalSeconds       *float64 `json:"interval_seconds,omitempty"`
+	Bandwidth             *float64 `json:"bandwidth,omitempty"`
+	Parallel              *float64 `json:"parallel,omitempty"`
+	Reverse               *bool    `json:"reverse,omitempty"`
+	PacketCount           *float64 `json:"packet_count,omitempty"`
+	PacketIntervalSeconds *float64 `json:"packet_interval_seconds,omitempty"`
+	PacketSize            *float64 `json:"packet_size,omitempty"`
+	Enabled               *bool    `json:"enabled,omitempty"`
+}
+
+// ParseTaskSpec decodes the test of a pScheduler task, listing every field
+// that doesn't conform in the error. The protocol is udp or tcp for throughput
+// tests, udp for latency tests and the probe type of traces.
+func ParseTaskSpec(raw json.RawMessage) (*TaskSpec, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		return nil, fmt.Errorf("expected an object")
+	}
+	var v validator
+	test := v.object(fields["test"], "test")
+	if test == nil {
+		v.fail("test", "the test of the task")
+		return nil, v.err()
+	}
+	spec := v.object(test["spec"], "test.spec")
+	task := &TaskSpec{
+		Type:            v.str(test, "test.", "type"),
+		Tool:            v.str(fields, "", "tool"),
+		Tools:           v.strs(fields, "", "tools"),
+		Source:          v.str(spec, "test.spec.", "source"),
+		Dest:            v.str(spec, "test.spec.", "dest"),
+		IPVersion:       v.number(spec, "test.spec.", "ip-version"),
+		DurationSeconds: v.duration(spec, "test.spec.", "duration"),
+		Bandwidth:       v.number(spec, "test.spec.", "bandwidth"),
+		Parallel:        v.number(spec, "test.spec.", "parallel"),
+		Reverse:         v.boolean(spec, "test.spec.", "reverse"),
+	}
+	if schedule := v.object(fields["schedule"], "schedule"); schedule != nil {
+		task.IntervalSeconds = v.duration(schedule, "schedule.", "repeat")
+	}
+	if detail := v.object(fields["detail"], "detail"); detail != nil {
+		task.Enabled = v.boolean(detail, "detail.", "enabled")
+	}
+	if task.Tool == "" && len(task.Tools) > 0 {
+		task.Tool = task.Tools[0]
+	}
+	switch task.Type {
+	case "throughput":
+		task.Protocol = "tcp"
+		if udp := v.boolean(spec, "test.spec.", "udp"); udp != nil && *udp {
+			task.Protocol = "udp"
+		}
+	case "latency", "latencybg":
+		task.Protocol = "udp"
+		task.PacketCount = v.number(spec, "test.spec.", "packet-count")
+		task.PacketIntervalSeconds = v.number(spec, "test.spec.", "packet-interval")
+		task.PacketSize = v.number(spec, "test.spec.", "packet-padding")
+	case "rtt":
+		task.Protocol = strings.ToLower(v.str(spec, "test.spec.", "protocol"))
+		if task.Protocol == "" {
+			task.Protocol = "icmp"
+		}
+		task.PacketCount = v.number(spec, "test.spec.", "count")
+		task.PacketIntervalSeconds = v.duration(spec, "test.spec.", "interval")
+		task.PacketSize = v.number(spec, "test.spec.", "length")
+	case "trace":
+		task.Protocol = strings.ToLower(v.str(spec, "test.spec.", "probe-type"))
+		task.PacketSize = v.number(spec, "test.spec.", "length")
+	}
+	if task.Type == "" {
+		v.fail("test.type", "the test type")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// Returns a duration field in seconds, given in ISO 8601 (PT30S, P1DT2H) or
+// as a number of seconds
+func (v *validator) duration(fields map[string]json.RawMessage, path string, name string) *float64 {
+	value, ok := decodeValue(fields[name]).(string)
+	if !ok {
+		return v.number(fields, path, name)
+	}
+	seconds, ok := isoSeconds(value)
+	if !ok {
+		v.fail(path+name, "an ISO 8601 duration")
+		return nil
+	}
+	return &seconds
+}
+
+// Reads an ISO 8601 duration in seconds, months and years counted as 30 and
+// 365 days
+func isoSeconds(value string) (float64, bool) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if !strings.HasPrefix(value, "P") || len(value) < 3 {
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return n, true
+		}
+		return 0, false
+	}
+	day := 24 * 3600.0
+	var total float64
+	inTime := false
+	number := ""
+	for _, r := range value[1:] {
+		switch {
+		case r == 'T':
+			inTime = true
+			continue
+		case r >= '0' && r <= '9' || r == '.' || r == ',':
+			if r == ',' {
+				r = '.'
+			}
+			number += string(r)
+			continue
+		}
+		n, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return 0, false
+		}
+		number = ""
+		switch {
+		case r == 'Y' && !inTime:
+			total += n * 365 * day
+		case r == 'M' && !inTime:
+			total += n * 30 * day
+		case r == 'W' && !inTime:
+			total += n * 7 * day
+		case r == 'D' && !inTime:
+			total += n * day
+		case r == 'H' && inTime:
+			total += n * 3600
+		case r == 'M' && inTime:
+			total += n * 60
+		case r == 'S' && inTime:
+			total += n
+		default:
+			return 0, false
+		}
+	}
+	return total, number == ""
+}
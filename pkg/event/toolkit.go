@@ -0,0 +1,127 @@
+package event
+
+import "encoding/json"
+
+// Task is a task scheduled on a host's pScheduler and its recent runs, with
+// its test decoded into the typed fields of spec
+type Task struct {
+	Header
+	Host string            `json:"host"`
+	Spec *TaskSpec         `json:"spec,omitempty"`
+	Task json.RawMessage   `json:"task"`
+	Runs []json.RawMessage `json:"runs"`
+}
+
+// Inventory is what a toolkit reports about itself: its versions, clock,
+// services and communities, with the issues found in them
+type Inventory struct {
+	Header
+	Host               string             `json:"host"`
+	ToolkitVersion     string             `json:"toolkit_version,omitempty"`
+	ToolkitRPMVersion  string             `json:"toolkit_rpm_version,omitempty"`
+	OS                 string             `json:"os,omitempty"`
+	KernelVersion      string             `json:"kernel_version,omitempty"`
+	NTPSynchronized    *bool              `json:"ntp_synchronized,omitempty"`
+	AutoUpdates        *bool              `json:"auto_updates,omitempty"`
+	GloballyRegistered *bool              `json:"globally_registered,omitempty"`
+	Communities        []string           `json:"communities"`
+	Services           []InventoryService `json:"services"`
+	NTP                *InventoryNTP      `json:"ntp,omitempty"`
+	Calendar           json.RawMessage    `json:"calendar,omitempty"`
+	TLS                *InventoryTLS      `json:"tls,omitempty"`
+	Issues             []string           `json:"issues"`
+}
+
+// InventoryService is a service listed by a toolkit, such as esmond, NDT or NPAD
+type InventoryService struct {
+	Name      string   `json:"name"`
+	Version   string   `json:"version,omitempty"`
+	Enabled   *bool    `json:"enabled,omitempty"`
+	Running   *bool    `json:"running,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// InventoryNTP is the clock of a toolkit as get_ntp_info reports it, the
+// offset and delay to its NTP source in milliseconds. Whether it is
+// synchronized is the ntp_synchronized of the inventory.
+type InventoryNTP struct {
+	Synchronized    *bool    `json:"-"`
+	Source          string   `json:"source,omitempty"`
+	Stratum         *float64 `json:"stratum,omitempty"`
+	Offset          *float64 `json:"offset,omitempty"`
+	Delay           *float64 `json:"delay,omitempty"`
+	PollingInterval *float64 `json:"polling_interval,omitempty"`
+}
+
+// InventoryTLS is the certificate a toolkit presented over HTTPS, whether it
+// was trusted (unknown with -insecure-skip-verify) and the days it has left
+type InventoryTLS struct {
+	Subject      string   `json:"subject"`
+	Issuer       string   `json:"issuer"`
+	SerialNumber string   `json:"serial_number,omitempty"`
+	DNSNames     []string `json:"dns_names,omitempty"`
+	NotBefore    string   `json:"not_before"`
+	NotAfter     string   `json:"not_after"`
+	DaysLeft     float64  `json:"days_left"`
+	SelfSigned   bool     `json:"self_signed"`
+	Verified     *bool    `json:"verified,omitempty"`
+	VerifyError  string   `json:"verify_error,omitempty"`
+}
+
+// HostStatus is what the crawl of a host found: whether it answered over HTTP,
+// which perfSONAR components answered, the install bundle they make and every
+// endpoint called
+type HostStatus struct {
+	Header
+	Host          string `json:"host"`
+	Reachable     bool   `json:"reachable"`
+	HasToolkit    bool   `json:"has_toolkit"`
+	HasGraphs     bool   `json:"has_graphs"`
+	HasEsmond     bool   `json:"has_esmond"`
+	HasPScheduler bool   `json:"has_pscheduler"`
+	Bundle        string `json:"bundle,omitempty"`
+	// How far ahead of the collector the clock of the host is, from the Date
+	// headers of its answers and the offset its NTP reports
+	ClockSkewSeconds *float64         `json:"clock_skew_seconds,omitempty"`
+	NTPOffsetSeconds *float64         `json:"ntp_offset_seconds,omitempty"`
+	ClockSkewed      bool             `json:"clock_skewed"`
+	DurationSeconds  float64          `json:"duration_seconds"`
+	Endpoints        []EndpointStatus `json:"endpoints"`
+}
+
+// EndpointStatus totals the calls to an endpoint of a host: the HTTP status
+// codes answered, the types of the errors of those that weren't and the mean
+// and worst total time of a call, body included. The DNS, connect and TLS
+// handshake means are over the calls that opened a new connection, and the
+// time to first byte is from when the request was issued.
+type EndpointStatus struct {
+	Endpoint            string         `json:"endpoint"`
+	Calls               int            `json:"calls"`
+	StatusCodes         map[string]int `json:"status_codes,omitempty"`
+	Errors              map[string]int `json:"errors,omitempty"`
+	LastStatus          int            `json:"last_status,omitempty"`
+	NewConnections      int            `json:"new_connections"`
+	DNSSeconds          float64        `json:"dns_seconds,omitempty"`
+	ConnectSeconds      float64        `json:"connect_seconds,omitempty"`
+	TLSHandshakeSeconds float64        `json:"tls_handshake_seconds,omitempty"`
+	FirstByteSeconds    float64        `json:"ttfb_seconds,omitempty"`
+	LatencySeconds      float64        `json:"latency_seconds"`
+	MaxLatencySeconds   float64        `json:"max_latency_seconds"`
+}
+
+// ExpectedTest is a test a mesh config says should run between two hosts, a gap
+// when none of the archives crawled has data of it within the time window.
+// Archives only list measurements updated within the window, those without an
+// update time count as recent.
+type ExpectedTest struct {
+	Header
+	Mesh        string   `json:"mesh"`
+	Task        string   `json:"task"`
+	TestType    string   `json:"test_type"`
+	EventType   string   `json:"event_type"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Gap         bool     `json:"gap"`
+	LastUpdated string   `json:"last_updated,omitempty"`
+	Archives    []string `json:"archives,omitempty"`
+}
@@ -0,0 +1,70 @@
+// Package flagvar holds the flag.Value types shared by the crawler packages.
+package flagvar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ByteSize is a flag holding a number of bytes, written with an optional k, M,
+// G or T suffix
+type ByteSize int64
+
+func (b *ByteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *ByteSize) Set(value string) error {
+	value = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	multiplier := int64(1)
+	if i := strings.IndexAny(value, "KMGT"); i >= 0 && i == len(value)-1 {
+		multiplier = 1 << (10 * uint(strings.IndexByte("KMGT", value[i])+1))
+		value = value[:i]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = ByteSize(n * multiplier)
+	return nil
+}
+
+// Duration is a flag holding a duration, written like time.ParseDuration or in
+// days with a d suffix such as 7d
+type Duration time.Duration
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*d = Duration(n * float64(24*time.Hour))
+		return nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// StringList is a flag holding every value of a repeatable flag, in order
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,113 @@
+package graph
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Component is a connected component of the graph: hosts testing with each
+// other directly or through others, labeled with the mesh they likely are
+type Component struct {
+	ID        int
+	Label     string
+	Hosts     []*Node
+	Reachable int
+}
+
+// MarkReachable records that a crawled host answered
+func (g *Graph) MarkReachable(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.node(id).Reachable = true
+}
+
+// Components returns the connected components of the graph, edges taken
+// both ways, largest first and numbered from 1. Each is labeled with the mesh
+// most of its hosts belong to, else the AS most of them are in, else
+// component-<id>
+func (g *Graph) Components() []Component {
+	nodes := g.Nodes()
+	edges := g.Edges()
+	// Union-find over the nodes, the root of a set being its smallest id
+	parent := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		parent[node.ID] = node.ID
+	}
+	var find func(id string) string
+	find = func(id string) string {
+		if parent[id] != id {
+			parent[id] = find(parent[id])
+		}
+		return parent[id]
+	}
+	for _, edge := range edges {
+		from, to := find(edge.From), find(edge.To)
+		if from == to {
+			continue
+		}
+		if to < from {
+			from, to = to, from
+		}
+		parent[to] = from
+	}
+	sets := make(map[string][]*Node)
+	for _, node := range nodes {
+		root := find(node.ID)
+		sets[root] = append(sets[root], node)
+	}
+	components := make([]Component, 0, len(sets))
+	for _, hosts := range sets {
+		component := Component{Hosts: hosts}
+		for _, host := range hosts {
+			if host.Reachable {
+				component.Reachable++
+			}
+		}
+		components = append(components, component)
+	}
+	// Nodes are sorted so the first host of each set is its smallest id
+	sort.Slice(components, func(i, j int) bool {
+		if len(components[i].Hosts) != len(components[j].Hosts) {
+			return len(components[i].Hosts) > len(components[j].Hosts)
+		}
+		return components[i].Hosts[0].ID < components[j].Hosts[0].ID
+	})
+	for i := range components {
+		components[i].ID = i + 1
+		components[i].Label = label(components[i])
+	}
+	return components
+}
+
+// Returns the likely mesh of a component
+func label(component Component) string {
+	meshes := make(map[string]int)
+	networks := make(map[string]int)
+	for _, host := range component.Hosts {
+		for _, mesh := range host.Meshes {
+			meshes[mesh]++
+		}
+		if name := host.Attrs["asn_name"]; name != "" {
+			networks[name]++
+		}
+	}
+	if mesh := mostCounted(meshes); mesh != "" {
+		return mesh
+	}
+	if network := mostCounted(networks); network != "" {
+		return network
+	}
+	return "component-" + strconv.Itoa(component.ID)
+}
+
+// Returns the key counted the most, ties going to the smallest key, empty when
+// there is none
+func mostCounted(counts map[string]int) string {
+	best, most := "", 0
+	for key, count := range counts {
+		if count > most || count == most && key < best {
+			best, most = key, count
+		}
+	}
+	return best
+}
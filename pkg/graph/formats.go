@@ -0,0 +1,156 @@
+package graph
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Returns the attributes of a node in every format: its depth, whether it is
+// a seed, its meshes and what enrichment knew of it
+func (n *Node) attributes() map[string]string {
+	attrs := map[string]string{
+		"depth": strconv.Itoa(n.Depth),
+		"seed":  strconv.FormatBool(n.Seed),
+	}
+	if len(n.Meshes) > 0 {
+		attrs["meshes"] = strings.Join(n.Meshes, ",")
+	}
+	for name, value := range n.Attrs {
+		attrs[name] = value
+	}
+	return attrs
+}
+
+// Returns the sorted names of every node attribute and their types in the
+// GraphML and GEXF vocabularies
+func attributeNames(nodes []*Node) ([]string, map[string]string) {
+	types := map[string]string{"depth": "int", "seed": "boolean"}
+	for _, node := range nodes {
+		for name := range node.attributes() {
+			if _, ok := types[name]; ok {
+				continue
+			}
+			switch name {
+			case "latitude", "longitude":
+				types[name] = "double"
+			default:
+				types[name] = "string"
+			}
+		}
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, types
+}
+
+// WriteGraphML writes the graph as GraphML, the format of yEd and Gephi
+func (g *Graph) WriteGraphML(w io.Writer) error {
+	nodes, edges := g.Nodes(), g.Edges()
+	names, types := attributeNames(nodes)
+	var out strings.Builder
+	out.WriteString(xml.Header)
+	out.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	for _, name := range names {
+		fmt.Fprintf(&out, "  <key id=%q for=\"node\" attr.name=%q attr.type=%q/>\n", name, name, types[name])
+	}
+	out.WriteString(`  <key id="weight" for="edge" attr.name="weight" attr.type="int"/>` + "\n")
+	out.WriteString(`  <graph id="perfsonar" edgedefault="directed">` + "\n")
+	for _, node := range nodes {
+		fmt.Fprintf(&out, "    <node id=\"%s\">\n", escape(node.ID))
+		attrs := node.attributes()
+		for _, name := range names {
+			if value, ok := attrs[name]; ok {
+				fmt.Fprintf(&out, "      <data key=%q>%s</data>\n", name, escape(value))
+			}
+		}
+		out.WriteString("    </node>\n")
+	}
+	for i, edge := range edges {
+		fmt.Fprintf(&out, "    <edge id=\"e%d\" source=\"%s\" target=\"%s\"><data key=\"weight\">%d</data></edge>\n",
+			i, escape(edge.From), escape(edge.To), edge.Weight)
+	}
+	out.WriteString("  </graph>\n</graphml>\n")
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// WriteDOT writes the graph in the DOT language of Graphviz, seeds drawn as
+// boxes
+func (g *Graph) WriteDOT(w io.Writer) error {
+	nodes, edges := g.Nodes(), g.Edges()
+	var out strings.Builder
+	out.WriteString("digraph perfsonar {\n")
+	for _, node := range nodes {
+		attrs := node.attributes()
+		names := make([]string, 0, len(attrs))
+		for name := range attrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var list []string
+		for _, name := range names {
+			list = append(list, fmt.Sprintf("%s=%s", name, quote(attrs[name])))
+		}
+		if node.Seed {
+			list = append(list, "shape=box")
+		}
+		fmt.Fprintf(&out, "  %s [%s];\n", quote(node.ID), strings.Join(list, ", "))
+	}
+	for _, edge := range edges {
+		fmt.Fprintf(&out, "  %s -> %s [weight=%d];\n", quote(edge.From), quote(edge.To), edge.Weight)
+	}
+	out.WriteString("}\n")
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// WriteGEXF writes the graph as GEXF 1.3, the native format of Gephi
+func (g *Graph) WriteGEXF(w io.Writer) error {
+	nodes, edges := g.Nodes(), g.Edges()
+	names, types := attributeNames(nodes)
+	var out strings.Builder
+	out.WriteString(xml.Header)
+	out.WriteString(`<gexf xmlns="http://gexf.net/1.3" version="1.3">` + "\n")
+	out.WriteString(`  <graph defaultedgetype="directed">` + "\n")
+	out.WriteString(`    <attributes class="node">` + "\n")
+	for i, name := range names {
+		fmt.Fprintf(&out, "      <attribute id=\"%d\" title=%q type=%q/>\n", i, name, types[name])
+	}
+	out.WriteString("    </attributes>\n    <nodes>\n")
+	for _, node := range nodes {
+		fmt.Fprintf(&out, "      <node id=\"%s\" label=\"%s\">\n        <attvalues>\n", escape(node.ID), escape(node.ID))
+		attrs := node.attributes()
+		for i, name := range names {
+			if value, ok := attrs[name]; ok {
+				fmt.Fprintf(&out, "          <attvalue for=\"%d\" value=\"%s\"/>\n", i, escape(value))
+			}
+		}
+		out.WriteString("        </attvalues>\n      </node>\n")
+	}
+	out.WriteString("    </nodes>\n    <edges>\n")
+	for i, edge := range edges {
+		fmt.Fprintf(&out, "      <edge id=\"%d\" source=\"%s\" target=\"%s\" weight=\"%d\"/>\n", i, escape(edge.From), escape(edge.To), edge.Weight)
+	}
+	out.WriteString("    </edges>\n  </graph>\n</gexf>\n")
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// Escapes text for XML
+func escape(text string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}
+
+// Quotes a DOT identifier
+func quote(id string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(id) + `"`
+}
@@ -0,0 +1,200 @@
+// Package graph builds the host-to-host graph of a crawl from its link events
+// and writes it as GraphML, DOT or GEXF for Gephi or Graphviz.
+package graph
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Node is a host of the graph with what its links said about it
+type Node struct {
+	ID     string
+	Depth  int
+	Seed   bool
+	Meshes []string
+	Attrs  map[string]string
+	// Reachable is set once the host was crawled and answered
+	Reachable bool
+}
+
+// Edge links a host to a test partner found on it, Weight counting the links
+type Edge struct {
+	From   string
+	To     string
+	Weight int
+}
+
+// Graph is the host graph of a crawl, safe for concurrent use
+type Graph struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	edges map[[2]string]*Edge
+}
+
+// New returns an empty graph
+func New() *Graph {
+	return &Graph{nodes: make(map[string]*Node), edges: make(map[[2]string]*Edge)}
+}
+
+// Add records a link: its host becomes a node, linked from its origin when
+// that is a crawled host rather than a discovery source
+func (g *Graph) Add(link event.Link) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	node := g.node(link.Address)
+	if node.Depth < 0 || link.Depth < node.Depth {
+		node.Depth = link.Depth
+	}
+	if link.Geo != nil {
+		setAttr(node, "country_code", link.Geo.CountryCode)
+		setAttr(node, "country", link.Geo.Country)
+		setAttr(node, "city", link.Geo.City)
+		if link.Geo.Latitude != nil && link.Geo.Longitude != nil {
+			setAttr(node, "latitude", strconv.FormatFloat(*link.Geo.Latitude, 'f', -1, 64))
+			setAttr(node, "longitude", strconv.FormatFloat(*link.Geo.Longitude, 'f', -1, 64))
+		}
+	}
+	if link.ASN != nil {
+		setAttr(node, "asn", strconv.FormatUint(uint64(link.ASN.Number), 10))
+		setAttr(node, "asn_name", link.ASN.Name)
+	}
+	for _, mesh := range link.Meshes {
+		if i := sort.SearchStrings(node.Meshes, mesh); i == len(node.Meshes) || node.Meshes[i] != mesh {
+			node.Meshes = append(node.Meshes[:i], append([]string{mesh}, node.Meshes[i:]...)...)
+		}
+	}
+	// Discovery origins name their source, crawled ones are host keys
+	if link.Discovery != nil || strings.Contains(link.Origin, ",") {
+		node.Seed = true
+		return
+	}
+	if link.Origin == link.Address {
+		return
+	}
+	g.node(link.Origin)
+	key := [2]string{link.Origin, link.Address}
+	edge, ok := g.edges[key]
+	if !ok {
+		edge = &Edge{From: link.Origin, To: link.Address}
+		g.edges[key] = edge
+	}
+	edge.Weight++
+}
+
+// Returns the node of id, adding it if needed, the lock must be held
+func (g *Graph) node(id string) *Node {
+	node, ok := g.nodes[id]
+	if !ok {
+		node = &Node{ID: id, Depth: -1, Attrs: make(map[string]string)}
+		g.nodes[id] = node
+	}
+	return node
+}
+
+// Sets an attribute of a node unless value is empty
+func setAttr(node *Node, name string, value string) {
+	if value != "" {
+		node.Attrs[name] = value
+	}
+}
+
+// Nodes returns the nodes sorted by id
+func (g *Graph) Nodes() []*Node {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	nodes := make([]*Node, 0, len(g.nodes))
+	for _, node := range g.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// Edges returns the edges sorted by their ends
+func (g *Graph) Edges() []*Edge {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	edges := make([]*Edge, 0, len(g.edges))
+	for _, edge := range g.edges {
+		edges = append(edges, edge)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		return edges[i].To < edges[j].To
+	})
+	return edges
+}
+
+// ReadLinks adds every link event of a link stream file, gzip compressed or
+// not, to the graph
+func (g *Graph) ReadLinks(r io.Reader) error {
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		buffered = bufio.NewReader(gz)
+	}
+	scanner := bufio.NewScanner(buffered)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var link event.Link
+		if err := json.Unmarshal(scanner.Bytes(), &link); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if link.Address == "" {
+			return fmt.Errorf("line %d: not a link event", line)
+		}
+		g.Add(link)
+	}
+	return scanner.Err()
+}
+
+// Formats the graph can be written in
+var Formats = []string{"graphml", "dot", "gexf"}
+
+// FormatOf returns the format of a file from its extension
+func FormatOf(path string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".graphml":
+		return "graphml", nil
+	case ".dot", ".gv":
+		return "dot", nil
+	case ".gexf":
+		return "gexf", nil
+	default:
+		return "", fmt.Errorf("%s: unknown graph format %q, expected .graphml, .dot, .gv or .gexf", path, ext)
+	}
+}
+
+// Write writes the graph in format
+func (g *Graph) Write(w io.Writer, format string) error {
+	switch format {
+	case "graphml":
+		return g.WriteGraphML(w)
+	case "dot":
+		return g.WriteDOT(w)
+	case "gexf":
+		return g.WriteGEXF(w)
+	}
+	return fmt.Errorf("unknown graph format %q, expected %s", format, strings.Join(Formats, ", "))
+}
@@ -0,0 +1,140 @@
+// Package httpx holds the HTTP plumbing shared by the crawler, discovery and
+// sinks: the pooled and proxied transport, timed requests and JSON shape
+// checks.
+package httpx
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Flags of the HTTP plumbing
+var Flags = flag.NewFlagSet("httpx", flag.ContinueOnError)
+
+// Timeout of requests and connections, shared by every package
+var Timeout = Flags.Duration("timeout", 10*time.Second, "Timeout for each HTTP request, including reading the response (see -endpoint-timeouts)")
+
+// Retry flags, used by the crawler and the sinks
+var retryBackoff = Flags.Duration("retry-backoff", time.Second, "Delay before the first retry, doubled for each following retry")
+var retryMaxBackoff = Flags.Duration("retry-max-backoff", 30*time.Second, "Maximum delay between two retries")
+
+// Connection pool flags
+var maxIdleConns = Flags.Int("max-idle-conns", 1024, "Maximum number of idle keep-alive connections kept across all hosts")
+var maxIdleConnsPerHost = Flags.Int("max-idle-conns-per-host", 4, "Maximum number of idle keep-alive connections kept to each host")
+var idleConnTimeout = Flags.Duration("idle-conn-timeout", 90*time.Second, "How long an idle keep-alive connection is kept before being closed")
+
+// How much of an unread body is drained so its connection can be reused,
+// larger leftovers cost less as a new connection
+const drainLimit = 64 << 10
+
+// NewTransport returns a transport using the connection pool and proxy flags
+// and config. Every request of a client goes through its one transport so
+// connections are reused.
+func NewTransport(config *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	transport.Proxy = proxyFunc()
+	transport.MaxIdleConns = *maxIdleConns
+	transport.MaxIdleConnsPerHost = *maxIdleConnsPerHost
+	transport.IdleConnTimeout = *idleConnTimeout
+	return transport
+}
+
+// CloseBody closes a response body, reading what is left of it first so the
+// keep-alive connection goes back to the pool instead of being torn down
+func CloseBody(resp *http.Response) {
+	io.CopyN(ioutil.Discard, resp.Body, drainLimit)
+	resp.Body.Close()
+}
+
+// RetryableStatus returns true for HTTP statuses worth retrying
+func RetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// Backoff returns the delay before retry number attempt, the exponential delay is
+// capped and then jittered down by up to half so workers don't retry in lockstep
+func Backoff(attempt int) time.Duration {
+	delay := *retryBackoff
+	for i := 1; i < attempt && delay < *retryMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > *retryMaxBackoff {
+		delay = *retryMaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Request issues a GET with client within ctx that is abandoned after timeout
+// (0 for none). The timeout covers reading the body, it is released when the
+// body is closed.
+func Request(ctx context.Context, client *http.Client, url string, timeout time.Duration) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	Identify(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// Response body releasing the context of its request when closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Top-level JSON shapes expected from hosts
+const (
+	JSONObject = '{'
+	JSONArray  = '['
+)
+
+// DecodeShape decodes a JSON response into v after checking its top-level
+// shape, so that null or an error object where a list is expected isn't
+// mistaken for an empty result
+func DecodeShape(body io.Reader, shape byte, v interface{}) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return err
+	}
+	if len(raw) == 0 || raw[0] != shape {
+		expected := "object"
+		if shape == JSONArray {
+			expected = "list"
+		}
+		found := string(raw)
+		if len(found) > 32 {
+			found = found[:32] + "..."
+		}
+		return fmt.Errorf("expected a JSON %s, got %s", expected, found)
+	}
+	return json.Unmarshal(raw, v)
+}
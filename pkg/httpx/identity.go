@@ -0,0 +1,65 @@
+package httpx
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"runtime/debug"
+	"strings"
+)
+
+// Identity flags, so the admins of the crawled hosts can tell who is crawling
+// them and how to reach them
+var contact = Flags.String("contact", "", "URL or email address of whoever runs the crawl, added to the User-Agent so the admins of the crawled hosts can reach them")
+var fromHeader = Flags.Bool("from-header", false, "Also send the -contact email address in the From header of every request")
+var userAgent = Flags.String("user-agent", "", "User-Agent of every request, replacing the default one naming ps-splunk and the -contact")
+
+// Project page named by the default User-Agent
+const projectURL = "https://github.com/bored-engineer/ps-splunk"
+
+// Headers identifying the crawl, set by setupIdentity
+var identity = http.Header{}
+
+// Checks the identity flags and builds the headers they give
+func setupIdentity() error {
+	from := ""
+	if *fromHeader {
+		if *contact == "" {
+			return fmt.Errorf("-from-header needs -contact")
+		}
+		addr, err := mail.ParseAddress(*contact)
+		if err != nil {
+			return fmt.Errorf("-from-header needs an email address as -contact: %v", err)
+		}
+		from = addr.Address
+	}
+	if strings.ContainsAny(*contact, "\r\n()") {
+		return fmt.Errorf("invalid -contact %q", *contact)
+	}
+	agent := *userAgent
+	if agent == "" {
+		agent = "ps-splunk"
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			agent += "/" + strings.TrimPrefix(info.Main.Version, "v")
+		}
+		agent += " (perfSONAR crawler; +" + projectURL
+		if *contact != "" {
+			agent += "; contact: " + *contact
+		}
+		agent += ")"
+	}
+	identity = http.Header{}
+	identity.Set("User-Agent", agent)
+	if from != "" {
+		identity.Set("From", from)
+	}
+	return nil
+}
+
+// Identify sets the User-Agent, and the From header when asked for, of a
+// request instead of the default of Go
+func Identify(req *http.Request) {
+	for name, values := range identity {
+		req.Header[name] = values
+	}
+}
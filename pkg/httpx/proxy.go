@@ -0,0 +1,69 @@
+package httpx
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Proxy flags, without them the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables are honored
+var proxy = Flags.String("proxy", "", "Proxy every request goes through: http://host:port, https://host:port or socks5://host:port, credentials given as user:password@ (default from HTTP_PROXY, HTTPS_PROXY and NO_PROXY)")
+var socks5 = Flags.String("socks5", "", "SOCKS5 proxy every request goes through as host:port, the same as -proxy socks5://host:port")
+var proxyAuth = Flags.String("proxy-auth", "", "Credentials of the proxy as user:password, kept out of the -proxy URL")
+
+// The proxy set by the flags, nil to use the environment
+var proxyURL *url.URL
+
+// Setup checks the proxy and identity flags
+func Setup() error {
+	if err := setupIdentity(); err != nil {
+		return err
+	}
+	spec := *proxy
+	if *socks5 != "" {
+		if spec != "" {
+			return fmt.Errorf("-proxy and -socks5 are exclusive")
+		}
+		spec = "socks5://" + *socks5
+	}
+	if spec == "" {
+		if *proxyAuth != "" {
+			return fmt.Errorf("-proxy-auth needs -proxy or -socks5")
+		}
+		return nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return fmt.Errorf("invalid proxy %q: %v", spec, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("invalid proxy %q, expected an http, https or socks5 URL", spec)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return fmt.Errorf("invalid proxy %q: %v", spec, err)
+	}
+	if *proxyAuth != "" {
+		user, password, ok := strings.Cut(*proxyAuth, ":")
+		if !ok {
+			return fmt.Errorf("invalid -proxy-auth, expected user:password")
+		}
+		u.User = url.UserPassword(user, password)
+	}
+	proxyURL = u
+	return nil
+}
+
+// Returns the proxy function of the transports: the proxy of the flags, which
+// the transport authenticates to with the credentials of its URL, or the
+// environment
+func proxyFunc() func(*http.Request) (*url.URL, error) {
+	if proxyURL != nil {
+		return http.ProxyURL(proxyURL)
+	}
+	return http.ProxyFromEnvironment
+}
@@ -0,0 +1,89 @@
+package httpx
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timing is how long the phases of a request took, from when it was issued
+// for the first byte and the total. Phases a request skipped, such as the
+// lookup, connect and handshake on a reused connection, are zero.
+type Timing struct {
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	FirstByte    time.Duration
+	Total        time.Duration
+	Reused       bool
+}
+
+// Trace records the Timing of a request through net/http/httptrace. Parallel
+// dials of several addresses only count the first connection made.
+type Trace struct {
+	mu                               sync.Mutex
+	start                            time.Time
+	dnsStart, connectStart, tlsStart time.Time
+	timing                           Timing
+}
+
+// WithTrace returns ctx with a new Trace recording the request made with it
+func WithTrace(ctx context.Context) (context.Context, *Trace) {
+	t := &Trace{start: time.Now()}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.begin(&t.dnsStart) },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err == nil {
+				t.end(&t.timing.DNS, t.dnsStart)
+			}
+		},
+		ConnectStart: func(string, string) { t.begin(&t.connectStart) },
+		ConnectDone: func(network string, addr string, err error) {
+			if err == nil {
+				t.end(&t.timing.Connect, t.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() { t.begin(&t.tlsStart) },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				t.end(&t.timing.TLSHandshake, t.tlsStart)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.timing.Reused = info.Reused
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() { t.end(&t.timing.FirstByte, t.start) },
+	}), t
+}
+
+// Records the start of a phase, the first one when dials run in parallel
+func (t *Trace) begin(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+}
+
+// Records how long a phase took since from, unless it already ended
+func (t *Trace) end(phase *time.Duration, from time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if *phase == 0 && !from.IsZero() {
+		*phase = time.Since(from)
+	}
+}
+
+// Finish returns the Timing of the request, its total being the time since it
+// was issued
+func (t *Trace) Finish() Timing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timing := t.timing
+	timing.Total = time.Since(t.start)
+	return timing
+}
@@ -0,0 +1,171 @@
+// Package logging gives every crawler package a leveled, structured logger
+// scoped to its module, written as text or JSON. Records below warn go to
+// stdout (see SetOutput) and the others to stderr.
+package logging
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Flags of the logs, merged into the command line by cmd/map
+var Flags = flag.NewFlagSet("logging", flag.ContinueOnError)
+
+// Log flags
+var level = Flags.String("log-level", "info", "Lowest level logged: debug, info, warn or error, for every module or per module as module=level pairs, e.g. info,crawler=debug")
+var format = Flags.String("log-format", "text", "Format of the logs: text or json (one object per line)")
+
+// How the records are currently written and filtered
+type config struct {
+	format string
+	output io.Writer
+	low    slog.Handler
+	high   slog.Handler
+	level  slog.Level
+	levels map[string]slog.Level
+}
+
+// The current config, swapped by Setup and SetOutput
+var current atomic.Pointer[config]
+
+func init() {
+	current.Store(newConfig("text", os.Stdout, slog.LevelInfo, nil))
+}
+
+// Builds a config writing the records below warn to low and the others to stderr
+func newConfig(format string, low io.Writer, level slog.Level, levels map[string]slog.Level) *config {
+	c := &config{format: format, output: low, level: level, levels: levels}
+	c.low, c.high = newHandler(format, low), newHandler(format, os.Stderr)
+	return c
+}
+
+// Returns the handler of format writing to w, every level is passed through
+// as the modules filter the records themselves
+func newHandler(format string, w io.Writer) slog.Handler {
+	options := &slog.HandlerOptions{
+		AddSource:   true,
+		Level:       slog.LevelDebug,
+		ReplaceAttr: shortSource,
+	}
+	if format == "json" {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+// Replaces the source of a record with its file:line, like log.Lshortfile
+func shortSource(groups []string, a slog.Attr) slog.Attr {
+	if source, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey && len(groups) == 0 {
+		return slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", filepath.Base(source.File), source.Line))
+	}
+	return a
+}
+
+// Setup checks the log flags and switches every logger to them, keeping the
+// output set by SetOutput
+func Setup() error {
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("invalid -log-format %q, expected text or json", *format)
+	}
+	def, levels := slog.LevelInfo, make(map[string]slog.Level)
+	for _, pair := range strings.Split(*level, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		module, name, scoped := strings.Cut(pair, "=")
+		if !scoped {
+			name = module
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(name)); err != nil {
+			return fmt.Errorf("invalid -log-level %q: %v", pair, err)
+		}
+		if scoped {
+			levels[strings.TrimSpace(module)] = l
+		} else {
+			def = l
+		}
+	}
+	current.Store(newConfig(*format, current.Load().output, def, levels))
+	return nil
+}
+
+// SetOutput sets where the records below warn are written, stdout by default
+func SetOutput(w io.Writer) {
+	c := current.Load()
+	current.Store(newConfig(c.format, w, c.level, c.levels))
+}
+
+// Logger is the logger of a module, with Fatal for the failures the crawl
+// can't go on after
+type Logger struct {
+	*slog.Logger
+}
+
+// New returns the logger of module, its records carry a module attribute and
+// are filtered by the level of the module
+func New(module string) *Logger {
+	return &Logger{slog.New(&moduleHandler{module: module})}
+}
+
+// Fatal logs msg at the error level then exits
+func (l *Logger) Fatal(msg string, args ...any) {
+	var pcs [1]uintptr
+	// Skip runtime.Callers and Fatal so the source is the caller
+	runtime.Callers(2, pcs[:])
+	record := slog.NewRecord(time.Now(), slog.LevelError, msg, pcs[0])
+	record.Add(args...)
+	l.Handler().Handle(context.Background(), record)
+	os.Exit(1)
+}
+
+// Handler of a module, it writes through the current config so loggers made
+// before Setup follow the flags
+type moduleHandler struct {
+	module string
+	// Applied in order to the handler of the config by WithAttrs and WithGroup
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *moduleHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	c := current.Load()
+	if module, ok := c.levels[h.module]; ok {
+		return l >= module
+	}
+	return l >= c.level
+}
+
+func (h *moduleHandler) Handle(ctx context.Context, r slog.Record) error {
+	c := current.Load()
+	handler := c.low
+	if r.Level >= slog.LevelWarn {
+		handler = c.high
+	}
+	handler = handler.WithAttrs([]slog.Attr{slog.String("module", h.module)})
+	for _, with := range h.with {
+		handler = with(handler)
+	}
+	return handler.Handle(ctx, r)
+}
+
+func (h *moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.extend(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *moduleHandler) WithGroup(name string) slog.Handler {
+	return h.extend(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+// Returns a copy of the handler applying with after its own
+func (h *moduleHandler) extend(with func(slog.Handler) slog.Handler) slog.Handler {
+	return &moduleHandler{module: h.module, with: append(h.with[:len(h.with):len(h.with)], with)}
+}
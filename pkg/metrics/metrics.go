@@ -0,0 +1,261 @@
+// Package metrics implements the Prometheus counters, gauges and histograms
+// of the crawl without any dependency.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Every metric exposed on /metrics, in registration order
+var registry []metric
+
+// A metric able to write itself in the Prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+// CounterVec is a counter with a value per combination of label values
+type CounterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	// The label values of each rendered key
+	keys map[string][]string
+}
+
+// NewCounterVec creates and registers a counter
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64), keys: make(map[string][]string)}
+	// A counter without labels is exposed from the start
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+	registry = append(registry, c)
+	return c
+}
+
+// Add adds v to the counter of the label values
+func (c *CounterVec) Add(v float64, values ...string) {
+	key := renderLabels(c.labels, values)
+	c.Lock()
+	c.values[key] += v
+	c.keys[key] = values
+	c.Unlock()
+}
+
+// Total returns the sum of the counter over every label value
+func (c *CounterVec) Total() float64 {
+	c.Lock()
+	defer c.Unlock()
+	sum := 0.0
+	for _, v := range c.values {
+		sum += v
+	}
+	return sum
+}
+
+// SumBy returns the counter summed by the values of one of its labels
+func (c *CounterVec) SumBy(label string) map[string]float64 {
+	sums := make(map[string]float64)
+	c.Lock()
+	defer c.Unlock()
+	for i, name := range c.labels {
+		if name != label {
+			continue
+		}
+		for key, v := range c.values {
+			if values := c.keys[key]; i < len(values) {
+				sums[values[i]] += v
+			}
+		}
+	}
+	return sums
+}
+
+// Inc increments the counter of the label values
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.Lock()
+	defer c.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// GaugeFunc is a gauge read from a function when scraped, returning a value per label values
+type GaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	read   func() map[string]float64
+}
+
+// NewGaugeFunc creates and registers a gauge, read keys are the values of its single label
+func NewGaugeFunc(name string, help string, label string, read func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, read: read}
+	if label != "" {
+		g.labels = []string{label}
+	}
+	registry = append(registry, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	values := g.read()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels := ""
+		if len(g.labels) > 0 {
+			labels = renderLabels(g.labels, []string{key})
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatFloat(values[key]))
+	}
+}
+
+// HistogramVec is a histogram with a series per combination of label values
+type HistogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+// Observations of one histogram series
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a histogram with the given upper bounds
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	registry = append(registry, h)
+	return h
+}
+
+// Observe records an observation for the label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := renderLabels(h.labels, values)
+	h.Lock()
+	defer h.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.Lock()
+	defer h.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		series := h.series[key]
+		values := append(append([]string{}, series.values...), "")
+		for i, bound := range h.buckets {
+			values[len(values)-1] = formatFloat(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, renderLabels(labels, values), series.counts[i])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, renderLabels(labels, values), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, series.count)
+	}
+}
+
+// Renders label names and values as {a="x",b="y"}
+func renderLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		pairs[i] = name + `="` + value + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Returns the keys of a counter sorted
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Formats a sample value the way Prometheus expects
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// DurationBuckets are the buckets in seconds for request and host crawl durations
+var DurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// Handler serves every registered metric in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		buffered := bufio.NewWriter(w)
+		for _, m := range registry {
+			m.write(buffered)
+		}
+		buffered.Flush()
+	})
+}
+
+// Serve serves the metrics on /metrics of addr, and the other handlers by
+// their path, until the listener fails
+func Serve(addr string, handlers map[string]http.Handler) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	for path, handler := range handlers {
+		mux.Handle(path, handler)
+	}
+	return http.ListenAndServe(addr, mux)
+}
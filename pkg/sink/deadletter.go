@@ -0,0 +1,88 @@
+package sink
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/metrics"
+)
+
+// Dead-letter flags
+var deadLetterFile = Flags.String("dead-letter-file", "", "Newline delimited JSON file the events rejected by the HEC and Elasticsearch sinks, or dropped after their retries, are appended to with the reason, \"none\" to only log them (default a dead_letter file named like the output files in -output-dir)")
+
+// Events written to the dead-letter file
+var deadLetters = metrics.NewCounterVec("ps_dead_letter_events_total", "Events rejected or dropped by each sink and written to the dead-letter file.", "stream", "sink")
+
+// The dead-letter file, created with the first event written to it
+var deadLetter struct {
+	sync.Mutex
+	file *os.File
+	path string
+}
+
+// Record of the dead-letter file, the event as the sink got it and why it
+// gave up on it
+type deadLetterRecord struct {
+	event.Header
+	Stream string          `json:"stream"`
+	Sink   string          `json:"sink"`
+	Reason string          `json:"reason"`
+	Event  json.RawMessage `json:"event"`
+}
+
+// Appends the events a sink of stream rejected or dropped to the dead-letter
+// file, so they can be inspected and sent again
+func writeDeadLetters(stream string, sink string, reason string, events [][]byte) {
+	if *deadLetterFile == "none" || len(events) == 0 {
+		return
+	}
+	deadLetter.Lock()
+	defer deadLetter.Unlock()
+	if deadLetter.file == nil {
+		path := *deadLetterFile
+		if path == "" {
+			path = fileName(*outputDir, "dead_letter", 0, ".json")
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			logger.Error("Creating dead-letter file failed", "err", err)
+			return
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			logger.Error("Creating dead-letter file failed", "err", err)
+			return
+		}
+		deadLetter.file, deadLetter.path = file, path
+		logger.Warn("Writing rejected events to the dead-letter file", "file", path)
+	}
+	var records []byte
+	for _, payload := range events {
+		record := deadLetterRecord{event.NewHeader(), stream, sink, reason, payload}
+		data, err := json.Marshal(record)
+		if err != nil {
+			// Not valid JSON, keep it as a string
+			record.Event, _ = json.Marshal(string(payload))
+			data, _ = json.Marshal(record)
+		}
+		records = append(append(records, data...), '\n')
+	}
+	if _, err := deadLetter.file.Write(records); err != nil {
+		logger.Error("Writing dead-letter file failed", "stream", stream, "events", len(events), "err", err)
+		return
+	}
+	deadLetters.Add(float64(len(events)), stream, sink)
+}
+
+// Closes the dead-letter file, if any, adding it to the manifest
+func closeDeadLetters() {
+	deadLetter.Lock()
+	defer deadLetter.Unlock()
+	if deadLetter.file != nil {
+		deadLetter.file.Close()
+		deadLetter.file = nil
+		addToManifest("dead_letter", deadLetter.path, -1)
+	}
+}
@@ -0,0 +1,436 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Elasticsearch/OpenSearch flags
+var esURL = Flags.String("es-url", "", "Elasticsearch or OpenSearch URL used by the elasticsearch and opensearch sinks, e.g. https://es:9200")
+var esUsername = Flags.String("es-username", "", "User for basic authentication to Elasticsearch/OpenSearch")
+var esPassword = Flags.String("es-password", "", "Password for basic authentication to Elasticsearch/OpenSearch")
+var esAPIKey = Flags.String("es-api-key", "", "Base64 encoded Elasticsearch API key, used instead of basic authentication")
+var esBatchSize = Flags.Int("es-batch-size", 500, "Maximum number of events sent in one bulk request")
+var esRetries = Flags.Int("es-retries", 5, "Number of times a bulk request or its throttled events are retried before being dropped")
+var esTemplates = Flags.Bool("es-templates", true, "Install an index template for every stream indexed")
+var esInsecureSkipVerify = Flags.Bool("es-insecure-skip-verify", false, "Don't verify the Elasticsearch/OpenSearch server certificate")
+var esIndexes = streamStrings{}
+
+func init() {
+	Flags.Var(esIndexes, "es-index", "Index name prefix for every stream, or per stream as stream=prefix pairs, events go to daily <prefix>-YYYY.MM.DD indexes (default ps-<stream>)")
+}
+
+// HTTP client used for Elasticsearch, separate from the crawl client and its TLS settings
+var esClient = http.Client{Timeout: time.Minute}
+
+// Index prefixes whose template was already installed
+var esInstalled = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// Response returned by the bulk API, each item is keyed by its action
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// Checks the Elasticsearch flags and configures its client
+func setupElastic() error {
+	if *esURL == "" {
+		return nil
+	}
+	if *esBatchSize < 1 {
+		return fmt.Errorf("-es-batch-size must be at least 1")
+	}
+	esClient.Transport = httpx.NewTransport(&tls.Config{InsecureSkipVerify: *esInsecureSkipVerify})
+	return nil
+}
+
+// Sink indexing events in batches with the bulk API
+type esSink struct {
+	stream  string
+	prefix  string
+	actions [][]byte
+}
+
+// Creates the Elasticsearch sink of stream, flavor is elasticsearch or opensearch
+// and only changes how the free form payloads are mapped by the template
+func newESSink(stream string, flavor string) (*esSink, error) {
+	if *esURL == "" {
+		return nil, fmt.Errorf("-es-url is required")
+	}
+	prefix := esIndexes.get(stream, "ps-"+stream)
+	if *esTemplates {
+		if err := esInstallTemplate(stream, prefix, flavor); err != nil {
+			return nil, fmt.Errorf("installing the %s index template: %v", prefix, err)
+		}
+	}
+	return &esSink{stream: stream, prefix: prefix}, nil
+}
+
+func (s *esSink) Write(log Event) error {
+	// Index by the collection day of the event so old indexes can be rolled off
+	index := s.prefix + "-" + log.Time.UTC().Format("2006.01.02")
+	action := fmt.Sprintf("{\"index\":{\"_index\":%q}}\n%s\n", index, log.Payload)
+	s.actions = append(s.actions, []byte(action))
+	if len(s.actions) >= *esBatchSize {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Sends the pending batch, if any. Events that still fail after the retries
+// are dropped so they don't block the stream.
+func (s *esSink) Flush() error {
+	if len(s.actions) == 0 {
+		return nil
+	}
+	actions := s.actions
+	s.actions = nil
+	return esBulk(s.stream, actions)
+}
+
+func (s *esSink) Close() error {
+	return s.Flush()
+}
+
+// Sends actions of stream with the bulk API, resending the whole request on
+// throttling and server errors, and the events rejected with a 429 on their own
+func esBulk(stream string, actions [][]byte) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var throttled [][]byte
+		throttled, err = esPost(stream, actions)
+		if err == nil && len(throttled) == 0 {
+			return nil
+		}
+		if err == nil {
+			actions = throttled
+			err = fmt.Errorf("%d events throttled", len(throttled))
+		}
+		if _, permanent := err.(esRejected); permanent || attempt > *esRetries {
+			writeDeadLetters(stream, "elasticsearch", err.Error(), esEvents(actions))
+			return fmt.Errorf("dropped %d events: %v", len(actions), err)
+		}
+		delay := httpx.Backoff(attempt)
+		logger.Warn("Retrying bulk request", "delay", delay, "err", err)
+		time.Sleep(delay)
+	}
+}
+
+// Error for requests or events Elasticsearch rejected and that won't succeed when retried
+type esRejected struct {
+	status string
+	text   string
+}
+
+func (e esRejected) Error() string {
+	return "Elasticsearch rejected the request: " + e.status + ": " + e.text
+}
+
+// Returns the events of index actions, the line after their metadata
+func esEvents(actions [][]byte) [][]byte {
+	events := make([][]byte, len(actions))
+	for i, action := range actions {
+		events[i] = bytes.TrimSpace(action[bytes.IndexByte(action, '\n')+1:])
+	}
+	return events
+}
+
+// Posts one bulk request, returning the actions of the events throttled with
+// a 429. The events rejected otherwise go to the dead-letter file.
+func esPost(stream string, actions [][]byte) ([][]byte, error) {
+	resp, err := esRequest("POST", "/_bulk", "application/x-ndjson", bytes.Join(actions, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer httpx.CloseBody(resp)
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if httpx.RetryableStatus(resp.StatusCode) {
+			return nil, fmt.Errorf("%s: %s", resp.Status, data)
+		}
+		return nil, esRejected{resp.Status, string(data)}
+	}
+	var parsed esBulkResponse
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	if !parsed.Errors {
+		return nil, nil
+	}
+	// Keep the throttled events and dead letter the others
+	var throttled [][]byte
+	failed := 0
+	var reason json.RawMessage
+	for i, item := range parsed.Items {
+		for _, result := range item {
+			switch {
+			case result.Status == http.StatusTooManyRequests && i < len(actions):
+				throttled = append(throttled, actions[i])
+			case result.Status >= 300:
+				failed++
+				reason = result.Error
+				if i < len(actions) {
+					writeDeadLetters(stream, "elasticsearch", fmt.Sprintf("%d: %s", result.Status, result.Error), esEvents(actions[i:i+1]))
+				}
+			}
+		}
+	}
+	if failed > 0 {
+		logger.Error("Elasticsearch rejected events", "events", failed, "reason", reason)
+	}
+	return throttled, nil
+}
+
+// Sends an authenticated request to the Elasticsearch URL
+func esRequest(method string, path string, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(*esURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	switch {
+	case *esAPIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+*esAPIKey)
+	case *esUsername != "":
+		req.SetBasicAuth(*esUsername, *esPassword)
+	}
+	return esClient.Do(req)
+}
+
+// Installs the composable index template matching the daily indexes of prefix
+func esInstallTemplate(stream string, prefix string, flavor string) error {
+	esInstalled.Lock()
+	defer esInstalled.Unlock()
+	if esInstalled.m[prefix] {
+		return nil
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"index_patterns": []string{prefix + "-*"},
+		"priority":       100,
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"properties": esMapping(stream, flavor),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := esRequest("PUT", "/_index_template/"+prefix, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer httpx.CloseBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, data)
+	}
+	esInstalled.m[prefix] = true
+	return nil
+}
+
+// Returns the field mappings of the events of stream. The summaries, results
+// and tasks differ between hosts, so they are kept as flattened objects instead of letting
+// dynamic mapping run into conflicting types.
+func esMapping(stream string, flavor string) map[string]interface{} {
+	keyword := map[string]interface{}{"type": "keyword"}
+	flattened := map[string]interface{}{"type": "flattened"}
+	if flavor == "opensearch" {
+		flattened = map[string]interface{}{"type": "flat_object"}
+	}
+	properties := map[string]interface{}{
+		"schema_version": map[string]interface{}{"type": "integer"},
+		"run_id":         keyword,
+		"time":           map[string]interface{}{"type": "date"},
+		"collector":      keyword,
+		"site":           keyword,
+	}
+	enrichment := map[string]interface{}{
+		"geo": map[string]interface{}{"properties": map[string]interface{}{
+			"country_code": keyword,
+			"country":      keyword,
+			"city":         keyword,
+			"latitude":     map[string]interface{}{"type": "double"},
+			"longitude":    map[string]interface{}{"type": "double"},
+		}},
+		"asn": map[string]interface{}{"properties": map[string]interface{}{
+			"number": map[string]interface{}{"type": "long"},
+			"name":   keyword,
+			"prefix": keyword,
+		}},
+		"meshes": keyword,
+	}
+	switch stream {
+	case "link":
+		properties["address"] = keyword
+		properties["origin"] = keyword
+		properties["depth"] = map[string]interface{}{"type": "integer"}
+		properties["count"] = map[string]interface{}{"type": "integer"}
+		for name, mapping := range enrichment {
+			properties[name] = mapping
+		}
+	case "summary":
+		properties["host"] = keyword
+		properties["summary"] = flattened
+		for name, mapping := range enrichment {
+			properties[name] = mapping
+		}
+	case "results":
+		properties["host"] = keyword
+		properties["source"] = keyword
+		properties["result"] = flattened
+	case "tasks":
+		properties["host"] = keyword
+		properties["task"] = flattened
+		properties["runs"] = flattened
+	case "paths":
+		for _, name := range []string{"host", "archive", "metadata_key", "source", "destination", "tool_name", "path_id"} {
+			properties[name] = keyword
+		}
+		properties["ts"] = map[string]interface{}{"type": "date", "format": "epoch_second"}
+		properties["hop_count"] = map[string]interface{}{"type": "integer"}
+		properties["hops"] = map[string]interface{}{"properties": map[string]interface{}{
+			"ttl":      map[string]interface{}{"type": "integer"},
+			"query":    map[string]interface{}{"type": "integer"},
+			"ip":       keyword,
+			"hostname": keyword,
+			"rtt":      map[string]interface{}{"type": "double"},
+			"mtu":      map[string]interface{}{"type": "integer"},
+			"success":  map[string]interface{}{"type": "boolean"},
+			"error":    map[string]interface{}{"type": "text"},
+		}}
+	case "timeseries":
+		for _, name := range []string{"host", "archive", "metadata_key", "source", "destination", "tool_name", "event_type", "summary_type"} {
+			properties[name] = keyword
+		}
+		properties["summary_window"] = map[string]interface{}{"type": "integer"}
+		properties["ts"] = map[string]interface{}{"type": "date", "format": "epoch_second"}
+		// Numbers or objects depending on the event type, kept in the source only
+		properties["value"] = map[string]interface{}{"type": "object", "enabled": false}
+		for _, name := range []string{"throughput", "latency", "loss", "min", "mean", "max", "p95"} {
+			properties[name] = map[string]interface{}{"type": "double"}
+		}
+		properties["aggregate_window"] = map[string]interface{}{"type": "integer"}
+		properties["count"] = map[string]interface{}{"type": "integer"}
+	case "inventory":
+		for _, name := range []string{"host", "toolkit_version", "toolkit_rpm_version", "os", "kernel_version", "communities", "issues"} {
+			properties[name] = keyword
+		}
+		for _, name := range []string{"ntp_synchronized", "auto_updates", "globally_registered"} {
+			properties[name] = map[string]interface{}{"type": "boolean"}
+		}
+		properties["services"] = map[string]interface{}{"properties": map[string]interface{}{
+			"name":      keyword,
+			"version":   keyword,
+			"enabled":   map[string]interface{}{"type": "boolean"},
+			"running":   map[string]interface{}{"type": "boolean"},
+			"addresses": keyword,
+		}}
+		properties["ntp"] = map[string]interface{}{"properties": map[string]interface{}{
+			"source":           keyword,
+			"stratum":          map[string]interface{}{"type": "integer"},
+			"offset":           map[string]interface{}{"type": "double"},
+			"delay":            map[string]interface{}{"type": "double"},
+			"polling_interval": map[string]interface{}{"type": "integer"},
+		}}
+		// Whatever the toolkit schedules, kept in the source only
+		properties["calendar"] = map[string]interface{}{"type": "object", "enabled": false}
+	case "expected":
+		for _, name := range []string{"mesh", "task", "test_type", "event_type", "source", "destination", "archives"} {
+			properties[name] = keyword
+		}
+		properties["gap"] = map[string]interface{}{"type": "boolean"}
+		properties["last_updated"] = map[string]interface{}{"type": "date"}
+	case "components":
+		for _, name := range []string{"label", "host", "meshes"} {
+			properties[name] = keyword
+		}
+		for _, name := range []string{"component", "hosts", "reachable_hosts"} {
+			properties[name] = map[string]interface{}{"type": "integer"}
+		}
+		properties["reachable"] = map[string]interface{}{"type": "boolean"}
+	case "report":
+		properties["start_time"] = map[string]interface{}{"type": "date"}
+		properties["end_time"] = map[string]interface{}{"type": "date"}
+		properties["duration_seconds"] = map[string]interface{}{"type": "double"}
+	case "pairs":
+		for _, name := range []string{"host_a", "host_b", "direction", "reporters"} {
+			properties[name] = keyword
+		}
+		properties["a_to_b"] = map[string]interface{}{"type": "boolean"}
+		properties["b_to_a"] = map[string]interface{}{"type": "boolean"}
+		properties["tests"] = map[string]interface{}{"type": "integer"}
+	case "truncated":
+		properties["reason"] = keyword
+		properties["budget_seconds"] = map[string]interface{}{"type": "double"}
+		properties["elapsed_seconds"] = map[string]interface{}{"type": "double"}
+		properties["completed"] = map[string]interface{}{"type": "integer"}
+		properties["pending"] = map[string]interface{}{"type": "integer"}
+	case "failed":
+		properties["address"] = keyword
+		properties["endpoint"] = keyword
+		properties["url"] = keyword
+		properties["attempts"] = map[string]interface{}{"type": "integer"}
+		properties["error"] = map[string]interface{}{"type": "text"}
+	case "host_status":
+		properties["host"] = keyword
+		properties["bundle"] = keyword
+		for _, name := range []string{"reachable", "has_toolkit", "has_graphs", "has_esmond", "has_pscheduler"} {
+			properties[name] = map[string]interface{}{"type": "boolean"}
+		}
+		properties["duration_seconds"] = map[string]interface{}{"type": "double"}
+		properties["endpoints"] = map[string]interface{}{"properties": map[string]interface{}{
+			"endpoint":              keyword,
+			"calls":                 map[string]interface{}{"type": "integer"},
+			"status_codes":          flattened,
+			"errors":                flattened,
+			"last_status":           map[string]interface{}{"type": "integer"},
+			"new_connections":       map[string]interface{}{"type": "integer"},
+			"dns_seconds":           map[string]interface{}{"type": "double"},
+			"connect_seconds":       map[string]interface{}{"type": "double"},
+			"tls_handshake_seconds": map[string]interface{}{"type": "double"},
+			"ttfb_seconds":          map[string]interface{}{"type": "double"},
+			"latency_seconds":       map[string]interface{}{"type": "double"},
+			"max_latency_seconds":   map[string]interface{}{"type": "double"},
+		}}
+	case "metrics":
+		for _, name := range []string{"metric_name", "archive_host", "metadata_key", "source_address", "destination_address", "tool_name", "event_type", "summary_type"} {
+			properties[name] = keyword
+		}
+		properties["_value"] = map[string]interface{}{"type": "double"}
+		properties["summary_window"] = map[string]interface{}{"type": "integer"}
+		properties["aggregate_window"] = map[string]interface{}{"type": "integer"}
+	case "errors":
+		for _, name := range []string{"host", "endpoint", "url", "category"} {
+			properties[name] = keyword
+		}
+		properties["status"] = map[string]interface{}{"type": "integer"}
+		properties["error"] = map[string]interface{}{"type": "text"}
+	case "parse_errors":
+		properties["host"] = keyword
+		properties["endpoint"] = keyword
+		properties["url"] = keyword
+		properties["error"] = map[string]interface{}{"type": "text"}
+		// Whatever the host sent, kept in the source only
+		properties["payload"] = map[string]interface{}{"type": "object", "enabled": false}
+	}
+	return properties
+}
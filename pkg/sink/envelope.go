@@ -0,0 +1,119 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Event is an event queued to a stream: its JSON payload and what the sinks
+// route and index it by, read from the payload once, the host it is about
+// (its address for links and failures) and when it was collected. Every sink
+// serializes it in its own format.
+type Event struct {
+	Stream  string
+	Host    string
+	Time    time.Time
+	Payload []byte
+}
+
+// NewEvent returns the event of stream with the JSON payload, timestamped now
+// when the payload has no collection time
+func NewEvent(stream string, payload []byte) Event {
+	var keys struct {
+		Time    string `json:"time"`
+		Host    string `json:"host"`
+		Address string `json:"address"`
+	}
+	json.Unmarshal(payload, &keys)
+	e := Event{Stream: stream, Host: keys.Host, Payload: bytes.TrimSpace(payload)}
+	if e.Host == "" {
+		e.Host = keys.Address
+	}
+	collected, err := time.Parse(event.TimeLayout, keys.Time)
+	if err != nil {
+		collected = time.Now()
+	}
+	e.Time = collected
+	return e
+}
+
+// NDJSON returns the payload newline terminated, as the file, stdout and TCP
+// sinks write it
+func (e Event) NDJSON() []byte {
+	return append(append(make([]byte, 0, len(e.Payload)+1), e.Payload...), '\n')
+}
+
+// Protobuf returns the event encoded as the message
+//
+//	message Event {
+//	  string stream = 1;
+//	  string host = 2;
+//	  int64 time_unix_micro = 3;
+//	  bytes payload = 4;
+//	}
+func (e Event) Protobuf() []byte {
+	b := make([]byte, 0, len(e.Payload)+len(e.Stream)+len(e.Host)+32)
+	b = protobufBytes(b, 1, []byte(e.Stream))
+	b = protobufBytes(b, 2, []byte(e.Host))
+	b = binary.AppendUvarint(b, 3<<3)
+	b = binary.AppendUvarint(b, uint64(e.Time.UnixNano()/1e3))
+	return protobufBytes(b, 4, e.Payload)
+}
+
+// Appends a length delimited field, omitted when empty like proto3 does
+func protobufBytes(b []byte, field uint64, value []byte) []byte {
+	if len(value) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// Checks a -<sink>-format flag of the message brokers
+func checkFormat(name string, format string) error {
+	if format != "json" && format != "protobuf" {
+		return fmt.Errorf("invalid -%s %q, expected json or protobuf", name, format)
+	}
+	return nil
+}
+
+// Returns the message of an event in format, its JSON payload or the
+// protobuf Event
+func encodeEvent(e Event, format string) []byte {
+	if format == "protobuf" {
+		return e.Protobuf()
+	}
+	return e.Payload
+}
+
+// Returns the content type of the messages in format
+func formatContentType(format string) string {
+	if format == "protobuf" {
+		return "application/x-protobuf"
+	}
+	return "application/json"
+}
+
+// Encodes an event spilled to disk, the stream being that of the queue
+func (e Event) spillRecord() []byte {
+	record := make([]byte, 0, 4+2+len(e.Host)+8+len(e.Payload))
+	record = binary.BigEndian.AppendUint32(record, uint32(2+len(e.Host)+8+len(e.Payload)))
+	record = binary.BigEndian.AppendUint16(record, uint16(len(e.Host)))
+	record = append(record, e.Host...)
+	record = binary.BigEndian.AppendUint64(record, uint64(e.Time.UnixNano()))
+	return append(record, e.Payload...)
+}
+
+// Decodes an event spilled to disk by stream, without its length
+func spilledEvent(stream string, record []byte) Event {
+	hostLen := int(binary.BigEndian.Uint16(record))
+	host := string(record[2 : 2+hostLen])
+	nanos := int64(binary.BigEndian.Uint64(record[2+hostLen:]))
+	return Event{Stream: stream, Host: host, Time: time.Unix(0, nanos), Payload: record[2+hostLen+8:]}
+}
@@ -0,0 +1,114 @@
+package sink
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// File name flags
+var fileTemplate = Flags.String("file-template", "", "Name of the files written under -output-dir, with the {stream}, {start_time}, {seq} and {collector} tokens and the strftime %Y, %m, %d, %H, %M, %S, %y and %j of the crawl start, "+
+	"e.g. %Y/%m/%d/{stream}-{start_time}-{seq}.json.gz (default {start_time}-{stream}.json, or {start_time}-{seq}-{stream}.json when numbered)")
+
+// Extensions the sinks give their files, in place of those of -file-template
+var fileExtensions = []string{".json.gz", ".json", ".parquet"}
+
+// Checks -file-template
+func setupFileTemplate() error {
+	if *fileTemplate == "" {
+		return nil
+	}
+	if !strings.Contains(*fileTemplate, "{stream}") {
+		return fmt.Errorf("-file-template must contain {stream}, the sourcetype is taken from it")
+	}
+	if filepath.IsAbs(*fileTemplate) || strings.HasPrefix(filepath.Clean(*fileTemplate), "..") {
+		return fmt.Errorf("-file-template must stay under -output-dir")
+	}
+	if numberedFiles() && !strings.Contains(*fileTemplate, "{seq}") {
+		return fmt.Errorf("-file-template must contain {seq} when the files are numbered by -file-gzip, -file-atomic, -file-max-size or -file-max-age")
+	}
+	return nil
+}
+
+// Returns the path of a file of stream under dir with the extension ext, part
+// numbering the files of a stream from 1 or 0 for its only file
+func fileName(dir string, stream string, part int, ext string) string {
+	if *fileTemplate == "" {
+		if part == 0 {
+			return filepath.Join(dir, event.StartTime+"-"+stream+ext)
+		}
+		return filepath.Join(dir, fmt.Sprintf("%s-%04d-%s%s", event.StartTime, part, stream, ext))
+	}
+	name := *fileTemplate
+	for _, known := range fileExtensions {
+		if strings.HasSuffix(name, known) {
+			name = strings.TrimSuffix(name, known)
+			break
+		}
+	}
+	if part == 0 {
+		part = 1
+	}
+	return filepath.Join(dir, filepath.FromSlash(expandName(name, stream, part))+ext)
+}
+
+// Expands the tokens of -file-template in name for part of stream
+func expandName(name string, stream string, part int) string {
+	start, _ := time.Parse("20060102T150405Z", event.StartTime)
+	return strings.NewReplacer(
+		"{stream}", stream,
+		"{start_time}", event.StartTime,
+		"{seq}", fmt.Sprintf("%04d", part),
+		"{collector}", safeName(event.Vantage()),
+	).Replace(strftime(name, start))
+}
+
+// Expands the strftime tokens of format with t
+func strftime(format string, t time.Time) string {
+	var name strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			name.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&name, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&name, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&name, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&name, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&name, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&name, "%02d", t.Second())
+		case 'y':
+			fmt.Fprintf(&name, "%02d", t.Year()%100)
+		case 'j':
+			fmt.Fprintf(&name, "%03d", t.YearDay())
+		case '%':
+			name.WriteByte('%')
+		default:
+			name.WriteByte('%')
+			name.WriteByte(format[i])
+		}
+	}
+	return name.String()
+}
+
+// Replaces what isn't safe in a file name, such as the spaces of a collector
+func safeName(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.', r == '@':
+			return r
+		}
+		return '_'
+	}, value)
+}
@@ -0,0 +1,108 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Most bytes of events forwarded to the coordinator in one request
+const forwardBatchBytes = 4 << 20
+
+// Number of times a failed forward is retried before its events are dropped
+const forwardRetries = 10
+
+// Coordinator the events of a distributed crawl worker are forwarded to, set
+// by ForwardTo
+var forwardURL, forwardToken string
+
+// HTTP client used to forward the events
+var forwardClient = http.Client{Timeout: time.Minute}
+
+// ForwardTo makes every stream forward its events to the coordinator of a
+// distributed crawl at url, which writes them to its own sinks
+func ForwardTo(url string, token string) {
+	forwardURL, forwardToken = strings.TrimSuffix(url, "/"), token
+	forwardClient.Transport = httpx.NewTransport(nil)
+}
+
+// Forward adds an event already serialized and newline terminated, as
+// forwarded by a worker of a distributed crawl or replayed from a file
+func (q *Queue) Forward(line []byte) {
+	eventsEmitted.Inc(q.name)
+	bytesEmitted.Add(float64(len(line)), q.name)
+	q.put(NewEvent(q.name, line))
+}
+
+// Sink posting the events of a stream to the coordinator in batches
+type forwardSink struct {
+	stream string
+	batch  bytes.Buffer
+}
+
+// Creates the forwarding sink of stream
+func newForwardSink(stream string) (*forwardSink, error) {
+	if forwardURL == "" {
+		return nil, fmt.Errorf("only workers of a distributed crawl forward their events")
+	}
+	return &forwardSink{stream: stream}, nil
+}
+
+func (s *forwardSink) Write(event Event) error {
+	s.batch.Write(event.NDJSON())
+	if s.batch.Len() >= forwardBatchBytes {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Posts the pending events, if any. Events that still fail after the retries
+// are dropped so they don't block the stream.
+func (s *forwardSink) Flush() error {
+	if s.batch.Len() == 0 {
+		return nil
+	}
+	defer s.batch.Reset()
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = s.post(s.batch.Bytes()); err == nil {
+			return nil
+		}
+		if attempt > forwardRetries {
+			return fmt.Errorf("dropped %d bytes of events: %v", s.batch.Len(), err)
+		}
+		delay := httpx.Backoff(attempt)
+		logger.Warn("Retrying forwarding events to the coordinator", "stream", s.stream, "delay", delay, "err", err)
+		time.Sleep(delay)
+	}
+}
+
+// Posts newline delimited events to the events endpoint of the coordinator
+func (s *forwardSink) post(events []byte) error {
+	req, err := http.NewRequest("POST", forwardURL+"/events?stream="+url.QueryEscape(s.stream), bytes.NewReader(events))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Authorization", "Bearer "+forwardToken)
+	resp, err := forwardClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpx.CloseBody(resp)
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func (s *forwardSink) Close() error {
+	return s.Flush()
+}
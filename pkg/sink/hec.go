@@ -0,0 +1,341 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Splunk HTTP Event Collector flags
+var hecURL = Flags.String("hec-url", "", "Splunk HTTP Event Collector URL used by the hec sink, e.g. https://splunk:8088")
+var hecToken = Flags.String("hec-token", "", "HTTP Event Collector token")
+var hecBatchSize = Flags.Int("hec-batch-size", 500, "Maximum number of events sent in one HEC request")
+var hecGzip = Flags.Bool("hec-gzip", true, "Gzip compress HEC requests")
+var hecAck = Flags.Bool("hec-ack", false, "Wait for indexer acknowledgement of every HEC batch, the token must have acknowledgement enabled")
+var hecAckTimeout = Flags.Duration("hec-ack-timeout", 2*time.Minute, "How long to wait for an acknowledgement before resending a batch")
+var hecRetries = Flags.Int("hec-retries", 5, "Number of times a failed HEC request is retried before the batch is dropped")
+var hecInsecureSkipVerify = Flags.Bool("hec-insecure-skip-verify", false, "Don't verify the HEC server certificate")
+var hecSourcetypes = streamStrings{}
+var hecIndexes = streamStrings{}
+
+func init() {
+	Flags.Var(hecSourcetypes, "hec-sourcetype", "HEC sourcetype for every stream, or per stream as stream=sourcetype pairs (default ps-<stream>)")
+	Flags.Var(hecIndexes, "hec-index", "HEC index for every stream, or per stream as stream=index pairs (default the token's index)")
+}
+
+// HTTP client used for HEC, separate from the crawl client and its TLS settings
+var hecClient = http.Client{Timeout: time.Minute}
+
+// Envelope of every event sent to HEC, metrics are sent as a metric event
+// with their name, value and dimensions as fields
+type hecEvent struct {
+	Time       float64                `json:"time"`
+	Source     string                 `json:"source"`
+	Sourcetype string                 `json:"sourcetype"`
+	Index      string                 `json:"index,omitempty"`
+	Event      json.RawMessage        `json:"event"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Stream whose events are Splunk metrics
+const metricsStream = "metrics"
+
+// Response returned by the HEC endpoints
+type hecResponse struct {
+	Text  string          `json:"text"`
+	Code  int             `json:"code"`
+	AckID *int64          `json:"ackId"`
+	Acks  map[string]bool `json:"acks"`
+	// Index of the event that made HEC reject a batch
+	InvalidEvent *int `json:"invalid-event-number"`
+}
+
+// Checks the HEC flags and configures its client
+func setupHEC() error {
+	if *hecURL == "" {
+		return nil
+	}
+	if *hecToken == "" {
+		return fmt.Errorf("-hec-token is required with -hec-url")
+	}
+	if *hecBatchSize < 1 {
+		return fmt.Errorf("-hec-batch-size must be at least 1")
+	}
+	hecClient.Transport = httpx.NewTransport(&tls.Config{InsecureSkipVerify: *hecInsecureSkipVerify})
+	return nil
+}
+
+// Sink sending events to the event collector in batches
+type hecSink struct {
+	stream     string
+	channel    string
+	sourcetype string
+	index      string
+	batch      bytes.Buffer
+	// The events of the batch and where their lines end in it
+	events [][]byte
+	ends   []int
+}
+
+// Creates the HEC sink of stream, every sink gets its own channel for acknowledgements
+func newHECSink(stream string) (*hecSink, error) {
+	if *hecURL == "" {
+		return nil, fmt.Errorf("-hec-url is required")
+	}
+	return &hecSink{
+		stream:     stream,
+		channel:    event.NewUUID(),
+		sourcetype: hecSourcetypes.get(stream, "ps-"+stream),
+		index:      hecIndexes.get(stream, ""),
+	}, nil
+}
+
+func (s *hecSink) Write(log Event) error {
+	event := hecEvent{
+		Time:       float64(log.Time.UnixNano()) / 1e9,
+		Source:     "ps-splunk:" + s.stream,
+		Sourcetype: s.sourcetype,
+		Index:      s.index,
+		Event:      json.RawMessage(log.Payload),
+	}
+	if s.stream == metricsStream && json.Unmarshal(log.Payload, &event.Fields) == nil {
+		// The time is in the envelope already
+		delete(event.Fields, "time")
+		event.Event = json.RawMessage(`"metric"`)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		// Not valid JSON, send it as a string instead of losing it
+		event.Event, _ = json.Marshal(string(event.Event))
+		data, _ = json.Marshal(event)
+	}
+	s.batch.Write(data)
+	s.batch.WriteByte('\n')
+	s.events = append(s.events, log.Payload)
+	s.ends = append(s.ends, s.batch.Len())
+	if len(s.events) >= *hecBatchSize {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Sends the pending batch, if any. When HEC rejects an invalid event the
+// events before it were indexed, so it goes to the dead-letter file and the
+// rest of the batch is sent again. A batch that still fails after the retries
+// is dead lettered and dropped so it doesn't block the stream.
+func (s *hecSink) Flush() error {
+	body, events, ends := s.batch.Bytes(), s.events, s.ends
+	defer func() {
+		s.batch.Reset()
+		s.events, s.ends = nil, nil
+	}()
+	for len(events) > 0 {
+		err := hecSend(s.channel, body)
+		if err == nil {
+			return nil
+		}
+		rejected, ok := err.(hecRejected)
+		if !ok || rejected.invalid < 0 || rejected.invalid >= len(events) {
+			writeDeadLetters(s.stream, "hec", err.Error(), events)
+			return fmt.Errorf("dropped %d events: %v", len(events), err)
+		}
+		i := rejected.invalid
+		writeDeadLetters(s.stream, "hec", err.Error(), events[i:i+1])
+		logger.Error("HEC rejected an event", "stream", s.stream, "err", err)
+		body = body[ends[i]:]
+		events = events[i+1:]
+		rest := make([]int, len(ends)-i-1)
+		for j := range rest {
+			rest[j] = ends[i+1+j] - ends[i]
+		}
+		ends = rest
+	}
+	return nil
+}
+
+func (s *hecSink) Close() error {
+	return s.Flush()
+}
+
+// Posts a batch of events, retrying server errors and missing acknowledgements
+func hecSend(channel string, events []byte) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var ackID *int64
+		ackID, err = hecPost(channel, "/services/collector/event", events)
+		if err == nil && (!*hecAck || ackID == nil) {
+			return nil
+		}
+		if err == nil {
+			if err = hecWaitAck(channel, *ackID); err == nil {
+				return nil
+			}
+		}
+		if _, permanent := err.(hecRejected); permanent || attempt > *hecRetries {
+			return err
+		}
+		delay := httpx.Backoff(attempt)
+		logger.Warn("Retrying HEC batch", "delay", delay, "err", err)
+		time.Sleep(delay)
+	}
+}
+
+// Error for requests HEC rejected and that won't succeed when retried, with
+// the index of the invalid event of the batch or -1
+type hecRejected struct {
+	status  string
+	text    string
+	invalid int
+}
+
+func (e hecRejected) Error() string {
+	return "HEC rejected the request: " + e.status + ": " + e.text
+}
+
+// Posts a body to a HEC endpoint, returning the acknowledgement id if any
+func hecPost(channel string, path string, body []byte) (*int64, error) {
+	// Compress the body
+	var reader io.Reader = bytes.NewReader(body)
+	if *hecGzip {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(body)
+		gz.Close()
+		reader = &compressed
+	}
+	req, err := http.NewRequest("POST", hecEndpoint(path), reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Splunk "+*hecToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Splunk-Request-Channel", channel)
+	if *hecGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := hecClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpx.CloseBody(resp)
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var parsed hecResponse
+	json.Unmarshal(data, &parsed)
+	if resp.StatusCode != http.StatusOK {
+		// Server errors, throttling and a busy indexer are worth retrying
+		if httpx.RetryableStatus(resp.StatusCode) {
+			return nil, fmt.Errorf("%s: %s", resp.Status, parsed.Text)
+		}
+		invalid := -1
+		if parsed.InvalidEvent != nil {
+			invalid = *parsed.InvalidEvent
+		}
+		return nil, hecRejected{resp.Status, parsed.Text, invalid}
+	}
+	return parsed.AckID, nil
+}
+
+// Polls the acknowledgement endpoint until ackID is indexed or the timeout passes
+func hecWaitAck(channel string, ackID int64) error {
+	deadline := time.Now().Add(*hecAckTimeout)
+	body := []byte(fmt.Sprintf(`{"acks":[%d]}`, ackID))
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		// The ack endpoint answers with the same response shape
+		acks, err := hecAcks(channel, body)
+		if err != nil {
+			return err
+		}
+		if acks[fmt.Sprint(ackID)] {
+			return nil
+		}
+	}
+	return fmt.Errorf("no acknowledgement for batch %d after %s", ackID, *hecAckTimeout)
+}
+
+// Queries the acknowledgement endpoint
+func hecAcks(channel string, body []byte) (map[string]bool, error) {
+	req, err := http.NewRequest("POST", hecEndpoint("/services/collector/ack"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Splunk "+*hecToken)
+	req.Header.Set("X-Splunk-Request-Channel", channel)
+	resp, err := hecClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpx.CloseBody(resp)
+	var parsed hecResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, parsed.Text)
+	}
+	return parsed.Acks, nil
+}
+
+// Joins path onto the HEC URL unless it already names an endpoint
+func hecEndpoint(path string) string {
+	base := strings.TrimRight(*hecURL, "/")
+	if i := strings.Index(base, "/services/collector"); i >= 0 {
+		base = base[:i]
+	}
+	return base + path
+}
+
+// Flag holding strings keyed by stream name, given as stream=value pairs
+// separated by commas or by repeating the flag. A value without a stream
+// applies to every stream that isn't named explicitly.
+type streamStrings map[string]string
+
+func (s streamStrings) String() string {
+	pairs := make([]string, 0, len(s))
+	for name, value := range s {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (s streamStrings) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 1 {
+			s["*"] = kv[0]
+			continue
+		}
+		name := strings.TrimSpace(kv[0])
+		if QueueNamed(name) == nil {
+			return fmt.Errorf("unknown stream %q", name)
+		}
+		s[name] = strings.TrimSpace(kv[1])
+	}
+	return nil
+}
+
+// Returns the value for stream, falling back to the catch-all and then def
+func (s streamStrings) get(stream string, def string) string {
+	if value, ok := s[stream]; ok {
+		return value
+	}
+	if value, ok := s["*"]; ok {
+		return value
+	}
+	return def
+}
@@ -0,0 +1,325 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// InfluxDB flags
+var influxURL = Flags.String("influx-url", "", "InfluxDB URL used by the influx sink, e.g. http://influx:8086")
+var influxAPI = Flags.String("influx-api", "v2", "InfluxDB write API: v2 (-influx-org, -influx-bucket and -influx-token) or v1 (-influx-database, -influx-username and -influx-password)")
+var influxToken = Flags.String("influx-token", "", "InfluxDB v2 API token")
+var influxOrg = Flags.String("influx-org", "", "InfluxDB v2 organization")
+var influxBucket = Flags.String("influx-bucket", "", "InfluxDB v2 bucket")
+var influxDatabase = Flags.String("influx-database", "", "InfluxDB v1 database")
+var influxUsername = Flags.String("influx-username", "", "InfluxDB v1 user")
+var influxPassword = Flags.String("influx-password", "", "InfluxDB v1 password")
+var influxBatchSize = Flags.Int("influx-batch-size", 5000, "Maximum number of points sent in one InfluxDB write request")
+var influxRetries = Flags.Int("influx-retries", 5, "Number of times a failed InfluxDB write is retried before its points are dropped")
+var influxInsecureSkipVerify = Flags.Bool("influx-insecure-skip-verify", false, "Don't verify the InfluxDB server certificate")
+
+// HTTP client used for InfluxDB
+var influxClient = http.Client{Timeout: time.Minute}
+
+// Measurements of the graphs values, named like the esmond event types so
+// both sources land in the same measurements
+var influxGraphsMeasurements = map[string]string{
+	"throughput": "throughput",
+	"latency":    "histogram-owdelay",
+	"loss":       "packet-loss-rate",
+}
+
+// Checks the InfluxDB flags and configures its client
+func setupInflux() error {
+	if *influxURL == "" {
+		return nil
+	}
+	switch *influxAPI {
+	case "v2":
+		if *influxOrg == "" || *influxBucket == "" {
+			return fmt.Errorf("-influx-org and -influx-bucket are required with -influx-api v2")
+		}
+	case "v1":
+		if *influxDatabase == "" {
+			return fmt.Errorf("-influx-database is required with -influx-api v1")
+		}
+	default:
+		return fmt.Errorf("invalid -influx-api %q, expected v1 or v2", *influxAPI)
+	}
+	if *influxBatchSize < 1 {
+		return fmt.Errorf("-influx-batch-size must be at least 1")
+	}
+	influxClient.Transport = httpx.NewTransport(&tls.Config{InsecureSkipVerify: *influxInsecureSkipVerify})
+	return nil
+}
+
+// Sink writing the numeric values of the results or timeseries stream as
+// InfluxDB line protocol: a measurement per event type tagged with the test
+type influxSink struct {
+	stream string
+	batch  bytes.Buffer
+	count  int
+}
+
+// Creates the InfluxDB sink of stream
+func newInfluxSink(stream string) (*influxSink, error) {
+	if *influxURL == "" {
+		return nil, fmt.Errorf("-influx-url is required")
+	}
+	if stream != "results" && stream != "timeseries" {
+		return nil, fmt.Errorf("influx only writes the results and timeseries streams")
+	}
+	return &influxSink{stream: stream}, nil
+}
+
+// A point of line protocol
+type influxPoint struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]string
+	// Microseconds since the epoch
+	timestamp int64
+}
+
+func (s *influxSink) Write(log Event) error {
+	var points []influxPoint
+	if s.stream == "timeseries" {
+		var point event.Datapoint
+		if err := json.Unmarshal(log.Payload, &point); err != nil {
+			return err
+		}
+		points = datapointPoints(point)
+	} else {
+		rows, err := resultRows(log.Payload)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			points = append(points, rowPoints(row)...)
+		}
+	}
+	for _, point := range points {
+		point.write(&s.batch)
+		s.count++
+	}
+	if s.count >= *influxBatchSize {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Returns the points of the rows of a parquet results file, a point for every
+// value of a graphs row
+func rowPoints(row parquetRow) []influxPoint {
+	tags := map[string]string{
+		"collector":           row.collector,
+		"site":                row.site,
+		"host":                row.host,
+		"source":              row.source,
+		"source_address":      row.sourceAddress,
+		"destination_address": row.destinationAddress,
+		"tool_name":           row.toolName,
+	}
+	if row.summaryWindow != nil {
+		tags["summary_window"] = strconv.FormatInt(*row.summaryWindow, 10)
+	}
+	timestamp := row.time
+	if row.timestamp != nil {
+		timestamp = *row.timestamp
+	}
+	var points []influxPoint
+	for _, value := range []struct {
+		name  string
+		value *float64
+	}{{"throughput", row.throughput}, {"latency", row.latency}, {"loss", row.loss}, {"value", row.value}} {
+		if value.value == nil {
+			continue
+		}
+		measurement := row.eventType
+		if measurement == "" {
+			measurement = influxGraphsMeasurements[value.name]
+		}
+		points = append(points, influxPoint{
+			measurement: measurement,
+			tags:        tags,
+			fields:      map[string]string{"value": influxFloat(*value.value)},
+			timestamp:   timestamp,
+		})
+	}
+	return points
+}
+
+// Returns the point of a numeric datapoint of a time series, the statistics
+// of an aggregate being fields next to its mean value
+func datapointPoints(point event.Datapoint) []influxPoint {
+	var value *float64
+	for _, v := range []*float64{point.Throughput, point.Latency, point.Loss} {
+		if v != nil {
+			value = v
+		}
+	}
+	if value == nil {
+		return nil
+	}
+	p := influxPoint{
+		measurement: point.EventType,
+		tags: map[string]string{
+			"collector":           point.Collector,
+			"site":                point.Site,
+			"host":                point.Host,
+			"source_address":      point.Source,
+			"destination_address": point.Destination,
+			"tool_name":           point.ToolName,
+			"summary_type":        point.SummaryType,
+			"summary_window":      strconv.Itoa(point.SummaryWindow),
+		},
+		fields:    map[string]string{"value": influxFloat(*value)},
+		timestamp: point.Timestamp * 1e6,
+	}
+	if point.AggregateWindow > 0 {
+		p.tags["aggregate_window"] = strconv.Itoa(point.AggregateWindow)
+		p.fields["count"] = strconv.Itoa(point.Count) + "i"
+		for name, stat := range map[string]*float64{"min": point.Min, "max": point.Max, "p95": point.P95} {
+			if stat != nil {
+				p.fields[name] = influxFloat(*stat)
+			}
+		}
+	}
+	return []influxPoint{p}
+}
+
+// Formats a float field value
+func influxFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Escapes of the measurement, and of the tag keys and values
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// Writes the point as a line, its empty tags left out and tags and fields
+// sorted as InfluxDB prefers
+func (p influxPoint) write(buf *bytes.Buffer) {
+	buf.WriteString(influxMeasurementEscaper.Replace(p.measurement))
+	for _, key := range sortedKeys(p.tags) {
+		if p.tags[key] != "" {
+			buf.WriteString("," + influxTagEscaper.Replace(key) + "=" + influxTagEscaper.Replace(p.tags[key]))
+		}
+	}
+	for i, key := range sortedKeys(p.fields) {
+		if i == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(influxTagEscaper.Replace(key) + "=" + p.fields[key])
+	}
+	fmt.Fprintf(buf, " %d\n", p.timestamp)
+}
+
+// Returns the keys of a map sorted
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Sends the pending points, if any. Points that still fail after the retries
+// are dropped so they don't block the stream.
+func (s *influxSink) Flush() error {
+	if s.count == 0 {
+		return nil
+	}
+	count := s.count
+	err := influxSend(s.batch.Bytes())
+	s.batch.Reset()
+	s.count = 0
+	if err != nil {
+		return fmt.Errorf("dropped %d points: %v", count, err)
+	}
+	return nil
+}
+
+func (s *influxSink) Close() error {
+	return s.Flush()
+}
+
+// Error for writes InfluxDB rejected and that won't succeed when retried
+type influxRejected struct {
+	status string
+	body   string
+}
+
+func (e influxRejected) Error() string {
+	return "InfluxDB rejected the write: " + e.status + ": " + e.body
+}
+
+// Posts lines of line protocol, retrying server errors and throttling
+func influxSend(lines []byte) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = influxPost(lines); err == nil {
+			return nil
+		}
+		if _, permanent := err.(influxRejected); permanent || attempt > *influxRetries {
+			return err
+		}
+		delay := httpx.Backoff(attempt)
+		logger.Warn("Retrying InfluxDB write", "delay", delay, "err", err)
+		time.Sleep(delay)
+	}
+}
+
+// Posts lines to the write endpoint of the API, with microsecond timestamps
+func influxPost(lines []byte) error {
+	query := url.Values{"precision": {"us"}}
+	path := "/api/v2/write"
+	if *influxAPI == "v1" {
+		path = "/write"
+		query.Set("db", *influxDatabase)
+	} else {
+		query.Set("org", *influxOrg)
+		query.Set("bucket", *influxBucket)
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(*influxURL, "/")+path+"?"+query.Encode(), bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case *influxAPI == "v2" && *influxToken != "":
+		req.Header.Set("Authorization", "Token "+*influxToken)
+	case *influxAPI == "v1" && *influxUsername != "":
+		req.SetBasicAuth(*influxUsername, *influxPassword)
+	}
+	resp, err := influxClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpx.CloseBody(resp)
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if httpx.RetryableStatus(resp.StatusCode) {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return influxRejected{resp.Status, string(bytes.TrimSpace(body))}
+}
@@ -0,0 +1,589 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Kafka flags
+var kafkaBrokers = Flags.String("kafka-brokers", "", "Comma separated bootstrap brokers (host:port) used by the kafka sink")
+var kafkaAcks = Flags.Int("kafka-acks", -1, "Acknowledgements required from the brokers: -1 for all in sync replicas, 1 for the leader, 0 for none")
+var kafkaBatchSize = Flags.Int("kafka-batch-size", 500, "Maximum number of events sent in one produce request")
+var kafkaRetries = Flags.Int("kafka-retries", 5, "Number of times a failed produce request is retried before its events are dropped")
+var kafkaTLS = Flags.Bool("kafka-tls", false, "Connect to the brokers with TLS")
+var kafkaInsecureSkipVerify = Flags.Bool("kafka-insecure-skip-verify", false, "Don't verify the broker certificates")
+var kafkaClientID = Flags.String("kafka-client-id", "ps-splunk", "Client id sent to the brokers")
+var kafkaFormat = Flags.String("kafka-format", "json", "Format of the messages produced: json, the event, or protobuf, the Event message wrapping it")
+var kafkaTopics = streamStrings{}
+
+func init() {
+	Flags.Var(kafkaTopics, "kafka-topic", "Kafka topic for every stream, or per stream as stream=topic pairs (default ps-<stream>)")
+}
+
+// Kafka API keys and error codes used by the producer
+const (
+	kafkaProduce  = 0
+	kafkaMetadata = 3
+
+	kafkaUnknownTopic       = 3
+	kafkaLeaderNotAvailable = 5
+	kafkaNotLeader          = 6
+	kafkaRequestTimedOut    = 7
+	kafkaNotEnoughReplicas  = 19
+)
+
+// Errors the brokers return for a partition that are solved by retrying,
+// possibly after refreshing the metadata
+func kafkaRetriable(code int16) bool {
+	switch code {
+	case kafkaUnknownTopic, kafkaLeaderNotAvailable, kafkaNotLeader, kafkaRequestTimedOut, kafkaNotEnoughReplicas:
+		return true
+	}
+	return false
+}
+
+// Sink producing the events of a stream to a topic, keyed by host so all the
+// events of a host land on the same partition
+type kafkaSink struct {
+	topic string
+	// Broker addresses by node id, connections to them and partition leaders
+	brokers map[int32]string
+	conns   map[int32]*kafkaConn
+	leaders []int32
+	// Events waiting for the next produce request, by partition
+	pending map[int32][]kafkaMessage
+	count   int
+	// Next partition for events without a host
+	next int32
+}
+
+// A single event and its key
+type kafkaMessage struct {
+	key   []byte
+	value []byte
+	time  time.Time
+}
+
+// Creates the Kafka sink of stream and reads the topic metadata
+func newKafkaSink(stream string) (*kafkaSink, error) {
+	if *kafkaBrokers == "" {
+		return nil, fmt.Errorf("-kafka-brokers is required")
+	}
+	if *kafkaBatchSize < 1 {
+		return nil, fmt.Errorf("-kafka-batch-size must be at least 1")
+	}
+	if err := checkFormat("kafka-format", *kafkaFormat); err != nil {
+		return nil, err
+	}
+	s := &kafkaSink{
+		topic:   kafkaTopics.get(stream, "ps-"+stream),
+		conns:   make(map[int32]*kafkaConn),
+		pending: make(map[int32][]kafkaMessage),
+	}
+	if err := s.refresh(); err != nil {
+		return nil, fmt.Errorf("topic %s: %v", s.topic, err)
+	}
+	return s, nil
+}
+
+func (s *kafkaSink) Write(log Event) error {
+	key := log.Host
+	// Partition like the Java client does so consumers agree on the placement
+	var partition int32
+	if key != "" {
+		partition = (murmur2([]byte(key)) & 0x7fffffff) % int32(len(s.leaders))
+	} else {
+		partition = s.next % int32(len(s.leaders))
+		s.next++
+	}
+	message := kafkaMessage{value: encodeEvent(log, *kafkaFormat), time: log.Time}
+	if key != "" {
+		message.key = []byte(key)
+	}
+	s.pending[partition] = append(s.pending[partition], message)
+	s.count++
+	if s.count >= *kafkaBatchSize {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Produces the pending events, retrying the partitions that failed with a
+// retriable error. Events still failing after the retries are dropped so they
+// don't block the stream.
+func (s *kafkaSink) Flush() error {
+	if s.count == 0 {
+		return nil
+	}
+	pending := s.pending
+	s.pending = make(map[int32][]kafkaMessage)
+	s.count = 0
+	var err error
+	for attempt := 1; ; attempt++ {
+		pending, err = s.produce(pending)
+		if len(pending) == 0 {
+			return err
+		}
+		if attempt > *kafkaRetries {
+			dropped := 0
+			for _, messages := range pending {
+				dropped += len(messages)
+			}
+			return fmt.Errorf("dropped %d events: %v", dropped, err)
+		}
+		delay := httpx.Backoff(attempt)
+		logger.Warn("Retrying Kafka produce", "topic", s.topic, "delay", delay, "err", err)
+		time.Sleep(delay)
+		if err := s.refresh(); err != nil {
+			logger.Warn("Refreshing Kafka metadata failed", "topic", s.topic, "err", err)
+		}
+	}
+}
+
+func (s *kafkaSink) Close() error {
+	err := s.Flush()
+	for id, conn := range s.conns {
+		conn.Close()
+		delete(s.conns, id)
+	}
+	return err
+}
+
+// Sends one produce request per leader, returning the events to retry and
+// the last error. Events failing with errors that can't be retried are lost.
+func (s *kafkaSink) produce(pending map[int32][]kafkaMessage) (map[int32][]kafkaMessage, error) {
+	// Group the partitions by leader
+	byLeader := make(map[int32][]int32)
+	for partition := range pending {
+		leader := s.leaders[partition]
+		byLeader[leader] = append(byLeader[leader], partition)
+	}
+	retry := make(map[int32][]kafkaMessage)
+	var lastErr error
+	for leader, partitions := range byLeader {
+		errs, err := s.produceTo(leader, partitions, pending)
+		if err != nil {
+			// The connection is unusable, retry everything sent on it
+			lastErr = err
+			if conn, ok := s.conns[leader]; ok {
+				conn.Close()
+				delete(s.conns, leader)
+			}
+			for _, partition := range partitions {
+				retry[partition] = pending[partition]
+			}
+			continue
+		}
+		for partition, code := range errs {
+			if code == 0 {
+				continue
+			}
+			lastErr = fmt.Errorf("partition %d: error code %d", partition, code)
+			if kafkaRetriable(code) {
+				retry[partition] = pending[partition]
+			} else {
+				logger.Error("Kafka rejected events", "topic", s.topic, "events", len(pending[partition]), "err", lastErr)
+			}
+		}
+	}
+	return retry, lastErr
+}
+
+// Sends the batches of partitions to a leader, returning the error code of each partition
+func (s *kafkaSink) produceTo(leader int32, partitions []int32, pending map[int32][]kafkaMessage) (map[int32]int16, error) {
+	conn, err := s.conn(leader)
+	if err != nil {
+		return nil, err
+	}
+	var e kafkaEncoder
+	e.int16(-1) // No transactional id
+	e.int16(int16(*kafkaAcks))
+	e.int32(int32(httpx.Timeout.Seconds() * 1000))
+	e.int32(1)
+	e.string(s.topic)
+	e.int32(int32(len(partitions)))
+	for _, partition := range partitions {
+		e.int32(partition)
+		e.bytes(kafkaRecordBatch(pending[partition]))
+	}
+	// Without acknowledgements the brokers don't answer at all
+	if *kafkaAcks == 0 {
+		return nil, conn.send(kafkaProduce, 3, e.Bytes())
+	}
+	response, err := conn.request(kafkaProduce, 3, e.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	d := kafkaDecoder{b: response}
+	errs := make(map[int32]int16)
+	for topics := d.int32(); topics > 0; topics-- {
+		d.string()
+		for count := d.int32(); count > 0 && d.err == nil; count-- {
+			partition := d.int32()
+			errs[partition] = d.int16()
+			d.int64() // Base offset
+			d.int64() // Log append time
+		}
+	}
+	return errs, d.err
+}
+
+// Returns the connection to a broker, connecting when needed
+func (s *kafkaSink) conn(id int32) (*kafkaConn, error) {
+	if conn, ok := s.conns[id]; ok {
+		return conn, nil
+	}
+	addr, ok := s.brokers[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown broker %d", id)
+	}
+	conn, err := dialKafka(addr)
+	if err != nil {
+		return nil, err
+	}
+	s.conns[id] = conn
+	return conn, nil
+}
+
+// Reads the brokers and partition leaders of the topic from the first
+// bootstrap broker that answers, waiting for topics being auto created
+func (s *kafkaSink) refresh() error {
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		if attempt > 0 {
+			time.Sleep(httpx.Backoff(attempt))
+		}
+		for _, addr := range strings.Split(*kafkaBrokers, ",") {
+			conn, err := dialKafka(strings.TrimSpace(addr))
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			lastErr = s.metadata(conn)
+			conn.Close()
+			if lastErr == nil {
+				return nil
+			}
+			if _, ok := lastErr.(kafkaTopicError); !ok {
+				continue
+			}
+			break
+		}
+	}
+	return lastErr
+}
+
+// Error for a topic the brokers have no usable metadata for yet
+type kafkaTopicError int16
+
+func (e kafkaTopicError) Error() string {
+	return "metadata error code " + strconv.Itoa(int(e))
+}
+
+// Sends a metadata request for the topic and keeps the answer
+func (s *kafkaSink) metadata(conn *kafkaConn) error {
+	var e kafkaEncoder
+	e.int32(1)
+	e.string(s.topic)
+	response, err := conn.request(kafkaMetadata, 1, e.Bytes())
+	if err != nil {
+		return err
+	}
+	d := kafkaDecoder{b: response}
+	brokers := make(map[int32]string)
+	for count := d.int32(); count > 0 && d.err == nil; count-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // Rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32() // Controller
+	var leaders []int32
+	var topicErr int16
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		topicErr = d.int16()
+		d.string()
+		d.int8() // Internal
+		for count := d.int32(); count > 0 && d.err == nil; count-- {
+			d.int16()
+			partition := d.int32()
+			leader := d.int32()
+			d.skipArray(4) // Replicas
+			d.skipArray(4) // In sync replicas
+			for int32(len(leaders)) <= partition {
+				leaders = append(leaders, -1)
+			}
+			leaders[partition] = leader
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if topicErr != 0 || len(leaders) == 0 {
+		return kafkaTopicError(topicErr)
+	}
+	for _, leader := range leaders {
+		if leader < 0 {
+			return kafkaTopicError(kafkaLeaderNotAvailable)
+		}
+	}
+	s.brokers = brokers
+	s.leaders = leaders
+	// Connections to brokers that aren't leaders anymore can go
+	for id, conn := range s.conns {
+		if _, ok := brokers[id]; !ok {
+			conn.Close()
+			delete(s.conns, id)
+		}
+	}
+	return nil
+}
+
+// Encodes messages as a v2 record batch
+func kafkaRecordBatch(messages []kafkaMessage) []byte {
+	first := messages[0].time.UnixNano() / 1e6
+	max := first
+	var records kafkaEncoder
+	for i, message := range messages {
+		timestamp := message.time.UnixNano() / 1e6
+		if timestamp > max {
+			max = timestamp
+		}
+		var r kafkaEncoder
+		r.int8(0) // Attributes
+		r.varint(timestamp - first)
+		r.varint(int64(i))
+		if message.key == nil {
+			r.varint(-1)
+		} else {
+			r.varint(int64(len(message.key)))
+			r.Write(message.key)
+		}
+		r.varint(int64(len(message.value)))
+		r.Write(message.value)
+		r.varint(0) // Headers
+		records.varint(int64(r.Len()))
+		records.Write(r.Bytes())
+	}
+	// The CRC covers everything from the attributes on
+	var body kafkaEncoder
+	body.int16(0) // Attributes, no compression
+	body.int32(int32(len(messages) - 1))
+	body.int64(first)
+	body.int64(max)
+	body.int64(-1) // Producer id
+	body.int16(-1) // Producer epoch
+	body.int32(-1) // Base sequence
+	body.int32(int32(len(messages)))
+	body.Write(records.Bytes())
+	var batch kafkaEncoder
+	batch.int64(0) // Base offset
+	batch.int32(int32(4 + 1 + 4 + body.Len()))
+	batch.int32(-1) // Partition leader epoch
+	batch.int8(2)   // Magic
+	batch.int32(int32(crc32.Checksum(body.Bytes(), crc32.MakeTable(crc32.Castagnoli))))
+	batch.Write(body.Bytes())
+	return batch.Bytes()
+}
+
+// Kafka's murmur2 hash, as used by the default partitioner of the Java client
+func murmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	length := len(data)
+	h := uint32(0x9747b28c) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// Connection to a broker, requests are sent one at a time
+type kafkaConn struct {
+	net.Conn
+	correlation int32
+}
+
+// Connects to a broker
+func dialKafka(addr string) (*kafkaConn, error) {
+	dialer := &net.Dialer{Timeout: *httpx.Timeout}
+	if *kafkaTLS {
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{InsecureSkipVerify: *kafkaInsecureSkipVerify})
+		if err != nil {
+			return nil, err
+		}
+		return &kafkaConn{Conn: conn}, nil
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{Conn: conn}, nil
+}
+
+// Writes a request with its header
+func (c *kafkaConn) send(apiKey int16, version int16, body []byte) error {
+	c.correlation++
+	var e kafkaEncoder
+	e.int32(0) // Size, filled in below
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(c.correlation)
+	e.string(*kafkaClientID)
+	e.Write(body)
+	request := e.Bytes()
+	binary.BigEndian.PutUint32(request, uint32(len(request)-4))
+	c.SetDeadline(time.Now().Add(*httpx.Timeout + time.Minute))
+	_, err := c.Write(request)
+	return err
+}
+
+// Sends a request and returns the body of its response
+func (c *kafkaConn) request(apiKey int16, version int16, body []byte) ([]byte, error) {
+	if err := c.send(apiKey, version, body); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c, response); err != nil {
+		return nil, err
+	}
+	if len(response) < 4 || int32(binary.BigEndian.Uint32(response)) != c.correlation {
+		return nil, fmt.Errorf("unexpected response from %s", c.RemoteAddr())
+	}
+	return response[4:], nil
+}
+
+// Buffer writing the big endian primitives of the Kafka protocol
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	binary.Write(&e.Buffer, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	binary.Write(&e.Buffer, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	binary.Write(&e.Buffer, binary.BigEndian, v)
+}
+
+// Zigzag varints, like encoding/binary writes them
+func (e *kafkaEncoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+// Reader of the Kafka protocol primitives, remembering the first error
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+// Consumes n bytes, returning nil once the data is exhausted
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = fmt.Errorf("truncated Kafka response")
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// Reads a nullable string, null being returned as empty
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// Skips an array of fixed size elements
+func (d *kafkaDecoder) skipArray(size int) {
+	if n := d.int32(); n > 0 {
+		d.take(int(n) * size)
+	}
+}
@@ -0,0 +1,205 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Manifest flags
+var writeManifest = Flags.Bool("manifest", true, "Once the crawl is done, write a <start>.manifest file listing every output file with its SHA-256 and records, the events of every stream and the flags of the crawl, and a <start>.sha256 file for sha256sum -c, next to the output files")
+
+// Flags of the crawl recorded by the manifest, set by SetManifestFlags
+var manifestFlags *flag.FlagSet
+
+// The output files completed by the sinks, in the order they were
+var manifestFiles struct {
+	sync.Mutex
+	files []manifestFile
+}
+
+// Manifest of a crawl, so loaders can check they got every file complete
+// before ingesting them
+type manifest struct {
+	event.Header
+	StartTime  string                    `json:"start_time"`
+	Parameters map[string]string         `json:"parameters"`
+	Streams    map[string]manifestStream `json:"streams"`
+	Files      []manifestFile            `json:"files"`
+}
+
+// Events and bytes queued to a stream, what its sinks got
+type manifestStream struct {
+	Events int64 `json:"events"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// An output file, its path relative to the manifest
+type manifestFile struct {
+	Path    string `json:"path"`
+	Stream  string `json:"stream"`
+	Records int64  `json:"records"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"`
+}
+
+// SetManifestFlags sets the flags whose values given on the command line are
+// recorded by the manifest, the secrets redacted
+func SetManifestFlags(flags *flag.FlagSet) {
+	manifestFlags = flags
+}
+
+// Adds the complete file at path written by a sink of stream to the manifest,
+// with its rows or, when negative, counting its lines
+func addToManifest(stream string, path string, rows int64) {
+	if !*writeManifest {
+		return
+	}
+	sum, size, lines, err := hashFile(path)
+	if err != nil {
+		logger.Error("Hashing output file failed", "file", path, "err", err)
+		return
+	}
+	if rows < 0 {
+		rows = lines
+	}
+	manifestFiles.Lock()
+	defer manifestFiles.Unlock()
+	manifestFiles.files = append(manifestFiles.files, manifestFile{Path: path, Stream: stream, Records: rows, Bytes: size, SHA256: sum})
+}
+
+// Returns the SHA-256 and size of a file and the lines of its content,
+// decompressed when gzipped
+func hashFile(path string) (string, int64, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	var lines lineCounter
+	var w io.Writer = io.MultiWriter(hash, &lines)
+	gzipped := strings.HasSuffix(path, ".gz")
+	if gzipped {
+		w = hash
+	}
+	size, err := io.Copy(w, bufio.NewReader(file))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if gzipped {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", 0, 0, err
+		}
+		reader, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			return "", 0, 0, err
+		}
+		if _, err := io.Copy(&lines, reader); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, int64(lines), nil
+}
+
+// Writer counting the lines written to it
+type lineCounter int64
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	*c += lineCounter(bytes.Count(p, []byte{'\n'}))
+	return len(p), nil
+}
+
+// Writes the manifest and checksum file of the crawl once every sink is
+// closed, when a sink wrote files. They are queued for upload after the files.
+func writeManifestFiles() {
+	manifestFiles.Lock()
+	files := manifestFiles.files
+	manifestFiles.Unlock()
+	if !*writeManifest || len(files) == 0 {
+		return
+	}
+	// Named like the files with -file-template, otherwise after the start time alone
+	path := filepath.Join(*outputDir, event.StartTime+".manifest")
+	if *fileTemplate != "" {
+		path = fileName(*outputDir, "manifest", 0, ".manifest")
+	}
+	dir := filepath.Dir(path)
+	m := manifest{
+		Header:     event.NewHeader(),
+		StartTime:  event.StartTime,
+		Parameters: manifestParameters(),
+		Streams:    make(map[string]manifestStream),
+	}
+	emitted, emittedBytes := EmittedBy()
+	for _, queue := range queues {
+		m.Streams[queue.name] = manifestStream{int64(emitted[queue.name]), int64(emittedBytes[queue.name])}
+	}
+	var sums strings.Builder
+	for _, file := range files {
+		if rel, err := filepath.Rel(dir, file.Path); err == nil {
+			file.Path = filepath.ToSlash(rel)
+		}
+		m.Files = append(m.Files, file)
+		fmt.Fprintf(&sums, "%s  %s\n", file.SHA256, file.Path)
+	}
+	data, _ := json.MarshalIndent(m, "", "  ")
+	sumsPath := strings.TrimSuffix(path, ".manifest") + ".sha256"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.Error("Writing manifest failed", "err", err)
+		return
+	}
+	// The checksums first, a loader waiting for the manifest then has both
+	for _, file := range []struct {
+		path string
+		data []byte
+	}{{sumsPath, []byte(sums.String())}, {path, append(data, '\n')}} {
+		if err := ioutil.WriteFile(file.path+".tmp", file.data, 0644); err != nil {
+			logger.Error("Writing manifest failed", "file", file.path, "err", err)
+			return
+		}
+		if err := os.Rename(file.path+".tmp", file.path); err != nil {
+			logger.Error("Writing manifest failed", "file", file.path, "err", err)
+			return
+		}
+		uploadFile("manifest", *outputDir, file.path)
+	}
+	logger.Info("Manifest written", "file", path, "files", len(files))
+}
+
+// Returns the flags given to the crawl, redacting tokens, passwords and the
+// credentials of URLs
+func manifestParameters() map[string]string {
+	parameters := make(map[string]string)
+	if manifestFlags == nil {
+		return parameters
+	}
+	manifestFlags.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch {
+		case strings.HasSuffix(f.Name, "-token") || strings.HasSuffix(f.Name, "-password") || strings.HasSuffix(f.Name, "-api-key"):
+			value = "REDACTED"
+		case strings.Contains(value, "@"):
+			if u, err := url.Parse(value); err == nil && u.User != nil {
+				u.User = url.User("REDACTED")
+				value = u.String()
+			}
+		}
+		parameters[f.Name] = value
+	})
+	return parameters
+}
@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The XML stream of the modular input sinks, every stream shares it: the
+// first write opens it and the last sink closed ends it
+var modinputStream struct {
+	opened bool
+	sinks  int
+}
+
+// Sink streaming the events to splunkd in the XML format of modular inputs,
+// with the sourcetype of their stream and the time of their header
+type modinputSink struct {
+	sourcetype string
+}
+
+// Creates a modular input sink for stream
+func newModinputSink(stream string) *modinputSink {
+	stdoutLock.Lock()
+	defer stdoutLock.Unlock()
+	modinputStream.sinks++
+	return &modinputSink{sourcetype: "ps-" + stream}
+}
+
+func (s *modinputSink) Write(event Event) error {
+	var element strings.Builder
+	element.WriteString("<event>")
+	fmt.Fprintf(&element, "<time>%d.%06d</time>", event.Time.Unix(), event.Time.Nanosecond()/1000)
+	element.WriteString("<sourcetype>" + s.sourcetype + "</sourcetype><data>")
+	xml.EscapeText(&element, event.Payload)
+	element.WriteString("</data></event>\n")
+	stdoutLock.Lock()
+	defer stdoutLock.Unlock()
+	if !modinputStream.opened {
+		modinputStream.opened = true
+		if _, err := os.Stdout.WriteString("<stream>\n"); err != nil {
+			return err
+		}
+	}
+	_, err := os.Stdout.WriteString(element.String())
+	return err
+}
+
+func (s *modinputSink) Flush() error {
+	return nil
+}
+
+func (s *modinputSink) Close() error {
+	stdoutLock.Lock()
+	defer stdoutLock.Unlock()
+	if modinputStream.sinks--; modinputStream.sinks > 0 || !modinputStream.opened {
+		return nil
+	}
+	_, err := os.Stdout.WriteString("</stream>\n")
+	return err
+}
@@ -0,0 +1,563 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Parquet flags
+var parquetRowGroupSize = Flags.Int("parquet-row-group-size", 100000, "Number of rows buffered in memory for each row group of a parquet file")
+
+// A row of the parquet results file: one measurement of a test, either a
+// graphs test summary for one direction or a datapoint of an esmond series
+type parquetRow struct {
+	time               int64
+	runID              string
+	collector          string
+	site               string
+	host               string
+	source             string
+	sourceAddress      string
+	destinationAddress string
+	toolName           string
+	eventType          string
+	summaryWindow      *int64
+	timestamp          *int64
+	throughput         *float64
+	latency            *float64
+	loss               *float64
+	value              *float64
+}
+
+// Parquet physical types, converted types and repetitions used by the schema
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+
+	parquetRequired = 0
+	parquetOptional = 1
+)
+
+// A column of the results schema and how to read it from a row, value
+// returns nil for nulls and otherwise an int64, a float64 or a string
+type parquetColumn struct {
+	name      string
+	kind      int32
+	converted int32
+	optional  bool
+	value     func(r *parquetRow) interface{}
+}
+
+// Returns a string value, empty strings being null
+func parquetString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// Returns an optional int64 value
+func parquetInt(n *int64) interface{} {
+	if n == nil {
+		return nil
+	}
+	return *n
+}
+
+// Returns an optional float64 value
+func parquetFloat(f *float64) interface{} {
+	if f == nil {
+		return nil
+	}
+	return *f
+}
+
+// Schema of the results file. Throughput is in bits per second, latency is the
+// one way delay or round trip time in milliseconds and loss a rate from 0 to 1.
+var parquetColumns = []parquetColumn{
+	{"time", parquetInt64, parquetTimestampMicros, false, func(r *parquetRow) interface{} { return r.time }},
+	{"run_id", parquetByteArray, parquetUTF8, false, func(r *parquetRow) interface{} { return r.runID }},
+	{"collector", parquetByteArray, parquetUTF8, true, func(r *parquetRow) interface{} { return parquetString(r.collector) }},
+	{"site", parquetByteArray, parquetUTF8, true, func(r *parquetRow) interface{} { return parquetString(r.site) }},
+	{"host", parquetByteArray, parquetUTF8, false, func(r *parquetRow) interface{} { return r.host }},
+	{"source", parquetByteArray, parquetUTF8, false, func(r *parquetRow) interface{} { return r.source }},
+	{"source_address", parquetByteArray, parquetUTF8, true, func(r *parquetRow) interface{} { return parquetString(r.sourceAddress) }},
+	{"destination_address", parquetByteArray, parquetUTF8, true, func(r *parquetRow) interface{} { return parquetString(r.destinationAddress) }},
+	{"tool_name", parquetByteArray, parquetUTF8, true, func(r *parquetRow) interface{} { return parquetString(r.toolName) }},
+	{"event_type", parquetByteArray, parquetUTF8, true, func(r *parquetRow) interface{} { return parquetString(r.eventType) }},
+	{"summary_window", parquetInt64, -1, true, func(r *parquetRow) interface{} { return parquetInt(r.summaryWindow) }},
+	{"timestamp", parquetInt64, parquetTimestampMicros, true, func(r *parquetRow) interface{} { return parquetInt(r.timestamp) }},
+	{"throughput", parquetDouble, -1, true, func(r *parquetRow) interface{} { return parquetFloat(r.throughput) }},
+	{"latency", parquetDouble, -1, true, func(r *parquetRow) interface{} { return parquetFloat(r.latency) }},
+	{"loss", parquetDouble, -1, true, func(r *parquetRow) interface{} { return parquetFloat(r.loss) }},
+	{"value", parquetDouble, -1, true, func(r *parquetRow) interface{} { return parquetFloat(r.value) }},
+}
+
+// Sink writing the results stream to a gzip compressed parquet file. The
+// file is written under a temporary name and renamed once its footer is written.
+type parquetSink struct {
+	dir       string
+	stream    string
+	file      *os.File
+	path      string
+	offset    int64
+	rows      []parquetRow
+	rowGroups []parquetRowGroup
+	total     int64
+}
+
+// Offsets and sizes of a written row group, kept for the footer
+type parquetRowGroup struct {
+	rows    int64
+	size    int64
+	columns []parquetChunk
+}
+
+// A written column chunk, made of a single data page
+type parquetChunk struct {
+	offset       int64
+	values       int64
+	uncompressed int64
+	compressed   int64
+}
+
+// Creates the parquet sink of stream in dir
+func newParquetSink(dir string, stream string) (*parquetSink, error) {
+	if stream != "results" {
+		return nil, fmt.Errorf("parquet only has a schema for the results stream")
+	}
+	if *parquetRowGroupSize < 1 {
+		return nil, fmt.Errorf("-parquet-row-group-size must be at least 1")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if *fileTemplate != "" && !strings.Contains(*fileTemplate, "{seq}") {
+		return nil, fmt.Errorf("-file-template must contain {seq} for the parquet sink, its files are numbered")
+	}
+	// Like rotated files, every file gets the next unused number
+	s := &parquetSink{dir: dir, stream: stream}
+	for part := 1; ; part++ {
+		s.path = fileName(dir, stream, part, ".parquet")
+		if _, err := os.Stat(s.path); err == nil {
+			continue
+		}
+		if _, err := os.Stat(s.path + ".tmp"); err == nil {
+			continue
+		}
+		break
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	if err := s.write([]byte("PAR1")); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Writes to the file keeping track of the offset
+func (s *parquetSink) write(b []byte) error {
+	n, err := s.file.Write(b)
+	s.offset += int64(n)
+	return err
+}
+
+func (s *parquetSink) Write(log Event) error {
+	rows, err := resultRows(log.Payload)
+	if err != nil {
+		return err
+	}
+	s.rows = append(s.rows, rows...)
+	if len(s.rows) >= *parquetRowGroupSize {
+		return s.writeRowGroup()
+	}
+	return nil
+}
+
+// Row groups can't be appended to, so flushing waits for a full one
+func (s *parquetSink) Flush() error {
+	return nil
+}
+
+func (s *parquetSink) Close() error {
+	err := s.writeRowGroup()
+	if err == nil {
+		err = s.writeFooter()
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(s.path+".tmp", s.path); err != nil {
+		return err
+	}
+	if err := writeDoneMarker(s.path); err != nil {
+		return err
+	}
+	addToManifest(s.stream, s.path, s.total)
+	uploadFile(s.stream, s.dir, s.path)
+	return nil
+}
+
+// Returns the rows of a result event
+func resultRows(log []byte) ([]parquetRow, error) {
+	var result event.Result
+	if err := json.Unmarshal(log, &result); err != nil {
+		return nil, err
+	}
+	collected, err := time.Parse(event.TimeLayout, result.Time)
+	if err != nil {
+		collected = time.Now()
+	}
+	row := parquetRow{
+		time:      collected.UnixNano() / 1e3,
+		runID:     result.RunID,
+		collector: result.Collector,
+		site:      result.Site,
+		host:      result.Host,
+		source:    result.Source,
+	}
+	if result.Source == "esmond" {
+		return esmondRows(row, result.Result), nil
+	}
+	return graphsRows(row, result.Result), nil
+}
+
+// Returns the rows of a graphs test, one per direction with values. The _src_
+// values are measured from the source to the destination and _dst_ the reverse.
+func graphsRows(row parquetRow, raw json.RawMessage) []parquetRow {
+	var test map[string]interface{}
+	if json.Unmarshal(raw, &test) != nil {
+		return nil
+	}
+	source, _ := test["source_ip"].(string)
+	destination, _ := test["destination_ip"].(string)
+	if updated, ok := test["last_updated"].(float64); ok {
+		ts := int64(updated) * 1e6
+		row.timestamp = &ts
+	}
+	var rows []parquetRow
+	for _, direction := range []string{"src", "dst"} {
+		r := row
+		r.sourceAddress, r.destinationAddress = source, destination
+		if direction == "dst" {
+			r.sourceAddress, r.destinationAddress = destination, source
+		}
+		r.throughput = event.JSONFloat(test["throughput_"+direction+"_val"])
+		r.latency = event.JSONFloat(test["owdelay_"+direction+"_val"])
+		r.loss = event.JSONFloat(test["loss_"+direction+"_val"])
+		if r.throughput != nil || r.latency != nil || r.loss != nil {
+			rows = append(rows, r)
+		}
+	}
+	return rows
+}
+
+// Returns a row per datapoint of an esmond series with a numeric value,
+// histograms being reduced to their mean
+func esmondRows(row parquetRow, raw json.RawMessage) []parquetRow {
+	var series event.EsmondResult
+	if json.Unmarshal(raw, &series) != nil {
+		return nil
+	}
+	var points []struct {
+		TS  int64       `json:"ts"`
+		Val interface{} `json:"val"`
+	}
+	if json.Unmarshal(series.Data, &points) != nil {
+		return nil
+	}
+	row.sourceAddress = series.Source
+	row.destinationAddress = series.Destination
+	row.toolName = series.ToolName
+	row.eventType = series.EventType
+	if series.SummaryWindow > 0 {
+		window := int64(series.SummaryWindow)
+		row.summaryWindow = &window
+	}
+	var rows []parquetRow
+	for _, point := range points {
+		r := row
+		ts := point.TS * 1e6
+		r.timestamp = &ts
+		value := event.SeriesValue(point.Val)
+		if value == nil {
+			continue
+		}
+		switch series.EventType {
+		case "throughput":
+			r.throughput = value
+		case "packet-loss-rate":
+			r.loss = value
+		case "histogram-owdelay", "histogram-rtt":
+			r.latency = value
+		default:
+			r.value = value
+		}
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+// Writes the buffered rows as a row group, with one gzip compressed plain
+// encoded data page per column
+func (s *parquetSink) writeRowGroup() error {
+	if len(s.rows) == 0 {
+		return nil
+	}
+	group := parquetRowGroup{rows: int64(len(s.rows))}
+	for _, column := range parquetColumns {
+		// Definition levels (only for optional columns) then the non null values
+		var levels, values bytes.Buffer
+		var defined []bool
+		for i := range s.rows {
+			value := column.value(&s.rows[i])
+			defined = append(defined, value != nil)
+			switch v := value.(type) {
+			case int64:
+				binary.Write(&values, binary.LittleEndian, v)
+			case float64:
+				binary.Write(&values, binary.LittleEndian, math.Float64bits(v))
+			case string:
+				binary.Write(&values, binary.LittleEndian, uint32(len(v)))
+				values.WriteString(v)
+			}
+		}
+		var page bytes.Buffer
+		if column.optional {
+			parquetLevels(&levels, defined)
+			binary.Write(&page, binary.LittleEndian, uint32(levels.Len()))
+			page.Write(levels.Bytes())
+		}
+		page.Write(values.Bytes())
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(page.Bytes())
+		gz.Close()
+		// Page header
+		var header thriftWriter
+		header.begin()
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(page.Len()))
+		header.i32(3, int32(compressed.Len()))
+		header.beginStruct(5)
+		header.i32(1, int32(len(s.rows)))
+		header.i32(2, 0) // PLAIN
+		header.i32(3, 3) // RLE
+		header.i32(4, 3) // RLE
+		header.end()
+		header.end()
+		chunk := parquetChunk{
+			offset:       s.offset,
+			values:       int64(len(s.rows)),
+			uncompressed: int64(header.Len() + page.Len()),
+			compressed:   int64(header.Len() + compressed.Len()),
+		}
+		if err := s.write(header.Bytes()); err != nil {
+			return err
+		}
+		if err := s.write(compressed.Bytes()); err != nil {
+			return err
+		}
+		group.size += chunk.uncompressed
+		group.columns = append(group.columns, chunk)
+	}
+	s.rowGroups = append(s.rowGroups, group)
+	s.total += group.rows
+	s.rows = s.rows[:0]
+	return nil
+}
+
+// Encodes definition levels of bit width 1 with the RLE/bit-packing hybrid,
+// using only RLE runs
+func parquetLevels(b *bytes.Buffer, defined []bool) {
+	var varint [binary.MaxVarintLen64]byte
+	for i := 0; i < len(defined); {
+		run := 1
+		for i+run < len(defined) && defined[i+run] == defined[i] {
+			run++
+		}
+		b.Write(varint[:binary.PutUvarint(varint[:], uint64(run)<<1)])
+		if defined[i] {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+		i += run
+	}
+}
+
+// Writes the file metadata, its length and the closing magic
+func (s *parquetSink) writeFooter() error {
+	var w thriftWriter
+	w.begin()
+	w.i32(1, 1)
+	// Schema, a root group followed by the columns
+	w.beginList(2, thriftStruct, len(parquetColumns)+1)
+	w.begin()
+	w.binary(4, "schema")
+	w.i32(5, int32(len(parquetColumns)))
+	w.end()
+	for _, column := range parquetColumns {
+		w.begin()
+		w.i32(1, column.kind)
+		if column.optional {
+			w.i32(3, parquetOptional)
+		} else {
+			w.i32(3, parquetRequired)
+		}
+		w.binary(4, column.name)
+		if column.converted >= 0 {
+			w.i32(6, column.converted)
+		}
+		w.end()
+	}
+	w.i64(3, s.total)
+	// Row groups
+	w.beginList(4, thriftStruct, len(s.rowGroups))
+	for _, group := range s.rowGroups {
+		w.begin()
+		w.beginList(1, thriftStruct, len(group.columns))
+		for i, chunk := range group.columns {
+			column := parquetColumns[i]
+			w.begin()
+			w.i64(2, chunk.offset)
+			w.beginStruct(3)
+			w.i32(1, column.kind)
+			w.beginList(2, thriftI32, 2)
+			w.varint(0) // PLAIN
+			w.varint(3) // RLE
+			w.beginList(3, thriftBinary, 1)
+			w.string(column.name)
+			w.i32(4, 2) // GZIP
+			w.i64(5, chunk.values)
+			w.i64(6, chunk.uncompressed)
+			w.i64(7, chunk.compressed)
+			w.i64(9, chunk.offset)
+			w.end()
+			w.end()
+		}
+		w.i64(2, group.size)
+		w.i64(3, group.rows)
+		w.end()
+	}
+	w.binary(6, "ps-splunk")
+	w.end()
+	if err := s.write(w.Bytes()); err != nil {
+		return err
+	}
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(w.Len()))
+	if err := s.write(length[:]); err != nil {
+		return err
+	}
+	return s.write([]byte("PAR1"))
+}
+
+// Thrift compact protocol element types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// Writer of the thrift compact protocol used by the parquet metadata, it
+// tracks the last field id of every open struct for the field id deltas
+type thriftWriter struct {
+	bytes.Buffer
+	last []int16
+}
+
+// Starts a struct, either the top level one or a list element
+func (w *thriftWriter) begin() {
+	w.last = append(w.last, 0)
+}
+
+// Ends the current struct
+func (w *thriftWriter) end() {
+	w.WriteByte(0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+// Writes a field header
+func (w *thriftWriter) field(id int16, kind byte) {
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		w.WriteByte(kind)
+		w.varint(int64(id))
+	}
+	*last = id
+}
+
+// Writes a zigzag varint
+func (w *thriftWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// Writes a length prefixed string, as a list element or after a field header
+func (w *thriftWriter) string(s string) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], uint64(len(s)))])
+	w.WriteString(s)
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.varint(v)
+}
+
+func (w *thriftWriter) binary(id int16, s string) {
+	w.field(id, thriftBinary)
+	w.string(s)
+}
+
+// Starts a struct field, closed with end
+func (w *thriftWriter) beginStruct(id int16) {
+	w.field(id, thriftStruct)
+	w.begin()
+}
+
+// Writes a list field header, the n elements follow
+func (w *thriftWriter) beginList(id int16, kind byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.WriteByte(byte(n)<<4 | kind)
+		return
+	}
+	w.WriteByte(0xF0 | kind)
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], uint64(n))])
+}
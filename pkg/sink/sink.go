@@ -0,0 +1,533 @@
+// Package sink queues the events of every stream and writes them to files,
+// stdout, splunkd as a modular input, Splunk HEC, Elasticsearch, Kafka, AMQP,
+// NATS JetStream, InfluxDB, SQLite, Parquet, TCP or syslog. The files completed
+// can be uploaded to S3, GCS or Azure Blob Storage.
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/flagvar"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+	"github.com/bored-engineer/ps-splunk/pkg/logging"
+	"github.com/bored-engineer/ps-splunk/pkg/metrics"
+)
+
+// Flags of the sinks
+var Flags = flag.NewFlagSet("sink", flag.ContinueOnError)
+
+// Logger of the sinks
+var logger = logging.New("sink")
+
+// Output flags
+var outputDir = Flags.String("output-dir", ".", "Directory the output files are written to")
+var outputSpecs = flagvar.StringList{}
+var flushInterval = Flags.Duration("flush-interval", 5*time.Second, "Maximum time an event is buffered by a sink before being flushed")
+var fileGzip = Flags.Bool("file-gzip", false, "Gzip compress the files written by the file sinks")
+var fileMaxSize = flagvar.ByteSize(0)
+var fileMaxAge = Flags.Duration("file-max-age", 0, "Start a new file once the current one is this old (0 for no limit)")
+var fileAtomic = Flags.Bool("file-atomic", false, "Write every file under a .tmp name renamed once complete, so file monitors never read a partial file, the files of each run being numbered")
+var fileDoneMarker = Flags.Bool("file-done-marker", false, "Write an empty <file>.done marker next to every file once complete, for batch ingestion")
+
+func init() {
+	Flags.Var(&fileMaxSize, "file-max-size", "Start a new file once the current one holds this many uncompressed bytes, e.g. 512M (0 for no limit)")
+	Flags.Var(&outputSpecs, "output", "Sink for every stream, or for one stream as stream=sink, repeat to tee. "+
+		"Sinks: file, file:///dir, stdout, modinput (the XML stream of a Splunk modular input), hec, elasticsearch, opensearch, kafka, amqp, nats, influx, sqlite://path.db, parquet, parquet:///dir, tcp://host:port, syslog, syslog://host:port, syslog+tls://host:port (default file, or hec with -hec-url)")
+}
+
+// Set when a sink writes the events to stdout
+var stdoutEvents bool
+
+// Tracks the stream writers so Close can wait for them to flush
+var writers sync.WaitGroup
+
+// The sink metrics
+var (
+	sinkBytes  = metrics.NewCounterVec("ps_sink_bytes_total", "Bytes written to each sink.", "stream", "sink")
+	sinkEvents = metrics.NewCounterVec("ps_sink_events_total", "Events written to each sink.", "stream", "sink")
+)
+
+// Setup checks the output flags and sets up the HEC, InfluxDB and
+// Elasticsearch clients. Stdout is kept for the events if a sink writes there,
+// the info log moving to stderr.
+func Setup() error {
+	if *queueSize < 1 {
+		return fmt.Errorf("-queue-size must be at least 1")
+	}
+	if *maxInFlight < 0 {
+		return fmt.Errorf("-max-in-flight must not be negative")
+	}
+	if err := setupFileTemplate(); err != nil {
+		return err
+	}
+	for _, queue := range queues {
+		for _, spec := range streamSpecs(queue.name) {
+			if spec == "stdout" || spec == "modinput" {
+				logging.SetOutput(os.Stderr)
+				stdoutEvents = true
+			}
+		}
+	}
+	if err := setupHEC(); err != nil {
+		return err
+	}
+	if err := setupInflux(); err != nil {
+		return err
+	}
+	if err := setupUpload(); err != nil {
+		return err
+	}
+	if err := setupSyslog(); err != nil {
+		return err
+	}
+	return setupElastic()
+}
+
+// Open opens the sinks of every queue and spawns a writer for each stream
+func Open() error {
+	startUploads()
+	for _, queue := range queues {
+		sinks, err := openSinks(queue.name)
+		if err != nil {
+			return err
+		}
+		writers.Add(1)
+		queue.open(*queueSize)
+		go streamWriter(queue, sinks)
+	}
+	return nil
+}
+
+// Close closes every queue and waits for the writers to drain them and the
+// files they completed to be uploaded
+func Close() {
+	for _, queue := range queues {
+		queue.close()
+	}
+	writers.Wait()
+	closeDeadLetters()
+	writeManifestFiles()
+	finishUploads()
+}
+
+// WritesStdout returns true when a sink writes the events to stdout
+func WritesStdout() bool {
+	return stdoutEvents
+}
+
+// OutputSink is a destination for the events of one stream
+type OutputSink interface {
+	// Write queues a single event, serialized in the format of the sink
+	Write(event Event) error
+	// Flush pushes out any buffered events
+	Flush() error
+	// Close flushes and releases the sink
+	Close() error
+}
+
+// Returns the sink specs for stream. A stream named by any -output only uses
+// the sinks given for it, every other stream uses the sinks given without one.
+// A worker of a distributed crawl hands every event to the coordinator.
+func streamSpecs(stream string) []string {
+	if forwardURL != "" {
+		return []string{"coordinator"}
+	}
+	var own, all []string
+	for _, spec := range outputSpecs {
+		if i := strings.Index(spec, "="); i >= 0 && QueueNamed(spec[:i]) != nil {
+			if spec[:i] == stream {
+				own = append(own, spec[i+1:])
+			}
+			continue
+		}
+		all = append(all, spec)
+	}
+	if len(own) > 0 {
+		return own
+	}
+	if len(all) > 0 {
+		return all
+	}
+	if *hecURL != "" {
+		return []string{"hec"}
+	}
+	return []string{"file"}
+}
+
+// Opens all the sinks of stream
+func openSinks(stream string) ([]OutputSink, error) {
+	var sinks []OutputSink
+	for _, spec := range streamSpecs(stream) {
+		sink, err := openSink(stream, spec)
+		if err != nil {
+			return nil, fmt.Errorf("-output %s: %v", spec, err)
+		}
+		sinks = append(sinks, countingSink{sink, stream, spec})
+	}
+	return sinks, nil
+}
+
+// Opens the sink described by spec for stream
+func openSink(stream string, spec string) (OutputSink, error) {
+	switch spec {
+	case "file":
+		return newFileSink(*outputDir, stream)
+	case "stdout":
+		return stdoutSink{}, nil
+	case "modinput":
+		return newModinputSink(stream), nil
+	case "hec":
+		return newHECSink(stream)
+	case "parquet":
+		return newParquetSink(*outputDir, stream)
+	case "elasticsearch", "opensearch":
+		return newESSink(stream, spec)
+	case "kafka":
+		return newKafkaSink(stream)
+	case "amqp":
+		return newAMQPSink(stream)
+	case "nats":
+		return newNATSSink(stream)
+	case "influx":
+		return newInfluxSink(stream)
+	case "coordinator":
+		return newForwardSink(stream)
+	case "syslog":
+		return newSyslogSink(stream)
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return newFileSink(u.Path, stream)
+	case "tcp":
+		return newTCPSink(u.Host), nil
+	case "syslog":
+		return newRemoteSyslogSink(false, u.Host, stream), nil
+	case "syslog+tls":
+		return newRemoteSyslogSink(true, u.Host, stream), nil
+	case "sqlite":
+		return newSQLiteSink(u.Host+u.Path, stream)
+	case "parquet":
+		return newParquetSink(u.Path, stream)
+	}
+	return nil, fmt.Errorf("unknown sink")
+}
+
+// Wraps a sink to count the events and bytes written to it
+type countingSink struct {
+	OutputSink
+	stream string
+	spec   string
+}
+
+func (s countingSink) Write(event Event) error {
+	if err := s.OutputSink.Write(event); err != nil {
+		return err
+	}
+	sinkEvents.Inc(s.stream, s.spec)
+	sinkBytes.Add(float64(len(event.Payload)+1), s.stream, s.spec)
+	return nil
+}
+
+// Stream writer takes the channel of a queue and writes it to every sink of
+// the stream, flushing them periodically and closing them once the channel is
+// drained. Flushed events are acknowledged to the queue, and flushed early
+// when producers wait for them.
+func streamWriter(queue *Queue, sinks []OutputSink) {
+	defer writers.Done()
+	stream := queue.name
+	ticker := time.NewTicker(*flushInterval)
+	defer ticker.Stop()
+	// Events written since the last flush
+	unacked := 0
+	flush := func() {
+		for _, sink := range sinks {
+			if err := sink.Flush(); err != nil {
+				logger.Error("Flushing sink failed", "stream", stream, "err", err)
+			}
+		}
+		// Events the sinks failed to flush were dropped, they aren't in flight either
+		queue.ack(unacked)
+		unacked = 0
+	}
+	for {
+		select {
+		case log, ok := <-queue.out:
+			if !ok {
+				for _, sink := range sinks {
+					if err := sink.Close(); err != nil {
+						logger.Error("Closing sink failed", "stream", stream, "err", err)
+					}
+				}
+				return
+			}
+			for _, sink := range sinks {
+				if err := sink.Write(log); err != nil {
+					logger.Error("Writing event failed", "stream", stream, "err", err)
+				}
+			}
+			unacked++
+			// Batch the flush of waiting producers up to half the limit
+			if queue.throttled() && (unacked >= *maxInFlight/2 || queue.Len() == 0) {
+				flush()
+			}
+		case <-queue.pressure:
+			if unacked > 0 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Sink writing newline delimited JSON to a file per stream and run, or to
+// numbered parts of it when compressing or rotating
+type fileSink struct {
+	dir    string
+	stream string
+	// The current file, its final path and whether it is still written under a temporary name
+	file      *os.File
+	compress  *gzip.Writer
+	writer    *bufio.Writer
+	path      string
+	temporary bool
+	// Uncompressed bytes written to the current file, when it was opened and its number
+	size   int64
+	opened time.Time
+	part   int
+}
+
+// Creates the output file of stream in dir
+func newFileSink(dir string, stream string) (*fileSink, error) {
+	// Make sure the output directory exists
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &fileSink{dir: dir, stream: stream}
+	return s, s.open()
+}
+
+// Opens the next file. Without compression, rotation or -file-atomic there is a
+// single file that a resumed crawl appends to, otherwise each part gets the next
+// unused number. Compressed and atomic parts are only renamed to their final
+// name once complete, so nothing reads a partial file.
+func (s *fileSink) open() error {
+	// The stream must stay in the name, the sourcetype is taken from it
+	if !numberedFiles() {
+		s.path = fileName(s.dir, s.stream, 0, ".json")
+	} else {
+		ext := ".json"
+		if *fileGzip {
+			ext = ".json.gz"
+		}
+		for {
+			s.part++
+			s.path = fileName(s.dir, s.stream, s.part, ext)
+			if _, err := os.Stat(s.path); err == nil {
+				continue
+			}
+			if _, err := os.Stat(s.path + ".tmp"); err == nil {
+				continue
+			}
+			break
+		}
+	}
+	// Templates may name subdirectories, such as one per day
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	s.temporary = *fileGzip || *fileAtomic
+	name := s.path
+	if s.temporary {
+		name += ".tmp"
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.compress = nil
+	s.writer = bufio.NewWriter(file)
+	if *fileGzip {
+		s.compress = gzip.NewWriter(file)
+		s.writer = bufio.NewWriter(s.compress)
+	}
+	s.size = 0
+	s.opened = time.Now()
+	return nil
+}
+
+// Whether the current file reached the size or age limit
+func (s *fileSink) full(next int) bool {
+	if s.size == 0 {
+		return false
+	}
+	return (fileMaxSize > 0 && s.size+int64(next) > int64(fileMaxSize)) ||
+		(*fileMaxAge > 0 && time.Since(s.opened) >= *fileMaxAge)
+}
+
+// Closes the current file and starts the next one
+func (s *fileSink) rotate() error {
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// Flushes and closes the current file, giving it its final name
+func (s *fileSink) closeFile() error {
+	err := s.writer.Flush()
+	if s.compress != nil {
+		if closeErr := s.compress.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if s.temporary {
+		if err := os.Rename(s.path+".tmp", s.path); err != nil {
+			return err
+		}
+	}
+	if err := writeDoneMarker(s.path); err != nil {
+		return err
+	}
+	addToManifest(s.stream, s.path, -1)
+	uploadFile(s.stream, s.dir, s.path)
+	return nil
+}
+
+// Returns true when every run writes numbered files rather than appending to one
+func numberedFiles() bool {
+	return *fileGzip || *fileAtomic || fileMaxSize > 0 || *fileMaxAge > 0
+}
+
+// Marks the file at path as complete with -file-done-marker
+func writeDoneMarker(path string) error {
+	if !*fileDoneMarker {
+		return nil
+	}
+	return ioutil.WriteFile(path+".done", nil, 0644)
+}
+
+func (s *fileSink) Write(event Event) error {
+	line := event.NDJSON()
+	if s.full(len(line)) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.writer.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) Flush() error {
+	// Idle files still rotate once they are old enough
+	if s.full(0) {
+		return s.rotate()
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if s.compress != nil {
+		return s.compress.Flush()
+	}
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	return s.closeFile()
+}
+
+// Serializes the writes of every stdout sink so events never interleave
+var stdoutLock sync.Mutex
+
+// Sink writing newline delimited JSON to stdout
+type stdoutSink struct{}
+
+func (stdoutSink) Write(event Event) error {
+	stdoutLock.Lock()
+	defer stdoutLock.Unlock()
+	_, err := os.Stdout.Write(event.NDJSON())
+	return err
+}
+
+func (stdoutSink) Flush() error {
+	return nil
+}
+
+func (stdoutSink) Close() error {
+	return nil
+}
+
+// Sink writing newline delimited JSON to a TCP listener, reconnecting when
+// the connection drops
+type tcpSink struct {
+	addr   string
+	conn   net.Conn
+	writer *bufio.Writer
+}
+
+// Creates a TCP sink, the connection is made on the first write
+func newTCPSink(addr string) *tcpSink {
+	return &tcpSink{addr: addr}
+}
+
+func (s *tcpSink) Write(event Event) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.addr, *httpx.Timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+		s.writer = bufio.NewWriter(conn)
+	}
+	if _, err := s.writer.Write(event.NDJSON()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *tcpSink) Flush() error {
+	if s.conn == nil {
+		return nil
+	}
+	if err := s.writer.Flush(); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *tcpSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.writer.Flush()
+	s.conn.Close()
+	s.conn = nil
+	return err
+}
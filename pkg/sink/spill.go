@@ -0,0 +1,234 @@
+package sink
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/metrics"
+)
+
+// Output queue flags
+var queueSize = Flags.Int("queue-size", 10000, "Events buffered in memory per output stream before spilling to disk")
+var spillDir = Flags.String("spill-dir", os.TempDir(), "Directory for the files events spill to when a stream's sinks fall behind")
+var maxInFlight = Flags.Int("max-in-flight", 100000, "Events per output stream queued or written but not yet flushed by its sinks before the crawl waits for them to catch up (0 for no limit, spilling to disk)")
+
+// Every queue, in the order they were created
+var queues []*Queue
+
+// The queue metrics
+var (
+	eventsEmitted = metrics.NewCounterVec("ps_events_emitted_total", "Events queued to each output stream.", "stream")
+	bytesEmitted  = metrics.NewCounterVec("ps_bytes_emitted_total", "Bytes of the events queued to each output stream.", "stream")
+	backpressure  = metrics.NewCounterVec("ps_backpressure_seconds_total", "Time spent waiting for the sinks of each output stream to flush by -max-in-flight.", "stream")
+	_             = metrics.NewGaugeFunc("ps_events_in_flight", "Events of each output stream not yet flushed by its sinks.", "stream", func() map[string]float64 {
+		inFlight := make(map[string]float64)
+		for _, queue := range queues {
+			queue.Lock()
+			inFlight[queue.name] = float64(queue.inFlight)
+			queue.Unlock()
+		}
+		return inFlight
+	})
+)
+
+// Queue is the output queue of a stream, keeping a bounded number of events in memory. Once the channel
+// is full events are appended to a spill file, which a pump goroutine feeds
+// back into the channel in order as the sinks catch up, so memory stays
+// bounded however far behind the sinks are. Events stay in flight until the
+// sinks flushed them, and adding one waits while -max-in-flight are, so slow
+// or failing sinks slow the crawl down rather than the disk filling up.
+type Queue struct {
+	sync.Mutex
+	name    string
+	out     chan Event
+	more    *sync.Cond
+	file    *os.File
+	read    int64
+	write   int64
+	pending int
+	closed  bool
+	// Events not yet acknowledged by the writer, the producers waiting for it
+	// to and the channel waking it when they start to
+	inFlight int
+	waiting  int
+	acked    *sync.Cond
+	pressure chan struct{}
+}
+
+// NewQueue creates the output queue of the stream name, its sinks are opened
+// with the others by Open
+func NewQueue(name string) *Queue {
+	q := &Queue{name: name, pressure: make(chan struct{}, 1)}
+	q.more = sync.NewCond(q)
+	q.acked = sync.NewCond(q)
+	queues = append(queues, q)
+	return q
+}
+
+// Queues returns every queue, in the order they were created
+func Queues() []*Queue {
+	return queues
+}
+
+// QueueNamed returns the queue of the stream name, or nil if there is none
+func QueueNamed(name string) *Queue {
+	for _, queue := range queues {
+		if queue.name == name {
+			return queue
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the stream
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// Emit serializes an event as JSON and adds it to the queue
+func (q *Queue) Emit(event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("Serializing event failed", "stream", q.name, "err", err)
+		return
+	}
+	eventsEmitted.Inc(q.name)
+	bytesEmitted.Add(float64(len(data)+1), q.name)
+	q.put(NewEvent(q.name, data))
+}
+
+// EmittedBy returns the number of events and bytes queued to each stream
+func EmittedBy() (map[string]float64, map[string]float64) {
+	return eventsEmitted.SumBy("stream"), bytesEmitted.SumBy("stream")
+}
+
+// Allocates the channel and starts the pump
+func (q *Queue) open(size int) {
+	q.out = make(chan Event, size)
+	go q.pump()
+}
+
+// Adds an event, spilling it to disk if the channel is full or older
+// events are already waiting on disk. Once the writer runs, it first waits
+// for the sinks to flush while -max-in-flight events are in flight.
+func (q *Queue) put(event Event) {
+	q.Lock()
+	defer q.Unlock()
+	if *maxInFlight > 0 && q.out != nil && q.inFlight >= *maxInFlight {
+		start := time.Now()
+		q.waiting++
+		for q.inFlight >= *maxInFlight {
+			select {
+			case q.pressure <- struct{}{}:
+			default:
+			}
+			q.acked.Wait()
+		}
+		q.waiting--
+		backpressure.Add(time.Since(start).Seconds(), q.name)
+	}
+	q.inFlight++
+	if q.pending == 0 {
+		select {
+		case q.out <- event:
+			return
+		default:
+		}
+	}
+	// Lazily create the spill file, it is unlinked right away so it never outlives the crawl
+	if q.file == nil {
+		file, err := ioutil.TempFile(*spillDir, "ps-splunk-"+q.name+"-")
+		if err != nil {
+			logger.Fatal("Creating spill file failed", "stream", q.name, "err", err)
+		}
+		os.Remove(file.Name())
+		q.file = file
+		logger.Info("Spilling events to disk", "stream", q.name)
+	}
+	// Append the event with its length
+	record := event.spillRecord()
+	if _, err := q.file.WriteAt(record, q.write); err != nil {
+		logger.Fatal("Writing spill file failed", "stream", q.name, "err", err)
+	}
+	q.write += int64(len(record))
+	q.pending++
+	q.more.Signal()
+}
+
+// Moves spilled events back into the channel, closing it once the queue is
+// closed and empty
+func (q *Queue) pump() {
+	for {
+		q.Lock()
+		for q.pending == 0 && !q.closed {
+			q.more.Wait()
+		}
+		if q.pending == 0 {
+			q.Unlock()
+			close(q.out)
+			if q.file != nil {
+				q.file.Close()
+			}
+			return
+		}
+		file, offset := q.file, q.read
+		q.Unlock()
+		// Read the oldest spilled event, the lock isn't needed as it is fully written
+		var length [4]byte
+		if _, err := file.ReadAt(length[:], offset); err != nil {
+			logger.Fatal("Reading spill file failed", "stream", q.name, "err", err)
+		}
+		record := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := file.ReadAt(record, offset+4); err != nil {
+			logger.Fatal("Reading spill file failed", "stream", q.name, "err", err)
+		}
+		q.out <- spilledEvent(q.name, record)
+		q.Lock()
+		q.read += int64(4 + len(record))
+		q.pending--
+		// Reclaim the disk space once everything spilled was moved
+		if q.pending == 0 {
+			q.file.Truncate(0)
+			q.read, q.write = 0, 0
+		}
+		q.Unlock()
+	}
+}
+
+// Acknowledges n events flushed by the sinks, letting the producers waiting on
+// them add more
+func (q *Queue) ack(n int) {
+	if n == 0 {
+		return
+	}
+	q.Lock()
+	q.inFlight -= n
+	q.Unlock()
+	q.acked.Broadcast()
+}
+
+// Whether producers wait for the sinks to flush
+func (q *Queue) throttled() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.waiting > 0
+}
+
+// Len returns the number of events waiting in memory and on disk
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.out) + q.pending
+}
+
+// Marks the queue as complete, the channel closes once it is drained
+func (q *Queue) close() {
+	q.Lock()
+	q.closed = true
+	q.Unlock()
+	q.more.Signal()
+}
@@ -0,0 +1,699 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bored-engineer/ps-splunk/pkg/enrich"
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// SQLite flags
+var sqliteBinary = Flags.String("sqlite-binary", "sqlite3", "sqlite3 command line shell used by the sqlite sink to write the database")
+
+// Tables written by the sqlite sink, hosts are filled from the links and summaries
+const sqliteSchema = `PRAGMA journal_mode=WAL;
+CREATE TABLE IF NOT EXISTS hosts (
+	run_id TEXT NOT NULL,
+	address TEXT NOT NULL,
+	first_seen TEXT,
+	depth INTEGER,
+	crawled INTEGER NOT NULL DEFAULT 0,
+	country_code TEXT,
+	city TEXT,
+	latitude REAL,
+	longitude REAL,
+	asn INTEGER,
+	as_name TEXT,
+	prefix TEXT,
+	PRIMARY KEY (run_id, address)
+);
+CREATE TABLE IF NOT EXISTS links (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	address TEXT NOT NULL,
+	origin TEXT,
+	depth INTEGER,
+	count INTEGER
+);
+CREATE INDEX IF NOT EXISTS links_address ON links (run_id, address);
+CREATE INDEX IF NOT EXISTS links_origin ON links (run_id, origin);
+CREATE TABLE IF NOT EXISTS summaries (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	host TEXT NOT NULL,
+	summary TEXT
+);
+CREATE INDEX IF NOT EXISTS summaries_host ON summaries (run_id, host);
+CREATE TABLE IF NOT EXISTS test_results (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	host TEXT NOT NULL,
+	source TEXT,
+	source_address TEXT,
+	destination_address TEXT,
+	event_type TEXT,
+	result TEXT
+);
+CREATE INDEX IF NOT EXISTS test_results_host ON test_results (run_id, host);
+CREATE INDEX IF NOT EXISTS test_results_pair ON test_results (source_address, destination_address);
+CREATE TABLE IF NOT EXISTS failures (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	address TEXT NOT NULL,
+	endpoint TEXT,
+	url TEXT,
+	attempts INTEGER,
+	error TEXT
+);
+CREATE INDEX IF NOT EXISTS failures_address ON failures (run_id, address);
+CREATE TABLE IF NOT EXISTS parse_errors (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	host TEXT NOT NULL,
+	endpoint TEXT,
+	url TEXT,
+	error TEXT,
+	payload TEXT
+);
+CREATE INDEX IF NOT EXISTS parse_errors_host ON parse_errors (run_id, host);
+CREATE TABLE IF NOT EXISTS errors (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	host TEXT NOT NULL,
+	endpoint TEXT,
+	url TEXT,
+	category TEXT,
+	status INTEGER,
+	error TEXT
+);
+CREATE INDEX IF NOT EXISTS errors_host ON errors (run_id, host, endpoint);
+CREATE TABLE IF NOT EXISTS host_status (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	host TEXT NOT NULL,
+	reachable INTEGER,
+	has_toolkit INTEGER,
+	has_graphs INTEGER,
+	has_esmond INTEGER,
+	has_pscheduler INTEGER,
+	bundle TEXT,
+	duration_seconds REAL,
+	endpoints TEXT
+);
+CREATE INDEX IF NOT EXISTS host_status_host ON host_status (run_id, host);
+CREATE TABLE IF NOT EXISTS metrics (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	metric_name TEXT NOT NULL,
+	value REAL,
+	archive_host TEXT,
+	metadata_key TEXT,
+	source_address TEXT,
+	destination_address TEXT,
+	tool_name TEXT,
+	event_type TEXT,
+	summary_type TEXT,
+	summary_window INTEGER,
+	aggregate_window INTEGER
+);
+CREATE INDEX IF NOT EXISTS metrics_name ON metrics (metric_name, source_address, destination_address, time);
+CREATE TABLE IF NOT EXISTS tasks (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	host TEXT NOT NULL,
+	task TEXT,
+	runs TEXT
+);
+CREATE INDEX IF NOT EXISTS tasks_host ON tasks (run_id, host);
+CREATE TABLE IF NOT EXISTS paths (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	host TEXT NOT NULL,
+	metadata_key TEXT,
+	source_address TEXT,
+	destination_address TEXT,
+	tool_name TEXT,
+	ts INTEGER,
+	path_id TEXT,
+	hop_count INTEGER
+);
+CREATE INDEX IF NOT EXISTS paths_pair ON paths (source_address, destination_address, ts);
+CREATE TABLE IF NOT EXISTS path_hops (
+	run_id TEXT NOT NULL,
+	host TEXT NOT NULL,
+	metadata_key TEXT,
+	ts INTEGER,
+	ttl INTEGER,
+	query INTEGER,
+	ip TEXT,
+	hostname TEXT,
+	rtt REAL,
+	mtu INTEGER,
+	success INTEGER,
+	error TEXT
+);
+CREATE INDEX IF NOT EXISTS path_hops_path ON path_hops (run_id, host, metadata_key, ts);
+CREATE INDEX IF NOT EXISTS path_hops_ip ON path_hops (ip);
+CREATE TABLE IF NOT EXISTS timeseries (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	host TEXT NOT NULL,
+	metadata_key TEXT,
+	source_address TEXT,
+	destination_address TEXT,
+	tool_name TEXT,
+	event_type TEXT,
+	summary_type TEXT,
+	summary_window INTEGER,
+	ts INTEGER,
+	throughput REAL,
+	latency REAL,
+	loss REAL,
+	value TEXT,
+	aggregate_window INTEGER,
+	count INTEGER,
+	min REAL,
+	mean REAL,
+	max REAL,
+	p95 REAL
+);
+CREATE TABLE IF NOT EXISTS inventory (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	host TEXT NOT NULL,
+	toolkit_version TEXT,
+	toolkit_rpm_version TEXT,
+	os TEXT,
+	kernel_version TEXT,
+	ntp_synchronized INTEGER,
+	auto_updates INTEGER,
+	globally_registered INTEGER,
+	communities TEXT,
+	services TEXT,
+	ntp TEXT,
+	calendar TEXT,
+	issues TEXT
+);
+CREATE INDEX IF NOT EXISTS inventory_host ON inventory (run_id, host);
+CREATE TABLE IF NOT EXISTS expected_tests (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	mesh TEXT,
+	task TEXT,
+	test_type TEXT,
+	event_type TEXT,
+	source TEXT,
+	destination TEXT,
+	gap INTEGER,
+	last_updated TEXT,
+	archives TEXT
+);
+CREATE TABLE IF NOT EXISTS components (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	component INTEGER,
+	label TEXT,
+	host TEXT,
+	reachable INTEGER,
+	meshes TEXT,
+	hosts INTEGER,
+	reachable_hosts INTEGER
+);
+CREATE TABLE IF NOT EXISTS truncations (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	reason TEXT,
+	budget_seconds REAL,
+	elapsed_seconds REAL,
+	completed INTEGER,
+	pending INTEGER
+);
+CREATE TABLE IF NOT EXISTS pairs (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	host_a TEXT NOT NULL,
+	host_b TEXT NOT NULL,
+	a_to_b INTEGER,
+	b_to_a INTEGER,
+	direction TEXT,
+	tests INTEGER,
+	reporters TEXT
+);
+CREATE INDEX IF NOT EXISTS pairs_hosts ON pairs (run_id, host_a, host_b);
+CREATE TABLE IF NOT EXISTS registrations (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	source TEXT,
+	url TEXT,
+	type TEXT,
+	hosts TEXT,
+	service_types TEXT,
+	communities TEXT,
+	site_name TEXT,
+	country TEXT,
+	toolkit_version TEXT,
+	uri TEXT,
+	client_uuid TEXT,
+	expires TEXT,
+	expired INTEGER,
+	registration TEXT
+);
+CREATE INDEX IF NOT EXISTS registrations_uri ON registrations (run_id, uri);
+CREATE TABLE IF NOT EXISTS reports (
+	run_id TEXT NOT NULL,
+	time TEXT,
+	duration_seconds REAL,
+	hosts_discovered INTEGER,
+	hosts_crawled INTEGER,
+	hosts_responsive INTEGER,
+	hosts_with_archive INTEGER,
+	report TEXT
+);
+CREATE INDEX IF NOT EXISTS timeseries_pair ON timeseries (source_address, destination_address, event_type, ts);
+`
+
+// Line sqlite3 prints once the statements before it all ran
+const sqliteDone = "done"
+
+// A database shared by the sinks of every stream, written by one sqlite3 process
+type sqliteDB struct {
+	sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr bytes.Buffer
+	refs   int
+	// Set once sqlite3 stopped on a failing statement
+	err error
+}
+
+// Open databases by path
+var sqliteDBs = struct {
+	sync.Mutex
+	m map[string]*sqliteDB
+}{m: make(map[string]*sqliteDB)}
+
+// Returns the database at path, starting its sqlite3 process and creating the tables if needed
+func openSQLiteDB(path string) (*sqliteDB, error) {
+	sqliteDBs.Lock()
+	defer sqliteDBs.Unlock()
+	if db, ok := sqliteDBs.m[path]; ok {
+		db.refs++
+		return db, nil
+	}
+	// With -bail sqlite3 exits on the first failing statement instead of
+	// going on with the rest of the transaction
+	cmd := exec.Command(*sqliteBinary, "-batch", "-bail", path)
+	db := &sqliteDB{cmd: cmd, refs: 1}
+	cmd.Stderr = io.MultiWriter(os.Stderr, &db.stderr)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	db.stdin, db.stdout = stdin, bufio.NewReader(stdout)
+	if err := db.run([]byte(sqliteSchema)); err != nil {
+		return nil, err
+	}
+	sqliteDBs.m[path] = db
+	return db, nil
+}
+
+// Runs statements in a single transaction
+func (db *sqliteDB) exec(statements []byte) error {
+	db.Lock()
+	defer db.Unlock()
+	return db.run([]byte("BEGIN;\n" + string(statements) + "COMMIT;\n"))
+}
+
+// Runs statements and waits for sqlite3 to print that they all ran, the lock
+// must be held. Once sqlite3 stopped every call fails with its error.
+func (db *sqliteDB) run(statements []byte) error {
+	if db.err != nil {
+		return db.err
+	}
+	_, err := fmt.Fprintf(db.stdin, "%sSELECT '%s';\n", statements, sqliteDone)
+	// Other lines are the output of the statements, such as the journal mode
+	for err == nil {
+		var line string
+		if line, err = db.stdout.ReadString('\n'); err == nil && strings.TrimSpace(line) == sqliteDone {
+			return nil
+		}
+	}
+	// sqlite3 exited on a failing statement, its stderr says which
+	db.stdin.Close()
+	db.cmd.Wait()
+	if message := strings.TrimSpace(db.stderr.String()); message != "" {
+		db.err = fmt.Errorf("sqlite3: %s", message)
+	} else {
+		db.err = fmt.Errorf("sqlite3 stopped: %v", err)
+	}
+	return db.err
+}
+
+// Releases the database, the last sink to close it waits for sqlite3 to finish
+func (db *sqliteDB) close(path string) error {
+	sqliteDBs.Lock()
+	db.refs--
+	last := db.refs == 0
+	if last {
+		delete(sqliteDBs.m, path)
+	}
+	sqliteDBs.Unlock()
+	if !last {
+		return nil
+	}
+	// A failed sqlite3 was already waited for, its error reported
+	if db.err != nil {
+		return nil
+	}
+	db.stdin.Close()
+	return db.cmd.Wait()
+}
+
+// Sink writing the events of a stream to the tables of a SQLite database
+type sqliteSink struct {
+	db         *sqliteDB
+	path       string
+	stream     string
+	statements bytes.Buffer
+}
+
+// Creates the SQLite sink of stream writing to the database at path
+func newSQLiteSink(path string, stream string) (*sqliteSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("missing database path")
+	}
+	db, err := openSQLiteDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteSink{db: db, path: path, stream: stream}, nil
+}
+
+func (s *sqliteSink) Write(e Event) error {
+	log := e.Payload
+	var header event.Header
+	if err := json.Unmarshal(log, &header); err != nil {
+		return err
+	}
+	run, collected := sqlString(header.RunID), sqlString(header.Time)
+	switch s.stream {
+	case "link":
+		var link event.Link
+		if err := json.Unmarshal(log, &link); err != nil {
+			return err
+		}
+		address := sqlText(link.Address)
+		fmt.Fprintf(&s.statements, "INSERT INTO links VALUES (%s, %s, %s, %s, %d, %d);\n",
+			run, collected, address, sqlString(link.Origin), link.Depth, link.Count)
+		geo, asn := link.Geo, link.ASN
+		if geo == nil {
+			geo = &enrich.GeoIP{}
+		}
+		if asn == nil {
+			asn = &enrich.ASN{}
+		}
+		fmt.Fprintf(&s.statements, "INSERT OR IGNORE INTO hosts (run_id, address, first_seen, depth, country_code, city, latitude, longitude, asn, as_name, prefix) "+
+			"VALUES (%s, %s, %s, %d, %s, %s, %s, %s, %s, %s, %s);\n",
+			run, address, collected, link.Depth, sqlString(geo.CountryCode), sqlString(geo.City),
+			sqlFloat(geo.Latitude), sqlFloat(geo.Longitude), sqlUint(uint64(asn.Number)), sqlString(asn.Name), sqlString(asn.Prefix))
+	case "summary":
+		var summary event.Summary
+		if err := json.Unmarshal(log, &summary); err != nil {
+			return err
+		}
+		host := sqlText(summary.Host)
+		if summary.Tombstone {
+			// The host is gone, it has no summary and wasn't crawled
+			fmt.Fprintf(&s.statements, "INSERT INTO summaries VALUES (%s, %s, %s, NULL);\n", run, collected, host)
+			break
+		}
+		fmt.Fprintf(&s.statements, "INSERT INTO summaries VALUES (%s, %s, %s, %s);\n",
+			run, collected, host, sqlString(string(summary.Summary)))
+		fmt.Fprintf(&s.statements, "INSERT OR IGNORE INTO hosts (run_id, address, first_seen) VALUES (%s, %s, %s);\n", run, host, collected)
+		fmt.Fprintf(&s.statements, "UPDATE hosts SET crawled = 1 WHERE run_id = %s AND address = %s;\n", run, host)
+	case "results":
+		var result event.Result
+		if err := json.Unmarshal(log, &result); err != nil {
+			return err
+		}
+		// Graphs tests and esmond series name their endpoints differently
+		var fields struct {
+			SourceIP      string `json:"source_ip"`
+			DestinationIP string `json:"destination_ip"`
+			Source        string `json:"source"`
+			Destination   string `json:"destination"`
+			EventType     string `json:"event_type"`
+		}
+		json.Unmarshal(result.Result, &fields)
+		if fields.SourceIP == "" {
+			fields.SourceIP = fields.Source
+		}
+		if fields.DestinationIP == "" {
+			fields.DestinationIP = fields.Destination
+		}
+		fmt.Fprintf(&s.statements, "INSERT INTO test_results VALUES (%s, %s, %s, %s, %s, %s, %s, %s);\n",
+			run, collected, sqlText(result.Host), sqlString(result.Source), sqlString(fields.SourceIP),
+			sqlString(fields.DestinationIP), sqlString(fields.EventType), sqlString(string(result.Result)))
+	case "failed":
+		var failure event.Failure
+		if err := json.Unmarshal(log, &failure); err != nil {
+			return err
+		}
+		fmt.Fprintf(&s.statements, "INSERT INTO failures VALUES (%s, %s, %s, %s, %s, %d, %s);\n",
+			run, collected, sqlText(failure.Address), sqlString(failure.Endpoint), sqlString(failure.URL),
+			failure.Attempts, sqlString(failure.Error))
+	case "host_status":
+		var status event.HostStatus
+		if err := json.Unmarshal(log, &status); err != nil {
+			return err
+		}
+		endpoints, _ := json.Marshal(status.Endpoints)
+		fmt.Fprintf(&s.statements, "INSERT INTO host_status VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s);\n",
+			run, collected, sqlText(status.Host), sqlBool(&status.Reachable), sqlBool(&status.HasToolkit),
+			sqlBool(&status.HasGraphs), sqlBool(&status.HasEsmond), sqlBool(&status.HasPScheduler),
+			sqlString(status.Bundle), sqlFloat(&status.DurationSeconds), sqlString(string(endpoints)))
+	case "metrics":
+		var metric event.Metric
+		if err := json.Unmarshal(log, &metric); err != nil {
+			return err
+		}
+		fmt.Fprintf(&s.statements, "INSERT INTO metrics VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %d, %s);\n",
+			run, collected, sqlText(metric.MetricName), sqlFloat(&metric.Value), sqlString(metric.ArchiveHost),
+			sqlString(metric.MetadataKey), sqlString(metric.Source), sqlString(metric.Destination), sqlString(metric.ToolName),
+			sqlString(metric.EventType), sqlString(metric.SummaryType), metric.SummaryWindow, sqlUint(uint64(metric.AggregateWindow)))
+	case "parse_errors":
+		var parseError event.ParseError
+		if err := json.Unmarshal(log, &parseError); err != nil {
+			return err
+		}
+		fmt.Fprintf(&s.statements, "INSERT INTO parse_errors VALUES (%s, %s, %s, %s, %s, %s, %s);\n",
+			run, collected, sqlText(parseError.Host), sqlString(parseError.Endpoint), sqlString(parseError.URL),
+			sqlString(parseError.Error), sqlString(string(parseError.Payload)))
+	case "errors":
+		var requestError event.RequestError
+		if err := json.Unmarshal(log, &requestError); err != nil {
+			return err
+		}
+		fmt.Fprintf(&s.statements, "INSERT INTO errors VALUES (%s, %s, %s, %s, %s, %s, %s, %s);\n",
+			run, collected, sqlText(requestError.Host), sqlString(requestError.Endpoint), sqlString(requestError.URL),
+			sqlString(requestError.Category), sqlUint(uint64(requestError.Status)), sqlString(requestError.Error))
+	case "pairs":
+		var pair event.LinkPair
+		if err := json.Unmarshal(log, &pair); err != nil {
+			return err
+		}
+		reporters, _ := json.Marshal(pair.Reporters)
+		fmt.Fprintf(&s.statements, "INSERT INTO pairs VALUES (%s, %s, %s, %s, %s, %s, %s, %d, %s);\n",
+			run, collected, sqlText(pair.HostA), sqlText(pair.HostB), sqlBool(&pair.AToB), sqlBool(&pair.BToA),
+			sqlString(pair.Direction), pair.Tests, sqlString(string(reporters)))
+	case "truncated":
+		var truncation event.Truncation
+		if err := json.Unmarshal(log, &truncation); err != nil {
+			return err
+		}
+		fmt.Fprintf(&s.statements, "INSERT INTO truncations VALUES (%s, %s, %s, %s, %s, %d, %d);\n",
+			run, collected, sqlString(truncation.Reason), sqlFloat(&truncation.BudgetSeconds),
+			sqlFloat(&truncation.ElapsedSeconds), truncation.Completed, truncation.Pending)
+	case "tasks":
+		var task event.Task
+		if err := json.Unmarshal(log, &task); err != nil {
+			return err
+		}
+		runs, _ := json.Marshal(task.Runs)
+		fmt.Fprintf(&s.statements, "INSERT INTO tasks VALUES (%s, %s, %s, %s, %s);\n",
+			run, collected, sqlText(task.Host), sqlString(string(task.Task)), sqlString(string(runs)))
+	case "paths":
+		var path event.Path
+		if err := json.Unmarshal(log, &path); err != nil {
+			return err
+		}
+		host, key := sqlText(path.Host), sqlString(path.MetadataKey)
+		fmt.Fprintf(&s.statements, "INSERT INTO paths VALUES (%s, %s, %s, %s, %s, %s, %s, %d, %s, %d);\n",
+			run, collected, host, key, sqlString(path.Source), sqlString(path.Destination),
+			sqlString(path.ToolName), path.Timestamp, sqlString(path.PathID), path.HopCount)
+		for _, hop := range path.Hops {
+			mtu := "NULL"
+			if hop.MTU != nil {
+				mtu = strconv.Itoa(*hop.MTU)
+			}
+			success := 0
+			if hop.Success {
+				success = 1
+			}
+			fmt.Fprintf(&s.statements, "INSERT INTO path_hops VALUES (%s, %s, %s, %d, %d, %d, %s, %s, %s, %s, %d, %s);\n",
+				run, host, key, path.Timestamp, hop.TTL, hop.Query, sqlString(hop.IP), sqlString(hop.Hostname),
+				sqlFloat(hop.RTT), mtu, success, sqlString(hop.Error))
+		}
+	case "timeseries":
+		var point event.Datapoint
+		if err := json.Unmarshal(log, &point); err != nil {
+			return err
+		}
+		fmt.Fprintf(&s.statements, "INSERT INTO timeseries VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %d, %d, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s);\n",
+			run, collected, sqlText(point.Host), sqlString(point.MetadataKey), sqlString(point.Source),
+			sqlString(point.Destination), sqlString(point.ToolName), sqlString(point.EventType), sqlString(point.SummaryType),
+			point.SummaryWindow, point.Timestamp, sqlFloat(point.Throughput), sqlFloat(point.Latency), sqlFloat(point.Loss),
+			sqlString(string(point.Value)), sqlUint(uint64(point.AggregateWindow)), sqlUint(uint64(point.Count)),
+			sqlFloat(point.Min), sqlFloat(point.Mean), sqlFloat(point.Max), sqlFloat(point.P95))
+	case "inventory":
+		var record event.Inventory
+		if err := json.Unmarshal(log, &record); err != nil {
+			return err
+		}
+		communities, _ := json.Marshal(record.Communities)
+		services, _ := json.Marshal(record.Services)
+		var ntp []byte
+		if record.NTP != nil {
+			ntp, _ = json.Marshal(record.NTP)
+		}
+		issues, _ := json.Marshal(record.Issues)
+		fmt.Fprintf(&s.statements, "INSERT INTO inventory VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s);\n",
+			run, collected, sqlText(record.Host), sqlString(record.ToolkitVersion), sqlString(record.ToolkitRPMVersion),
+			sqlString(record.OS), sqlString(record.KernelVersion), sqlBool(record.NTPSynchronized), sqlBool(record.AutoUpdates),
+			sqlBool(record.GloballyRegistered), sqlString(string(communities)), sqlString(string(services)),
+			sqlString(string(ntp)), sqlString(string(record.Calendar)), sqlString(string(issues)))
+	case "expected":
+		var test event.ExpectedTest
+		if err := json.Unmarshal(log, &test); err != nil {
+			return err
+		}
+		archives, _ := json.Marshal(test.Archives)
+		fmt.Fprintf(&s.statements, "INSERT INTO expected_tests VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s);\n",
+			run, collected, sqlString(test.Mesh), sqlString(test.Task), sqlString(test.TestType), sqlString(test.EventType),
+			sqlString(test.Source), sqlString(test.Destination), sqlBool(&test.Gap), sqlString(test.LastUpdated), sqlString(string(archives)))
+	case "components":
+		var member event.Component
+		if err := json.Unmarshal(log, &member); err != nil {
+			return err
+		}
+		meshes, _ := json.Marshal(member.Meshes)
+		fmt.Fprintf(&s.statements, "INSERT INTO components VALUES (%s, %s, %d, %s, %s, %s, %s, %d, %d);\n",
+			run, collected, member.Component, sqlString(member.Label), sqlString(member.Host), sqlBool(&member.Reachable),
+			sqlString(string(meshes)), member.Hosts, member.ReachableHosts)
+	case "registrations":
+		var record event.Registration
+		if err := json.Unmarshal(log, &record); err != nil {
+			return err
+		}
+		hosts, _ := json.Marshal(record.Hosts)
+		serviceTypes, _ := json.Marshal(record.ServiceTypes)
+		communities, _ := json.Marshal(record.Communities)
+		fmt.Fprintf(&s.statements, "INSERT INTO registrations VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s);\n",
+			run, collected, sqlString(record.Discovery.Source), sqlString(record.Discovery.URL), sqlString(record.Type),
+			sqlString(string(hosts)), sqlString(string(serviceTypes)), sqlString(string(communities)), sqlString(record.SiteName),
+			sqlString(record.Country), sqlString(record.ToolkitVersion), sqlString(record.URI), sqlString(record.ClientUUID),
+			sqlString(record.Expires), sqlBool(&record.Expired), sqlString(string(bytes.TrimSpace(log))))
+	case "report":
+		var report event.Report
+		if err := json.Unmarshal(log, &report); err != nil {
+			return err
+		}
+		fmt.Fprintf(&s.statements, "INSERT INTO reports VALUES (%s, %s, %s, %d, %d, %d, %d, %s);\n",
+			run, collected, sqlFloat(&report.DurationSeconds), report.HostsDiscovered, report.HostsCrawled,
+			report.HostsResponsive, report.HostsWithArchive, sqlString(string(bytes.TrimSpace(log))))
+	default:
+		return fmt.Errorf("no table for stream %s", s.stream)
+	}
+	return nil
+}
+
+// Writes the pending statements as one transaction
+func (s *sqliteSink) Flush() error {
+	if s.statements.Len() == 0 {
+		return nil
+	}
+	err := s.db.exec(s.statements.Bytes())
+	s.statements.Reset()
+	return err
+}
+
+func (s *sqliteSink) Close() error {
+	err := s.Flush()
+	if closeErr := s.db.close(s.path); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Quotes a string as an SQL literal for the NOT NULL columns, empty strings
+// staying empty
+func sqlText(value string) string {
+	if value == "" {
+		return "''"
+	}
+	return sqlString(value)
+}
+
+// Quotes a string as an SQL literal, empty strings are NULL. NUL bytes can't
+// be passed through the shell and are dropped.
+func sqlString(value string) string {
+	if value == "" {
+		return "NULL"
+	}
+	value = strings.Replace(value, "\x00", "", -1)
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// Formats an optional number as an SQL literal
+func sqlFloat(value *float64) string {
+	if value == nil {
+		return "NULL"
+	}
+	return strconv.FormatFloat(*value, 'g', -1, 64)
+}
+
+// Formats an optional boolean as an SQL literal
+func sqlBool(value *bool) string {
+	switch {
+	case value == nil:
+		return "NULL"
+	case *value:
+		return "1"
+	}
+	return "0"
+}
+
+// Formats a number as an SQL literal, zero being unknown
+func sqlUint(value uint64) string {
+	if value == 0 {
+		return "NULL"
+	}
+	return strconv.FormatUint(value, 10)
+}
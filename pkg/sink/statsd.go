@@ -0,0 +1,94 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsD and Graphite flags
+var statsdAddress = Flags.String("statsd", "", "StatsD server (host:port) the headline numbers of the crawl are sent to over UDP as gauges once it ends")
+var graphiteAddress = Flags.String("graphite", "", "Graphite server (host:port) the headline numbers of the crawl are sent to with the plaintext protocol once it ends")
+var statsPrefix = Flags.String("stats-prefix", "perfsonar", "Prefix of the names of the headline numbers sent to StatsD and Graphite")
+
+// Largest StatsD packet, fitting the MTU of most networks
+const statsdPacketSize = 1432
+
+// SendsStats returns true when the headline numbers of the crawl are sent to
+// StatsD or Graphite
+func SendsStats() bool {
+	return *statsdAddress != "" || *graphiteAddress != ""
+}
+
+// SendStats sends the headline numbers of the crawl, by their name under the
+// prefix, to StatsD and Graphite
+func SendStats(stats map[string]float64) error {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var failed []string
+	if *statsdAddress != "" {
+		if err := sendStatsD(names, stats); err != nil {
+			failed = append(failed, "statsd: "+err.Error())
+		}
+	}
+	if *graphiteAddress != "" {
+		if err := sendGraphite(names, stats); err != nil {
+			failed = append(failed, "graphite: "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Sends the numbers as gauges, as many to a packet as fit
+func sendStatsD(names []string, stats map[string]float64) error {
+	conn, err := net.DialTimeout("udp", *statsdAddress, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	for _, name := range names {
+		line := *statsPrefix + "." + name + ":" + strconv.FormatFloat(stats[name], 'f', -1, 64) + "|g"
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		_, err = conn.Write(packet.Bytes())
+	}
+	return err
+}
+
+// Sends the numbers timestamped now over a single connection
+func sendGraphite(names []string, stats map[string]float64) error {
+	conn, err := net.DialTimeout("tcp", *graphiteAddress, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	now := time.Now().Unix()
+	var lines bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&lines, "%s.%s %s %d\n", *statsPrefix, name, strconv.FormatFloat(stats[name], 'f', -1, 64), now)
+	}
+	_, err = conn.Write(lines.Bytes())
+	return err
+}
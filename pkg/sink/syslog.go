@@ -0,0 +1,225 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+)
+
+// Remote syslog flags
+var syslogFormat = Flags.String("syslog-format", "rfc3164", "Format of the messages sent by the syslog:// and syslog+tls:// sinks: rfc3164, newline delimited, or rfc5424, octet counted with the stream, run and collector as structured data")
+var syslogRetries = Flags.Int("syslog-retries", 5, "Number of times the syslog sinks reconnect to resend their pending messages before dropping them")
+var syslogCABundle = Flags.String("syslog-ca-bundle", "", "PEM file of CA certificates trusted for the syslog+tls:// server in addition to the system roots")
+var syslogClientCert = Flags.String("syslog-client-cert", "", "PEM certificate presented to the syslog+tls:// server")
+var syslogClientKey = Flags.String("syslog-client-key", "", "PEM private key of -syslog-client-cert")
+var syslogInsecureSkipVerify = Flags.Bool("syslog-insecure-skip-verify", false, "Don't verify the syslog+tls:// server certificate")
+
+// SD-ID of the structured data of RFC 5424 messages, under the private
+// enterprise number reserved for documentation by RFC 5612
+const syslogSDID = "ps-splunk@32473"
+
+// Syslog priority of the messages, the daemon facility at the info severity
+const syslogPriority = 3*8 + 6
+
+// Pending messages sent once they reach this size, or on every flush
+const syslogBatchBytes = 64 * 1024
+
+// TLS configuration of the syslog+tls:// sinks, built once
+var syslogTLS *tls.Config
+
+// Checks the remote syslog flags and loads the TLS certificates
+func setupSyslog() error {
+	if *syslogFormat != "rfc3164" && *syslogFormat != "rfc5424" {
+		return fmt.Errorf("invalid -syslog-format %q, expected rfc3164 or rfc5424", *syslogFormat)
+	}
+	config := &tls.Config{InsecureSkipVerify: *syslogInsecureSkipVerify}
+	if *syslogCABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(*syslogCABundle)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", *syslogCABundle)
+		}
+		config.RootCAs = pool
+	}
+	if *syslogClientCert != "" || *syslogClientKey != "" {
+		if *syslogClientCert == "" || *syslogClientKey == "" {
+			return fmt.Errorf("-syslog-client-cert and -syslog-client-key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(*syslogClientCert, *syslogClientKey)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	syslogTLS = config
+	return nil
+}
+
+// Sink sending each event to the local syslog daemon tagged with the stream
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// Connects to the local syslog daemon
+func newSyslogSink(stream string) (*syslogSink, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "ps-splunk-"+stream)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer}, nil
+}
+
+func (s *syslogSink) Write(event Event) error {
+	return s.writer.Info(string(event.Payload))
+}
+
+func (s *syslogSink) Flush() error {
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
+
+// Sink sending each event as a syslog message to a remote server over TCP or
+// TLS. Messages are batched and a batch the connection dropped on is resent
+// on a new connection after a backoff, so a message may be received twice.
+type remoteSyslogSink struct {
+	secure   bool
+	addr     string
+	stream   string
+	hostname string
+	conn     net.Conn
+	pending  bytes.Buffer
+}
+
+// Creates the remote syslog sink of stream, the connection is made on the first flush
+func newRemoteSyslogSink(secure bool, addr string, stream string) *remoteSyslogSink {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	return &remoteSyslogSink{secure: secure, addr: addr, stream: stream, hostname: hostname}
+}
+
+func (s *remoteSyslogSink) Write(log Event) error {
+	message := log.Payload
+	if *syslogFormat == "rfc5424" {
+		formatted := s.rfc5424(log)
+		// Octet counting framing of RFC 5425, messages may hold newlines
+		fmt.Fprintf(&s.pending, "%d %s", len(formatted), formatted)
+	} else {
+		// The format of log/syslog for remote servers
+		fmt.Fprintf(&s.pending, "<%d>%s %s ps-splunk-%s[%d]: %s\n", syslogPriority,
+			time.Now().Format(time.RFC3339), s.hostname, s.stream, os.Getpid(), message)
+	}
+	if s.pending.Len() >= syslogBatchBytes {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Returns the RFC 5424 message of an event, timestamped by its collection time
+func (s *remoteSyslogSink) rfc5424(log Event) []byte {
+	var header event.Header
+	json.Unmarshal(log.Payload, &header)
+	timestamp := log.Time.Format(event.TimeLayout)
+	params := []string{"stream", s.stream, "run_id", header.RunID, "collector", header.Collector, "site", header.Site}
+	var data strings.Builder
+	data.WriteString("[" + syslogSDID)
+	for i := 0; i < len(params); i += 2 {
+		if params[i+1] != "" {
+			fmt.Fprintf(&data, " %s=\"%s\"", params[i], sdEscape(params[i+1]))
+		}
+	}
+	if header.SchemaVersion != 0 {
+		data.WriteString(" schema_version=\"" + strconv.Itoa(header.SchemaVersion) + "\"")
+	}
+	data.WriteString("]")
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	return []byte(fmt.Sprintf("<%d>1 %s %s ps-splunk %d %s %s %s", syslogPriority,
+		timestamp, s.hostname, os.Getpid(), s.stream, data.String(), log.Payload))
+}
+
+// Escapes the characters RFC 5424 doesn't allow unescaped in a parameter value
+func sdEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// Sends the pending messages, reconnecting with a backoff when the connection
+// fails. Messages that still can't be sent after the retries are dropped so
+// they don't block the stream.
+func (s *remoteSyslogSink) Flush() error {
+	if s.pending.Len() == 0 {
+		return nil
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.send()
+		if err == nil {
+			s.pending.Reset()
+			return nil
+		}
+		s.disconnect()
+		if attempt > *syslogRetries {
+			size := s.pending.Len()
+			s.pending.Reset()
+			return fmt.Errorf("dropped %d bytes of messages: %v", size, err)
+		}
+		delay := httpx.Backoff(attempt)
+		logger.Warn("Reconnecting to syslog", "addr", s.addr, "delay", delay, "err", err)
+		time.Sleep(delay)
+	}
+}
+
+// Writes the pending messages, connecting first if needed
+func (s *remoteSyslogSink) send() error {
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: *httpx.Timeout}
+		var conn net.Conn
+		var err error
+		if s.secure {
+			conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, syslogTLS)
+		} else {
+			conn, err = dialer.Dial("tcp", s.addr)
+		}
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(*httpx.Timeout))
+	_, err := s.conn.Write(s.pending.Bytes())
+	return err
+}
+
+// Drops the connection, the next send reconnecting
+func (s *remoteSyslogSink) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *remoteSyslogSink) Close() error {
+	err := s.Flush()
+	s.disconnect()
+	return err
+}
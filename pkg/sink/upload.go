@@ -0,0 +1,477 @@
+package sink
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/ps-splunk/pkg/httpx"
+	"github.com/bored-engineer/ps-splunk/pkg/metrics"
+)
+
+// Object storage flags
+var uploadURL = Flags.String("upload-url", "", "Bucket the output files are uploaded to once complete: s3://bucket/prefix, gs://bucket/prefix or azure://account/container/prefix (default disabled)")
+var uploadEndpoint = Flags.String("upload-endpoint", "", "URL of an S3 compatible store such as MinIO, or of an Azure emulator, used instead of the cloud endpoint with path style requests")
+var uploadRegion = Flags.String("upload-region", "", "AWS region of the S3 bucket and of the -upload-notify queue (default $AWS_REGION, else us-east-1)")
+var uploadSSE = Flags.String("upload-sse", "", "Server-side encryption of the S3 objects: AES256 or aws:kms (default that of the bucket)")
+var uploadKMSKey = Flags.String("upload-kms-key", "", "Key encrypting the objects: the AWS KMS key id with -upload-sse aws:kms, the Cloud KMS key name on GCS or the encryption scope on Azure")
+var uploadNotify = Flags.String("upload-notify", "", "SNS topic ARN or SQS queue URL sent an S3 event notification for every object uploaded to S3, such as the queue of an SQS-based S3 input")
+var uploadRetries = Flags.Int("upload-retries", 5, "Number of times a failed upload or notification is retried before it is given up, the file staying on disk")
+var uploadPrefixes = streamStrings{}
+
+func init() {
+	Flags.Var(uploadPrefixes, "upload-prefix", "Object key prefix for every stream, or per stream as stream=prefix pairs, with the tokens of -file-template but {seq} (default the path of -upload-url)")
+}
+
+// HTTP client used for object storage, separate from the crawl client
+var uploadClient = http.Client{Timeout: 10 * time.Minute}
+
+// Where the files are uploaded: the store, the URL of the bucket or container
+// the keys are appended to and the credentials
+var uploadTarget struct {
+	scheme    string
+	bucket    string
+	base      string
+	prefix    string
+	accessKey string
+	secretKey string
+	token     string
+	sas       string
+}
+
+// The files waiting to be uploaded, in the order they were completed
+var uploads = struct {
+	queue chan pendingUpload
+	done  sync.WaitGroup
+}{}
+
+// A complete output file of stream, written under dir
+type pendingUpload struct {
+	stream string
+	dir    string
+	path   string
+}
+
+// The upload metrics
+var (
+	uploadFiles = metrics.NewCounterVec("ps_uploads_total", "Output files uploaded to object storage by stream and status (uploaded, failed).", "stream", "status")
+	uploadBytes = metrics.NewCounterVec("ps_upload_bytes_total", "Bytes of the output files uploaded to object storage.", "stream")
+)
+
+// Checks the object storage flags and reads the credentials from the
+// environment: the AWS keys for S3, the HMAC keys of GCS passed the same way,
+// and a SAS token for Azure
+func setupUpload() error {
+	if *uploadURL == "" {
+		if *uploadNotify != "" {
+			return fmt.Errorf("-upload-notify requires -upload-url")
+		}
+		return nil
+	}
+	// Not parsed as a URL, the prefix may hold strftime tokens
+	scheme, location, _ := strings.Cut(*uploadURL, "://")
+	host, prefix, _ := strings.Cut(location, "/")
+	if host == "" {
+		return fmt.Errorf("-upload-url must name the bucket, as s3://bucket/prefix")
+	}
+	if *uploadRegion == "" {
+		*uploadRegion = os.Getenv("AWS_REGION")
+	}
+	if *uploadRegion == "" {
+		*uploadRegion = "us-east-1"
+	}
+	endpoint := strings.TrimSuffix(*uploadEndpoint, "/")
+	uploadTarget.scheme = scheme
+	uploadTarget.bucket = host
+	uploadTarget.prefix = strings.Trim(prefix, "/")
+	switch scheme {
+	case "s3", "gs":
+		uploadTarget.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		uploadTarget.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		uploadTarget.token = os.Getenv("AWS_SESSION_TOKEN")
+		if uploadTarget.accessKey == "" || uploadTarget.secretKey == "" {
+			return fmt.Errorf("$AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY are required to upload to %s://", scheme)
+		}
+		switch {
+		case endpoint != "":
+			uploadTarget.base = endpoint + "/" + host
+		case scheme == "s3":
+			uploadTarget.base = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", host, *uploadRegion)
+		default:
+			uploadTarget.base = "https://storage.googleapis.com/" + host
+		}
+	case "azure":
+		container, prefix, _ := strings.Cut(prefix, "/")
+		if container == "" {
+			return fmt.Errorf("-upload-url must name the container, as azure://account/container/prefix")
+		}
+		uploadTarget.bucket = container
+		uploadTarget.prefix = strings.Trim(prefix, "/")
+		uploadTarget.sas = strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+		if uploadTarget.sas == "" {
+			return fmt.Errorf("$AZURE_STORAGE_SAS_TOKEN is required to upload to azure://")
+		}
+		if endpoint == "" {
+			endpoint = "https://" + host + ".blob.core.windows.net"
+		}
+		uploadTarget.base = endpoint + "/" + container
+	default:
+		return fmt.Errorf("-upload-url must be an s3://, gs:// or azure:// URL")
+	}
+	if *uploadSSE != "" && (scheme != "s3" || (*uploadSSE != "AES256" && *uploadSSE != "aws:kms")) {
+		return fmt.Errorf("-upload-sse must be AES256 or aws:kms, and only applies to s3://")
+	}
+	if *uploadNotify != "" {
+		if scheme != "s3" {
+			return fmt.Errorf("-upload-notify only applies to s3://")
+		}
+		if !strings.HasPrefix(*uploadNotify, "arn:aws:sns:") && !strings.HasPrefix(*uploadNotify, "https://") && !strings.HasPrefix(*uploadNotify, "http://") {
+			return fmt.Errorf("-upload-notify must be an SNS topic ARN or an SQS queue URL")
+		}
+	}
+	uploadClient.Transport = httpx.NewTransport(nil)
+	return nil
+}
+
+// Starts uploading the files queued by uploadFile
+func startUploads() {
+	if *uploadURL == "" {
+		return
+	}
+	uploads.queue = make(chan pendingUpload, 64)
+	uploads.done.Add(1)
+	go uploader()
+}
+
+// Waits for the files queued to be uploaded, once the sinks are closed
+func finishUploads() {
+	if uploads.queue == nil {
+		return
+	}
+	close(uploads.queue)
+	uploads.done.Wait()
+}
+
+// Queues the complete file at path, written by a sink of stream under dir, to
+// be uploaded with -upload-url
+func uploadFile(stream string, dir string, path string) {
+	if uploads.queue == nil {
+		return
+	}
+	uploads.queue <- pendingUpload{stream, dir, path}
+}
+
+// Uploads the queued files one at a time, a file that can't be uploaded is
+// logged and left on disk
+func uploader() {
+	defer uploads.done.Done()
+	for file := range uploads.queue {
+		key := objectKey(file)
+		size, etag, err := uploadObject(key, file.path)
+		if err != nil {
+			uploadFiles.Inc(file.stream, "failed")
+			logger.Error("Uploading file failed", "file", file.path, "key", key, "err", err)
+			continue
+		}
+		uploadFiles.Inc(file.stream, "uploaded")
+		uploadBytes.Add(float64(size), file.stream)
+		logger.Info("File uploaded", "file", file.path, "key", key, "bytes", size)
+		if *uploadNotify != "" {
+			if err := uploadRetry("notification", func() error { return notifyUpload(key, size, etag) }); err != nil {
+				logger.Error("Notifying upload failed", "key", key, "err", err)
+			}
+		}
+	}
+}
+
+// Returns the object key of a file, its path under the output directory after
+// the prefix of its stream
+func objectKey(file pendingUpload) string {
+	rel, err := filepath.Rel(file.dir, file.path)
+	if err != nil {
+		rel = filepath.Base(file.path)
+	}
+	prefix := expandName(uploadPrefixes.get(file.stream, uploadTarget.prefix), file.stream, 0)
+	return path.Join(prefix, filepath.ToSlash(rel))
+}
+
+// Error for requests the store rejected and that won't succeed when retried
+type uploadRejected struct {
+	error
+}
+
+// Calls try until it succeeds, the store rejects it or -upload-retries is spent
+func uploadRetry(what string, try func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := try()
+		if err == nil {
+			return nil
+		}
+		if _, permanent := err.(uploadRejected); permanent || attempt > *uploadRetries {
+			return err
+		}
+		delay := httpx.Backoff(attempt)
+		logger.Warn("Retrying "+what, "delay", delay, "err", err)
+		time.Sleep(delay)
+	}
+}
+
+// Uploads the file at name to key, returning its size and ETag
+func uploadObject(key string, name string) (int64, string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+	var etag string
+	err = uploadRetry("upload", func() error {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		header, err := putObject(key, ioutil.NopCloser(file), size, contentType(name), payloadHash)
+		if err != nil {
+			return err
+		}
+		etag = strings.Trim(header.Get("ETag"), `"`)
+		return nil
+	})
+	return size, etag, err
+}
+
+// Puts body as the object at key with the headers of the store
+func putObject(key string, body io.ReadCloser, size int64, contentType string, payloadHash string) (http.Header, error) {
+	target := uploadTarget.base + "/" + awsEscape(key, true)
+	if uploadTarget.sas != "" {
+		target += "?" + uploadTarget.sas
+	}
+	req, err := http.NewRequest("PUT", target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	switch uploadTarget.scheme {
+	case "azure":
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+		req.Header.Set("x-ms-version", "2021-08-06")
+		if *uploadKMSKey != "" {
+			req.Header.Set("x-ms-encryption-scope", *uploadKMSKey)
+		}
+	case "gs":
+		if *uploadKMSKey != "" {
+			req.Header.Set("x-goog-encryption-kms-key-name", *uploadKMSKey)
+		}
+		req.Header.Set("x-amz-content-sha256", payloadHash)
+		signV4(req, "s3", "auto", payloadHash, time.Now())
+	case "s3":
+		if *uploadSSE != "" {
+			req.Header.Set("x-amz-server-side-encryption", *uploadSSE)
+		}
+		if *uploadSSE == "aws:kms" && *uploadKMSKey != "" {
+			req.Header.Set("x-amz-server-side-encryption-aws-kms-key-id", *uploadKMSKey)
+		}
+		req.Header.Set("x-amz-content-sha256", payloadHash)
+		signV4(req, "s3", *uploadRegion, payloadHash, time.Now())
+	}
+	return uploadDo(req)
+}
+
+// Sends req, returning the response headers or the error the store answered
+func uploadDo(req *http.Request) (http.Header, error) {
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpx.CloseBody(resp)
+	if resp.StatusCode/100 == 2 {
+		return resp.Header, nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	if !httpx.RetryableStatus(resp.StatusCode) && resp.StatusCode != http.StatusRequestTimeout {
+		return nil, uploadRejected{err}
+	}
+	return nil, err
+}
+
+// Returns the content type of an output file from its extension
+func contentType(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".json"):
+		return "application/x-ndjson"
+	case strings.HasSuffix(name, ".gz"):
+		return "application/gzip"
+	}
+	return "application/octet-stream"
+}
+
+// S3 event notification, the message S3 sends to SNS and SQS when an object
+// is created, which SQS-based S3 inputs read the new objects from
+type s3Event struct {
+	Records []s3EventRecord `json:"Records"`
+}
+
+type s3EventRecord struct {
+	EventVersion string `json:"eventVersion"`
+	EventSource  string `json:"eventSource"`
+	AWSRegion    string `json:"awsRegion"`
+	EventTime    string `json:"eventTime"`
+	EventName    string `json:"eventName"`
+	S3           struct {
+		SchemaVersion string `json:"s3SchemaVersion"`
+		Bucket        struct {
+			Name string `json:"name"`
+			ARN  string `json:"arn"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+			ETag string `json:"eTag,omitempty"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// Sends the S3 event notification of the object uploaded to key to the SNS
+// topic or SQS queue of -upload-notify
+func notifyUpload(key string, size int64, etag string) error {
+	record := s3EventRecord{
+		EventVersion: "2.1",
+		EventSource:  "aws:s3",
+		AWSRegion:    *uploadRegion,
+		EventTime:    time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		EventName:    "ObjectCreated:Put",
+	}
+	record.S3.SchemaVersion = "1.0"
+	record.S3.Bucket.Name = uploadTarget.bucket
+	record.S3.Bucket.ARN = "arn:aws:s3:::" + uploadTarget.bucket
+	// Like S3, the key is URL encoded
+	record.S3.Object.Key = strings.ReplaceAll(url.QueryEscape(key), "%2F", "/")
+	record.S3.Object.Size = size
+	record.S3.Object.ETag = etag
+	message, err := json.Marshal(s3Event{Records: []s3EventRecord{record}})
+	if err != nil {
+		return err
+	}
+	form := url.Values{}
+	var target, service, region string
+	if strings.HasPrefix(*uploadNotify, "arn:aws:sns:") {
+		// arn:aws:sns:region:account:topic
+		region = strings.Split(*uploadNotify, ":")[3]
+		service = "sns"
+		target = fmt.Sprintf("https://sns.%s.amazonaws.com/", region)
+		form.Set("Action", "Publish")
+		form.Set("Version", "2010-03-31")
+		form.Set("TopicArn", *uploadNotify)
+		form.Set("Message", string(message))
+	} else {
+		region = *uploadRegion
+		service = "sqs"
+		target = *uploadNotify
+		form.Set("Action", "SendMessage")
+		form.Set("Version", "2012-11-05")
+		form.Set("MessageBody", string(message))
+	}
+	body := form.Encode()
+	req, err := http.NewRequest("POST", target, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	sum := sha256.Sum256([]byte(body))
+	signV4(req, service, region, hex.EncodeToString(sum[:]), time.Now())
+	_, err = uploadDo(req)
+	return err
+}
+
+// Signs req with AWS Signature Version 4 for service in region at now,
+// payloadHash being the hex SHA-256 of its body. Every header set so far is
+// signed along with the host.
+func signV4(req *http.Request, service string, region string, payloadHash string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if uploadTarget.token != "" {
+		req.Header.Set("X-Amz-Security-Token", uploadTarget.token)
+	}
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for name, value := range req.Header {
+		name = strings.ToLower(name)
+		names = append(names, name)
+		values[name] = strings.TrimSpace(strings.Join(value, ","))
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	canonical := strings.Join([]string{req.Method, uri, canonicalQuery(req.URL.Query()), headers.String(), signed, payloadHash}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := []byte("AWS4" + uploadTarget.secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		uploadTarget.accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// Returns the canonical query string of Signature Version 4, sorted by name
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(name, false)+"="+awsEscape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// Percent encodes everything in s but the unreserved characters, and the
+// slashes when slash is set, as Signature Version 4 does
+func awsEscape(s string, slash bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (slash && c == '/') {
+			escaped.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&escaped, "%%%02X", c)
+	}
+	return escaped.String()
+}
+
+// Returns the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
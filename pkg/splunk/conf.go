@@ -0,0 +1,174 @@
+// Package splunk generates the Splunk configuration of the app from the event
+// structs, so the sourcetypes never drift from what the crawler writes.
+package splunk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/bored-engineer/ps-splunk/pkg/event"
+)
+
+// Header of every generated file
+const generated = "# Generated by cmd/splunkconf from the events of pkg/event, DO NOT EDIT.\n"
+
+// Sourcetype of the files monitored by inputs.conf, PSAutoType renames it to
+// the sourcetype of the stream in the file name
+const monitorSourcetype = "ps"
+
+// Sourcetype returns the sourcetype of a stream
+func Sourcetype(stream string) string {
+	return "ps-" + stream
+}
+
+// Index time settings shared by every sourcetype: one JSON event per line
+// with its timestamp in the time field of the header
+func indexSettings() [][2]string {
+	return [][2]string{
+		{"SHOULD_LINEMERGE", "false"},
+		{"LINE_BREAKER", `([\r\n]+)`},
+		{"TRUNCATE", "0"},
+		{"TIME_PREFIX", `"time":"`},
+		{"TIME_FORMAT", strptime(event.TimeLayout)},
+		{"MAX_TIMESTAMP_LOOKAHEAD", fmt.Sprint(len(event.TimeLayout))},
+		{"ANNOTATE_PUNCT", "false"},
+		{"KV_MODE", "json"},
+	}
+}
+
+// Go layout elements and their strptime conversions, longest first
+var layoutElements = [][2]string{
+	{"2006", "%Y"}, {".000000", ".%6N"}, {".000", ".%3N"}, {"-07:00", "%:z"}, {"-0700", "%z"},
+	{"01", "%m"}, {"02", "%d"}, {"15", "%H"}, {"04", "%M"}, {"05", "%S"},
+}
+
+// Converts a Go time layout to the strptime format Splunk parses it with
+func strptime(layout string) string {
+	var format strings.Builder
+	for layout != "" {
+		converted := false
+		for _, element := range layoutElements {
+			if strings.HasPrefix(layout, element[0]) {
+				format.WriteString(element[1])
+				layout = layout[len(element[0]):]
+				converted = true
+				break
+			}
+		}
+		if !converted {
+			format.WriteByte(layout[0])
+			layout = layout[1:]
+		}
+	}
+	return format.String()
+}
+
+// Props writes props.conf: the monitored sourcetype and a stanza per stream
+// with aliases flattening its nested and multivalue fields
+func Props(w io.Writer) error {
+	var conf strings.Builder
+	conf.WriteString(generated)
+	conf.WriteString("\n# Files monitored by inputs.conf, typed by the stream in their name\n")
+	writeStanza(&conf, monitorSourcetype, append(indexSettings(), [2]string{"TRANSFORMS-PSAutoType", "PSAutoType"}))
+	for _, stream := range event.Streams {
+		settings := indexSettings()
+		var aliases []string
+		for _, field := range Fields(stream.Event) {
+			if alias := flatName(field); alias != field {
+				aliases = append(aliases, fmt.Sprintf("%q AS %s", field, alias))
+			}
+		}
+		if len(aliases) > 0 {
+			settings = append(settings, [2]string{"FIELDALIAS-" + Sourcetype(stream.Name), strings.Join(aliases, " ")})
+		}
+		fmt.Fprintf(&conf, "\n# The %s stream, %s events\n", stream.Name, reflect.TypeOf(stream.Event).Name())
+		writeStanza(&conf, Sourcetype(stream.Name), settings)
+	}
+	_, err := io.WriteString(w, conf.String())
+	return err
+}
+
+// Transforms writes transforms.conf: PSAutoType setting the sourcetype of a
+// monitored file from the stream in its name. Names come from -file-template,
+// so the stream is matched anywhere in the file name as a word of its own.
+func Transforms(w io.Writer) error {
+	names := make([]string, 0, len(event.Streams))
+	for _, stream := range event.Streams {
+		names = append(names, stream.Name)
+	}
+	var conf strings.Builder
+	conf.WriteString(generated)
+	conf.WriteString("\n# Types the monitored files by the stream in their name\n")
+	writeStanza(&conf, "PSAutoType", [][2]string{
+		{"DEST_KEY", "MetaData:Sourcetype"},
+		{"SOURCE_KEY", "MetaData:Source"},
+		{"REGEX", `(?<![a-zA-Z])(` + strings.Join(names, "|") + `)(?![a-zA-Z])[^/\\]*\.json(\.gz)?$`},
+		{"FORMAT", "sourcetype::" + Sourcetype("$1")},
+		{"WRITE_META", "true"},
+	})
+	_, err := io.WriteString(w, conf.String())
+	return err
+}
+
+// Writes a stanza and its settings in order
+func writeStanza(conf *strings.Builder, name string, settings [][2]string) {
+	fmt.Fprintf(conf, "[%s]\n", name)
+	for _, setting := range settings {
+		fmt.Fprintf(conf, "%s = %s\n", setting[0], setting[1])
+	}
+}
+
+// Fields returns the names Splunk extracts the fields of an event under with
+// KV_MODE = json: nested objects joined with dots and arrays suffixed with {}.
+// Raw JSON, lists of it and maps are listed by their own name, their keys
+// vary.
+func Fields(ev interface{}) []string {
+	var fields []string
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.Anonymous {
+				walk(field.Type, prefix)
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" || !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			path, ft := prefix+name, deref(field.Type)
+			if ft.Kind() == reflect.Slice && ft != rawMessage && deref(ft.Elem()) != rawMessage {
+				path, ft = path+"{}", deref(ft.Elem())
+			}
+			if ft.Kind() == reflect.Struct {
+				walk(ft, path+".")
+				continue
+			}
+			fields = append(fields, path)
+		}
+	}
+	walk(deref(reflect.TypeOf(ev)), "")
+	return fields
+}
+
+var rawMessage = reflect.TypeOf(json.RawMessage{})
+
+// Returns the type pointed to by pointers
+func deref(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+// Returns the flat name of a field, geo.country_code becoming geo_country_code
+// and meshes{} meshes
+func flatName(field string) string {
+	return strings.NewReplacer("{}", "", ".", "_").Replace(field)
+}
@@ -0,0 +1,155 @@
+package splunk
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bored-engineer/ps-splunk/pkg/crawler"
+)
+
+// ModinputScheme is the scheme of the modular input, the binary runs as one
+// when installed as bin/ps_crawl in the app
+const ModinputScheme = "ps_crawl"
+
+// InputConfig is what splunkd passes a modular input on stdin: the stanzas to
+// run, or the items to validate with --validate-arguments
+type InputConfig struct {
+	ServerHost    string   `xml:"server_host"`
+	ServerURI     string   `xml:"server_uri"`
+	SessionKey    string   `xml:"session_key"`
+	CheckpointDir string   `xml:"checkpoint_dir"`
+	Stanzas       []Stanza `xml:"configuration>stanza"`
+	Items         []Stanza `xml:"item"`
+}
+
+// Stanza is an input of the scheme and its parameters, multivalue ones being
+// listed in param_list elements
+type Stanza struct {
+	Name   string `xml:"name,attr"`
+	Params []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"param"`
+	ParamLists []struct {
+		Name   string   `xml:"name,attr"`
+		Values []string `xml:"value"`
+	} `xml:"param_list"`
+}
+
+// ReadInputConfig parses the configuration splunkd writes to stdin
+func ReadInputConfig(r io.Reader) (*InputConfig, error) {
+	var config InputConfig
+	if err := xml.NewDecoder(r).Decode(&config); err != nil {
+		return nil, fmt.Errorf("modular input configuration: %v", err)
+	}
+	return &config, nil
+}
+
+// Stanza returns the single stanza run or validated, splunkd starting an
+// instance per stanza
+func (c *InputConfig) Stanza() (*Stanza, error) {
+	stanzas := append(c.Stanzas, c.Items...)
+	if len(stanzas) != 1 {
+		return nil, fmt.Errorf("modular input configuration lists %d stanzas, expected 1", len(stanzas))
+	}
+	return &stanzas[0], nil
+}
+
+// Values returns every parameter of the stanza in order, each value of a
+// param_list on its own
+func (s *Stanza) Values() [][2]string {
+	var values [][2]string
+	for _, param := range s.Params {
+		values = append(values, [2]string{param.Name, strings.TrimSpace(param.Value)})
+	}
+	for _, list := range s.ParamLists {
+		for _, value := range list.Values {
+			values = append(values, [2]string{list.Name, strings.TrimSpace(value)})
+		}
+	}
+	return values
+}
+
+// WriteValidationError reports why --validate-arguments rejected a stanza
+func WriteValidationError(w io.Writer, err error) error {
+	_, werr := fmt.Fprintf(w, "<error><message>%s</message></error>\n", escape(err.Error()))
+	return werr
+}
+
+// Returns the flags of the crawler packages, the arguments of the input
+func inputFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet(ModinputScheme, flag.ContinueOnError)
+	for _, fs := range crawler.FlagSets() {
+		fs.VisitAll(func(f *flag.Flag) {
+			flags.Var(f.Value, f.Name, f.Usage)
+		})
+	}
+	return flags
+}
+
+// Scheme writes the introspection scheme printed for --scheme, every crawler
+// flag being an argument of the input
+func Scheme(w io.Writer) error {
+	var scheme strings.Builder
+	scheme.WriteString("<scheme>\n")
+	scheme.WriteString("  <title>perfSONAR crawler</title>\n")
+	scheme.WriteString("  <description>Crawls the perfSONAR hosts found through the lookup service into the ps-* sourcetypes</description>\n")
+	scheme.WriteString("  <use_external_validation>true</use_external_validation>\n")
+	scheme.WriteString("  <use_single_instance>false</use_single_instance>\n")
+	scheme.WriteString("  <streaming_mode>xml</streaming_mode>\n")
+	scheme.WriteString("  <endpoint>\n    <args>\n")
+	inputFlags().VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&scheme, "      <arg name=\"%s\">\n", escape(f.Name))
+		fmt.Fprintf(&scheme, "        <description>%s</description>\n", escape(f.Usage))
+		fmt.Fprintf(&scheme, "        <data_type>%s</data_type>\n", dataType(f))
+		scheme.WriteString("        <required_on_create>false</required_on_create>\n")
+		scheme.WriteString("        <required_on_edit>false</required_on_edit>\n")
+		scheme.WriteString("      </arg>\n")
+	})
+	scheme.WriteString("    </args>\n  </endpoint>\n</scheme>\n")
+	_, err := io.WriteString(w, scheme.String())
+	return err
+}
+
+// InputsSpec writes the README/inputs.conf.spec of the modular input, listing
+// every crawler flag as a setting
+func InputsSpec(w io.Writer) error {
+	var spec strings.Builder
+	spec.WriteString(generated)
+	fmt.Fprintf(&spec, "\n[%s://<name>]\n", ModinputScheme)
+	spec.WriteString("* Crawls the perfSONAR hosts, each setting being the crawler flag of the\n")
+	spec.WriteString("* same name. Events are streamed to splunkd unless output is set.\n")
+	inputFlags().VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&spec, "\n%s = <%s>\n* %s\n", f.Name, dataType(f), f.Usage)
+		if f.DefValue != "" {
+			fmt.Fprintf(&spec, "* Defaults to %s.\n", f.DefValue)
+		}
+	})
+	_, err := io.WriteString(w, spec.String())
+	return err
+}
+
+// Returns the modular input data type of a flag
+func dataType(f *flag.Flag) string {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return "string"
+	}
+	switch getter.Get().(type) {
+	case bool:
+		return "boolean"
+	case int, int64, uint, uint64, float64:
+		return "number"
+	}
+	return "string"
+}
+
+// Escapes text for XML
+func escape(text string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}